@@ -9,11 +9,27 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var (
+	branchDelete bool
+	branchMove   bool
+)
+
 func NewCmdBranch(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "branch",
-		Short: "List branches",
-		Long:  "Online help: https://docs.dotmesh.com/references/cli/#list-the-branches-dm-branch",
+		Use:   "branch [<branch> [<commit>] | -d <branch> | -m [<old-branch>] <new-branch>]",
+		Short: "List, make, delete or rename branches",
+		Long: `List the branches of the current dot, make a new one, delete one with -d, or
+rename one with -m. Without an old name, -m renames the current branch.
+
+A new branch starts at the latest commit of the current branch, or at
+<commit>, which can be a commit id from any branch, HEAD^, a tag, or another
+branch for its latest commit. Unlike 'dm checkout -b', it doesn't switch to
+the new branch.
+
+Branches cloned from a deleted branch are kept. A renamed branch can still be
+found by its old name, so containers using it keep working.
+
+Online help: https://docs.dotmesh.com/references/cli/#list-the-branches-dm-branch`,
 		Run: func(cmd *cobra.Command, args []string) {
 			err := func() error {
 				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
@@ -28,6 +44,57 @@ func NewCmdBranch(out io.Writer) *cobra.Command {
 				if err != nil {
 					return err
 				}
+				if branchDelete && branchMove {
+					return fmt.Errorf("Please specify at most one of -d and -m.")
+				}
+				if branchMove {
+					if len(args) == 1 {
+						args = []string{b, args[0]}
+					}
+					if len(args) != 2 {
+						return fmt.Errorf("Please specify the branch to rename and its new name.")
+					}
+					err = dm.RenameBranch(v, args[0], args[1])
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(out, "Renamed branch %s to %s.\n", args[0], args[1])
+					return nil
+				}
+				if branchDelete {
+					if len(args) != 1 {
+						return fmt.Errorf("Please specify the branch to delete.")
+					}
+					if args[0] == b {
+						return fmt.Errorf(
+							"Branch %s is the current branch, please switch to another one before deleting it.",
+							args[0],
+						)
+					}
+					err = dm.DeleteBranch(v, args[0])
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(out, "Deleted branch %s.\n", args[0])
+					return nil
+				}
+				if len(args) > 2 {
+					return fmt.Errorf("Please specify the new branch and at most one commit to start it at.")
+				}
+				if len(args) > 0 {
+					ref := "HEAD"
+					if len(args) == 2 {
+						ref = args[1]
+					}
+					exists, err := dm.BranchExists(v, args[0])
+					if err != nil {
+						return err
+					}
+					if exists || args[0] == client.DefaultBranch {
+						return fmt.Errorf("Branch already exists: %s", args[0])
+					}
+					return dm.CreateBranchFromCommit(v, b, ref, args[0])
+				}
 				bs, err := dm.AllBranches(v)
 				if err != nil {
 					return err
@@ -48,5 +115,7 @@ func NewCmdBranch(out io.Writer) *cobra.Command {
 			}
 		},
 	}
+	cmd.Flags().BoolVarP(&branchDelete, "delete", "d", false, "delete a branch")
+	cmd.Flags().BoolVarP(&branchMove, "move", "m", false, "rename a branch")
 	return cmd
 }
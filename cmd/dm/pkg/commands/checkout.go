@@ -11,12 +11,22 @@ import (
 
 func NewCmdCheckout(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "checkout",
+		Use:   "checkout [-b] <branch> [<commit>]",
 		Short: "Switch or make branches",
-		Long:  "Online help: https://docs.dotmesh.com/references/cli/#switch-branches-dm-checkout-branch",
+		Long: `Switch to another branch of the current dot, or make a new one with -b and
+switch to it.
+
+A new branch starts at the latest commit of the current branch, or at
+<commit>, which can be a commit id from any branch, HEAD^, a tag, or another
+branch for its latest commit.
+
+Online help: https://docs.dotmesh.com/references/cli/#switch-branches-dm-checkout-branch`,
 		Run: func(cmd *cobra.Command, args []string) {
 			err := func() error {
-				if len(args) != 1 {
+				if len(args) == 2 && !makeBranch {
+					return fmt.Errorf("A commit can only be given when making a branch with -b.")
+				}
+				if len(args) != 1 && len(args) != 2 {
 					return fmt.Errorf("Please give me a branch name.")
 				}
 				branch := args[0]
@@ -33,6 +43,9 @@ func NewCmdCheckout(out io.Writer) *cobra.Command {
 				if err != nil {
 					return err
 				}
+				if len(args) == 2 {
+					return dm.CheckoutNewBranchFromCommit(v, b, args[1], branch)
+				}
 				if err := dm.CheckoutBranch(v, b, branch, makeBranch); err != nil {
 					return err
 				}
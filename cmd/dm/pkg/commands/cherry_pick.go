@@ -0,0 +1,79 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/dotmesh-io/dotmesh/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cherryPickMsg  string
+	cherryPickJSON bool
+)
+
+func NewCmdCherryPick(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cherry-pick [-m <message>] <commit>",
+		Short: "Apply the changes one commit made to the current branch",
+		Long: `Works out which files <commit> added, modified and removed, compared with the
+commit before it on its branch, makes the same changes to the current branch
+and commits them. <commit> may be on any branch of the current dot, or be a tag,
+or a branch name for that branch's latest commit. The new commit's metadata
+records which commit was picked, and it has the same message unless you give
+another.
+
+A file the current branch has changed differently since the commit before
+<commit> is a conflict: it's left alone, and listed so you can sort it out by
+hand.
+
+The current branch must have no uncommitted changes. Containers using the dot
+are stopped while the files are changed, and started again afterwards.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify one commit to cherry-pick.")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, err := dm.StrictCurrentVolume()
+				if err != nil {
+					return err
+				}
+				activeBranch, err := dm.CurrentBranch(activeVolume)
+				if err != nil {
+					return err
+				}
+				result, err := dm.CherryPick(activeVolume, activeBranch, args[0], cherryPickMsg)
+				if err != nil {
+					return err
+				}
+
+				if cherryPickJSON {
+					enc := json.NewEncoder(out)
+					enc.SetIndent("", "  ")
+					return enc.Encode(result)
+				}
+				fmt.Fprintf(out, "Picked %s onto %s as %s, %d changes applied.\n",
+					result.SourceCommit, activeBranch, result.SnapshotId, len(result.Applied))
+				if len(result.Conflicts) > 0 {
+					fmt.Fprintf(out, "%d conflicts were left as they are on %s:\n",
+						len(result.Conflicts), activeBranch)
+					for _, c := range result.Conflicts {
+						fmt.Fprintf(out, "  %s (ours %s, theirs %s)\n", c.Path, c.Ours, c.Theirs)
+					}
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&cherryPickMsg, "message", "m", "",
+		"Use the given string as the commit message (default: the picked commit's).")
+	cmd.Flags().BoolVarP(&cherryPickJSON, "json", "", false,
+		"show what was applied, and the conflicts, as JSON")
+	return cmd
+}
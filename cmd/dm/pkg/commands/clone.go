@@ -10,6 +10,15 @@ import (
 var cloneLocalVolume string
 var stash bool
 
+// in bytes per second, parsed with client.ParseRate
+var limitRate string
+
+// of the transfer in the queue of the node that runs it
+var transferPriority int
+
+// show what would be transferred, rather than transferring it
+var transferDryRun bool
+
 func NewCmdClone(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "clone <remote> [<dot> [<branch>]] [--local-name=<dot>] [--stash-on-divergence]",
@@ -39,17 +48,37 @@ Online help: https://docs.dotmesh.com/references/cli/#clone-dm-clone-local-name-
 				if err != nil {
 					return err
 				}
+				if transferDryRun {
+					plan, err := dm.PlanTransfer(
+						"pull", peer,
+						cloneLocalVolume, branchName,
+						filesystemName, branchName,
+						stash,
+					)
+					if err != nil {
+						return err
+					}
+					printTransferPlan(out, plan)
+					return nil
+				}
+				rate, err := client.ParseRate(limitRate)
+				if err != nil {
+					return err
+				}
 				transferId, err := dm.RequestTransfer(
 					"pull", peer,
 					cloneLocalVolume, branchName,
 					filesystemName, branchName,
 					nil,
 					stash,
+					rate,
+					transferPriority,
 					// TODO also switch to the remote?
 				)
 				if err != nil {
 					return err
 				}
+				printTransferId(out, transferId)
 				err = dm.PollTransfer(transferId, out, dm.UpdateBar)
 				if err != nil {
 					return err
@@ -63,5 +92,11 @@ Online help: https://docs.dotmesh.com/references/cli/#clone-dm-clone-local-name-
 	cmd.PersistentFlags().StringVarP(&cloneLocalVolume, "local-name", "", "",
 		"Local dot name to create")
 	cmd.PersistentFlags().BoolVarP(&stash, "stash-on-divergence", "", false, "stash any divergence on a branch and continue")
+	cmd.PersistentFlags().StringVarP(&limitRate, "limit-rate", "", "",
+		"maximum transfer rate in bytes per second, optionally followed by K, M or G (e.g. 10M)")
+	cmd.PersistentFlags().IntVarP(&transferPriority, "priority", "", 0,
+		"priority of the transfer when the node has too many to run at once, higher goes first")
+	cmd.PersistentFlags().BoolVarP(&transferDryRun, "dry-run", "", false,
+		"show which branches and commits would be transferred, and how big they are, without transferring anything")
 	return cmd
 }
@@ -78,6 +78,8 @@ var (
 var inheritedEnvironment = []string{
 	"FILESYSTEM_METADATA_TIMEOUT",
 	"EXTRA_HOST_COMMANDS",
+	"TRANSFER_RATE_LIMIT",
+	"MAX_CONCURRENT_TRANSFERS",
 }
 
 var timings map[string]float64
@@ -65,5 +65,40 @@ func NewCmdCommit(out io.Writer) *cobra.Command {
 	commitMetadata = cmd.Flags().StringSliceP("metadata", "d", []string{},
 		"Add custom metadata to the commit (e.g. --metadata name=value).")
 
+	cmd.AddCommand(&cobra.Command{
+		Use:   "rm <ref>",
+		Short: "Delete a commit from the current branch",
+		Long: `Deletes one commit from the current branch, on every node in the
+cluster, leaving the commits either side of it. The branch's latest commit
+can't be deleted, and nor can a commit if a branch or fork was made from it, or
+if it's the latest commit a remote which this branch has been pushed to or
+pulled from is known to have.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify one ref only.")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				v, err := dm.StrictCurrentVolume()
+				if err != nil {
+					return err
+				}
+				b, err := dm.CurrentBranch(v)
+				if err != nil {
+					return err
+				}
+				id, err := dm.DeleteCommit(v, b, args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Deleted commit %s\n", id)
+				return nil
+			})
+		},
+	})
+
 	return cmd
 }
@@ -0,0 +1,244 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/dotmesh-io/dotmesh/pkg/client"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+var (
+	diffNameStatus bool
+	diffStat       bool
+	diffJSON       bool
+)
+
+func NewCmdDiff(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff [<commit>[..<commit>]] [-- <path>...]",
+		Short: "Show changes between commits, or uncommitted changes",
+		Long: `Show the changes to the current branch of the current dot.
+
+  dm diff                  uncommitted changes since the latest commit
+  dm diff <commit>         uncommitted changes since <commit>
+  dm diff <from>..<to>     changes between two commits
+  dm diff <from>..         changes from <from> to the latest commit
+
+A commit may also be given as a branch name, for that branch's latest commit.
+Paths after '--' limit the diff to those files and directories.
+
+Changes to small text files are shown as unified diffs; for other files only
+their sizes are shown.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				outputs := 0
+				for _, set := range []bool{diffNameStatus, diffStat, diffJSON} {
+					if set {
+						outputs++
+					}
+				}
+				if outputs > 1 {
+					return fmt.Errorf("Please specify at most one of --name-status, --stat and --json.")
+				}
+
+				revs, paths := args, []string{}
+				if dash := cmd.ArgsLenAtDash(); dash != -1 {
+					revs, paths = args[:dash], args[dash:]
+				}
+				if len(revs) > 1 {
+					return fmt.Errorf("Please specify one commit, or a range of commits as <from>..<to>.")
+				}
+
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, err := dm.StrictCurrentVolume()
+				if err != nil {
+					return err
+				}
+				if activeVolume == "" {
+					return fmt.Errorf(
+						"No current dot. Try 'dm list' and " +
+							"'dm switch' to switch to a dot.",
+					)
+				}
+				activeBranch, err := dm.CurrentBranch(activeVolume)
+				if err != nil {
+					return err
+				}
+
+				request := types.RPCDiffRequest{
+					Branch: activeBranch,
+					// the default and --stat output need them, and --json
+					// may as well have them
+					DiffOptions: types.DiffOptions{Hunks: !diffNameStatus},
+				}
+				request.Namespace, request.Name, err = client.ParseNamespacedVolume(activeVolume)
+				if err != nil {
+					return err
+				}
+				if len(revs) == 1 {
+					request.From, request.To = parseDiffRange(revs[0], activeBranch)
+				}
+
+				result, err := dm.DiffCommits(request)
+				if err != nil {
+					return err
+				}
+				result.Files = filterDiffPaths(result.Files, paths)
+				result.Total = len(result.Files)
+
+				switch {
+				case diffJSON:
+					enc := json.NewEncoder(out)
+					enc.SetIndent("", "  ")
+					return enc.Encode(result)
+				case diffNameStatus:
+					for _, f := range result.Files {
+						fmt.Fprintf(out, "%s\t%s\n", f.Change, f.Filename)
+					}
+				case diffStat:
+					printDiffStat(out, result.Files)
+				default:
+					for _, f := range result.Files {
+						if f.Hunks != "" {
+							fmt.Fprint(out, f.Hunks)
+						} else {
+							fmt.Fprintf(out, "%s %s%s\n", f.Change, diffDisplayName(f), diffSizes(f))
+						}
+					}
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&diffNameStatus, "name-status", "", false,
+		"show only the names of changed files, and how they changed")
+	cmd.Flags().BoolVarP(&diffStat, "stat", "", false,
+		"show how many lines changed in each file")
+	cmd.Flags().BoolVarP(&diffJSON, "json", "", false,
+		"show the changes as JSON")
+	return cmd
+}
+
+// parseDiffRange turns "<from>..<to>", "<from>.." or "<commit>" into the From
+// and To of a diff request. A missing <to> means the branch's latest commit,
+// and a lone <commit> is diffed with the uncommitted changes.
+func parseDiffRange(rev, branch string) (from, to string) {
+	parts := strings.SplitN(rev, "..", 2)
+	if len(parts) == 1 {
+		return rev, ""
+	}
+	from, to = parts[0], parts[1]
+	if to == "" {
+		to = branch
+	}
+	return from, to
+}
+
+// filterDiffPaths keeps the changes to the given files, and to anything under
+// the given directories. No paths keeps everything.
+func filterDiffPaths(files []types.ZFSFileDiff, paths []string) []types.ZFSFileDiff {
+	if len(paths) == 0 {
+		return files
+	}
+	prefixes := []string{}
+	for _, p := range paths {
+		p = strings.Trim(path.Clean(p), "/")
+		if p == "." || p == "" {
+			return files
+		}
+		prefixes = append(prefixes, p)
+	}
+	filtered := []types.ZFSFileDiff{}
+	for _, f := range files {
+		for _, p := range prefixes {
+			if f.Filename == p || strings.HasPrefix(f.Filename, p+"/") {
+				filtered = append(filtered, f)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+func diffDisplayName(f types.ZFSFileDiff) string {
+	for _, info := range []*types.DiffFileInfo{f.New, f.Old} {
+		if info != nil && info.Type == types.FileTypeDirectory {
+			return f.Filename + "/"
+		}
+	}
+	return f.Filename
+}
+
+// diffSizes describes how a file's size changed, for files without hunks.
+func diffSizes(f types.ZFSFileDiff) string {
+	isFile := func(info *types.DiffFileInfo) bool {
+		return info != nil && info.Type == types.FileTypeFile
+	}
+	switch {
+	case isFile(f.Old) && isFile(f.New):
+		return fmt.Sprintf(" (%d -> %d bytes)", f.Old.Size, f.New.Size)
+	case isFile(f.New):
+		return fmt.Sprintf(" (%d bytes)", f.New.Size)
+	case isFile(f.Old):
+		return fmt.Sprintf(" (%d bytes)", f.Old.Size)
+	}
+	return ""
+}
+
+// countHunkLines counts the lines added and removed by unified diff hunks.
+// The ---/+++ file names are only a header before the first @@, since after it
+// they're lines of the file which happen to start "-- " or "++ ".
+func countHunkLines(hunks string) (added, removed int) {
+	inHeader := true
+	for _, line := range strings.Split(hunks, "\n") {
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			inHeader = false
+		case inHeader:
+		case strings.HasPrefix(line, "+"):
+			added++
+		case strings.HasPrefix(line, "-"):
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// the longest run of +s and -s --stat shows for a file
+const maxStatBar = 50
+
+func printDiffStat(out io.Writer, files []types.ZFSFileDiff) {
+	width := 0
+	for _, f := range files {
+		if len(diffDisplayName(f)) > width {
+			width = len(diffDisplayName(f))
+		}
+	}
+	totalAdded, totalRemoved := 0, 0
+	for _, f := range files {
+		if f.Hunks == "" {
+			fmt.Fprintf(out, " %-*s | %s%s\n", width, diffDisplayName(f), f.Change, diffSizes(f))
+			continue
+		}
+		added, removed := countHunkLines(f.Hunks)
+		totalAdded += added
+		totalRemoved += removed
+		plus, minus := added, removed
+		if added+removed > maxStatBar {
+			plus = added * maxStatBar / (added + removed)
+			minus = maxStatBar - plus
+		}
+		fmt.Fprintf(out, " %-*s | %d %s%s\n", width, diffDisplayName(f), added+removed,
+			strings.Repeat("+", plus), strings.Repeat("-", minus))
+	}
+	fmt.Fprintf(out, " %d files changed, %d insertions(+), %d deletions(-)\n",
+		len(files), totalAdded, totalRemoved)
+}
@@ -0,0 +1,149 @@
+package commands
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+)
+
+func Test_parseDiffRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		rev      string
+		wantFrom string
+		wantTo   string
+	}{
+		{
+			name:     "one commit",
+			rev:      "abc",
+			wantFrom: "abc",
+			wantTo:   "",
+		},
+		{
+			name:     "two commits",
+			rev:      "abc..def",
+			wantFrom: "abc",
+			wantTo:   "def",
+		},
+		{
+			name:     "to the latest commit",
+			rev:      "abc..",
+			wantFrom: "abc",
+			wantTo:   "feature",
+		},
+		{
+			name:     "from a branch",
+			rev:      "master..def",
+			wantFrom: "master",
+			wantTo:   "def",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := parseDiffRange(tt.rev, "feature")
+			if from != tt.wantFrom || to != tt.wantTo {
+				t.Errorf("parseDiffRange() = %q, %q, want %q, %q", from, to, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func Test_filterDiffPaths(t *testing.T) {
+	files := []types.ZFSFileDiff{
+		{Filename: "a"},
+		{Filename: "data"},
+		{Filename: "data/x.csv"},
+		{Filename: "data/more/y.csv"},
+		{Filename: "database"},
+	}
+	tests := []struct {
+		name  string
+		paths []string
+		want  []string
+	}{
+		{
+			name:  "no paths",
+			paths: []string{},
+			want:  []string{"a", "data", "data/x.csv", "data/more/y.csv", "database"},
+		},
+		{
+			name:  "a file",
+			paths: []string{"a"},
+			want:  []string{"a"},
+		},
+		{
+			name:  "a directory, but not files it's a prefix of",
+			paths: []string{"data/"},
+			want:  []string{"data", "data/x.csv", "data/more/y.csv"},
+		},
+		{
+			name:  "several paths",
+			paths: []string{"/a", "./data/more"},
+			want:  []string{"a", "data/more/y.csv"},
+		},
+		{
+			name:  "the root",
+			paths: []string{"."},
+			want:  []string{"a", "data", "data/x.csv", "data/more/y.csv", "database"},
+		},
+		{
+			name:  "nothing matching",
+			paths: []string{"b"},
+			want:  []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, f := range filterDiffPaths(files, tt.paths) {
+				got = append(got, f.Filename)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterDiffPaths() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_countHunkLines(t *testing.T) {
+	tests := []struct {
+		name        string
+		hunks       string
+		wantAdded   int
+		wantRemoved int
+	}{
+		{
+			name:        "changed line",
+			hunks:       "--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n host: db\n-port: 5432\n+port: 5433\n",
+			wantAdded:   1,
+			wantRemoved: 1,
+		},
+		{
+			name:        "several hunks",
+			hunks:       "--- a/f\n+++ b/f\n@@ -1 +1,2 @@\n a\n+b\n@@ -10,2 +11 @@\n-c\n-d\n",
+			wantAdded:   1,
+			wantRemoved: 2,
+		},
+		{
+			name:        "lines that look like a header",
+			hunks:       "--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n--- old rule\n+++ new rule\n",
+			wantAdded:   1,
+			wantRemoved: 1,
+		},
+		{
+			name:        "no changes",
+			hunks:       "",
+			wantAdded:   0,
+			wantRemoved: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := countHunkLines(tt.hunks)
+			if added != tt.wantAdded || removed != tt.wantRemoved {
+				t.Errorf("countHunkLines() = %d, %d, want %d, %d", added, removed, tt.wantAdded, tt.wantRemoved)
+			}
+		})
+	}
+}
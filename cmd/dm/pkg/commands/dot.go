@@ -101,6 +101,11 @@ change the default remote dot for <dot> on <remote>.
 
 Run 'dm dot show [<dot>]' to show information about the dot.
 
+Run 'dm dot retention set|show|dry-run [<dot>]' to manage which of the dot's
+commits are pruned.
+
+Run 'dm dot schedule set|show|rm [<dot>]' to commit the dot on a schedule.
+
 Where '[<dot>]' is omitted, the current dot (selected by 'dm switch')
 is used.`,
 	}
@@ -109,6 +114,8 @@ is used.`,
 	cmd.AddCommand(NewCmdDotShow(os.Stdout))
 	cmd.AddCommand(NewCmdDotDelete(os.Stdout))
 	cmd.AddCommand(NewCmdDotForceBranchMaster(os.Stdout))
+	cmd.AddCommand(NewCmdDotRetention(os.Stdout))
+	cmd.AddCommand(NewCmdDotSchedule(os.Stdout))
 
 	return cmd
 }
@@ -152,7 +159,14 @@ func dotSetUpstream(cmd *cobra.Command, args []string, out io.Writer) error {
 		return err
 	}
 
-	dm.Configuration.SetDefaultRemoteVolumeFor(peer, localNamespace, localDot, remoteNamespace, remoteDot)
+	err = dm.Configuration.SetDefaultRemoteVolumeFor(peer, localNamespace, localDot, remoteNamespace, remoteDot)
+	if err != nil {
+		return err
+	}
+	// only dotmesh remotes can be compared with by 'dm status'
+	if _, ok := remote.(*client.DMRemote); ok {
+		return dm.Configuration.SetUpstreamFor(peer, localNamespace, localDot)
+	}
 	return nil
 }
 
@@ -54,12 +54,21 @@ func Initialise() {
 	MainCmd.AddCommand(NewCmdSwitch(os.Stdout))
 	MainCmd.AddCommand(NewCmdCommit(os.Stdout))
 	MainCmd.AddCommand(NewCmdLog(os.Stdout))
+	MainCmd.AddCommand(NewCmdDiff(os.Stdout))
 	MainCmd.AddCommand(NewCmdBranch(os.Stdout))
+	MainCmd.AddCommand(NewCmdTag(os.Stdout))
 	MainCmd.AddCommand(NewCmdCheckout(os.Stdout))
 	MainCmd.AddCommand(NewCmdReset(os.Stdout))
+	MainCmd.AddCommand(NewCmdRevert(os.Stdout))
+	MainCmd.AddCommand(NewCmdRestore(os.Stdout))
+	MainCmd.AddCommand(NewCmdMerge(os.Stdout))
+	MainCmd.AddCommand(NewCmdCherryPick(os.Stdout))
+	MainCmd.AddCommand(NewCmdStash(os.Stdout))
+	MainCmd.AddCommand(NewCmdStatus(os.Stdout))
 	MainCmd.AddCommand(NewCmdClone(os.Stdout))
 	MainCmd.AddCommand(NewCmdPull(os.Stdout))
 	MainCmd.AddCommand(NewCmdPush(os.Stdout))
+	MainCmd.AddCommand(NewCmdTransfer(os.Stdout))
 	MainCmd.AddCommand(NewCmdDebug(os.Stdout))
 	MainCmd.AddCommand(NewCmdDot(os.Stdout))
 	MainCmd.AddCommand(NewCmdVersion(os.Stdout))
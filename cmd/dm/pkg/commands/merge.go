@@ -0,0 +1,83 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/dotmesh-io/dotmesh/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var (
+	mergeMsg  string
+	mergeJSON bool
+)
+
+func NewCmdMerge(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "merge [-m <message>] <branch>",
+		Short: "Bring the changes made on another branch into the current one",
+		Long: `Applies the changes made on <branch>, since it last had a commit in common
+with the current branch, to the current branch, and makes a merge commit.
+Merging the same branch again later only brings in what's changed on it since.
+
+Changes are merged file by file. A file or directory changed on both branches
+is a conflict, unless both changed it the same way: it's left as it is on the
+current branch, and listed so you can sort it out by hand, for example with
+'dm restore --from <branch> <path>'. A merge which left conflicts doesn't count
+as having merged <branch>, so merging it again lists them again until the two
+branches agree on them.
+
+The current branch must have no uncommitted changes. Containers using the dot
+are stopped while the files are changed, and started again afterwards.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify one branch to merge.")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, err := dm.StrictCurrentVolume()
+				if err != nil {
+					return err
+				}
+				activeBranch, err := dm.CurrentBranch(activeVolume)
+				if err != nil {
+					return err
+				}
+				result, err := dm.Merge(activeVolume, activeBranch, args[0], mergeMsg)
+				if err != nil {
+					return err
+				}
+
+				if mergeJSON {
+					enc := json.NewEncoder(out)
+					enc.SetIndent("", "  ")
+					return enc.Encode(result)
+				}
+				if result.UpToDate {
+					fmt.Fprintf(out, "Already up to date with %s.\n", args[0])
+					return nil
+				}
+				fmt.Fprintf(out, "Merged %s into %s as %s, %d changes applied.\n",
+					args[0], activeBranch, result.SnapshotId, len(result.Applied))
+				if len(result.Conflicts) > 0 {
+					fmt.Fprintf(out, "%d conflicts were left as they are on %s:\n",
+						len(result.Conflicts), activeBranch)
+					for _, c := range result.Conflicts {
+						fmt.Fprintf(out, "  %s (ours %s, theirs %s)\n", c.Path, c.Ours, c.Theirs)
+					}
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&mergeMsg, "message", "m", "",
+		"Use the given string as the commit message (default \"Merge <branch>\").")
+	cmd.Flags().BoolVarP(&mergeJSON, "json", "", false,
+		"show what was merged, and the conflicts, as JSON")
+	return cmd
+}
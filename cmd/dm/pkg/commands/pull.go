@@ -44,16 +44,36 @@ Online help: https://docs.dotmesh.com/references/cli/#pull-dm-pull-remote-dot-br
 				if err != nil {
 					return err
 				}
+				if transferDryRun {
+					plan, err := dm.PlanTransfer(
+						"pull", peer,
+						filesystemName, branchName,
+						pullRemoteVolume, branchName,
+						stash,
+					)
+					if err != nil {
+						return err
+					}
+					printTransferPlan(out, plan)
+					return nil
+				}
+				rate, err := client.ParseRate(limitRate)
+				if err != nil {
+					return err
+				}
 				transferId, err := dm.RequestTransfer(
 					"pull", peer,
 					filesystemName, branchName,
 					pullRemoteVolume, branchName,
 					nil,
 					stash,
+					rate,
+					transferPriority,
 				)
 				if err != nil {
 					return err
 				}
+				printTransferId(out, transferId)
 				err = dm.PollTransfer(transferId, out, dm.UpdateBar)
 				if err != nil {
 					return err
@@ -70,5 +90,11 @@ Online help: https://docs.dotmesh.com/references/cli/#pull-dm-pull-remote-dot-br
 	cmd.PersistentFlags().StringVarP(&pullRemoteVolume, "remote-name", "", "",
 		"Remote dot name to pull from")
 	cmd.PersistentFlags().BoolVarP(&stash, "stash-on-divergence", "", false, "stash any divergence on a branch and continue")
+	cmd.PersistentFlags().StringVarP(&limitRate, "limit-rate", "", "",
+		"maximum transfer rate in bytes per second, optionally followed by K, M or G (e.g. 10M)")
+	cmd.PersistentFlags().IntVarP(&transferPriority, "priority", "", 0,
+		"priority of the transfer when the node has too many to run at once, higher goes first")
+	cmd.PersistentFlags().BoolVarP(&transferDryRun, "dry-run", "", false,
+		"show which branches and commits would be transferred, and how big they are, without transferring anything")
 	return cmd
 }
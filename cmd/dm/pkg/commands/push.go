@@ -43,12 +43,27 @@ Online help: https://docs.dotmesh.com/references/cli/#push-dm-push-remote-remote
 				if err != nil {
 					return err
 				}
+				if transferDryRun {
+					plan, err := dm.PlanTransfer(
+						"push", peer, filesystemName, branchName, pushRemoteVolume, "", stash,
+					)
+					if err != nil {
+						return err
+					}
+					printTransferPlan(out, plan)
+					return nil
+				}
+				rate, err := client.ParseRate(limitRate)
+				if err != nil {
+					return err
+				}
 				transferId, err := dm.RequestTransfer(
-					"push", peer, filesystemName, branchName, pushRemoteVolume, "", nil, stash,
+					"push", peer, filesystemName, branchName, pushRemoteVolume, "", nil, stash, rate, transferPriority,
 				)
 				if err != nil {
 					return err
 				}
+				printTransferId(out, transferId)
 				err = dm.PollTransfer(transferId, out, dm.UpdateBar)
 				if err != nil {
 					return err
@@ -64,5 +79,11 @@ Online help: https://docs.dotmesh.com/references/cli/#push-dm-push-remote-remote
 	cmd.PersistentFlags().StringVarP(&pushRemoteVolume, "remote-name", "", "",
 		"Remote dot name to push to, including remote namespace e.g. alice/apples")
 	cmd.PersistentFlags().BoolVarP(&stash, "stash-on-divergence", "", false, "stash any divergence on a branch and continue")
+	cmd.PersistentFlags().StringVarP(&limitRate, "limit-rate", "", "",
+		"maximum transfer rate in bytes per second, optionally followed by K, M or G (e.g. 10M)")
+	cmd.PersistentFlags().IntVarP(&transferPriority, "priority", "", 0,
+		"priority of the transfer when the node has too many to run at once, higher goes first")
+	cmd.PersistentFlags().BoolVarP(&transferDryRun, "dry-run", "", false,
+		"show which branches and commits would be transferred, and how big they are, without transferring anything")
 	return cmd
 }
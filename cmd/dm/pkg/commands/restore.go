@@ -0,0 +1,67 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dotmesh-io/dotmesh/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var (
+	restoreFrom   string
+	restoreCommit bool
+	restoreMsg    string
+)
+
+func NewCmdRestore(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore --from <ref> [--commit] [-m <message>] <path>...",
+		Short: "Put files back as they were in an earlier commit",
+		Long: `Replaces the given files or directories of the current branch with their
+contents in the commit <ref>, leaving everything else alone. Paths are relative
+to the root of the dot, as 'dm diff' shows them. To put the whole dot back, use
+'dm revert' instead.
+
+Containers using the dot are stopped while the files are replaced, and started
+again afterwards. With --commit (or --message), the result is committed.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if restoreFrom == "" {
+					return fmt.Errorf("Please specify the commit to restore from with --from.")
+				}
+				if len(args) == 0 {
+					return fmt.Errorf("Please specify which paths to restore.")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, err := dm.StrictCurrentVolume()
+				if err != nil {
+					return err
+				}
+				activeBranch, err := dm.CurrentBranch(activeVolume)
+				if err != nil {
+					return err
+				}
+				commit := restoreCommit || restoreMsg != ""
+				id, err := dm.Restore(activeVolume, activeBranch, restoreFrom, args, commit, restoreMsg)
+				if err != nil {
+					return err
+				}
+				if commit {
+					fmt.Fprintf(out, "%s\n", id)
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&restoreFrom, "from", "", "",
+		"the commit to restore the paths from")
+	cmd.Flags().BoolVarP(&restoreCommit, "commit", "", false,
+		"commit the restored paths")
+	cmd.Flags().StringVarP(&restoreMsg, "message", "m", "",
+		"commit the restored paths with the given message")
+	return cmd
+}
@@ -0,0 +1,236 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dotmesh-io/dotmesh/pkg/client"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+var (
+	retentionBranch      string
+	retentionAllBranches bool
+	retentionKeepLast    int
+	retentionKeepDaily   int
+	retentionKeepMeta    []string
+)
+
+func NewCmdDotRetention(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "retention",
+		Short: "Manage which commits of a dot are pruned",
+		Long: `A retention policy says which commits of a branch to keep. Every few
+minutes, the master of each branch with a policy deletes the commits it doesn't
+keep, on every node, unless something still needs them: a branch or fork made
+from them, or a remote that was last pushed to or pulled from at them.
+
+A commit is kept if any of --keep-last, --keep-daily or --keep-metadata keep
+it. The latest commit is always kept. A policy set with --all-branches applies
+to every branch of the dot which doesn't have a policy of its own.
+
+Where '[<dot>]' is omitted, the current dot (selected by 'dm switch') is used,
+and the branch defaults to its current branch.`,
+	}
+
+	setCmd := &cobra.Command{
+		Use:   "set [<dot>] [--keep-last <n>] [--keep-daily <n>] [--keep-metadata <name>=<value>]",
+		Short: "Set the retention policy, or remove it if no rules are given",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, request, err := retentionRequest(args)
+				if err != nil {
+					return err
+				}
+				request.Policy, err = retentionPolicyFromFlags()
+				if err != nil {
+					return err
+				}
+				err = dm.SetRetentionPolicy(request)
+				if err != nil {
+					return err
+				}
+				if request.Policy.Empty() {
+					fmt.Fprintf(out, "Removed the retention policy for %s\n", retentionDescription(request))
+				} else {
+					fmt.Fprintf(out, "Set the retention policy for %s\n", retentionDescription(request))
+				}
+				return nil
+			})
+		},
+	}
+	retentionPolicyFlags(setCmd)
+	cmd.AddCommand(setCmd)
+
+	showCmd := &cobra.Command{
+		Use:   "show [<dot>]",
+		Short: "Show the retention policy",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, request, err := retentionRequest(args)
+				if err != nil {
+					return err
+				}
+				policy, err := dm.GetRetentionPolicy(request)
+				if err != nil {
+					return err
+				}
+				if policy.Empty() {
+					fmt.Fprintf(out, "No retention policy for %s, every commit is kept.\n", retentionDescription(request))
+					return nil
+				}
+				if policy.Branch == "" {
+					fmt.Fprintf(out, "Retention policy for every branch of %s/%s:\n", request.Namespace, request.Name)
+				} else {
+					fmt.Fprintf(out, "Retention policy for %s/%s@%s:\n", request.Namespace, request.Name, policy.Branch)
+				}
+				for _, rule := range retentionRules(policy) {
+					fmt.Fprintf(out, "  %s\n", rule)
+				}
+				return nil
+			})
+		},
+	}
+	showCmd.Flags().StringVarP(&retentionBranch, "branch", "b", "", "branch to show the policy of")
+	showCmd.Flags().BoolVarP(&retentionAllBranches, "all-branches", "", false,
+		"show the policy for every branch of the dot")
+	cmd.AddCommand(showCmd)
+
+	dryRunCmd := &cobra.Command{
+		Use:   "dry-run [<dot>] [--keep-last <n>] [--keep-daily <n>] [--keep-metadata <name>=<value>]",
+		Short: "List the commits which would be pruned",
+		Long: `Lists the commits of a branch which would be pruned now, by the rules given
+or otherwise by the branch's policy, without deleting anything.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, request, err := retentionRequest(args)
+				if err != nil {
+					return err
+				}
+				if cmd.Flags().Changed("keep-last") || cmd.Flags().Changed("keep-daily") || cmd.Flags().Changed("keep-metadata") {
+					request.Policy, err = retentionPolicyFromFlags()
+					if err != nil {
+						return err
+					}
+				}
+				pruned, err := dm.RetentionDryRun(request)
+				if err != nil {
+					return err
+				}
+				if len(pruned) == 0 {
+					fmt.Fprintf(out, "No commits would be pruned.\n")
+					return nil
+				}
+				w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "COMMIT\tDATE\tMESSAGE\tPRUNED\n")
+				for _, p := range pruned {
+					pruned := "yes"
+					if p.Protected != "" {
+						pruned = "no: " + p.Protected
+					}
+					fmt.Fprintf(
+						w, "%s\t%s\t%s\t%s\n",
+						p.Snapshot.Id, p.Snapshot.Metadata["timestamp"], p.Snapshot.Metadata["message"], pruned,
+					)
+				}
+				return w.Flush()
+			})
+		},
+	}
+	retentionPolicyFlags(dryRunCmd)
+	cmd.AddCommand(dryRunCmd)
+
+	return cmd
+}
+
+func retentionPolicyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&retentionBranch, "branch", "b", "", "branch the policy is for")
+	cmd.Flags().BoolVarP(&retentionAllBranches, "all-branches", "", false,
+		"the policy is for every branch of the dot without one of its own")
+	cmd.Flags().IntVarP(&retentionKeepLast, "keep-last", "", 0,
+		"keep the latest n commits")
+	cmd.Flags().IntVarP(&retentionKeepDaily, "keep-daily", "", 0,
+		"keep the latest commit of each of the last n days")
+	cmd.Flags().StringSliceVarP(&retentionKeepMeta, "keep-metadata", "", []string{},
+		"keep commits with this metadata (e.g. --keep-metadata tag=release)")
+}
+
+func retentionPolicyFromFlags() (*types.RetentionPolicy, error) {
+	policy := &types.RetentionPolicy{
+		KeepLast:  retentionKeepLast,
+		KeepDaily: retentionKeepDaily,
+	}
+	for _, pair := range retentionKeepMeta {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Each metadata value must be a name=value pair: %s", pair)
+		}
+		if policy.KeepMetadata == nil {
+			policy.KeepMetadata = map[string]string{}
+		}
+		policy.KeepMetadata[parts[0]] = parts[1]
+	}
+	return policy, nil
+}
+
+func retentionRequest(args []string) (*client.DotmeshAPI, types.RetentionPolicyRequest, error) {
+	request := types.RetentionPolicyRequest{AllBranches: retentionAllBranches}
+	dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+	if err != nil {
+		return nil, request, err
+	}
+	var qualifiedDotName string
+	switch len(args) {
+	case 0:
+		qualifiedDotName, err = dm.StrictCurrentVolume()
+		if err != nil {
+			return nil, request, err
+		}
+	case 1:
+		qualifiedDotName = args[0]
+	default:
+		return nil, request, fmt.Errorf("Please specify at most one dot.")
+	}
+	request.Namespace, request.Name, err = client.ParseNamespacedVolume(qualifiedDotName)
+	if err != nil {
+		return nil, request, err
+	}
+	request.Branch = retentionBranch
+	if request.Branch == "" {
+		request.Branch, err = dm.CurrentBranch(qualifiedDotName)
+		if err != nil {
+			return nil, request, err
+		}
+	}
+	return dm, request, nil
+}
+
+func retentionDescription(request types.RetentionPolicyRequest) string {
+	if request.AllBranches {
+		return fmt.Sprintf("every branch of %s/%s", request.Namespace, request.Name)
+	}
+	return fmt.Sprintf("%s/%s@%s", request.Namespace, request.Name, request.Branch)
+}
+
+func retentionRules(policy types.RetentionPolicy) []string {
+	rules := []string{}
+	if policy.KeepLast > 0 {
+		rules = append(rules, fmt.Sprintf("keep the last %d commits", policy.KeepLast))
+	}
+	if policy.KeepDaily > 0 {
+		rules = append(rules, fmt.Sprintf("keep one commit a day for %d days", policy.KeepDaily))
+	}
+	names := []string{}
+	for name := range policy.KeepMetadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rules = append(rules, fmt.Sprintf("keep commits with %s=%s", name, policy.KeepMetadata[name]))
+	}
+	return rules
+}
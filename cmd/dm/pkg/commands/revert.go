@@ -0,0 +1,53 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dotmesh-io/dotmesh/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var revertMsg string
+
+func NewCmdRevert(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "revert <ref>",
+		Short: "Make a new commit with the contents of an earlier one",
+		Long: `Makes a new commit on the current branch whose contents are those of
+<ref>, throwing away any uncommitted changes. Unlike 'dm reset --hard', the
+commits since <ref> are kept, so it's safe on branches other people use. The
+new commit's metadata records which commit it reverted to.
+
+Containers using the dot are stopped while its contents are replaced, and
+started again afterwards.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify one ref only.")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, err := dm.StrictCurrentVolume()
+				if err != nil {
+					return err
+				}
+				activeBranch, err := dm.CurrentBranch(activeVolume)
+				if err != nil {
+					return err
+				}
+				id, err := dm.Revert(activeVolume, activeBranch, args[0], revertMsg)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "%s\n", id)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&revertMsg, "message", "m", "",
+		"Use the given string as the commit message (default \"Revert to <commit>\").")
+	return cmd
+}
@@ -94,11 +94,14 @@ func NewCmdS3(out io.Writer) *cobra.Command {
 					filesystemName, branchName,
 					prefixes,
 					false,
+					0,
+					0,
 					// TODO also switch to the remote?
 				)
 				if err != nil {
 					return err
 				}
+				printTransferId(out, transferId)
 				err = dm.PollTransfer(transferId, out, dm.UpdateBar)
 				if err != nil {
 					return err
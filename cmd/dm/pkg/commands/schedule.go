@@ -0,0 +1,189 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/dotmesh-io/dotmesh/pkg/client"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+var (
+	scheduleBranch      string
+	scheduleAllBranches bool
+	scheduleMessage     string
+	scheduleMetadata    []string
+)
+
+func NewCmdDotSchedule(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schedule",
+		Short: "Manage scheduled commits of a dot",
+		Long: `A commit schedule makes the master of a branch commit it at the times given
+by a cron expression (in UTC), unless nothing has changed since its latest
+commit. The schedule follows the branch if it moves to another node.
+
+The commit message is a Go template, given the {{.Dot}}, {{.Branch}} and
+{{.Time}} of the commit, e.g. --message "Nightly snapshot of {{.Branch}}". A
+schedule set with --all-branches applies to every branch of the dot which
+doesn't have a schedule of its own.
+
+Where '[<dot>]' is omitted, the current dot (selected by 'dm switch') is used,
+and the branch defaults to its current branch.`,
+	}
+
+	setCmd := &cobra.Command{
+		Use:   "set [<dot>] <cron> [--message <template>] [--metadata <name>=<value>]",
+		Short: "Set the commit schedule, e.g. dm dot schedule set '0 * * * *'",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) == 0 {
+					return fmt.Errorf("Please specify a cron expression, e.g. '0 2 * * *' for 2am every day.")
+				}
+				cron := args[len(args)-1]
+				dm, request, err := scheduleRequest(args[:len(args)-1])
+				if err != nil {
+					return err
+				}
+				request.Schedule = &types.CommitSchedule{
+					Cron:    cron,
+					Message: scheduleMessage,
+				}
+				for _, pair := range scheduleMetadata {
+					parts := strings.SplitN(pair, "=", 2)
+					if len(parts) != 2 {
+						return fmt.Errorf("Each metadata value must be a name=value pair: %s", pair)
+					}
+					if request.Schedule.Metadata == nil {
+						request.Schedule.Metadata = map[string]string{}
+					}
+					request.Schedule.Metadata[parts[0]] = parts[1]
+				}
+				err = dm.SetCommitSchedule(request)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Set the commit schedule for %s\n", scheduleDescription(request))
+				return nil
+			})
+		},
+	}
+	scheduleTargetFlags(setCmd)
+	setCmd.Flags().StringVarP(&scheduleMessage, "message", "m", "",
+		"commit message template (default \"Scheduled commit\")")
+	setCmd.Flags().StringSliceVarP(&scheduleMetadata, "metadata", "d", []string{},
+		"add metadata to each commit (e.g. -d source=nightly)")
+	cmd.AddCommand(setCmd)
+
+	showCmd := &cobra.Command{
+		Use:   "show [<dot>]",
+		Short: "Show the commit schedule",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, request, err := scheduleRequest(args)
+				if err != nil {
+					return err
+				}
+				cs, err := dm.GetCommitSchedule(request)
+				if err != nil {
+					return err
+				}
+				if cs.Cron == "" {
+					fmt.Fprintf(out, "No commit schedule for %s.\n", scheduleDescription(request))
+					return nil
+				}
+				if cs.Branch == "" {
+					fmt.Fprintf(out, "Commit schedule for every branch of %s/%s:\n", request.Namespace, request.Name)
+				} else {
+					fmt.Fprintf(out, "Commit schedule for %s/%s@%s:\n", request.Namespace, request.Name, cs.Branch)
+				}
+				fmt.Fprintf(out, "  cron: %s\n", cs.Cron)
+				if cs.Message != "" {
+					fmt.Fprintf(out, "  message: %s\n", cs.Message)
+				}
+				names := []string{}
+				for name := range cs.Metadata {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					fmt.Fprintf(out, "  metadata: %s=%s\n", name, cs.Metadata[name])
+				}
+				return nil
+			})
+		},
+	}
+	scheduleTargetFlags(showCmd)
+	cmd.AddCommand(showCmd)
+
+	rmCmd := &cobra.Command{
+		Use:   "rm [<dot>]",
+		Short: "Remove the commit schedule",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, request, err := scheduleRequest(args)
+				if err != nil {
+					return err
+				}
+				err = dm.SetCommitSchedule(request)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Removed the commit schedule for %s\n", scheduleDescription(request))
+				return nil
+			})
+		},
+	}
+	scheduleTargetFlags(rmCmd)
+	cmd.AddCommand(rmCmd)
+
+	return cmd
+}
+
+func scheduleTargetFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&scheduleBranch, "branch", "b", "", "branch the schedule is for")
+	cmd.Flags().BoolVarP(&scheduleAllBranches, "all-branches", "", false,
+		"the schedule is for every branch of the dot without one of its own")
+}
+
+func scheduleRequest(args []string) (*client.DotmeshAPI, types.CommitScheduleRequest, error) {
+	request := types.CommitScheduleRequest{AllBranches: scheduleAllBranches}
+	dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+	if err != nil {
+		return nil, request, err
+	}
+	var qualifiedDotName string
+	switch len(args) {
+	case 0:
+		qualifiedDotName, err = dm.StrictCurrentVolume()
+		if err != nil {
+			return nil, request, err
+		}
+	case 1:
+		qualifiedDotName = args[0]
+	default:
+		return nil, request, fmt.Errorf("Please specify at most one dot.")
+	}
+	request.Namespace, request.Name, err = client.ParseNamespacedVolume(qualifiedDotName)
+	if err != nil {
+		return nil, request, err
+	}
+	request.Branch = scheduleBranch
+	if request.Branch == "" {
+		request.Branch, err = dm.CurrentBranch(qualifiedDotName)
+		if err != nil {
+			return nil, request, err
+		}
+	}
+	return dm, request, nil
+}
+
+func scheduleDescription(request types.CommitScheduleRequest) string {
+	if request.AllBranches {
+		return fmt.Sprintf("every branch of %s/%s", request.Namespace, request.Name)
+	}
+	return fmt.Sprintf("%s/%s@%s", request.Namespace, request.Name, request.Branch)
+}
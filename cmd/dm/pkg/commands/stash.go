@@ -0,0 +1,183 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/pkg/client"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+var stashApplyMsg string
+
+func NewCmdStash(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stash",
+		Short: "Manage the stashes of the current dot",
+		Long: `When a branch has diverged from the copy it's being pushed to or pulled from,
+and the transfer was allowed to stash (--stash-on-divergence), the commits only
+the branch had are moved onto a new stash branch, named after the branch and
+the time, and the branch carries on from the latest commit both had.
+
+  dm stash list            list the stashes, newest first
+  dm stash show <stash>    show a stash's commits and what they changed
+  dm stash apply <stash>   make a commit on the branch the stash came from
+                           with the contents of the stash's latest commit
+  dm stash drop <stash>    delete a stash`,
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the stashes of the current dot",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, activeVolume, err := stashVolume()
+				if err != nil {
+					return err
+				}
+				stashes, err := dm.ListStashes(activeVolume)
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "STASH\tFROM\tCREATED\tCOMMITS\tTRANSFER\n")
+				for _, stash := range stashes {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n",
+						stash.Name, stashBranch(stash), stash.Created.Format(time.RFC3339),
+						len(stash.Commits), stash.TransferRequestId)
+				}
+				return w.Flush()
+			})
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "show <stash>",
+		Short: "Show a stash's commits and what they changed",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify one stash.")
+				}
+				dm, activeVolume, err := stashVolume()
+				if err != nil {
+					return err
+				}
+				stash, err := dm.GetStash(activeVolume, args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "stash %s\n", stash.Name)
+				fmt.Fprintf(out, "from: %s\n", stashBranch(stash))
+				fmt.Fprintf(out, "created: %s\n", stash.Created.Format(time.RFC3339))
+				if stash.TransferRequestId != "" {
+					fmt.Fprintf(out, "transfer: %s\n", stash.TransferRequestId)
+				}
+				fmt.Fprintf(out, "base: %s\n", stash.BaseCommit)
+				fmt.Fprintf(out, "\n")
+				for _, commit := range stash.Commits {
+					fmt.Fprintf(out, "%s %s\n", commit.Id, commit.Metadata["message"])
+				}
+				if len(stash.Commits) == 0 {
+					return nil
+				}
+
+				request := types.RPCDiffRequest{
+					Branch: stash.Name,
+					From:   stash.BaseCommit,
+					To:     stash.Name,
+				}
+				request.Namespace, request.Name, err = client.ParseNamespacedVolume(activeVolume)
+				if err != nil {
+					return err
+				}
+				result, err := dm.DiffCommits(request)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "\n")
+				for _, f := range result.Files {
+					fmt.Fprintf(out, "%s\t%s\n", f.Change, diffDisplayName(f))
+				}
+				return nil
+			})
+		},
+	})
+
+	applyCmd := &cobra.Command{
+		Use:   "apply [-m <message>] <stash>",
+		Short: "Commit the contents of a stash to the branch it came from",
+		Long: `Makes a new commit on the branch the stash came from, whose contents are those
+of the stash's latest commit, so the stashed work carries on from there. The
+branch's commits since the stash are kept, as with 'dm revert'. The stash is
+left alone, drop it with 'dm stash drop' once you're done with it.
+
+The branch must have no uncommitted changes. Containers using the dot are
+stopped while its contents are replaced, and started again afterwards.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify one stash.")
+				}
+				dm, activeVolume, err := stashVolume()
+				if err != nil {
+					return err
+				}
+				id, err := dm.ApplyStash(activeVolume, args[0], stashApplyMsg)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "%s\n", id)
+				return nil
+			})
+		},
+	}
+	applyCmd.Flags().StringVarP(&stashApplyMsg, "message", "m", "",
+		"Use the given string as the commit message (default \"Apply stash <stash>\").")
+	cmd.AddCommand(applyCmd)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "drop <stash>",
+		Short: "Delete a stash",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify one stash.")
+				}
+				dm, activeVolume, err := stashVolume()
+				if err != nil {
+					return err
+				}
+				err = dm.DropStash(activeVolume, args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Dropped stash %s.\n", args[0])
+				return nil
+			})
+		},
+	})
+	return cmd
+}
+
+func stashVolume() (*client.DotmeshAPI, string, error) {
+	dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+	if err != nil {
+		return nil, "", err
+	}
+	activeVolume, err := dm.StrictCurrentVolume()
+	if err != nil {
+		return nil, "", err
+	}
+	return dm, activeVolume, nil
+}
+
+func stashBranch(stash types.Stash) string {
+	if stash.Branch == "" {
+		return "master"
+	}
+	return stash.Branch
+}
@@ -0,0 +1,128 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dotmesh-io/dotmesh/pkg/client"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+var statusJSON bool
+
+func NewCmdStatus(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status [<remote>] [--json]",
+		Short: "Show where you are, and how the current branch stands against its upstream",
+		Long: `Shows the current remote, dot and branch, the node the branch's master copy is
+on, how big it is and how much of that isn't committed yet, the containers
+using it, and any of the dot's transfers which are still going.
+
+It also lists the commits of the branch that 'dm push' would push the current
+branch to, on the remote the dot has an upstream dot on (see 'dm dot
+set-upstream'), or on <remote> if one is given, and says how many commits the
+current branch has that it doesn't (ahead), and how many it has that the
+current branch doesn't (behind). Nothing is transferred.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 1 {
+					return fmt.Errorf("Please specify at most one remote.")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, err := dm.StrictCurrentVolume()
+				if err != nil {
+					return err
+				}
+				activeBranch, err := dm.CurrentBranch(activeVolume)
+				if err != nil {
+					return err
+				}
+				status, err := dm.DotStatus(activeVolume, activeBranch)
+				if err != nil {
+					return err
+				}
+				if len(args) == 1 {
+					comparison, err := dm.CompareWithRemote(args[0], activeVolume, activeBranch)
+					if err != nil {
+						return err
+					}
+					status.Upstream = &comparison
+					status.UpstreamError = ""
+				}
+
+				if statusJSON {
+					enc := json.NewEncoder(out)
+					enc.SetIndent("", "  ")
+					return enc.Encode(status)
+				}
+				printStatus(out, status)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&statusJSON, "json", "", false,
+		"show the status as JSON, for scripts")
+	return cmd
+}
+
+func printStatus(out io.Writer, status types.DotStatus) {
+	fmt.Fprintf(out, "On remote %s, dot %s/%s, branch %s\n",
+		status.Remote, status.Namespace, status.Name, statusBranch(status.Branch))
+	fmt.Fprintf(out, "Master node: %s\n", status.Master)
+	if status.DirtyBytes == 0 {
+		fmt.Fprintf(out, "Size: %s (all clean)\n", prettyPrintSize(status.SizeBytes))
+	} else {
+		fmt.Fprintf(out, "Size: %s (%s dirty)\n",
+			prettyPrintSize(status.SizeBytes), prettyPrintSize(status.DirtyBytes))
+	}
+
+	if len(status.Containers) == 0 {
+		fmt.Fprintf(out, "Containers: none\n")
+	} else {
+		names := []string{}
+		for _, c := range status.Containers {
+			names = append(names, c.Name)
+		}
+		fmt.Fprintf(out, "Containers: %s\n", strings.Join(names, ", "))
+	}
+
+	if len(status.Transfers) == 0 {
+		fmt.Fprintf(out, "Transfers: none\n")
+	} else {
+		fmt.Fprintf(out, "Transfers:\n")
+		for _, t := range status.Transfers {
+			fmt.Fprintf(out, "  %s %s %s/%s %s %s:%s/%s %s (%d/%d)\n",
+				t.TransferRequestId, t.Direction,
+				t.LocalNamespace, t.LocalName, statusBranch(t.LocalBranchName),
+				t.Peer, t.RemoteNamespace, t.RemoteName,
+				t.Status, t.Index, t.Total)
+		}
+	}
+
+	switch {
+	case status.UpstreamError != "":
+		fmt.Fprintf(out, "Upstream: %s\n", status.UpstreamError)
+	case status.Upstream == nil:
+		fmt.Fprintf(out, "No upstream dot, push the dot or run 'dm dot set-upstream'.\n")
+	case !status.Upstream.RemoteExists:
+		fmt.Fprintf(out, "%s/%s doesn't exist yet, ahead %d.\n",
+			status.Upstream.Remote, statusBranch(status.Upstream.RemoteBranch), status.Upstream.Ahead)
+	default:
+		fmt.Fprintf(out, "ahead %d, behind %d of %s/%s\n",
+			status.Upstream.Ahead, status.Upstream.Behind,
+			status.Upstream.Remote, statusBranch(status.Upstream.RemoteBranch))
+	}
+}
+
+func statusBranch(branch string) string {
+	if branch == "" {
+		return client.DefaultBranch
+	}
+	return branch
+}
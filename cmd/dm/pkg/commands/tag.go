@@ -0,0 +1,94 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/dotmesh-io/dotmesh/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var (
+	tagList   bool
+	tagDelete bool
+)
+
+func NewCmdTag(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tag [-l | -d <name> | <name> [<commit>]]",
+		Short: "List, create or delete tags",
+		Long: `Name a commit of the current dot, so that the name can be used wherever a
+commit id can: 'dm reset', 'dm revert', 'dm diff', S3 snapshot paths and so on.
+
+  dm tag <name>            tag the latest commit of the current branch
+  dm tag <name> <commit>   tag <commit>, which can be a commit id, HEAD^,
+                           another tag or a branch for its latest commit
+  dm tag -l                list the tags
+  dm tag -d <name>         delete a tag
+
+Tags belong to the dot rather than a branch, don't move once they're made,
+and go along with the commits they tag when the dot is pushed or pulled.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if tagList && tagDelete {
+					return fmt.Errorf("Please specify at most one of -l and -d.")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, err := dm.StrictCurrentVolume()
+				if err != nil {
+					return err
+				}
+
+				switch {
+				case tagDelete:
+					if len(args) != 1 {
+						return fmt.Errorf("Please specify the tag to delete.")
+					}
+					err = dm.DeleteTag(activeVolume, args[0])
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(out, "Deleted tag %s.\n", args[0])
+				case tagList || len(args) == 0:
+					if len(args) != 0 {
+						return fmt.Errorf("Please don't specify a tag when listing them.")
+					}
+					tags, err := dm.ListTags(activeVolume)
+					if err != nil {
+						return err
+					}
+					w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+					for _, tag := range tags {
+						fmt.Fprintf(w, "%s\t%s\n", tag.Name, tag.SnapshotId)
+					}
+					return w.Flush()
+				default:
+					if len(args) > 2 {
+						return fmt.Errorf("Please specify a tag name and at most one commit.")
+					}
+					ref := ""
+					if len(args) == 2 {
+						ref = args[1]
+					}
+					activeBranch, err := dm.CurrentBranch(activeVolume)
+					if err != nil {
+						return err
+					}
+					tag, err := dm.Tag(activeVolume, activeBranch, args[0], ref)
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(out, "Tagged %s as %s.\n", tag.SnapshotId, tag.Name)
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&tagList, "list", "l", false, "list the tags")
+	cmd.Flags().BoolVarP(&tagDelete, "delete", "d", false, "delete a tag")
+	return cmd
+}
@@ -0,0 +1,120 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dotmesh-io/dotmesh/pkg/client"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdTransfer(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "transfer",
+		Short: "Manage transfers started by push, pull and clone",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "cancel <transfer-id>",
+		Short: "Cancel a transfer which is still going",
+		Long: `Stops a push, pull or clone, on both clusters. Anything it had
+received so far is thrown away, rather than kept for the transfer to carry on
+from next time. The transfer id is printed when the transfer starts.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify one transfer id.")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				err = dm.CancelTransfer(args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Cancelled transfer %s\n", args[0])
+				return nil
+			})
+		},
+	})
+	reorderCmd := &cobra.Command{
+		Use:   "reorder <transfer-id> [--priority <n>] [--position <n>]",
+		Short: "Change where a queued transfer is in its node's queue",
+		Long: `When a node is already running as many transfers as it's allowed to
+(MAX_CONCURRENT_TRANSFERS), any more wait in a queue, highest priority first.
+--priority gives a queued transfer a new priority, and --position moves it to
+a place in the queue, 1 being the next to run.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify one transfer id.")
+				}
+				request := types.TransferReorderRequest{
+					TransferRequestId: args[0],
+					Position:          reorderPosition,
+				}
+				if cmd.Flags().Changed("priority") {
+					request.Priority = &reorderPriority
+				}
+				if request.Priority == nil && request.Position == 0 {
+					return fmt.Errorf("Please specify --priority or --position.")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				err = dm.ReorderTransfer(request)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Reordered transfer %s\n", args[0])
+				return nil
+			})
+		},
+	}
+	reorderCmd.Flags().IntVarP(&reorderPriority, "priority", "", 0,
+		"new priority for the transfer")
+	reorderCmd.Flags().IntVarP(&reorderPosition, "position", "", 0,
+		"new place in the queue for the transfer, 1 being the next to run")
+	cmd.AddCommand(reorderCmd)
+	return cmd
+}
+
+var reorderPriority, reorderPosition int
+
+// printTransferId tells the user how to cancel the transfer they've just
+// started, before its progress bar takes over.
+func printTransferId(out io.Writer, transferId string) {
+	fmt.Fprintf(out, "Transfer %s (cancel with 'dm transfer cancel %s')\n", transferId, transferId)
+}
+
+// printTransferPlan shows what a --dry-run push, pull or clone found it would
+// transfer.
+func printTransferPlan(out io.Writer, plan types.TransferPlan) {
+	fmt.Fprintf(out, "Dry run, nothing has been transferred. The %s would send:\n", plan.Direction)
+	for _, step := range plan.Steps {
+		fmt.Fprintf(out, "  branch %s (%s): ", statusBranch(step.Branch), step.FilesystemId)
+		switch {
+		case step.Error != "":
+			fmt.Fprintf(out, "can't, %s\n", step.Error)
+		case step.UpToDate:
+			fmt.Fprintf(out, "nothing, up to date\n")
+		default:
+			if step.StashNeeded {
+				fmt.Fprintf(out, "after stashing the receiving end's divergent commits, ")
+			}
+			fmt.Fprintf(out, "%d commits, %s (%s on the wire)\n",
+				len(step.Commits), prettyPrintSize(step.Size.Raw), prettyPrintSize(step.Size.Wire))
+			for _, commit := range step.Commits {
+				fmt.Fprintf(out, "    %s %s\n", commit.Id, commit.Metadata["message"])
+			}
+		}
+	}
+	fmt.Fprintf(out, "Total: %s (%s on the wire)\n",
+		prettyPrintSize(plan.Size.Raw), prettyPrintSize(plan.Size.Wire))
+	if plan.StashNeeded {
+		fmt.Fprintf(out, "The receiving end has diverged: its commits since the latest one both ends have\n"+
+			"need stashing, which --stash-on-divergence allows.\n")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/pkg/store"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+
+	"github.com/portworx/kvdb"
+)
+
+// branchOrigin finds the commit a new branch of a dot starts at, from the
+// point of view of the branch it's made from. The commit may be on another
+// branch, or on the one the source branch was cloned from, and the clone has
+// to be made from whichever filesystem it's on. It can also be given as a tag,
+// or a branch name for that branch's latest commit. Commits which are only
+// upstream of a fork aren't on any of the dot's branches, so can't be
+// branched from.
+func (s *InMemoryState) branchOrigin(tlf types.TopLevelFilesystem, filesystemId, ref string) (diffEnd, error) {
+	origin, err := s.resolveDiffRef(filesystemId, ref)
+	if err != nil {
+		return diffEnd{}, err
+	}
+	for _, id := range s.branchFilesystemIds(tlf) {
+		if id == origin.FilesystemID {
+			return origin, nil
+		}
+	}
+	return diffEnd{}, fmt.Errorf(
+		"Commit %s isn't on any branch of %s", ref, tlf.MasterBranch.Name,
+	)
+}
+
+// how long deleting a branch waits for the clone which takes over its commits
+// to be promoted
+const promoteTimeout = time.Minute
+
+// reparentClones picks which of the clones of a branch that's about to be
+// deleted gets promoted, returning its filesystem id, or "" if nothing was
+// cloned from the branch, along with the registry entries of the branch's
+// clones as they are once it's been promoted: the promoted clone takes over the
+// branch's origin, and the other clones of the branch become clones of it,
+// since every commit up to its origin moves to it. Nothing is changed until
+// the promotion has happened, by updateClones.
+func (s *InMemoryState) reparentClones(topLevelFilesystemId, filesystemId string, origin types.Origin) (string, map[string]types.Clone, error) {
+	dependents := map[string]types.Clone{}
+	for name, clone := range s.registry.ClonesFor(topLevelFilesystemId) {
+		if clone.Origin.FilesystemId == filesystemId {
+			dependents[name] = clone
+		}
+	}
+	if len(dependents) == 0 {
+		return "", dependents, nil
+	}
+
+	snapshots, err := s.SnapshotsForCurrentMaster(filesystemId)
+	if err != nil {
+		return "", nil, err
+	}
+	index := map[string]int{}
+	for i, snapshot := range snapshots {
+		index[snapshot.Id] = i
+	}
+	// the one cloned from the latest commit, so that it takes over the
+	// origins of all the others
+	promoted := ""
+	for name, clone := range dependents {
+		latest := index[dependents[promoted].Origin.SnapshotId]
+		if promoted == "" || index[clone.Origin.SnapshotId] > latest ||
+			(index[clone.Origin.SnapshotId] == latest && name < promoted) {
+			promoted = name
+		}
+	}
+
+	promotedId := dependents[promoted].FilesystemId
+	for name, clone := range dependents {
+		if name == promoted {
+			clone.Origin = origin
+		} else {
+			clone.Origin.FilesystemId = promotedId
+		}
+		dependents[name] = clone
+	}
+	return promotedId, dependents, nil
+}
+
+func (s *InMemoryState) updateClones(topLevelFilesystemId string, clones map[string]types.Clone) error {
+	for name, clone := range clones {
+		err := s.registry.UpdateClone(name, topLevelFilesystemId, clone)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promoteOnMaster promotes the master's copy of a clone of a filesystem which
+// is about to be deleted, so that the clone owns the commits it shares with the
+// filesystem before anything records that it does.
+func (s *InMemoryState) promoteOnMaster(filesystemId, originFilesystemId string) error {
+	responseChan, err := s.globalFsRequest(
+		filesystemId,
+		&Event{Name: "promote", Args: &EventArgs{"originFilesystemId": originFilesystemId}},
+	)
+	if err != nil {
+		return err
+	}
+	var e *Event
+	select {
+	case <-time.After(promoteTimeout):
+		// something needs to read the response from the response chan
+		go func() { <-responseChan }()
+		return fmt.Errorf("timed out promoting %s, please try again", filesystemId)
+	case e = <-responseChan:
+	}
+	if e == nil || e.Name != "promoted" {
+		return fmt.Errorf("failed to promote %s: %s", filesystemId, e)
+	}
+	return nil
+}
+
+// moveBranchSettings moves a branch's own retention policy and commit
+// schedule, which are stored by branch name, to its new name.
+func (s *InMemoryState) moveBranchSettings(topLevelFilesystemId, oldName, newName string) error {
+	policy, err := s.registryStore.GetRetentionPolicy(topLevelFilesystemId, oldName)
+	if err == nil {
+		policy.Branch = newName
+		err = s.registryStore.SetRetentionPolicy(policy, &store.SetOptions{})
+		if err != nil {
+			return err
+		}
+		err = s.registryStore.DeleteRetentionPolicy(topLevelFilesystemId, oldName)
+	}
+	if err != nil && err != kvdb.ErrNotFound {
+		return err
+	}
+
+	schedules, err := s.commitSchedules()
+	if err != nil {
+		return err
+	}
+	cs, ok := schedules[topLevelFilesystemId][oldName]
+	if !ok {
+		return nil
+	}
+	cs.Branch = newName
+	err = s.registryStore.SetCommitSchedule(&cs, &store.SetOptions{})
+	if err != nil {
+		return err
+	}
+	return s.registryStore.DeleteCommitSchedule(topLevelFilesystemId, oldName)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/dotmesh-io/dotmesh/pkg/fsm"
+	"github.com/dotmesh-io/dotmesh/pkg/registry"
+	"github.com/dotmesh-io/dotmesh/pkg/store"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/dotmesh-io/dotmesh/pkg/user"
+)
+
+// snapshotsFSM is a filesystem machine which only knows its snapshots.
+type snapshotsFSM struct {
+	fsm.FSM
+	snapshots []*types.Snapshot
+}
+
+func (f *snapshotsFSM) GetSnapshots(nodeID string) []*types.Snapshot {
+	return f.snapshots
+}
+
+// newBranchesState returns the state of a node which is the master of dot-1,
+// a fork of dot-2, with branches feature and other, each with one commit
+// named after it.
+func newBranchesState(t *testing.T) *InMemoryState {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	um := user.New(store.NewKVDBStoreWithIndex(client, "users"))
+	owner, err := um.New("foo", "foo@bar.pub", "verysecret")
+	if err != nil {
+		t.Fatalf("failed to create new user: %s", err)
+	}
+	registryStore := store.NewKVDBFilesystemStore(client)
+	r := registry.NewRegistry(um, registryStore)
+	for _, rf := range []types.RegistryFilesystem{
+		{Id: "dot-2", Name: "upstream", OwnerId: owner.Id},
+		{Id: "dot-1", Name: "dot", OwnerId: owner.Id, ForkParentId: "dot-2", ForkParentSnapshotId: "upstream-commit"},
+	} {
+		err = r.UpdateFilesystemFromEtcd(types.VolumeName{Namespace: "admin", Name: rf.Name}, rf)
+		if err != nil {
+			t.Fatalf("failed to update filesystem from etcd: %s", err)
+		}
+	}
+	for _, name := range []string{"feature", "other"} {
+		r.UpdateCloneFromEtcd(name, "dot-1", types.Clone{
+			TopLevelFilesystemId: "dot-1",
+			FilesystemId:         "clone-" + name,
+			Name:                 name,
+			Origin:               types.Origin{FilesystemId: "dot-1", SnapshotId: "master-commit"},
+		})
+	}
+
+	s := &InMemoryState{
+		filesystems:     map[string]fsm.FSM{},
+		filesystemsLock: &sync.RWMutex{},
+		registry:        r,
+		registryStore:   registryStore,
+	}
+	for id, commit := range map[string]string{
+		"dot-2":         "upstream-commit",
+		"dot-1":         "master-commit",
+		"clone-feature": "feature-commit",
+		"clone-other":   "other-commit",
+	} {
+		r.SetMasterNode(id, "node-1")
+		s.filesystems[id] = &snapshotsFSM{snapshots: []*types.Snapshot{{Id: commit}}}
+	}
+	return s
+}
+
+func TestBranchOrigin(t *testing.T) {
+	s := newBranchesState(t)
+	tlf, err := s.registry.LookupFilesystem(types.VolumeName{Namespace: "admin", Name: "dot"})
+	if err != nil {
+		t.Fatalf("failed to look up dot: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		ref  string
+		want diffEnd
+	}{
+		{
+			name: "a commit of the branch",
+			ref:  "feature-commit",
+			want: diffEnd{FilesystemID: "clone-feature", SnapshotID: "feature-commit"},
+		},
+		{
+			name: "a commit of another branch",
+			ref:  "other-commit",
+			want: diffEnd{FilesystemID: "clone-other", SnapshotID: "other-commit"},
+		},
+		{
+			name: "a commit of the branch it was cloned from",
+			ref:  "master-commit",
+			want: diffEnd{FilesystemID: "dot-1", SnapshotID: "master-commit"},
+		},
+		{
+			name: "another branch's latest commit",
+			ref:  "other",
+			want: diffEnd{FilesystemID: "clone-other", SnapshotID: "other-commit"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.branchOrigin(tlf, "clone-feature", tt.ref)
+			if err != nil {
+				t.Fatalf("branchOrigin() failed: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("branchOrigin() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// a commit upstream of the fork can be diffed with, but isn't on any of
+	// the dot's branches
+	_, err = s.branchOrigin(tlf, "clone-feature", "upstream-commit")
+	if err == nil {
+		t.Errorf("expected branching from a commit outside the dot to fail")
+	}
+	_, err = s.branchOrigin(tlf, "clone-feature", "no-such-commit")
+	if err == nil {
+		t.Errorf("expected branching from a missing commit to fail")
+	}
+}
+
+func TestCheckBranchNameIsNotATag(t *testing.T) {
+	s := newBranchesState(t)
+	err := s.registryStore.SetTag(&types.Tag{
+		FilesystemId: "dot-1",
+		Name:         "v1",
+		SnapshotId:   "master-commit",
+	}, &store.SetOptions{})
+	if err != nil {
+		t.Fatalf("failed to tag: %s", err)
+	}
+
+	err = s.checkBranchNameIsNotATag("dot-1", "v1")
+	if err == nil {
+		t.Errorf("expected a branch named after a tag to be refused")
+	}
+	err = s.checkBranchNameIsNotATag("dot-1", "v2")
+	if err != nil {
+		t.Errorf("expected a branch not named after a tag to be allowed, got %s", err)
+	}
+	// tags are per dot
+	err = s.checkBranchNameIsNotATag("dot-2", "v1")
+	if err != nil {
+		t.Errorf("expected a branch named after another dot's tag to be allowed, got %s", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/dotmesh-io/dotmesh/pkg/uuid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkCommitDeletable returns why a commit of a filesystem can't be deleted,
+// or nil if nothing needs it.
+func (s *InMemoryState) checkCommitDeletable(filesystemId, snapshotId string) error {
+	snapshots, err := s.SnapshotsForCurrentMaster(filesystemId)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) > 0 && snapshots[len(snapshots)-1].Id == snapshotId {
+		// a replica which missed the delete would still have it on top of
+		// the master's latest commit, and couldn't receive anything after
+		return fmt.Errorf(
+			"Commit %s is the latest on its branch, so it can't be deleted", snapshotId,
+		)
+	}
+	for _, clones := range s.registry.DumpClones() {
+		for name, clone := range clones {
+			if clone.Origin.FilesystemId == filesystemId && clone.Origin.SnapshotId == snapshotId {
+				return fmt.Errorf(
+					"Commit %s is the origin of branch %s, so it can't be deleted while the branch exists",
+					snapshotId, name,
+				)
+			}
+		}
+	}
+	for _, tlf := range s.registry.DumpTopLevelFilesystems() {
+		if tlf.ForkParentId == filesystemId && tlf.ForkParentSnapshotId == snapshotId {
+			return fmt.Errorf(
+				"Commit %s is the origin of fork %s, so it can't be deleted while the fork exists",
+				snapshotId, tlf.MasterBranch.Name,
+			)
+		}
+	}
+	if tlf, _, err := s.registry.LookupFilesystemById(filesystemId); err == nil {
+		tags, err := s.registryStore.ListTags(tlf.MasterBranch.Id)
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if tag.SnapshotId == snapshotId {
+				return fmt.Errorf(
+					"Commit %s is tagged %s, so it can't be deleted while the tag exists",
+					snapshotId, tag.Name,
+				)
+			}
+		}
+	}
+	bases, err := s.remoteBases(filesystemId)
+	if err != nil {
+		return err
+	}
+	for remote, base := range bases {
+		if base == snapshotId {
+			return fmt.Errorf(
+				"Commit %s is the latest one %s is known to have, so without it the two would look diverged the next time they're pushed or pulled",
+				snapshotId, remote,
+			)
+		}
+	}
+	return nil
+}
+
+// remoteBases returns, for each remote dot this filesystem has been pushed to
+// or pulled from, the latest of our commits it's known to have. That's the
+// commit the next push or pull with it starts from.
+func (s *InMemoryState) remoteBases(filesystemId string) (map[string]string, error) {
+	snapshots, err := s.SnapshotsForCurrentMaster(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+	index := map[string]int{}
+	for i, snapshot := range snapshots {
+		index[snapshot.Id] = i
+	}
+
+	s.interclusterTransfersLock.RLock()
+	defer s.interclusterTransfersLock.RUnlock()
+	bases := map[string]string{}
+	for _, t := range s.interclusterTransfers {
+		if t.FilesystemId != filesystemId || t.Status != "finished" {
+			continue
+		}
+		i, ok := index[t.TargetCommit]
+		if !ok {
+			continue
+		}
+		remote := fmt.Sprintf("%s/%s", t.RemoteNamespace, t.RemoteName)
+		if t.RemoteBranchName != "" {
+			remote += "@" + t.RemoteBranchName
+		}
+		remote += " on " + t.Peer
+		if base, ok := bases[remote]; !ok || index[base] < i {
+			bases[remote] = t.TargetCommit
+		}
+	}
+	return bases, nil
+}
+
+// deleteCommit deletes a commit on the filesystem's master and then its
+// replicas, once checkCommitDeletable has said it can go.
+func (s *InMemoryState) deleteCommit(filesystemId, snapshotId string) error {
+	responseChan, err := s.globalFsRequest(
+		filesystemId,
+		&types.Event{Name: "delete-commit",
+			Args: &types.EventArgs{"snapshotId": snapshotId}},
+	)
+	if err != nil {
+		return err
+	}
+	e := <-responseChan
+	if e.Name != "commit-deleted" {
+		return maybeError(e, "commit-deleted")
+	}
+
+	// a replica that misses this keeps its copy, which does no harm: the
+	// commit isn't the latest (checkCommitDeletable won't let that go), so
+	// the replica still has the master's latest on top and can carry on
+	// receiving
+	err = s.deleteCommitOnReplicas(filesystemId, snapshotId)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":         err,
+			"filesystem_id": filesystemId,
+			"snapshot_id":   snapshotId,
+		}).Error("[deleteCommit] failed to ask replicas to delete the commit")
+	}
+	return nil
+}
+
+// deleteCommitOnReplicas asks every node to delete its copy of a commit the
+// master has deleted.
+func (s *InMemoryState) deleteCommitOnReplicas(filesystemId, snapshotId string) error {
+	event := types.NewEvent(types.EventNameDeleteCommit)
+	event.ID = uuid.New().String()
+	event.Type = types.EventTypeClusterRequest
+	event.FilesystemID = filesystemId
+	(*event.Args)["snapshotId"] = snapshotId
+	return s.messenger.Publish(event)
+}
+
+// deleteReplicaCommit deletes this node's copy of a commit, if it's a replica
+// which has one.
+func (s *InMemoryState) deleteReplicaCommit(event *types.Event) error {
+	masterNode, ok := s.registry.GetMasterNode(event.FilesystemID)
+	if ok && masterNode == s.NodeID() {
+		return nil
+	}
+	snapshotId := event.Args.GetString("snapshotId")
+	snapshots, err := s.SnapshotsFor(s.NodeID(), event.FilesystemID)
+	if err != nil {
+		// no machine for it, so there's no copy here either
+		return nil
+	}
+	found := false
+	for _, snapshot := range snapshots {
+		if snapshot.Id == snapshotId {
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	responseChan, err := s.dispatchEvent(event.FilesystemID, event, uuid.New().String())
+	if err != nil {
+		return err
+	}
+	go func() {
+		e := <-responseChan
+		if e.Name != "commit-deleted" {
+			log.WithFields(log.Fields{
+				"filesystem_id": event.FilesystemID,
+				"snapshot_id":   snapshotId,
+				"response":      e,
+			}).Error("[deleteReplicaCommit] failed to delete replica's commit")
+		}
+	}()
+	return nil
+}
@@ -23,8 +23,10 @@ import (
 	"github.com/dotmesh-io/dotmesh/pkg/observer"
 	"github.com/dotmesh-io/dotmesh/pkg/registry"
 	"github.com/dotmesh-io/dotmesh/pkg/store"
+	"github.com/dotmesh-io/dotmesh/pkg/transferqueue"
 	"github.com/dotmesh-io/dotmesh/pkg/types"
 	"github.com/dotmesh-io/dotmesh/pkg/user"
+	"github.com/dotmesh-io/dotmesh/pkg/utils"
 	"github.com/dotmesh-io/dotmesh/pkg/zfs"
 
 	log "github.com/sirupsen/logrus"
@@ -69,6 +71,12 @@ type InMemoryState struct {
 	debugPartialFailDelete           bool
 	versionInfo                      *VersionInfo
 	zfs                              zfs.ZFS
+	// caps the combined rate of all replication streams to and from this
+	// node, nil for no limit
+	rateLimiter *utils.RateLimiter
+	// schedules the transfers this node initiates, nil to start them all
+	// straight away
+	transferQueue *transferqueue.Queue
 }
 
 // typically methods on the InMemoryState "god object"
@@ -87,7 +95,12 @@ func NewInMemoryState(config Config) *InMemoryState {
 		os.Exit(1)
 	}
 
-	zfsInterface, err := zfs.NewZFS(config.ZFSExecPath, config.ZPoolPath, POOL, config.PoolName)
+	var zfsInterface zfs.ZFS
+	if config.FilesystemBackend == types.FilesystemBackendDir {
+		zfsInterface, err = zfs.NewDirZFS(config.DirBackendRoot)
+	} else {
+		zfsInterface, err = zfs.NewZFS(config.ZFSExecPath, config.ZPoolPath, config.PoolName, MOUNT_ZFS)
+	}
 	if err != nil {
 		// CG added this one but not a fan of panicing rather than returning
 		panic(err)
@@ -129,8 +142,10 @@ func NewInMemoryState(config Config) *InMemoryState {
 		globalDirtyCache:          make(map[string]dirtyInfo),
 		userManager:               config.UserManager,
 		// publisher:                 ,
-		versionInfo: &VersionInfo{InstalledVersion: serverVersion},
-		zfs:         zfsInterface,
+		versionInfo:   &VersionInfo{InstalledVersion: serverVersion},
+		zfs:           zfsInterface,
+		rateLimiter:   utils.NewRateLimiter(config.TransferRateLimit),
+		transferQueue: transferqueue.New(config.MaxConcurrentTransfers),
 	}
 
 	publisher := notification.New(context.Background())
@@ -191,6 +206,14 @@ func (s *InMemoryState) subscribeToClusterEvents(ctx context.Context) error {
 						"event_id": event.ID,
 					}).Error("[subscribeToClusterEvents] failed to send event response")
 				}
+			case types.EventNameDeleteCommit:
+				err = s.deleteReplicaCommit(event)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"error":         err,
+						"filesystem_id": event.FilesystemID,
+					}).Error("[subscribeToClusterEvents] failed to delete replica's commit")
+				}
 			}
 		}
 	}
@@ -339,6 +362,23 @@ func (s *InMemoryState) processFilesystemEvent(event *types.Event) error {
 		return nil
 	}
 
+	if event.Name == "cancel-transfer" {
+		// a machine doing a transfer doesn't take requests until it's
+		// finished, so stop it directly. The request still goes through the
+		// queue afterwards, to tidy up once the machine has stopped.
+		fs, err := s.InitFilesystemMachine(event.FilesystemID)
+		if err != nil {
+			return err
+		}
+		transferRequestId, _ := (*event.Args)["TransferRequestId"].(string)
+		fs.CancelTransfer(transferRequestId)
+	}
+	if event.Name == "reorder-transfer" {
+		// the transfer is waiting in this node's queue, and its machine
+		// with it, so this can't go through the machine
+		return s.respondToEvent(event.FilesystemID, event.ID, s.reorderTransfer(event))
+	}
+
 	c, err := s.dispatchEvent(event.FilesystemID, event, event.ID)
 	if err != nil {
 		return err
@@ -349,6 +389,25 @@ func (s *InMemoryState) processFilesystemEvent(event *types.Event) error {
 	return s.respondToEvent(event.FilesystemID, event.ID, internalResponse)
 }
 
+// reorderTransfer moves a transfer waiting in this node's queue as a
+// reorder-transfer event asks.
+func (s *InMemoryState) reorderTransfer(event *types.Event) *types.Event {
+	transferRequestId, _ := (*event.Args)["TransferRequestId"].(string)
+	if priority, ok := (*event.Args)["Priority"].(float64); ok {
+		err := s.transferQueue.Reprioritise(transferRequestId, int(priority))
+		if err != nil {
+			return types.NewErrorEvent("cant-reprioritise-transfer", err)
+		}
+	}
+	if position, ok := (*event.Args)["Position"].(float64); ok && position > 0 {
+		err := s.transferQueue.Move(transferRequestId, int(position))
+		if err != nil {
+			return types.NewErrorEvent("cant-move-transfer", err)
+		}
+	}
+	return &types.Event{Name: "transfer-reordered"}
+}
+
 func (s *InMemoryState) notifyPushCompleted(filesystemId string, success bool) {
 
 	f, err := s.GetFilesystemMachine(filesystemId)
@@ -361,6 +420,18 @@ func (s *InMemoryState) notifyPushCompleted(filesystemId string, success bool) {
 	log.Printf("[notifyPushCompleted:%s] done notify chan", filesystemId)
 }
 
+func (s *InMemoryState) notifyResumedPushCompleted(filesystemId, snapshotId string) {
+
+	f, err := s.GetFilesystemMachine(filesystemId)
+	if err != nil {
+		log.Printf("[notifyResumedPushCompleted] No such filesystem id %s", filesystemId)
+		return
+	}
+	log.Printf("[notifyResumedPushCompleted:%s] about to notify chan with snapshot %s", filesystemId, snapshotId)
+	f.ResumedPushCompleted(snapshotId)
+	log.Printf("[notifyResumedPushCompleted:%s] done notify chan", filesystemId)
+}
+
 func (s *InMemoryState) getCurrentState(filesystemId string) (string, error) {
 	// init fsMachine in case it isn't.
 	// XXX this trusts (authenticated) POST data :/
@@ -76,6 +76,9 @@ func (s *InMemoryState) InitFilesystemMachine(filesystemId string) (fsm.FSM, err
 			ZPoolPath:                 ZPOOL,
 			MountZFS:                  MOUNT_ZFS,
 			PoolName:                  POOL,
+			ZFS:                       s.zfs,
+			RateLimiter:               s.rateLimiter,
+			TransferQueue:             s.transferQueue,
 		})
 
 		go s.filesystems[filesystemId].Run() // concurrently run state machine
@@ -218,7 +221,7 @@ func (s *InMemoryState) AlignMountStateWithMasters(filesystemId string) error {
 	}, fmt.Sprintf("aligning mount state of %s with masters", filesystemId))
 }
 
-func (s *InMemoryState) ActivateClone(topLevelFilesystemId, originFilesystemId, originSnapshotId, newCloneFilesystemId, newBranchName string) (string, error) {
+func (s *InMemoryState) ActivateClone(topLevelFilesystemId, originFilesystemId, originSnapshotId, newCloneFilesystemId, newBranchName string, stash *types.StashInfo) (string, error) {
 	// RegisterClone(name string, topLevelFilesystemId string, clone Clone)
 	err := s.registry.RegisterClone(
 		newBranchName, topLevelFilesystemId,
@@ -228,6 +231,7 @@ func (s *InMemoryState) ActivateClone(topLevelFilesystemId, originFilesystemId,
 				FilesystemId: originFilesystemId,
 				SnapshotId:   originSnapshotId,
 			},
+			Stash: stash,
 		},
 	)
 	if err != nil {
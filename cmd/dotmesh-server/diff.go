@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+)
+
+// diffEnd is one side of a diff: a commit, or a filesystem's uncommitted
+// state if SnapshotID is "".
+type diffEnd struct {
+	FilesystemID string
+	SnapshotID   string
+}
+
+// latestCommit returns the latest commit of a filesystem.
+func (s *InMemoryState) latestCommit(filesystemId string) (diffEnd, error) {
+	snapshots, err := s.SnapshotsForCurrentMaster(filesystemId)
+	if err != nil {
+		return diffEnd{}, err
+	}
+	if len(snapshots) == 0 {
+		return diffEnd{}, fmt.Errorf("filesystem %s has no commits", filesystemId)
+	}
+	return diffEnd{FilesystemID: filesystemId, SnapshotID: snapshots[len(snapshots)-1].Id}, nil
+}
+
+// resolveDiffRef finds the commit a ref names, from the point of view of a
+// branch's filesystem. "" is the branch's latest commit, the name of one of
+// the dot's branches is that branch's latest commit, and the name of one of
+// its tags is the tagged commit. Anything else is a commit id, which is
+// looked for on the branch, then on the dot's other branches, then on the
+// dot's fork origins, so that commits which only exist upstream of a fork can
+// be compared too.
+func (s *InMemoryState) resolveDiffRef(filesystemId, ref string) (diffEnd, error) {
+	if ref == "" {
+		return s.latestCommit(filesystemId)
+	}
+	tlf, _, err := s.registry.LookupFilesystemById(filesystemId)
+	if err != nil {
+		return diffEnd{}, err
+	}
+	if ref == DEFAULT_BRANCH {
+		return s.latestCommit(tlf.MasterBranch.Id)
+	}
+	if clone, err := s.registry.LookupClone(tlf.MasterBranch.Id, ref); err == nil {
+		return s.latestCommit(clone.FilesystemId)
+	}
+	if tag, err := s.registryStore.GetTag(tlf.MasterBranch.Id, ref); err == nil {
+		ref = tag.SnapshotId
+	}
+
+	seen := map[string]bool{}
+	candidates := []string{filesystemId}
+	for {
+		for _, id := range s.branchFilesystemIds(tlf) {
+			candidates = append(candidates, id)
+		}
+		for _, id := range candidates {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			snapshots, err := s.SnapshotsForCurrentMaster(id)
+			if err != nil {
+				continue
+			}
+			for _, snapshot := range snapshots {
+				if snapshot.Id == ref {
+					return diffEnd{FilesystemID: id, SnapshotID: ref}, nil
+				}
+			}
+		}
+		// carry on up the chain of forks
+		if tlf.ForkParentId == "" || seen[tlf.ForkParentId] {
+			break
+		}
+		candidates = []string{tlf.ForkParentId}
+		tlf, _, err = s.registry.LookupFilesystemById(tlf.ForkParentId)
+		if err != nil {
+			// the fork origin's dot may be gone, but its filesystem is
+			// still worth a look
+			tlf = types.TopLevelFilesystem{}
+		}
+	}
+	return diffEnd{}, fmt.Errorf("commit %s not found", ref)
+}
+
+// branchFilesystemIds returns the filesystem ids of every branch of a dot,
+// master first.
+func (s *InMemoryState) branchFilesystemIds(tlf types.TopLevelFilesystem) []string {
+	if tlf.MasterBranch.Id == "" {
+		return nil
+	}
+	ids := []string{tlf.MasterBranch.Id}
+	names := []string{}
+	clones := s.registry.ClonesFor(tlf.MasterBranch.Id)
+	for name := range clones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ids = append(ids, clones[name].FilesystemId)
+	}
+	return ids
+}
+
+// diffRefs compares what two refs name (see resolveDiffRef) from the point
+// of view of a branch's filesystem. An empty to is the branch's uncommitted
+// state.
+func (s *InMemoryState) diffRefs(filesystemId, from, to string, opts types.DiffOptions) (*types.RPCDiffResponse, error) {
+	fromEnd, err := s.resolveDiffRef(filesystemId, from)
+	if err != nil {
+		return nil, err
+	}
+	toEnd := diffEnd{FilesystemID: filesystemId}
+	if to != "" {
+		toEnd, err = s.resolveDiffRef(filesystemId, to)
+		if err != nil {
+			return nil, err
+		}
+	}
+	files, total, err := s.diffCommits(fromEnd, toEnd, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &types.RPCDiffResponse{
+		FromCommit: fromEnd.SnapshotID,
+		ToCommit:   toEnd.SnapshotID,
+		Files:      files,
+		Total:      total,
+	}, nil
+}
+
+// diffCommits asks the master of the filesystem on the to side to compare
+// the two ends, both of which it needs to have.
+func (s *InMemoryState) diffCommits(from, to diffEnd, opts types.DiffOptions) ([]types.ZFSFileDiff, int, error) {
+	responseChan, err := s.globalFsRequest(
+		to.FilesystemID,
+		&Event{Name: "diff",
+			Args: &EventArgs{
+				"from_filesystem_id": from.FilesystemID,
+				"from_snapshot_id":   from.SnapshotID,
+				"to_snapshot_id":     to.SnapshotID,
+				"hunks":              opts.Hunks,
+				"offset":             opts.Offset,
+				"limit":              opts.Limit,
+			}},
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	return diffedFiles(<-responseChan)
+}
+
+// diffedFiles decodes the response to a diff event: the files, and how many
+// there are altogether if they're a page of a bigger diff.
+func diffedFiles(e *Event) ([]types.ZFSFileDiff, int, error) {
+	if e.Name != "diffed" {
+		return nil, 0, maybeError(e, "diffed")
+	}
+	f, ok := (*e.Args)["files"]
+	if !ok {
+		return nil, 0, fmt.Errorf("no files returned")
+	}
+	encodedFiles, ok := f.(string)
+	if !ok {
+		return nil, 0, fmt.Errorf("interface conversion failed to files: %v", f)
+	}
+	files, err := types.DecodeZFSFileDiff(encodedFiles)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to decode zfs diff files: %s", err)
+	}
+	total := len(files)
+	switch t := (*e.Args)["total"].(type) {
+	case int:
+		total = t
+	case float64:
+		total = int(t)
+	}
+	return files, total, nil
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"golang.org/x/net/context"
@@ -105,6 +106,25 @@ func (s *DiffHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// comparing commits or branches (/diff/ns:name/<commit> compares a
+	// commit with the uncommitted changes), or asking for hunks or a page of
+	// the diff, goes through the masters of the filesystems involved,
+	// wherever they are
+	query := req.URL.Query()
+	branch, from, to := query.Get("branch"), query.Get("from"), query.Get("to")
+	if snapshotID, ok := vars["snapshotID"]; ok && snapshotID != "" {
+		from = snapshotID
+	}
+	opts, err := diffOptionsFromQuery(query)
+	if err != nil {
+		http.Error(resp, err.Error(), 400)
+		return
+	}
+	if branch != "" || from != "" || to != "" || opts != (types.DiffOptions{}) {
+		s.serveDiffRefs(resp, volName, branch, from, to, opts)
+		return
+	}
+
 	// ensure any of these requests end up on the current master node for
 	// this filesystem
 	master, err := s.state.registry.CurrentMasterNode(filesystemID)
@@ -134,23 +154,16 @@ func (s *DiffHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	snapshotID, ok := vars["snapshotID"]
-	if !ok || snapshotID == "" {
-		snapshots, err := s.state.SnapshotsForCurrentMaster(filesystemID)
-		if err != nil {
-			http.Error(resp, fmt.Sprintf("failed to retrieve snapshots: %s", err), http.StatusInternalServerError)
-			return
-		}
-		if len(snapshots) == 0 {
-			http.Error(resp, "no snapshots found", http.StatusBadRequest)
-			return
-		}
-
-		snapshotID = snapshots[len(snapshots)-1].Id
+	snapshots, err := s.state.SnapshotsForCurrentMaster(filesystemID)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("failed to retrieve snapshots: %s", err), http.StatusInternalServerError)
+		return
 	}
-	if !validator.EnsureValidOrRespond(snapshotID, validator.IsValidSnapshotName, resp) {
+	if len(snapshots) == 0 {
+		http.Error(resp, "no snapshots found", http.StatusBadRequest)
 		return
 	}
+	snapshotID := snapshots[len(snapshots)-1].Id
 
 	// node is local, proceed with zfs diff
 	diff, err := s.getDiff(filesystemID, snapshotID)
@@ -184,25 +197,57 @@ func (s *DiffHandler) getDiff(filesystemID, snapshotID string) ([]types.ZFSFileD
 		return nil, err
 	}
 
-	e := <-responseChan
-	if e.Name == "diffed" {
-		f, ok := (*e.Args)["files"]
-		if !ok {
-			return nil, fmt.Errorf("no files returned")
-		}
-
-		encodedFiles, ok := f.(string)
-		if !ok {
-			return nil, fmt.Errorf("interface conversion failed to files: %v", f)
-		}
+	files, _, err := diffedFiles(<-responseChan)
+	return files, err
+}
 
-		files, err := types.DecodeZFSFileDiff(encodedFiles)
+// diffOptionsFromQuery reads ?hunks=true&offset=<n>&limit=<n>.
+func diffOptionsFromQuery(query url.Values) (types.DiffOptions, error) {
+	opts := types.DiffOptions{}
+	var err error
+	if hunks := query.Get("hunks"); hunks != "" {
+		opts.Hunks, err = strconv.ParseBool(hunks)
 		if err != nil {
-			return nil, fmt.Errorf("failed to decode zfs diff files: %s", err)
+			return opts, fmt.Errorf("bad hunks %q", hunks)
 		}
+	}
+	for name, value := range map[string]*int{"offset": &opts.Offset, "limit": &opts.Limit} {
+		if query.Get(name) == "" {
+			continue
+		}
+		*value, err = strconv.Atoi(query.Get(name))
+		if err != nil || *value < 0 {
+			return opts, fmt.Errorf("bad %s %q", name, query.Get(name))
+		}
+	}
+	return opts, nil
+}
 
-		return files, nil
+func (s *DiffHandler) serveDiffRefs(resp http.ResponseWriter, volName VolumeName, branch, from, to string, opts types.DiffOptions) {
+	if !validator.EnsureValidOrRespond(branch, validator.IsValidBranchName, resp) {
+		return
+	}
+	for _, ref := range []string{from, to} {
+		if ref != "" && !validator.EnsureValidOrRespond(ref, validator.IsValidSnapshotName, resp) {
+			return
+		}
+	}
+	if branch == DEFAULT_BRANCH {
+		branch = ""
+	}
+	filesystemID, err := s.state.registry.MaybeCloneFilesystemId(volName, branch)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+	result, err := s.state.diffRefs(filesystemID, from, to, opts)
+	if err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
 	}
-	return nil, fmt.Errorf("diff failed: %s", err)
 
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("X-Total-Count", strconv.Itoa(result.Total))
+	resp.WriteHeader(200)
+	json.NewEncoder(resp).Encode(&result.Files)
 }
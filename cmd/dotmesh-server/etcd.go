@@ -190,7 +190,7 @@ func (s *InMemoryState) isFilesystemDeletedInEtcd(fsId string) (bool, error) {
 	return true, nil
 }
 
-func (s *InMemoryState) markFilesystemAsDeletedInEtcd(fsId, username string, name VolumeName, tlFsId, branch string) error {
+func (s *InMemoryState) markFilesystemAsDeletedInEtcd(fsId, username string, name VolumeName, tlFsId, branch, promote string) error {
 	at := &types.FilesystemDeletionAudit{
 		FilesystemID:         fsId,
 		Server:               s.NodeID(),
@@ -199,6 +199,7 @@ func (s *InMemoryState) markFilesystemAsDeletedInEtcd(fsId, username string, nam
 		Name:                 name,
 		TopLevelFilesystemId: tlFsId,
 		Clone:                branch,
+		Promote:              promote,
 	}
 
 	err := s.filesystemStore.SetDeleted(at, &store.SetOptions{})
@@ -404,6 +405,9 @@ func (s *InMemoryState) handleFilesystemDeletion(fda *types.FilesystemDeletionAu
 		log.Infof("[handleFilesystemDeletion:%s] after initFs.. no fsMachine, error: %s", fda.FilesystemID, err)
 	} else {
 		log.Infof("[handleFilesystemDeletion:%s] after initFs.. state: %s, status: %s", fda.FilesystemID, f.GetCurrentState(), f.GetStatus())
+		if fda.Promote != "" {
+			s.promoteClone(fda.Promote, fda.FilesystemID)
+		}
 	}
 
 	var responseChan chan *Event
@@ -418,6 +422,53 @@ func (s *InMemoryState) handleFilesystemDeletion(fda *types.FilesystemDeletionAu
 	return nil
 }
 
+// promoteClone promotes this node's copy of a clone of a filesystem which is
+// being deleted, if it has one, waiting for it to finish so that deleting the
+// filesystem doesn't have to destroy the clone too. If it fails, ZFS refuses
+// to delete the filesystem while the clone still depends on it. The master's
+// copy was promoted before the deletion was recorded.
+func (s *InMemoryState) promoteClone(filesystemId, originFilesystemId string) {
+	if master, ok := s.registry.GetMasterNode(filesystemId); ok && master == s.NodeID() {
+		return
+	}
+	_, err := s.GetFilesystemMachine(filesystemId)
+	if err != nil {
+		// no machine for it, so there's no copy here to promote
+		return
+	}
+	responseChan, err := s.dispatchEvent(
+		filesystemId,
+		&types.Event{Name: "promote", Args: &types.EventArgs{"originFilesystemId": originFilesystemId}},
+		uuid.New().String(),
+	)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":         err,
+			"filesystem_id": filesystemId,
+			"origin":        originFilesystemId,
+		}).Error("[promoteClone] failed to ask for the clone to be promoted")
+		return
+	}
+	var e *types.Event
+	select {
+	case <-time.After(promoteTimeout):
+		go func() { <-responseChan }()
+		log.WithFields(log.Fields{
+			"filesystem_id": filesystemId,
+			"origin":        originFilesystemId,
+		}).Error("[promoteClone] timed out promoting clone")
+		return
+	case e = <-responseChan:
+	}
+	if e.Name != "promoted" {
+		log.WithFields(log.Fields{
+			"filesystem_id": filesystemId,
+			"origin":        originFilesystemId,
+			"response":      e,
+		}).Error("[promoteClone] failed to promote clone")
+	}
+}
+
 // make a global request, returning its id
 func (s *InMemoryState) globalFsRequestId(fs string, event *types.Event) (chan *types.Event, string, error) {
 
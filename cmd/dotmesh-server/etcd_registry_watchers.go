@@ -73,9 +73,10 @@ func (s *InMemoryState) watchRegistryClones() error {
 func (s *InMemoryState) processRegistryClone(c *types.Clone) error {
 	switch c.Meta.Action {
 	case types.KVDelete:
+		// only the key is left, which names the top level filesystem
 		s.registry.DeleteCloneFromEtcd(c.Name, c.FilesystemId)
 	case types.KVGet, types.KVCreate, types.KVSet:
-		s.registry.UpdateCloneFromEtcd(c.Name, c.FilesystemId, *c)
+		s.registry.UpdateCloneFromEtcd(c.Name, c.TopLevelFilesystemId, *c)
 	}
 	return nil
 }
@@ -38,6 +38,10 @@ const ROOT_FS = types.RootFS
 const META_KEY_PREFIX = types.MetaKeyPrefix
 const ETCD_PREFIX = types.EtcdPrefix
 
+// how many transfers a node runs at once, unless MAX_CONCURRENT_TRANSFERS
+// says otherwise
+const defaultMaxConcurrentTransfers = 4
+
 var ZFS string
 var MOUNT_ZFS string
 var ZPOOL string
@@ -91,9 +95,41 @@ func main() {
 		NatsConfig:                nats.DefaultConfig(),
 	}
 
-	POOL = os.Getenv("POOL")
-	if POOL == "" {
-		fmt.Printf("Environment variable POOL must be set\n")
+	// eg "10M" for 10 MiB/s
+	config.TransferRateLimit, err = client.ParseRate(os.Getenv("TRANSFER_RATE_LIMIT"))
+	if err != nil {
+		fmt.Printf("Environment variable TRANSFER_RATE_LIMIT is invalid: %s\n", err)
+		os.Exit(1)
+	}
+
+	config.MaxConcurrentTransfers = defaultMaxConcurrentTransfers
+	if max := os.Getenv("MAX_CONCURRENT_TRANSFERS"); max != "" {
+		config.MaxConcurrentTransfers, err = strconv.Atoi(max)
+		if err != nil {
+			fmt.Printf("Environment variable MAX_CONCURRENT_TRANSFERS is invalid: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	config.FilesystemBackend = os.Getenv(types.EnvFilesystemBackend)
+	if config.FilesystemBackend == "" {
+		config.FilesystemBackend = types.FilesystemBackendZFS
+	}
+	switch config.FilesystemBackend {
+	case types.FilesystemBackendZFS:
+		POOL = os.Getenv("POOL")
+		if POOL == "" {
+			fmt.Printf("Environment variable POOL must be set\n")
+			os.Exit(1)
+		}
+	case types.FilesystemBackendDir:
+		config.DirBackendRoot = os.Getenv(types.EnvDirBackendRoot)
+		if config.DirBackendRoot == "" {
+			config.DirBackendRoot = types.DefaultDirBackendRoot
+		}
+	default:
+		fmt.Printf("Environment variable %s must be one of %s, %s\n",
+			types.EnvFilesystemBackend, types.FilesystemBackendZFS, types.FilesystemBackendDir)
 		os.Exit(1)
 	}
 	CONTAINER_MOUNT_PREFIX = os.Getenv("CONTAINER_MOUNT_PREFIX")
@@ -140,14 +176,16 @@ func main() {
 		os.Exit(1)
 	}
 
-	zRoot := os.Getenv("ZFS_USERLAND_ROOT")
-	if zRoot == "" {
-		fmt.Println("Must specify ZFS_USERLAND_ROOT, e.g. /opt/zfs-0.7")
-		os.Exit(1)
+	if config.FilesystemBackend == types.FilesystemBackendZFS {
+		zRoot := os.Getenv("ZFS_USERLAND_ROOT")
+		if zRoot == "" {
+			fmt.Println("Must specify ZFS_USERLAND_ROOT, e.g. /opt/zfs-0.7")
+			os.Exit(1)
+		}
+		ZFS = zRoot + "/sbin/zfs"
+		MOUNT_ZFS = zRoot + "/sbin/mount.zfs"
+		ZPOOL = zRoot + "/sbin/zpool"
 	}
-	ZFS = zRoot + "/sbin/zfs"
-	MOUNT_ZFS = zRoot + "/sbin/mount.zfs"
-	ZPOOL = zRoot + "/sbin/zpool"
 	ips, _ := guessIPv4Addresses()
 	log.Printf("Detected my node IPs as %s", ips)
 
@@ -217,6 +255,14 @@ func main() {
 	go runForever(s.zfs.ReportZpoolCapacity, "reportZPoolUsageReporter",
 		10*time.Minute, 10*time.Minute,
 	)
+	// prune commits by the retention policies
+	go runForever(s.pruneCommits, "pruneCommits",
+		retentionInterval, retentionInterval,
+	)
+	// make scheduled commits
+	go runForever(newCommitScheduler(s).run, "commitScheduler",
+		scheduleInterval, scheduleInterval,
+	)
 	// kick off watching etcd
 	go runForever(s.fetchAndWatchEtcd, "fetchAndWatchEtcd",
 		1*time.Second, 1*time.Second,
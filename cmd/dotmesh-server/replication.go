@@ -7,16 +7,14 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os/exec"
-	"strings"
 
 	dmclient "github.com/dotmesh-io/dotmesh/pkg/client"
 	"github.com/dotmesh-io/dotmesh/pkg/user"
-	"github.com/dotmesh-io/dotmesh/pkg/zfs"
 	"github.com/gorilla/mux"
 
 	"github.com/dotmesh-io/dotmesh/pkg/fsm"
 	"github.com/dotmesh-io/dotmesh/pkg/utils"
+	"github.com/dotmesh-io/dotmesh/pkg/zfs"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -28,6 +26,9 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	z.fromSnap = vars["fromSnap"]
 	z.toSnap = vars["toSnap"]
 	z.filesystem = vars["filesystem"]
+	// set when the puller is carrying on from an interrupted receive, in
+	// which case z.toSnap is the snapshot that was interrupted
+	resumeToken := r.URL.Query().Get("resumeToken")
 
 	// TODO: add a coarse grained lock to start with: stop other readers from
 	// this filesystem, and also stop us moving this filesystem to another node
@@ -73,6 +74,9 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			z.fromSnap,
 			z.toSnap,
 		)
+		if r.URL.RawQuery != "" {
+			url += "?" + r.URL.RawQuery
+		}
 
 		// Proxy request to the master
 		req, err := http.NewRequest(
@@ -83,6 +87,7 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		utils.CopyStreamHeaders(req.Header, r.Header)
 
 		req.SetBasicAuth(
 			"admin",
@@ -100,6 +105,7 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		finished := make(chan bool)
 		log.Printf("[ZFSSender:ServeHTTP] Got HTTP response %+v", resp.StatusCode)
+		utils.CopyStreamHeaders(w.Header(), resp.Header)
 		w.WriteHeader(resp.StatusCode)
 		go utils.Pipe(resp.Body, url,
 			w, "proxied pull recipient",
@@ -120,9 +126,6 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		z.filesystem, z.fromSnap, z.toSnap,
 	)
 
-	// command writes into pipe
-	var cmd *exec.Cmd
-
 	snaps, err := z.state.SnapshotsFor(masterNodeID, z.filesystem)
 	if err != nil {
 		log.Printf(
@@ -145,36 +148,6 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if z.fromSnap == "START" {
-		zfs.LogZFSCommand(z.filesystem, fmt.Sprintf("%s send -p -R %s@%s", z.state.config.ZFSExecPath, zfs.FQ(z.state.config.PoolName, z.filesystem), z.toSnap))
-		cmd = exec.Command(
-			// -R sends interim snapshots as well
-			ZFS, "send", "-p", "-R", zfs.FQ(z.state.config.PoolName, z.filesystem)+"@"+z.toSnap,
-		)
-	} else {
-		var fromSnap string
-		// in clone case, z.fromSnap must be fully qualified
-		if strings.Contains(z.fromSnap, "@") {
-			// send a clone, so make it fully qualified
-			fromSnap = zfs.FQ(z.state.config.PoolName, z.fromSnap)
-		} else {
-			// presume it refers to a snapshot
-			fromSnap = z.fromSnap
-		}
-		zfs.LogZFSCommand(z.filesystem, fmt.Sprintf("%s send -p -I %s %s@%s", z.state.config.ZFSExecPath, fromSnap, zfs.FQ(z.state.config.PoolName, z.filesystem), z.toSnap))
-		cmd = exec.Command(
-			z.state.config.ZFSExecPath, "send", "-p",
-			"-I", fromSnap, zfs.FQ(z.state.config.PoolName, z.filesystem)+"@"+z.toSnap,
-		)
-	}
-
-	// How to set HTTP response code based on return code of process?
-	// (we can't - it's too late by the time we know the return code)
-	pipeReader, pipeWriter := io.Pipe()
-
-	defer pipeWriter.Close()
-	defer pipeReader.Close()
-
 	preludeEncoded, err := fsm.EncodePrelude(prelude)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -183,33 +156,49 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cmd.Stdout = pipeWriter
-	cmd.Stderr = getLogfile("zfs-send-errors")
+	// Send the stream in the best format the puller can receive, and tell it
+	// which, before anything is written. Pullers which don't say what they
+	// can receive get the original uncompressed framing.
+	encoding := utils.NegotiateStreamEncoding(r.Header.Get(utils.StreamAcceptEncodingHeader))
+	compressed := r.Header.Get(utils.AcceptCompressedStreamHeader) == "true" && z.state.zfs.CompressedStreams()
+	if encoding != "" {
+		w.Header().Set(utils.StreamEncodingHeader, encoding)
+	}
+	if compressed {
+		w.Header().Set(utils.CompressedStreamHeader, "true")
+	}
+
+	// How to set HTTP response code based on return code of process?
+	// (we can't - it's too late by the time we know the return code)
+	//
+	// z.fromSnap is "START", a snapshot id, or a fully qualified clone
+	// origin, which is what Send expects as its from snapshot.
+	pipeReader, errch := z.state.zfs.Send(
+		"", z.fromSnap, z.filesystem, z.toSnap,
+		zfs.SendOptions{ResumeToken: resumeToken, Compressed: compressed},
+		preludeEncoded,
+	)
+	defer pipeReader.Close()
 
 	finished := make(chan bool)
 	go utils.Pipe(
-		pipeReader, fmt.Sprintf("stdout of zfs send for %s", z.filesystem),
+		utils.Throttle{z.state.rateLimiter}.Reader(pipeReader),
+		fmt.Sprintf("stdout of zfs send for %s", z.filesystem),
 		w, "http response body",
 		finished,
 		make(chan *Event),
 		func(e *Event, c chan *Event) {},
 		func(bytes int64, t int64) {},
-		"compress",
+		utils.CompressMode(encoding),
 	)
 
-	// log.Printf(
-	// 	"[ZFSSender:%s] Writing prelude of %d bytes (encoded): %s",
-	// 	z.filesystem, len(preludeEncoded), preludeEncoded,
-	// )
-	pipeWriter.Write(preludeEncoded)
-
 	log.Printf(
-		"[ZFSSender:%s] About to Run() for %s => %s",
+		"[ZFSSender:%s] Waiting for send of %s => %s",
 		z.filesystem, z.fromSnap, z.toSnap,
 	)
-	err = cmd.Run()
+	err = <-errch
 	log.Printf(
-		"[ZFSSender:%s] Finished Run() for %s => %s: %s",
+		"[ZFSSender:%s] Finished send of %s => %s: %s",
 		z.filesystem, z.fromSnap, z.toSnap, err,
 	)
 	if err != nil {
@@ -218,11 +207,6 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			z.filesystem, z.fromSnap, z.toSnap, err,
 		)
 	}
-	// XXX Adding the log messages below seemed to stop a deadlock, not sure
-	// why. For now, let's just leave them in...
-	log.Printf("[ZFSSender:%s] Closing pipes...", z.filesystem)
-	pipeWriter.Close()
-	pipeReader.Close()
 
 	log.Printf("[ZFSSender:%s] Waiting for finish signal...", z.filesystem)
 	_ = <-finished
@@ -236,6 +220,9 @@ func (z *ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	z.fromSnap = vars["fromSnap"]
 	z.toSnap = vars["toSnap"]
 	z.filesystem = vars["filesystem"]
+	// set when the initiator is carrying on from an interrupted receive, in
+	// which case z.toSnap is the snapshot that was interrupted
+	resumeToken := r.URL.Query().Get("resumeToken")
 
 	// TODO: add a coarse grained lock to start with: stop other writers from
 	// writing to this filesystem (unlike readers, this is strictly
@@ -298,12 +285,16 @@ func (z *ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			z.fromSnap,
 			z.toSnap,
 		)
+		if r.URL.RawQuery != "" {
+			url += "?" + r.URL.RawQuery
+		}
 
 		// Proxy request to the master
 		req, err := http.NewRequest(
 			"POST", url,
 			r.Body,
 		)
+		utils.CopyStreamHeaders(req.Header, r.Header)
 
 		req.SetBasicAuth(
 			"admin",
@@ -340,22 +331,32 @@ func (z *ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// and is therefore blocking on us to tell it we've finished, one way or another, via
 	// z.state.notifyPushCompleted(z.filesystem, true/false) so we'd better do that in every path.
 
-	zfs.LogZFSCommand(z.filesystem, fmt.Sprintf("%s recv %s", ZFS, zfs.FQ(z.state.config.PoolName, z.filesystem)))
+	if resumeToken == "" {
+		// A fresh stream can't be received on top of what's left of an
+		// interrupted one, which the initiator has chosen not to carry on
+		// from.
+		err = z.state.zfs.AbortReceive(z.filesystem)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("Unable to abort partial receive into %s: %s\n", z.filesystem, err)))
+			log.Errorf("[ZFSReceiver:%s] Unable to abort partial receive: %s", z.filesystem, err)
+
+			go z.state.notifyPushCompleted(z.filesystem, false)
+			return
+		}
+	}
 
-	cmd := exec.Command(ZFS, "recv", zfs.FQ(z.state.config.PoolName, z.filesystem))
 	pipeReader, pipeWriter := io.Pipe()
 	defer pipeReader.Close()
 	defer pipeWriter.Close()
-	cmd.Stdin = pipeReader
-	cmd.Stdout = w
 
 	errBuffer := bytes.Buffer{}
 
-	cmd.Stderr = &errBuffer
 	finished := make(chan bool)
 
 	go utils.Pipe(
-		r.Body, fmt.Sprintf("http request body for %s", z.filesystem),
+		utils.Throttle{z.state.rateLimiter}.Reader(r.Body),
+		fmt.Sprintf("http request body for %s", z.filesystem),
 		pipeWriter, "zfs recv stdin", finished,
 		make(chan *Event),
 		func(e *Event, c chan *Event) {},
@@ -372,7 +373,8 @@ func (z *ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}
 			}()
 		},
-		"decompress",
+		// the initiator says how it compressed the stream, if at all
+		utils.DecompressMode(r.Header.Get(utils.StreamEncodingHeader)),
 	)
 
 	log.Printf("[ZFSReceiver:%s] about to start consuming prelude on %v", z.filesystem, pipeReader)
@@ -388,7 +390,7 @@ func (z *ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("[ZFSReceiver:%s] Got prelude %v", z.filesystem, prelude)
 
-	err = cmd.Run()
+	err = z.state.zfs.Recv(pipeReader, z.filesystem, &errBuffer)
 	if err != nil {
 		log.Printf(
 			"[ZFSReceiver:%s] Got error %s when running zfs recv, check the logs for output that looks like it's from zfs",
@@ -428,7 +430,7 @@ func (z *ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	pipeWriter.Close()
 	_ = <-finished
 
-	err = applyPrelude(prelude, zfs.FQ(z.state.config.PoolName, z.filesystem))
+	err = z.state.zfs.ApplyPrelude(prelude, z.filesystem)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(fmt.Sprintf("Unable to apply prelude for %s: %s\n", z.filesystem, err)))
@@ -443,6 +445,10 @@ func (z *ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("[ZFSReceiver:%s] Notifying fsmachine of success", z.filesystem)
 
+	if resumeToken != "" {
+		go z.state.notifyResumedPushCompleted(z.filesystem, z.toSnap)
+		return
+	}
 	go z.state.notifyPushCompleted(z.filesystem, true)
 }
 
@@ -47,7 +47,7 @@ POOL=${USE_POOL_NAME:-pool}
 POOL=$(echo $POOL |sed s/\#HOSTNAME\#/$HOSTNAME/)
 DOTMESH_INNER_SERVER_NAME=${DOTMESH_INNER_SERVER_NAME:-dotmesh-server-inner}
 FLEXVOLUME_DRIVER_DIR=${FLEXVOLUME_DRIVER_DIR:-/usr/libexec/kubernetes/kubelet-plugins/volume/exec}
-INHERIT_ENVIRONMENT_NAMES=( "DOTMESH_SERVER_PORT" "FILESYSTEM_METADATA_TIMEOUT" "DOTMESH_UPGRADES_URL" "DOTMESH_UPGRADES_INTERVAL_SECONDS" "NATS_URL" "NATS_USERNAME" "NATS_PASSWORD" "NATS_SUBJECT_PREFIX" "DOTMESH_STORAGE" "DOTMESH_BOLTDB_PATH")
+INHERIT_ENVIRONMENT_NAMES=( "DOTMESH_SERVER_PORT" "FILESYSTEM_METADATA_TIMEOUT" "DOTMESH_UPGRADES_URL" "DOTMESH_UPGRADES_INTERVAL_SECONDS" "NATS_URL" "NATS_USERNAME" "NATS_PASSWORD" "NATS_SUBJECT_PREFIX" "DOTMESH_STORAGE" "DOTMESH_BOLTDB_PATH" "TRANSFER_RATE_LIMIT" "MAX_CONCURRENT_TRANSFERS" "DOTMESH_FILESYSTEM_BACKEND" "DOTMESH_DIR_BACKEND_ROOT")
 
 if [ $POOL_SIZE = AUTO ]
 then
@@ -148,12 +148,40 @@ if [ ! -d $DIR ]; then
     mkdir -p $DIR
 fi
 
+# The dir backend keeps dots as plain directories, so it needs neither the ZFS
+# kernel module nor a pool. Its root has to be on the host and shared, like
+# the zfs mountpoint, for the mounts it makes to reach containers, so it
+# defaults to somewhere under $OUTER_DIR; a root elsewhere gets its own rshared
+# volume.
+if [ "$DOTMESH_FILESYSTEM_BACKEND" == "dir" ]; then
+    export DOTMESH_DIR_BACKEND_ROOT=${DOTMESH_DIR_BACKEND_ROOT:-$OUTER_DIR/dirs}
+    case "$DOTMESH_DIR_BACKEND_ROOT" in
+        "$OUTER_DIR"/*)
+            nsenter -t 1 -m -u -n -i /bin/sh -c "mkdir -p $DOTMESH_DIR_BACKEND_ROOT"
+            ;;
+        *)
+            # the same bind mount trick as for $OUTER_DIR above
+            nsenter -t 1 -m -u -n -i /bin/sh -c \
+                "set -xe
+                if [ \$(mount |grep $DOTMESH_DIR_BACKEND_ROOT |wc -l) -eq 0 ]; then
+                    mkdir -p $DOTMESH_DIR_BACKEND_ROOT && \
+                    mount --bind $DOTMESH_DIR_BACKEND_ROOT $DOTMESH_DIR_BACKEND_ROOT && \
+                    mount --make-rshared $DOTMESH_DIR_BACKEND_ROOT;
+                fi"
+            EXTRA_VOLUMES="$EXTRA_VOLUMES -v $DOTMESH_DIR_BACKEND_ROOT:$DOTMESH_DIR_BACKEND_ROOT:rshared"
+            ;;
+    esac
+    echo "Using the dir filesystem backend in $DOTMESH_DIR_BACKEND_ROOT, skipping ZFS setup."
+fi
+
 # KERNEL_ZFS_VERSION may already be set from outside, by
 # configuration; if so, we can skip all the attempts to load modules
 # and find the version, as the user is asserting they've handled all
 # of that.
 
-if [ -z "$KERNEL_ZFS_VERSION" ]; then
+if [ "$DOTMESH_FILESYSTEM_BACKEND" == "dir" ]; then
+    :
+elif [ -z "$KERNEL_ZFS_VERSION" ]; then
     if [ -n "`lsmod|grep zfs`" ]; then
         echo "ZFS already loaded :)"
     else
@@ -176,7 +204,9 @@ if [ -z "$KERNEL_ZFS_VERSION" ]; then
     fi
 fi
 
-if [[ "$KERNEL_ZFS_VERSION" == "0.6"* ]]; then
+if [ "$DOTMESH_FILESYSTEM_BACKEND" == "dir" ]; then
+    :
+elif [[ "$KERNEL_ZFS_VERSION" == "0.6"* ]]; then
     echo "Detected ZFS 0.6 kernel modules ($KERNEL_ZFS_VERSION), using matching userland"
     export ZFS_USERLAND_ROOT=/opt/zfs-0.6
 elif [[ "$KERNEL_ZFS_VERSION" == "0.7"* ]]; then
@@ -209,13 +239,15 @@ run_in_zfs_container() {
 
 set -ex
 
-if [ ! -e /dev/zfs ]; then
+if [ "$DOTMESH_FILESYSTEM_BACKEND" != "dir" ] && [ ! -e /dev/zfs ]; then
     mknod -m 660 /dev/zfs c $(cat /sys/class/misc/zfs/dev |sed 's/:/ /g')
 fi
 
 echo "`date`: On host '$HOSTNAME', working directory = '$OUTER_DIR', device = '$BLOCK_DEVICE', zfs mountpoint = '$MOUNTPOINT', pool = '$POOL', Dotmesh image = '$DOTMESH_DOCKER_IMAGE'"
 
-if ! run_in_zfs_container zpool-status zpool status $POOL; then
+if [ "$DOTMESH_FILESYSTEM_BACKEND" == "dir" ]; then
+    echo "`date`: No pool needed by the dir backend" >> $POOL_LOGFILE
+elif ! run_in_zfs_container zpool-status zpool status $POOL; then
 
     # TODO: make case where truncate previously succeeded but zpool create
     # failed or never run recoverable.
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/pkg/retention"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often each node prunes the commits of the filesystems it's the master
+// of
+const retentionInterval = 10 * time.Minute
+
+// retentionPolicies returns the stored policies, keyed by filesystem id then
+// branch ("" for the whole dot).
+func (s *InMemoryState) retentionPolicies() (map[string]map[string]types.RetentionPolicy, error) {
+	policies, err := s.registryStore.ListRetentionPolicies()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]map[string]types.RetentionPolicy{}
+	for _, p := range policies {
+		if _, ok := result[p.FilesystemId]; !ok {
+			result[p.FilesystemId] = map[string]types.RetentionPolicy{}
+		}
+		result[p.FilesystemId][p.Branch] = *p
+	}
+	return result, nil
+}
+
+// retentionPolicyFor returns the policy which applies to a filesystem: its
+// branch's own, or otherwise its dot's. ok is false if there's neither.
+func (s *InMemoryState) retentionPolicyFor(
+	policies map[string]map[string]types.RetentionPolicy, filesystemId string,
+) (policy types.RetentionPolicy, ok bool) {
+	tlf, cloneName, err := s.registry.LookupFilesystemById(filesystemId)
+	if err != nil {
+		return types.RetentionPolicy{}, false
+	}
+	branch := cloneName
+	if branch == "" {
+		branch = DEFAULT_BRANCH
+	}
+	dotPolicies := policies[tlf.MasterBranch.Id]
+	if policy, ok = dotPolicies[branch]; ok {
+		return policy, true
+	}
+	policy, ok = dotPolicies[""]
+	return policy, ok
+}
+
+// expiredCommits returns the commits of a filesystem which the policy doesn't
+// keep, marking the ones which something else still needs.
+func (s *InMemoryState) expiredCommits(filesystemId string, policy types.RetentionPolicy) ([]types.PrunedCommit, error) {
+	snapshots, err := s.SnapshotsForCurrentMaster(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+	result := []types.PrunedCommit{}
+	for _, snapshot := range retention.Expired(policy, snapshots, time.Now()) {
+		pruned := types.PrunedCommit{Snapshot: snapshot}
+		err := s.checkCommitDeletable(filesystemId, snapshot.Id)
+		if err != nil {
+			pruned.Protected = err.Error()
+		}
+		result = append(result, pruned)
+	}
+	return result, nil
+}
+
+// pruneCommits applies the retention policies to the filesystems this node
+// is the master of.
+func (s *InMemoryState) pruneCommits() error {
+	policies, err := s.retentionPolicies()
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	for _, filesystemId := range s.registry.FilesystemIdsIncludingClones() {
+		master, ok := s.registry.GetMasterNode(filesystemId)
+		if !ok || master != s.NodeID() {
+			continue
+		}
+		policy, ok := s.retentionPolicyFor(policies, filesystemId)
+		if !ok {
+			continue
+		}
+		err := s.pruneFilesystem(filesystemId, policy)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":         err,
+				"filesystem_id": filesystemId,
+			}).Error("[pruneCommits] failed to prune commits")
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryState) pruneFilesystem(filesystemId string, policy types.RetentionPolicy) error {
+	expired, err := s.expiredCommits(filesystemId, policy)
+	if err != nil {
+		return err
+	}
+	for _, pruned := range expired {
+		if pruned.Protected != "" {
+			log.WithFields(log.Fields{
+				"filesystem_id": filesystemId,
+				"snapshot_id":   pruned.Snapshot.Id,
+				"reason":        pruned.Protected,
+			}).Debug("[pruneFilesystem] keeping expired commit")
+			continue
+		}
+		err := s.deleteCommit(filesystemId, pruned.Snapshot.Id)
+		if err != nil {
+			return fmt.Errorf("failed to delete commit %s: %s", pruned.Snapshot.Id, err)
+		}
+		log.WithFields(log.Fields{
+			"filesystem_id": filesystemId,
+			"snapshot_id":   pruned.Snapshot.Id,
+			"message":       pruned.Snapshot.Metadata["message"],
+			"timestamp":     pruned.Snapshot.Metadata["timestamp"],
+		}).Info("[pruneFilesystem] pruned commit by retention policy")
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/dotmesh-io/dotmesh/pkg/container"
+	"github.com/dotmesh-io/dotmesh/pkg/fsm"
 	"github.com/dotmesh-io/dotmesh/pkg/registry"
 	"github.com/dotmesh-io/dotmesh/pkg/store"
 	"github.com/dotmesh-io/dotmesh/pkg/validator"
@@ -20,12 +21,14 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	uuid "github.com/nu7hatch/gouuid"
+	"github.com/portworx/kvdb"
 	"golang.org/x/net/context"
 
 	"github.com/dotmesh-io/dotmesh/pkg/auth"
 	dmclient "github.com/dotmesh-io/dotmesh/pkg/client"
 	"github.com/dotmesh-io/dotmesh/pkg/types"
 	"github.com/dotmesh-io/dotmesh/pkg/user"
+	"github.com/dotmesh-io/dotmesh/pkg/utils"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -87,6 +90,22 @@ func ensureAdminUser(r *http.Request) error {
 	return nil
 }
 
+// validateMetadata checks the names of user submitted metadata fields, which
+// must start with a lowercase character, because zfs user properties are
+// lowercase.
+func validateMetadata(meta map[string]string) error {
+	for name := range meta {
+		if name == "" {
+			return fmt.Errorf("Metadata field names can't be empty")
+		}
+		firstCharacter := string(name[0])
+		if firstCharacter == strings.ToUpper(firstCharacter) {
+			return fmt.Errorf("Metadata field names must start with lowercase characters: %s", name)
+		}
+	}
+	return nil
+}
+
 func (d *DotmeshRPC) Procure(
 	r *http.Request, args *types.ProcureArgs, result *string) error {
 	err := ensureAdminUser(r)
@@ -787,7 +806,7 @@ func (d *DotmeshRPC) StashAfter(
 	responseChan, err := d.state.globalFsRequest(
 		args.FilesystemId,
 		&Event{Name: "stash",
-			Args: &EventArgs{"snapshotId": args.SnapshotId}},
+			Args: &EventArgs{"snapshotId": args.SnapshotId, "transferRequestId": args.TransferRequestId}},
 	)
 	if err != nil {
 		// meh, maybe REST *would* be nicer
@@ -806,6 +825,128 @@ func (d *DotmeshRPC) StashAfter(
 	return nil
 }
 
+// Stashes lists the stash branches of a dot, newest first: branches dotmesh
+// made to keep the commits only one side had when a branch diverged.
+func (d *DotmeshRPC) Stashes(
+	r *http.Request,
+	args *VolumeName,
+	result *[]types.Stash,
+) error {
+	err := validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	tlf, err := d.state.registry.LookupFilesystem(*args)
+	if err != nil {
+		return err
+	}
+	*result = []types.Stash{}
+	for name, clone := range d.state.registry.ClonesFor(tlf.MasterBranch.Id) {
+		if clone.Stash == nil {
+			continue
+		}
+		commits, err := d.state.SnapshotsForCurrentMaster(clone.FilesystemId)
+		if err != nil {
+			return err
+		}
+		*result = append(*result, types.Stash{
+			Name:         name,
+			FilesystemId: clone.FilesystemId,
+			StashInfo:    *clone.Stash,
+			BaseCommit:   clone.Origin.SnapshotId,
+			Commits:      commits,
+		})
+	}
+	sort.Slice(*result, func(i, j int) bool {
+		return (*result)[i].Created.After((*result)[j].Created)
+	})
+	return nil
+}
+
+// ApplyStash makes a new commit on the branch a stash came from, whose
+// contents are those of the stash's latest commit, so the work that was
+// stashed carries on from there. The stash itself is left alone. It returns
+// the new commit's id.
+func (d *DotmeshRPC) ApplyStash(
+	r *http.Request,
+	args *types.ApplyStashRequest,
+	result *string,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	volumeName := VolumeName{Namespace: args.Namespace, Name: args.Name}
+	tlf, err := d.state.registry.LookupFilesystem(volumeName)
+	if err != nil {
+		return err
+	}
+	stash, err := d.state.registry.LookupClone(tlf.MasterBranch.Id, args.Stash)
+	if err != nil {
+		return err
+	}
+	if stash.Stash == nil {
+		return fmt.Errorf("%s isn't a stash.", args.Stash)
+	}
+	commits, err := d.state.SnapshotsForCurrentMaster(stash.FilesystemId)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return fmt.Errorf("The stash %s has no commits to apply.", args.Stash)
+	}
+	stashCommit := commits[len(commits)-1].Id
+
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(volumeName, stash.Stash.Branch)
+	if err != nil {
+		return fmt.Errorf("Can't find the branch %s was stashed from: %s", args.Stash, err)
+	}
+	dirtyBytes, _, err := d.dirtyDataAndRunningContainers(r.Context(), filesystemId)
+	if err != nil {
+		return err
+	}
+	if dirtyBytes > 0 {
+		return fmt.Errorf("The branch has uncommitted changes, please commit them before applying a stash.")
+	}
+
+	user, _, _ := r.BasicAuth()
+	meta := map[string]string{"message": args.Message, "author": user, "applied-stash": args.Stash}
+	if meta["message"] == "" {
+		meta["message"] = fmt.Sprintf("Apply stash %s", args.Stash)
+	}
+
+	responseChan, err := d.state.globalFsRequest(
+		filesystemId,
+		&Event{Name: "apply-stash",
+			Args: &EventArgs{
+				"sourceFilesystemId": stash.FilesystemId,
+				"snapshotId":         stashCommit,
+				"metadata":           meta,
+			}},
+	)
+	if err != nil {
+		return err
+	}
+
+	e := <-responseChan
+	if e.Name != "stash-applied" {
+		return maybeError(e, "stash-applied")
+	}
+	*result = (*e.Args)["SnapshotId"].(string)
+	log.Printf(
+		"Applied stash %s of %s/%s to %q as %s",
+		args.Stash, args.Namespace, args.Name, stash.Stash.Branch, *result,
+	)
+	return nil
+}
+
 // Acknowledge that an authenticated connection had been successfully established.
 func (d *DotmeshRPC) Ping(r *http.Request, args *struct{}, result *bool) error {
 	*result = true
@@ -866,16 +1007,13 @@ func (d *DotmeshRPC) Commit(
 		eventArgs["snapshotId"] = sid
 	}
 
-	// NB: metadata keys must always start lowercase, because zfs
+	err = validateMetadata(args.Metadata)
+	if err != nil {
+		return err
+	}
 	user, _, _ := r.BasicAuth()
 	meta := map[string]string{"message": args.Message, "author": user}
-
-	// check that user submitted metadata field names all start with lowercase
 	for name, value := range args.Metadata {
-		firstCharacter := string(name[0])
-		if firstCharacter == strings.ToUpper(firstCharacter) {
-			return fmt.Errorf("Metadata field names must start with lowercase characters: %s", name)
-		}
 		meta[name] = value
 	}
 	eventArgs["metadata"] = meta
@@ -915,6 +1053,7 @@ func (d *DotmeshRPC) MountCommit(
 		return err
 	}
 
+	args.CommitId = d.state.resolveCommitRef(args.FilesystemId, args.CommitId)
 	snapshots, err := d.state.SnapshotsForCurrentMaster(args.FilesystemId)
 	if err != nil {
 		return err
@@ -987,6 +1126,7 @@ func (d *DotmeshRPC) Rollback(
 	if err != nil {
 		return err
 	}
+	args.SnapshotId = d.state.resolveCommitRef(filesystemId, args.SnapshotId)
 	responseChan, err := d.state.globalFsRequest(
 		filesystemId,
 		&Event{Name: "rollback",
@@ -1014,169 +1154,1054 @@ func (d *DotmeshRPC) Rollback(
 	return nil
 }
 
-func maybeError(e *Event, expected string) error {
-	if e.Error() != nil {
-		log.Errorf("unexpected response '%s' (expected: '%s') - %#v", e.Name, expected, e.Args)
-		return e.Error()
+// Revert makes a new commit on a branch whose contents are those of an
+// earlier commit, without throwing away the commits in between as Rollback
+// does. It returns the new commit's id.
+func (d *DotmeshRPC) Revert(
+	r *http.Request,
+	args *types.RevertRequest,
+	result *string,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("Unexpected response %s - %#v", e.Name, e.Args)
-}
 
-// Return a list of clone names attributed to a given top-level filesystem name
-func (d *DotmeshRPC) Branches(r *http.Request, filesystemName *VolumeName, result *[]string) error {
-	err := validator.IsValidVolume(filesystemName.Namespace, filesystemName.Name)
+	err = validator.IsValidVolume(args.Namespace, args.Name)
 	if err != nil {
 		return err
 	}
 
-	filesystemId, err := d.state.registry.IdFromName(*filesystemName)
+	err = validator.IsValidBranchName(args.Branch)
 	if err != nil {
 		return err
 	}
-	filesystems := d.state.registry.ClonesFor(filesystemId)
-	names := []string{}
-	for name, _ := range filesystems {
-		names = append(names, name)
+
+	err = validator.IsValidSnapshotName(args.SnapshotId)
+	if err != nil {
+		return err
 	}
-	sort.Strings(names)
-	*result = names
+
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{Namespace: args.Namespace, Name: args.Name},
+		args.Branch,
+	)
+	if err != nil {
+		return err
+	}
+	args.SnapshotId = d.state.resolveCommitRef(filesystemId, args.SnapshotId)
+
+	err = validateMetadata(args.Metadata)
+	if err != nil {
+		return err
+	}
+	user, _, _ := r.BasicAuth()
+	meta := map[string]string{"message": args.Message, "author": user}
+	for name, value := range args.Metadata {
+		meta[name] = value
+	}
+
+	responseChan, err := d.state.globalFsRequest(
+		filesystemId,
+		&Event{Name: "revert",
+			Args: &EventArgs{"snapshotId": args.SnapshotId, "metadata": meta}},
+	)
+	if err != nil {
+		return err
+	}
+
+	e := <-responseChan
+	if e.Name != "reverted" {
+		return maybeError(e, "reverted")
+	}
+	*result = (*e.Args)["SnapshotId"].(string)
+	log.Printf(
+		"Reverted %s/%s@%s to %s as %s",
+		args.Namespace, args.Name, args.Branch, args.SnapshotId, *result,
+	)
 	return nil
 }
 
-func (d *DotmeshRPC) Branch(
+// Restore puts some paths of a branch back as they were in one of its
+// commits, on the branch's master, and optionally commits the result. It
+// returns the new commit's id, or "" if it wasn't asked to commit.
+func (d *DotmeshRPC) Restore(
 	r *http.Request,
-	args *struct{ Namespace, Name, SourceBranch, NewBranchName, SourceCommitId string },
-	result *bool,
+	args *types.RestoreRequest,
+	result *string,
 ) error {
-	// TODO pass through to a globalFsRequest
-
-	// find the real origin filesystem we're trying to clone from, identified
-	// to the user by "volume + sourcebranch", but to us by an underlying
-	// filesystem id (could be a clone of a clone)
-
-	// NB: are we special-casing master here? Yes, I think. You'll never be
-	// able to delete the master branch because it's equivalent to the
-	// topLevelFilesystemId. You could rename it though, I suppose. That's
-	// probably fine. We could fix this later by allowing promotions.
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
 
-	err := validator.IsValidVolume(args.Namespace, args.Name)
+	err = validator.IsValidVolume(args.Namespace, args.Name)
 	if err != nil {
 		return err
 	}
 
-	err = validator.IsValidBranchName(args.SourceBranch)
+	err = validator.IsValidBranchName(args.Branch)
 	if err != nil {
 		return err
 	}
 
-	err = validator.IsValidBranchName(args.NewBranchName)
+	err = validator.IsValidSnapshotName(args.SnapshotId)
 	if err != nil {
 		return err
 	}
 
-	tlf, err := d.state.registry.LookupFilesystem(VolumeName{Namespace: args.Namespace, Name: args.Name})
+	if len(args.Paths) == 0 {
+		return fmt.Errorf("Please specify which paths to restore.")
+	}
+
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{Namespace: args.Namespace, Name: args.Name},
+		args.Branch,
+	)
 	if err != nil {
 		return err
 	}
-	var originFilesystemId string
+	args.SnapshotId = d.state.resolveCommitRef(filesystemId, args.SnapshotId)
 
-	// find whether branch refers to top-level fs or a clone, by guessing based
-	// on name convention. XXX this shouldn't be dealing with "master" and
-	// branches
-	if args.SourceBranch == DEFAULT_BRANCH {
-		originFilesystemId = tlf.MasterBranch.Id
-	} else {
-		clone, err := d.state.registry.LookupClone(
-			tlf.MasterBranch.Id, args.SourceBranch,
-		)
-		originFilesystemId = clone.FilesystemId
+	eventArgs := EventArgs{
+		"snapshotId": args.SnapshotId,
+		"paths":      args.Paths,
+		"commit":     args.Commit,
+	}
+	if args.Commit {
+		err = validateMetadata(args.Metadata)
 		if err != nil {
 			return err
 		}
+		user, _, _ := r.BasicAuth()
+		meta := map[string]string{"message": args.Message, "author": user}
+		for name, value := range args.Metadata {
+			meta[name] = value
+		}
+		eventArgs["metadata"] = meta
 	}
-	// target node is responsible for creating registry entry (so that they're
-	// as close as possible to eachother), so give it all the info it needs to
-	// do that.
+
 	responseChan, err := d.state.globalFsRequest(
-		originFilesystemId,
-		&Event{Name: "clone",
-			Args: &EventArgs{
-				"topLevelFilesystemId": tlf.MasterBranch.Id,
-				"originFilesystemId":   originFilesystemId,
-				"originSnapshotId":     args.SourceCommitId,
-				"newBranchName":        args.NewBranchName,
-			},
-		},
+		filesystemId,
+		&Event{Name: "restore", Args: &eventArgs},
 	)
 	if err != nil {
 		return err
 	}
 
-	// TODO this may never succeed, if the master for it never shows up. maybe
-	// this response should have a timeout associated with it.
 	e := <-responseChan
-	if e.Name == "cloned" {
-		log.Printf(
-			"Cloned %s:%s@%s (%s) to %s", args.Name,
-			args.SourceBranch, args.SourceCommitId, originFilesystemId, (*e.Args)["newFilesystemId"].(string),
-		)
-		*result = true
-	} else {
-		return maybeError(e, "cloned")
+	if e.Name != "restored" {
+		return maybeError(e, "restored")
 	}
+	*result, _ = (*e.Args)["SnapshotId"].(string)
+	log.Printf(
+		"Restored %v of %s/%s@%s from %s",
+		args.Paths, args.Namespace, args.Name, args.Branch, args.SnapshotId,
+	)
 	return nil
 }
 
-// Return local version information.
-func (d *DotmeshRPC) Version(
-	r *http.Request, args *struct{}, result *VersionInfo) error {
+// Merge applies the changes made on one branch of a dot, since it last had a
+// commit in common with another branch, to the other branch and commits the
+// result there. Paths changed on both branches are left as they are on the
+// branch merged into, and listed as conflicts.
+func (d *DotmeshRPC) Merge(
+	r *http.Request,
+	args *types.MergeRequest,
+	result *types.MergeResult,
+) error {
 	err := ensureAdminUser(r)
-
 	if err != nil {
 		return err
 	}
 
-	*result = *d.state.versionInfo
-	return nil
-}
-
-func (d *DotmeshRPC) registerFilesystemBecomeMaster(
-	ctx context.Context,
-	filesystemNamespace, filesystemName, cloneName, filesystemId string,
-	path PathToTopLevelFilesystem,
-) error {
-
-	log.Debugf("[registerFilesystemBecomeMaster] called: filesystemNamespace=%s, filesystemName=%s, cloneName=%s, filesystemId=%s path=%+v",
-		filesystemNamespace, filesystemName, cloneName, filesystemId, path)
-
-	// Check that the fsid isn't already present on this node
-	_, err := d.state.GetFilesystemMachine(filesystemId)
-	if err == nil {
-		log.Errorf("[registerFilesystemBecomeMaster] failed to initialize filesystem %s due to it already existing", filesystemId)
-		return fmt.Errorf("Filesystem ID %s already exists", filesystemId)
+	err = validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
 	}
 
-	// TODO handle the case where the registry entry exists but the filesystems
-	// (fsMachine map) entry doesn't.
-
-	filesystemIds := []string{path.TopLevelFilesystemId}
-	for _, c := range path.Clones {
-		filesystemIds = append(filesystemIds, c.Clone.FilesystemId)
-	}
-	for _, f := range filesystemIds {
-		// If any filesystemId in the transfer is marked as deleted or
-		// cleanupPending, remove that mark. We want to allow it to live again,
-		// and we don't want it to be asynchronously deleted!
-		deleted, err := d.state.isFilesystemDeletedInEtcd(f)
+	for _, branch := range []string{args.Branch, args.SourceBranch} {
+		err = validator.IsValidBranchName(branch)
 		if err != nil {
 			return err
 		}
-		if deleted {
+	}
 
-			err = d.state.filesystemStore.DeleteDeleted(f)
-			// Key not found means someone deleted it between us checking and
-			// us deleting it. Proceed.
-			if err != nil && !store.IsKeyNotFound(err) {
+	volumeName := VolumeName{Namespace: args.Namespace, Name: args.Name}
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(volumeName, args.Branch)
+	if err != nil {
+		return err
+	}
+	sourceFilesystemId, err := d.state.registry.MaybeCloneFilesystemId(volumeName, args.SourceBranch)
+	if err != nil {
+		return err
+	}
+	if sourceFilesystemId == filesystemId {
+		return fmt.Errorf("Can't merge a branch into itself.")
+	}
+
+	dirtyBytes, _, err := d.dirtyDataAndRunningContainers(r.Context(), filesystemId)
+	if err != nil {
+		return err
+	}
+	if dirtyBytes > 0 {
+		return fmt.Errorf("The branch has uncommitted changes, please commit them before merging.")
+	}
+
+	sourceName := args.SourceBranch
+	if sourceName == "" {
+		sourceName = "master"
+	}
+	err = validateMetadata(args.Metadata)
+	if err != nil {
+		return err
+	}
+	user, _, _ := r.BasicAuth()
+	meta := map[string]string{"message": args.Message, "author": user}
+	for name, value := range args.Metadata {
+		meta[name] = value
+	}
+	if meta["message"] == "" {
+		meta["message"] = fmt.Sprintf("Merge %s", sourceName)
+	}
+	meta["merged-from"] = sourceName
+
+	responseChan, err := d.state.globalFsRequest(
+		filesystemId,
+		&Event{Name: "merge",
+			Args: &EventArgs{"sourceFilesystemId": sourceFilesystemId, "metadata": meta}},
+	)
+	if err != nil {
+		return err
+	}
+
+	e := <-responseChan
+	if e.Name != "merged" {
+		return maybeError(e, "merged")
+	}
+	encoded, _ := (*e.Args)["result"].(string)
+	err = json.Unmarshal([]byte(encoded), result)
+	if err != nil {
+		return fmt.Errorf("failed to decode the merge result: %s", err)
+	}
+	log.Printf(
+		"Merged %s into %s/%s@%s as %s with %d conflicts",
+		sourceName, args.Namespace, args.Name, args.Branch, result.SnapshotId, len(result.Conflicts),
+	)
+	return nil
+}
+
+// CherryPick applies the changes one commit made, since the commit before it
+// on its branch, to a branch of the same dot and commits them there. The new
+// commit's metadata says which commit was picked.
+func (d *DotmeshRPC) CherryPick(
+	r *http.Request,
+	args *types.CherryPickRequest,
+	result *types.MergeResult,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidBranchName(args.Branch)
+	if err != nil {
+		return err
+	}
+
+	if args.Commit == "" {
+		return fmt.Errorf("Please specify the commit to cherry-pick.")
+	}
+
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{Namespace: args.Namespace, Name: args.Name},
+		args.Branch,
+	)
+	if err != nil {
+		return err
+	}
+	source, err := d.state.resolveDiffRef(filesystemId, args.Commit)
+	if err != nil {
+		return err
+	}
+
+	dirtyBytes, _, err := d.dirtyDataAndRunningContainers(r.Context(), filesystemId)
+	if err != nil {
+		return err
+	}
+	if dirtyBytes > 0 {
+		return fmt.Errorf("The branch has uncommitted changes, please commit them before cherry-picking.")
+	}
+
+	err = validateMetadata(args.Metadata)
+	if err != nil {
+		return err
+	}
+	user, _, _ := r.BasicAuth()
+	meta := map[string]string{"message": args.Message, "author": user}
+	for name, value := range args.Metadata {
+		meta[name] = value
+	}
+
+	responseChan, err := d.state.globalFsRequest(
+		filesystemId,
+		&Event{Name: "cherry-pick",
+			Args: &EventArgs{
+				"sourceFilesystemId": source.FilesystemID,
+				"snapshotId":         source.SnapshotID,
+				"metadata":           meta,
+			}},
+	)
+	if err != nil {
+		return err
+	}
+
+	e := <-responseChan
+	if e.Name != "cherry-picked" {
+		return maybeError(e, "cherry-picked")
+	}
+	encoded, _ := (*e.Args)["result"].(string)
+	err = json.Unmarshal([]byte(encoded), result)
+	if err != nil {
+		return fmt.Errorf("failed to decode the cherry-pick result: %s", err)
+	}
+	log.Printf(
+		"Cherry-picked %s onto %s/%s@%s as %s with %d conflicts",
+		source.SnapshotID, args.Namespace, args.Name, args.Branch, result.SnapshotId, len(result.Conflicts),
+	)
+	return nil
+}
+
+// DeleteCommit destroys one commit of a branch, on its master and then on
+// every replica. It refuses to delete a commit which something else depends
+// on: the origin of a branch or fork, or the latest commit a remote is known
+// to share with us.
+func (d *DotmeshRPC) DeleteCommit(
+	r *http.Request,
+	args *struct{ Namespace, Name, Branch, SnapshotId string },
+	result *bool,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidBranchName(args.Branch)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidSnapshotName(args.SnapshotId)
+	if err != nil {
+		return err
+	}
+
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{Namespace: args.Namespace, Name: args.Name},
+		args.Branch,
+	)
+	if err != nil {
+		return err
+	}
+	args.SnapshotId = d.state.resolveCommitRef(filesystemId, args.SnapshotId)
+	err = d.state.checkCommitDeletable(filesystemId, args.SnapshotId)
+	if err != nil {
+		return err
+	}
+	err = d.state.deleteCommit(filesystemId, args.SnapshotId)
+	if err != nil {
+		return err
+	}
+	log.Printf(
+		"Deleted commit %s of %s/%s@%s",
+		args.SnapshotId,
+		args.Namespace,
+		args.Name,
+		args.Branch,
+	)
+	*result = true
+	return nil
+}
+
+// Tag names one of a dot's commits. Tags can't be moved once they're made,
+// only deleted and made again.
+func (d *DotmeshRPC) Tag(
+	r *http.Request,
+	args *types.TagRequest,
+	result *types.Tag,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidBranchName(args.Branch)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidTagName(args.Tag)
+	if err != nil {
+		return err
+	}
+
+	tlf, err := d.state.registry.LookupFilesystem(VolumeName{Namespace: args.Namespace, Name: args.Name})
+	if err != nil {
+		return err
+	}
+	if _, err := d.state.registry.LookupClone(tlf.MasterBranch.Id, args.Tag); err == nil || args.Tag == DEFAULT_BRANCH {
+		return fmt.Errorf("There's already a branch called %s, please choose another name for the tag.", args.Tag)
+	}
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{Namespace: args.Namespace, Name: args.Name},
+		args.Branch,
+	)
+	if err != nil {
+		return err
+	}
+	commit, err := d.state.resolveDiffRef(filesystemId, args.Commit)
+	if err != nil {
+		return err
+	}
+
+	user, _, _ := r.BasicAuth()
+	tag := types.Tag{
+		FilesystemId: tlf.MasterBranch.Id,
+		Name:         args.Tag,
+		SnapshotId:   commit.SnapshotID,
+		Author:       user,
+		Created:      time.Now(),
+	}
+	err = d.state.registryStore.SetTag(&tag, &store.SetOptions{})
+	if store.IsKeyAlreadyExist(err) {
+		return fmt.Errorf("Tag %s already exists.", args.Tag)
+	} else if err != nil {
+		return err
+	}
+	log.Printf("Tagged %s of %s/%s as %s", tag.SnapshotId, args.Namespace, args.Name, tag.Name)
+	*result = tag
+	return nil
+}
+
+// DeleteTag deletes one of a dot's tags. The commit it tagged is kept.
+func (d *DotmeshRPC) DeleteTag(
+	r *http.Request,
+	args *struct{ Namespace, Name, Tag string },
+	result *bool,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	tlf, err := d.state.registry.LookupFilesystem(VolumeName{Namespace: args.Namespace, Name: args.Name})
+	if err != nil {
+		return err
+	}
+	err = d.state.registryStore.DeleteTag(tlf.MasterBranch.Id, args.Tag)
+	if store.IsKeyNotFound(err) {
+		return fmt.Errorf("Tag %s not found.", args.Tag)
+	} else if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// Tags returns a dot's tags, sorted by name.
+func (d *DotmeshRPC) Tags(
+	r *http.Request,
+	args *VolumeName,
+	result *[]types.Tag,
+) error {
+	err := validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	tlf, err := d.state.registry.LookupFilesystem(*args)
+	if err != nil {
+		return err
+	}
+	tags, err := d.state.registryStore.ListTags(tlf.MasterBranch.Id)
+	if err != nil {
+		return err
+	}
+	*result = []types.Tag{}
+	for _, tag := range tags {
+		*result = append(*result, *tag)
+	}
+	sort.Slice(*result, func(i, j int) bool {
+		return (*result)[i].Name < (*result)[j].Name
+	})
+	return nil
+}
+
+// ImportTags is called by the other end of a push, once it's done, to bring
+// the dot's tags along with its commits. It returns how many tags were added.
+func (d *DotmeshRPC) ImportTags(
+	r *http.Request,
+	args *types.ImportTagsRequest,
+	result *int,
+) error {
+	err := validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	user := auth.GetUser(r)
+	if user == nil {
+		return fmt.Errorf("no user found in request ctx")
+	}
+	tlf, err := d.state.registry.LookupFilesystem(VolumeName{Namespace: args.Namespace, Name: args.Name})
+	if err != nil {
+		return err
+	}
+	authorized, err := tlf.Authorize(user)
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf(
+			"You are not the owner or a collaborator of volume %s/%s.",
+			args.Namespace, args.Name,
+		)
+	}
+	*result, err = d.state.importTags(tlf.MasterBranch.Id, args.Tags)
+	return err
+}
+
+// settingTarget checks the dot and branch named by a request about a
+// per-branch setting (a retention policy or commit schedule), returning the
+// dot's top level filesystem id, the filesystem id of the branch, and the
+// branch the setting is stored under ("" for every branch of the dot).
+func (d *DotmeshRPC) settingTarget(namespace, name, branch string, allBranches bool) (string, string, string, error) {
+	err := validator.IsValidVolume(namespace, name)
+	if err != nil {
+		return "", "", "", err
+	}
+	err = validator.IsValidBranchName(branch)
+	if err != nil {
+		return "", "", "", err
+	}
+	volumeName := VolumeName{Namespace: namespace, Name: name}
+	topLevelFilesystemId, err := d.state.registry.IdFromName(volumeName)
+	if err != nil {
+		return "", "", "", err
+	}
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(volumeName, branch)
+	if err != nil {
+		return "", "", "", err
+	}
+	if allBranches {
+		branch = ""
+	} else if branch == "" {
+		branch = DEFAULT_BRANCH
+	}
+	return topLevelFilesystemId, filesystemId, branch, nil
+}
+
+// retentionTarget is settingTarget for a RetentionPolicyRequest.
+func (d *DotmeshRPC) retentionTarget(args *types.RetentionPolicyRequest) (string, string, string, error) {
+	return d.settingTarget(args.Namespace, args.Name, args.Branch, args.AllBranches)
+}
+
+// SetRetentionPolicy stores the retention policy for a branch, or for every
+// branch of a dot. An empty policy removes it.
+func (d *DotmeshRPC) SetRetentionPolicy(
+	r *http.Request, args *types.RetentionPolicyRequest, result *bool,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+	topLevelFilesystemId, _, branch, err := d.retentionTarget(args)
+	if err != nil {
+		return err
+	}
+	if args.Policy == nil || args.Policy.Empty() {
+		err = d.state.registryStore.DeleteRetentionPolicy(topLevelFilesystemId, branch)
+		if err != nil && err != kvdb.ErrNotFound {
+			return err
+		}
+		*result = true
+		return nil
+	}
+	if args.Policy.KeepLast < 0 || args.Policy.KeepDaily < 0 {
+		return fmt.Errorf("Retention policies can't keep a negative number of commits")
+	}
+	policy := *args.Policy
+	policy.FilesystemId = topLevelFilesystemId
+	policy.Branch = branch
+	err = d.state.registryStore.SetRetentionPolicy(&policy, &store.SetOptions{})
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// GetRetentionPolicy returns the retention policy which applies to a branch,
+// or the one for every branch of a dot. The policy is empty if there isn't
+// one.
+func (d *DotmeshRPC) GetRetentionPolicy(
+	r *http.Request, args *types.RetentionPolicyRequest, result *types.RetentionPolicy,
+) error {
+	topLevelFilesystemId, filesystemId, _, err := d.retentionTarget(args)
+	if err != nil {
+		return err
+	}
+	policies, err := d.state.retentionPolicies()
+	if err != nil {
+		return err
+	}
+	if args.AllBranches {
+		*result = policies[topLevelFilesystemId][""]
+	} else {
+		*result, _ = d.state.retentionPolicyFor(policies, filesystemId)
+	}
+	return nil
+}
+
+// RetentionDryRun returns the commits of a branch which would be pruned by
+// the policy in the request, or else the one which applies to the branch.
+func (d *DotmeshRPC) RetentionDryRun(
+	r *http.Request, args *types.RetentionPolicyRequest, result *[]types.PrunedCommit,
+) error {
+	topLevelFilesystemId, filesystemId, _, err := d.retentionTarget(args)
+	if err != nil {
+		return err
+	}
+	var policy types.RetentionPolicy
+	if args.Policy != nil {
+		policy = *args.Policy
+	} else {
+		policies, err := d.state.retentionPolicies()
+		if err != nil {
+			return err
+		}
+		if args.AllBranches {
+			policy = policies[topLevelFilesystemId][""]
+		} else {
+			policy, _ = d.state.retentionPolicyFor(policies, filesystemId)
+		}
+	}
+	pruned, err := d.state.expiredCommits(filesystemId, policy)
+	if err != nil {
+		return err
+	}
+	*result = pruned
+	return nil
+}
+
+// SetCommitSchedule stores the commit schedule for a branch, or for every
+// branch of a dot, or removes it if the schedule has no cron expression.
+func (d *DotmeshRPC) SetCommitSchedule(
+	r *http.Request, args *types.CommitScheduleRequest, result *bool,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+	topLevelFilesystemId, _, branch, err := d.settingTarget(args.Namespace, args.Name, args.Branch, args.AllBranches)
+	if err != nil {
+		return err
+	}
+	if args.Schedule == nil || args.Schedule.Cron == "" {
+		err = d.state.registryStore.DeleteCommitSchedule(topLevelFilesystemId, branch)
+		if err != nil && err != kvdb.ErrNotFound {
+			return err
+		}
+		*result = true
+		return nil
+	}
+	cs := *args.Schedule
+	cs.FilesystemId = topLevelFilesystemId
+	cs.Branch = branch
+	err = checkCommitSchedule(cs)
+	if err != nil {
+		return err
+	}
+	err = d.state.registryStore.SetCommitSchedule(&cs, &store.SetOptions{})
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// GetCommitSchedule returns the commit schedule which applies to a branch,
+// or the one for every branch of a dot. The schedule has no cron expression
+// if there isn't one.
+func (d *DotmeshRPC) GetCommitSchedule(
+	r *http.Request, args *types.CommitScheduleRequest, result *types.CommitSchedule,
+) error {
+	topLevelFilesystemId, filesystemId, _, err := d.settingTarget(args.Namespace, args.Name, args.Branch, args.AllBranches)
+	if err != nil {
+		return err
+	}
+	schedules, err := d.state.commitSchedules()
+	if err != nil {
+		return err
+	}
+	if args.AllBranches {
+		*result = schedules[topLevelFilesystemId][""]
+	} else {
+		*result, _ = d.state.commitScheduleFor(schedules, filesystemId)
+	}
+	return nil
+}
+
+func maybeError(e *Event, expected string) error {
+	if e.Error() != nil {
+		log.Errorf("unexpected response '%s' (expected: '%s') - %#v", e.Name, expected, e.Args)
+		return e.Error()
+	}
+	return fmt.Errorf("Unexpected response %s - %#v", e.Name, e.Args)
+}
+
+// Return a list of clone names attributed to a given top-level filesystem name
+func (d *DotmeshRPC) Branches(r *http.Request, filesystemName *VolumeName, result *[]string) error {
+	err := validator.IsValidVolume(filesystemName.Namespace, filesystemName.Name)
+	if err != nil {
+		return err
+	}
+
+	filesystemId, err := d.state.registry.IdFromName(*filesystemName)
+	if err != nil {
+		return err
+	}
+	filesystems := d.state.registry.ClonesFor(filesystemId)
+	names := []string{}
+	for name, _ := range filesystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	*result = names
+	return nil
+}
+
+func (d *DotmeshRPC) Branch(
+	r *http.Request,
+	args *struct{ Namespace, Name, SourceBranch, NewBranchName, SourceCommitId string },
+	result *bool,
+) error {
+	// TODO pass through to a globalFsRequest
+
+	// find the real origin filesystem we're trying to clone from, identified
+	// to the user by "volume + sourcebranch", but to us by an underlying
+	// filesystem id (could be a clone of a clone)
+
+	// NB: are we special-casing master here? Yes, I think. You'll never be
+	// able to delete the master branch because it's equivalent to the
+	// topLevelFilesystemId. You could rename it though, I suppose. That's
+	// probably fine. We could fix this later by allowing promotions.
+
+	err := validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidBranchName(args.SourceBranch)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidBranchName(args.NewBranchName)
+	if err != nil {
+		return err
+	}
+
+	tlf, err := d.state.registry.LookupFilesystem(VolumeName{Namespace: args.Namespace, Name: args.Name})
+	if err != nil {
+		return err
+	}
+	err = d.state.checkBranchNameIsNotATag(tlf.MasterBranch.Id, args.NewBranchName)
+	if err != nil {
+		return err
+	}
+	var originFilesystemId string
+
+	// find whether branch refers to top-level fs or a clone, by guessing based
+	// on name convention. XXX this shouldn't be dealing with "master" and
+	// branches
+	if args.SourceBranch == DEFAULT_BRANCH {
+		originFilesystemId = tlf.MasterBranch.Id
+	} else {
+		clone, err := d.state.registry.LookupClone(
+			tlf.MasterBranch.Id, args.SourceBranch,
+		)
+		originFilesystemId = clone.FilesystemId
+		if err != nil {
+			return err
+		}
+	}
+	origin, err := d.state.branchOrigin(tlf, originFilesystemId, args.SourceCommitId)
+	if err != nil {
+		return err
+	}
+	originFilesystemId = origin.FilesystemID
+	args.SourceCommitId = origin.SnapshotID
+
+	// target node is responsible for creating registry entry (so that they're
+	// as close as possible to eachother), so give it all the info it needs to
+	// do that.
+	responseChan, err := d.state.globalFsRequest(
+		originFilesystemId,
+		&Event{Name: "clone",
+			Args: &EventArgs{
+				"topLevelFilesystemId": tlf.MasterBranch.Id,
+				"originFilesystemId":   originFilesystemId,
+				"originSnapshotId":     args.SourceCommitId,
+				"newBranchName":        args.NewBranchName,
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	// TODO this may never succeed, if the master for it never shows up. maybe
+	// this response should have a timeout associated with it.
+	e := <-responseChan
+	if e.Name == "cloned" {
+		log.Printf(
+			"Cloned %s:%s@%s (%s) to %s", args.Name,
+			args.SourceBranch, args.SourceCommitId, originFilesystemId, (*e.Args)["newFilesystemId"].(string),
+		)
+		*result = true
+	} else {
+		return maybeError(e, "cloned")
+	}
+	return nil
+}
+
+// DeleteBranch deletes a branch of a dot, on every node. Branches cloned from
+// it are promoted first, so that they survive it.
+func (d *DotmeshRPC) DeleteBranch(
+	r *http.Request,
+	args *struct{ Namespace, Name, Branch string },
+	result *bool,
+) error {
+	*result = false
+
+	err := validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+	err = validator.IsValidBranchName(args.Branch)
+	if err != nil {
+		return err
+	}
+	if args.Branch == "" || args.Branch == DEFAULT_BRANCH {
+		return fmt.Errorf("The master branch can't be deleted, delete the dot instead.")
+	}
+
+	user := auth.GetUser(r)
+	if user == nil {
+		return fmt.Errorf("no user found in request ctx")
+	}
+	filesystem, err := d.state.registry.LookupFilesystem(VolumeName{Namespace: args.Namespace, Name: args.Name})
+	if err != nil {
+		return err
+	}
+	authorized, err := filesystem.AuthorizeOwner(user)
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf(
+			"You are not the owner of volume %s/%s. Only the owner can delete its branches.",
+			args.Namespace, args.Name,
+		)
+	}
+	clone, err := d.state.registry.LookupClone(filesystem.MasterBranch.Id, args.Branch)
+	if err != nil {
+		return err
+	}
+
+	// Its clones aren't being deleted, so only the branch itself matters.
+	err = checkNotInUse(d, clone.FilesystemId, map[string]string{})
+	if err != nil {
+		return err
+	}
+
+	promote, reparented, err := d.state.reparentClones(filesystem.MasterBranch.Id, clone.FilesystemId, clone.Origin)
+	if err != nil {
+		return err
+	}
+	// The master's copy of the clone is promoted first, and the registry
+	// only updated once it has been, so that a failed promotion leaves the
+	// branch and its clones as they were.
+	if promote != "" {
+		err = d.state.promoteOnMaster(promote, clone.FilesystemId)
+		if err != nil {
+			return err
+		}
+	}
+	err = d.state.updateClones(filesystem.MasterBranch.Id, reparented)
+	if err != nil {
+		return err
+	}
+	// Every other node promotes its copy of the clone before deleting its
+	// copy of the branch, and the registry entry goes once it's been cleaned
+	// up.
+	err = d.state.markFilesystemAsDeletedInEtcd(
+		clone.FilesystemId, user.Name, VolumeName{},
+		filesystem.MasterBranch.Id, args.Branch, promote,
+	)
+	if err != nil {
+		return err
+	}
+	d.state.waitForFilesystemDeath(clone.FilesystemId)
+
+	log.Printf(
+		"Deleted branch %s of %s/%s (%s), promoting %q",
+		args.Branch, args.Namespace, args.Name, clone.FilesystemId, promote,
+	)
+	*result = true
+	return nil
+}
+
+// RenameBranch gives a branch a new name. The old name keeps finding the
+// branch until another branch is given it, so containers using it as
+// dot@branch and clients which haven't heard about the rename keep working.
+func (d *DotmeshRPC) RenameBranch(
+	r *http.Request,
+	args *struct{ Namespace, Name, Branch, NewBranchName string },
+	result *bool,
+) error {
+	*result = false
+
+	err := validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+	for _, branch := range []string{args.Branch, args.NewBranchName} {
+		err = validator.IsValidBranchName(branch)
+		if err != nil {
+			return err
+		}
+		if branch == "" || branch == DEFAULT_BRANCH {
+			return fmt.Errorf("The master branch can't be renamed, or replaced by renaming another branch.")
+		}
+	}
+
+	user := auth.GetUser(r)
+	if user == nil {
+		return fmt.Errorf("no user found in request ctx")
+	}
+	filesystem, err := d.state.registry.LookupFilesystem(VolumeName{Namespace: args.Namespace, Name: args.Name})
+	if err != nil {
+		return err
+	}
+	authorized, err := filesystem.AuthorizeOwner(user)
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf(
+			"You are not the owner of volume %s/%s. Only the owner can rename its branches.",
+			args.Namespace, args.Name,
+		)
+	}
+	topLevelFilesystemId := filesystem.MasterBranch.Id
+	if _, err := d.state.registry.LookupClone(topLevelFilesystemId, args.NewBranchName); err == nil {
+		return fmt.Errorf("Branch %s already exists.", args.NewBranchName)
+	}
+	err = d.state.checkBranchNameIsNotATag(topLevelFilesystemId, args.NewBranchName)
+	if err != nil {
+		return err
+	}
+
+	// This fails if anything else changed the branch at the same time.
+	err = d.state.registry.RenameClone(topLevelFilesystemId, args.Branch, args.NewBranchName)
+	if err != nil {
+		return fmt.Errorf("Unable to rename branch %s: %s", args.Branch, err)
+	}
+	err = d.state.moveBranchSettings(topLevelFilesystemId, args.Branch, args.NewBranchName)
+	if err != nil {
+		return err
+	}
+
+	log.Printf(
+		"Renamed branch %s of %s/%s to %s",
+		args.Branch, args.Namespace, args.Name, args.NewBranchName,
+	)
+	*result = true
+	return nil
+}
+
+// Return local version information.
+func (d *DotmeshRPC) Version(
+	r *http.Request, args *struct{}, result *VersionInfo) error {
+	err := ensureAdminUser(r)
+
+	if err != nil {
+		return err
+	}
+
+	*result = *d.state.versionInfo
+	return nil
+}
+
+func (d *DotmeshRPC) registerFilesystemBecomeMaster(
+	ctx context.Context,
+	filesystemNamespace, filesystemName, cloneName, filesystemId string,
+	path PathToTopLevelFilesystem,
+) error {
+
+	log.Debugf("[registerFilesystemBecomeMaster] called: filesystemNamespace=%s, filesystemName=%s, cloneName=%s, filesystemId=%s path=%+v",
+		filesystemNamespace, filesystemName, cloneName, filesystemId, path)
+
+	// Check that the fsid isn't already present on this node
+	_, err := d.state.GetFilesystemMachine(filesystemId)
+	if err == nil {
+		log.Errorf("[registerFilesystemBecomeMaster] failed to initialize filesystem %s due to it already existing", filesystemId)
+		return fmt.Errorf("Filesystem ID %s already exists", filesystemId)
+	}
+
+	// TODO handle the case where the registry entry exists but the filesystems
+	// (fsMachine map) entry doesn't.
+
+	filesystemIds := []string{path.TopLevelFilesystemId}
+	for _, c := range path.Clones {
+		filesystemIds = append(filesystemIds, c.Clone.FilesystemId)
+	}
+	for _, f := range filesystemIds {
+		// If any filesystemId in the transfer is marked as deleted or
+		// cleanupPending, remove that mark. We want to allow it to live again,
+		// and we don't want it to be asynchronously deleted!
+		deleted, err := d.state.isFilesystemDeletedInEtcd(f)
+		if err != nil {
+			return err
+		}
+		if deleted {
+
+			err = d.state.filesystemStore.DeleteDeleted(f)
+			// Key not found means someone deleted it between us checking and
+			// us deleting it. Proceed.
+			if err != nil && !store.IsKeyNotFound(err) {
 				return err
 			}
 			err = d.state.filesystemStore.DeleteCleanupPending(f)
@@ -1234,78 +2259,272 @@ func (d *DotmeshRPC) registerFilesystemBecomeMaster(
 		}
 	}
 
-	// for each clone, set up clone
-	for _, c := range path.Clones {
-		err := d.state.registry.RegisterClone(c.Name, path.TopLevelFilesystemId, c.Clone)
+	// for each clone, set up clone
+	for _, c := range path.Clones {
+		err := d.state.registry.RegisterClone(c.Name, path.TopLevelFilesystemId, c.Clone)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Debugf(
+		"[registerFilesystemBecomeMaster] set master and registered fs in registry for %s",
+		filesystemId,
+	)
+	return nil
+}
+
+func (d *DotmeshRPC) RegisterFilesystem(
+	r *http.Request,
+	args *struct {
+		Namespace, TopLevelFilesystemName, CloneName, FilesystemId string
+		PathToTopLevelFilesystem                                   PathToTopLevelFilesystem
+		BecomeMasterIfNotExists                                    bool
+	},
+	result *bool,
+) error {
+	log.Printf("[RegisterFilesystem] called with args: %+v", args)
+
+	isAdmin, err := AuthenticatedUserIsNamespaceAdministrator(r.Context(), args.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if !isAdmin {
+		return fmt.Errorf("User is not an administrator for namespace %s, so cannot create volumes",
+			args.Namespace)
+	}
+
+	err = validator.IsValidVolume(args.Namespace, args.TopLevelFilesystemName)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidBranchName(args.CloneName)
+	if err != nil {
+		return err
+	}
+
+	if !args.BecomeMasterIfNotExists {
+		panic("can't not become master in RegisterFilesystem inter-cluster rpc")
+	}
+	err = d.registerFilesystemBecomeMaster(
+		r.Context(),
+		args.Namespace,
+		args.TopLevelFilesystemName,
+		args.CloneName,
+		args.FilesystemId,
+		args.PathToTopLevelFilesystem,
+	)
+	*result = true
+	return err
+}
+
+func (d *DotmeshRPC) GetTransfer(r *http.Request, args *string, result *TransferPollResult) error {
+	// Poll the status of a transfer by fetching it from our local cache.
+	d.state.interclusterTransfersLock.Lock()
+	defer d.state.interclusterTransfersLock.Unlock()
+
+	res, ok := d.state.interclusterTransfers[*args]
+	if !ok {
+		return fmt.Errorf("No such intercluster transfer %s", *args)
+	}
+	*result = res
+	return nil
+}
+
+// Transfers lists the transfers of a dot's branches which haven't finished,
+// failed or been cancelled, whether this cluster started them or is the peer,
+// by transfer id. API keys are left out.
+func (d *DotmeshRPC) Transfers(r *http.Request, args *VolumeName, result *[]TransferPollResult) error {
+	err := validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+	tlf, err := d.state.registry.LookupFilesystem(*args)
+	if err != nil {
+		return err
+	}
+	filesystemIds := map[string]bool{tlf.MasterBranch.Id: true}
+	for _, clone := range d.state.registry.ClonesFor(tlf.MasterBranch.Id) {
+		filesystemIds[clone.FilesystemId] = true
+	}
+
+	d.state.interclusterTransfersLock.Lock()
+	defer d.state.interclusterTransfersLock.Unlock()
+	*result = []TransferPollResult{}
+	for _, transfer := range d.state.interclusterTransfers {
+		if transfer.Status == "finished" || transfer.Status == "error" || transfer.Status == "cancelled" {
+			continue
+		}
+		if !filesystemIds[transfer.FilesystemId] && !filesystemIds[transfer.InitiatorFilesystemId] {
+			continue
+		}
+		transfer.ApiKey = ""
+		*result = append(*result, transfer)
+	}
+	sort.Slice(*result, func(i, j int) bool {
+		return (*result)[i].TransferRequestId < (*result)[j].TransferRequestId
+	})
+	return nil
+}
+
+// Cancel a transfer which is still going. On the cluster which started it,
+// this stops the initiator, which tells the peer in turn. On the cluster
+// being pushed to, it stops the peer waiting for the rest of the push. Either
+// way, anything half-received is thrown away rather than kept to resume from.
+func (d *DotmeshRPC) CancelTransfer(r *http.Request, args *string, result *bool) error {
+	d.state.interclusterTransfersLock.Lock()
+	transfer, ok := d.state.interclusterTransfers[*args]
+	d.state.interclusterTransfersLock.Unlock()
+	if !ok {
+		return fmt.Errorf("No such intercluster transfer %s", *args)
+	}
+	err := d.authorizeTransfer(r, transfer)
+	if err != nil {
+		return err
+	}
+	switch transfer.Status {
+	case "finished", "error", "cancelled":
+		return fmt.Errorf("Transfer %s has already %s", *args, transferOutcome(transfer.Status))
+	}
+	if transfer.InitiatorNodeId == "" {
+		return fmt.Errorf("Transfer %s hasn't started yet, try again in a moment", *args)
+	}
+
+	// the initiator is one of our nodes if we started the transfer,
+	// otherwise we're the peer of a push
+	initiator := transfer.InitiatorNodeId == d.state.NodeID() ||
+		len(d.state.AddressesForServer(transfer.InitiatorNodeId)) > 0
+	filesystemId := transfer.FilesystemId
+	if initiator && transfer.InitiatorFilesystemId != "" {
+		filesystemId = transfer.InitiatorFilesystemId
+	}
+
+	var e *Event
+	err = tryUntilSucceedsN(func() error {
+		responseChan, err := d.state.globalFsRequest(filesystemId, &Event{
+			Name: "cancel-transfer",
+			Args: &EventArgs{"TransferRequestId": *args},
+		})
+		if err != nil {
+			return err
+		}
+		e = <-responseChan
+		if e.Name == "busy-transferring" {
+			// the machine hasn't noticed it's been cancelled yet
+			return fmt.Errorf("transfer %s is still stopping", *args)
+		}
+		return nil
+	}, "waiting for cancelled transfer to stop", 10)
+	if err != nil {
+		return err
+	}
+	if e.Name != "transfer-cancelled" {
+		return maybeError(e, "transfer-cancelled")
+	}
+
+	if !initiator {
+		// nothing else is going to update the peer's record of the
+		// transfer now
+		transfer.Status = "cancelled"
+		transfer.Message = "cancelled"
+		d.state.UpdateInterclusterTransfer(*args, transfer)
+		err = d.state.filesystemStore.SetTransfer(&transfer, &store.SetOptions{})
 		if err != nil {
 			return err
 		}
 	}
-
-	log.Debugf(
-		"[registerFilesystemBecomeMaster] set master and registered fs in registry for %s",
-		filesystemId,
-	)
+	*result = true
 	return nil
 }
 
-func (d *DotmeshRPC) RegisterFilesystem(
-	r *http.Request,
-	args *struct {
-		Namespace, TopLevelFilesystemName, CloneName, FilesystemId string
-		PathToTopLevelFilesystem                                   PathToTopLevelFilesystem
-		BecomeMasterIfNotExists                                    bool
-	},
-	result *bool,
-) error {
-	log.Printf("[RegisterFilesystem] called with args: %+v", args)
-
-	isAdmin, err := AuthenticatedUserIsNamespaceAdministrator(r.Context(), args.Namespace)
+// Change where a queued transfer is in the queue of the node which started
+// it, by giving it a new priority, moving it to a new place, or both.
+func (d *DotmeshRPC) ReorderTransfer(r *http.Request, args *types.TransferReorderRequest, result *bool) error {
+	d.state.interclusterTransfersLock.Lock()
+	transfer, ok := d.state.interclusterTransfers[args.TransferRequestId]
+	d.state.interclusterTransfersLock.Unlock()
+	if !ok {
+		return fmt.Errorf("No such intercluster transfer %s", args.TransferRequestId)
+	}
+	err := d.authorizeTransfer(r, transfer)
 	if err != nil {
 		return err
 	}
-
-	if !isAdmin {
-		return fmt.Errorf("User is not an administrator for namespace %s, so cannot create volumes",
-			args.Namespace)
+	if transfer.Status != "queued" {
+		return fmt.Errorf("Transfer %s isn't queued, it's %s", args.TransferRequestId, transfer.Status)
 	}
-
-	err = validator.IsValidVolume(args.Namespace, args.TopLevelFilesystemName)
-	if err != nil {
-		return err
+	if args.Priority == nil && args.Position == 0 {
+		return fmt.Errorf("Please give the transfer a new priority or position")
 	}
 
-	err = validator.IsValidBranchName(args.CloneName)
+	eventArgs := EventArgs{"TransferRequestId": args.TransferRequestId}
+	if args.Priority != nil {
+		eventArgs["Priority"] = *args.Priority
+	}
+	if args.Position > 0 {
+		eventArgs["Position"] = args.Position
+	}
+	// the initiator's queue is on the master of the filesystem it's
+	// transferring for
+	responseChan, err := d.state.globalFsRequest(transfer.InitiatorFilesystemId, &Event{
+		Name: "reorder-transfer",
+		Args: &eventArgs,
+	})
 	if err != nil {
 		return err
 	}
-
-	if !args.BecomeMasterIfNotExists {
-		panic("can't not become master in RegisterFilesystem inter-cluster rpc")
+	e := <-responseChan
+	if e.Name != "transfer-reordered" {
+		return maybeError(e, "transfer-reordered")
 	}
-	err = d.registerFilesystemBecomeMaster(
-		r.Context(),
-		args.Namespace,
-		args.TopLevelFilesystemName,
-		args.CloneName,
-		args.FilesystemId,
-		args.PathToTopLevelFilesystem,
-	)
 	*result = true
-	return err
+	return nil
 }
 
-func (d *DotmeshRPC) GetTransfer(r *http.Request, args *string, result *TransferPollResult) error {
-	// Poll the status of a transfer by fetching it from our local cache.
-	d.state.interclusterTransfersLock.Lock()
-	defer d.state.interclusterTransfersLock.Unlock()
+// authorizeTransfer checks that the user making request r may change
+// transfer, which they can if they could push or pull the dot it's for on
+// this cluster. That's the owner or a collaborator rather than only the
+// admin, as the initiator of a push cancels it on the peer as the user it's
+// pushing as.
+func (d *DotmeshRPC) authorizeTransfer(r *http.Request, transfer TransferPollResult) error {
+	user := auth.GetUser(r)
+	if user == nil {
+		return fmt.Errorf("no user found in request ctx")
+	}
+	// even when the dot's gone
+	if user.Id == ADMIN_USER_UUID {
+		return nil
+	}
+	for _, filesystemId := range []string{transfer.InitiatorFilesystemId, transfer.FilesystemId} {
+		if filesystemId == "" {
+			continue
+		}
+		// the initiator's filesystem is on the other cluster on a peer
+		tlf, _, err := d.state.registry.LookupFilesystemById(filesystemId)
+		if err != nil {
+			continue
+		}
+		authorized, err := tlf.Authorize(user)
+		if err != nil {
+			return err
+		}
+		if authorized {
+			return nil
+		}
+	}
+	return fmt.Errorf(
+		"You are not the owner or a collaborator of the dot transfer %s is for.",
+		transfer.TransferRequestId,
+	)
+}
 
-	res, ok := d.state.interclusterTransfers[*args]
-	if !ok {
-		return fmt.Errorf("No such intercluster transfer %s", *args)
+func transferOutcome(status string) string {
+	if status == "error" {
+		return "failed"
 	}
-	*result = res
-	return nil
+	return status
 }
 
 func (d *DotmeshRPC) S3Transfer(r *http.Request, args *types.S3TransferRequest, result *string) error {
@@ -1440,31 +2659,71 @@ func (d *DotmeshRPC) S3Transfer(r *http.Request, args *types.S3TransferRequest,
 
 // Register a transfer from an initiator (the cluster where the user initially
 // connected) to a peer (the cluster which will be the target of a push/pull).
+// This is what initiators which can't resume transfers or compress their
+// streams call, see NegotiateTransfer for the ones which can.
 func (d *DotmeshRPC) RegisterTransfer(
 	r *http.Request,
 	args *TransferPollResult,
 	result *bool,
 ) error {
+	_, err := d.registerTransfer(args)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// NegotiateTransfer registers a transfer like RegisterTransfer, but replies
+// with the transfer as the peer sees it, which for a push carries the
+// ResumeToken of any interrupted receive the initiator can carry on from, and
+// the StreamEncoding and CompressedStream it should send with, out of those
+// it offered. Peers too old to have it reply to RegisterTransfer with a bool,
+// so it's a separate method.
+func (d *DotmeshRPC) NegotiateTransfer(
+	r *http.Request,
+	args *TransferPollResult,
+	result *TransferPollResult,
+) error {
+	resumeToken, err := d.registerTransfer(args)
+	if err != nil {
+		return err
+	}
+	*result = *args
+	result.ResumeToken = resumeToken
+	return nil
+}
+
+// registerTransfer records a transfer and puts the filesystem's machine into
+// the peer state for it, returning the token of any interrupted receive a
+// push can resume.
+func (d *DotmeshRPC) registerTransfer(args *TransferPollResult) (string, error) {
 	log.Infof("[RegisterTransfer] called with args: %+v", args)
 
 	// We are the "remote" here. Local name is welcome to be invalid,
 	// that's the far end's problem
 	err := validator.IsValidVolume(args.RemoteNamespace, args.RemoteName)
 	if err != nil {
-		return err
+		return "", err
 	}
 	err = validator.IsValidBranchName(args.RemoteBranchName)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if args.TransferRequestId == "" {
-		return fmt.Errorf("TransferRequestId cannot be empty")
+		return "", fmt.Errorf("TransferRequestId cannot be empty")
 	}
 
+	// settle how the initiator should send the stream, out of what it
+	// offered, so that both ends record the same thing. Initiators which
+	// don't offer anything get the original uncompressed framing.
+	args.StreamEncoding = utils.NegotiateStreamEncoding(args.StreamEncoding)
+	args.CompressedStream = args.CompressedStream && d.state.zfs.CompressedStreams()
+
 	err = d.state.filesystemStore.SetTransfer(args, &store.SetOptions{})
 	if err != nil {
-		return err
+		return "", err
 	}
 	// XXX A transfer should be able to span multiple filesystemIds, really. So
 	// tying a transfer to a filesystem id is probably wrong. except, the thing
@@ -1477,7 +2736,7 @@ func (d *DotmeshRPC) RegisterTransfer(
 		},
 	})
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Block until the fsmachine is ready to transfer
@@ -1487,10 +2746,11 @@ func (d *DotmeshRPC) RegisterTransfer(
 
 	if e.Name != "awaiting-transfer" {
 		// Something went wrong!
-		return fmt.Errorf("Error requesting peer transfer: %+v", e)
+		return "", fmt.Errorf("Error requesting peer transfer: %+v", e)
 	}
 
-	return nil
+	resumeToken, _ := (*e.Args)["ResumeToken"].(string)
+	return resumeToken, nil
 }
 
 func (d *DotmeshRPC) dirtyDataAndRunningContainers(ctx context.Context, filesystemId string) (int64, []string, error) {
@@ -1513,18 +2773,17 @@ func (d *DotmeshRPC) dirtyDataAndRunningContainers(ctx context.Context, filesyst
 	return dirtyBytes, containersRunning, nil
 }
 
-// Need both push and pull because one cluster will often be behind NAT.
-// Transfer will immediately return a transferId which can be queried until
-// completion
-func (d *DotmeshRPC) Transfer(
+// CompareWithRemote works out how far a local branch is ahead of, or behind,
+// the branch on a peer cluster which a push or pull of it would transfer to or
+// from, by listing the peer's commits. Nothing is transferred. Direction,
+// TargetCommit and the other transfer options in args are ignored.
+func (d *DotmeshRPC) CompareWithRemote(
 	r *http.Request,
 	args *types.TransferRequest,
-	result *string,
+	result *types.RemoteComparison,
 ) error {
 	client := dmclient.NewJsonRpcClient(args.User, args.Peer, args.ApiKey, args.Port)
 
-	log.Infof("[Transfer] starting with %+v", safeArgs(*args))
-
 	// Remote name is welcome to be invalid, that's the far end's problem
 	err := validator.IsValidVolume(args.LocalNamespace, args.LocalName)
 	if err != nil {
@@ -1535,6 +2794,13 @@ func (d *DotmeshRPC) Transfer(
 		return err
 	}
 
+	localFilesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{Namespace: args.LocalNamespace, Name: args.LocalName}, args.LocalBranchName,
+	)
+	if err != nil {
+		return err
+	}
+
 	var remoteFilesystemId string
 	err = client.CallRemote(r.Context(),
 		"DotmeshRPC.Exists", map[string]string{
@@ -1545,6 +2811,66 @@ func (d *DotmeshRPC) Transfer(
 	if err != nil {
 		return err
 	}
+	if remoteFilesystemId != "" && remoteFilesystemId != localFilesystemId {
+		return fmt.Errorf(
+			"Cannot compare filesystems with different ids, remote=%s, local=%s",
+			remoteFilesystemId, localFilesystemId,
+		)
+	}
+
+	localSnaps, err := d.state.SnapshotsForCurrentMaster(localFilesystemId)
+	if err != nil {
+		return err
+	}
+	remoteSnaps := []*types.Snapshot{}
+	if remoteFilesystemId != "" {
+		err = client.CallRemote(r.Context(), "DotmeshRPC.CommitsById", remoteFilesystemId, &remoteSnaps)
+		if err != nil {
+			return err
+		}
+	}
+
+	localSnapPointers := []*types.Snapshot{}
+	for i := range localSnaps {
+		localSnapPointers = append(localSnapPointers, &localSnaps[i])
+	}
+	*result = types.RemoteComparison{
+		RemoteNamespace: args.RemoteNamespace,
+		RemoteName:      args.RemoteName,
+		RemoteBranch:    args.RemoteBranchName,
+		RemoteExists:    remoteFilesystemId != "",
+	}
+	result.Ahead, result.Behind, result.CommonAncestor = fsm.CompareSnapshots(localSnapPointers, remoteSnaps)
+	return nil
+}
+
+// transferEnds checks the args of a transfer, and finds the filesystem ids of
+// the branch on each end, "" for an end which doesn't have it yet. It refuses
+// transfers which can't go ahead: from an end without the branch, or between
+// branches which aren't the same filesystem.
+func (d *DotmeshRPC) transferEnds(
+	ctx context.Context, client *dmclient.JsonRpcClient, args *types.TransferRequest,
+) (string, string, error) {
+	// Remote name is welcome to be invalid, that's the far end's problem
+	err := validator.IsValidVolume(args.LocalNamespace, args.LocalName)
+	if err != nil {
+		return "", "", err
+	}
+	err = validator.IsValidBranchName(args.LocalBranchName)
+	if err != nil {
+		return "", "", err
+	}
+
+	var remoteFilesystemId string
+	err = client.CallRemote(ctx,
+		"DotmeshRPC.Exists", map[string]string{
+			"Namespace": args.RemoteNamespace,
+			"Name":      args.RemoteName,
+			"Branch":    args.RemoteBranchName,
+		}, &remoteFilesystemId)
+	if err != nil {
+		return "", "", err
+	}
 
 	localFilesystemId := d.state.registry.Exists(
 		VolumeName{Namespace: args.LocalNamespace, Name: args.LocalName}, args.LocalBranchName,
@@ -1554,22 +2880,37 @@ func (d *DotmeshRPC) Transfer(
 	localExists := localFilesystemId != ""
 
 	if !remoteExists && !localExists {
-		return fmt.Errorf("Both local and remote filesystems don't exist.")
+		return "", "", fmt.Errorf("Both local and remote filesystems don't exist.")
 	}
 	if args.Direction == "push" && !localExists {
-		return fmt.Errorf("Can't push when local doesn't exist")
+		return "", "", fmt.Errorf("Can't push when local doesn't exist")
 	}
 	if args.Direction == "pull" && !remoteExists {
-		return fmt.Errorf("Can't pull when remote doesn't exist")
+		return "", "", fmt.Errorf("Can't pull when remote doesn't exist")
 	}
+	if remoteExists && localExists && remoteFilesystemId != localFilesystemId {
+		return "", "", fmt.Errorf(
+			"Cannot reconcile filesystems with different ids, remote=%s, local=%s, args=%+v",
+			remoteFilesystemId, localFilesystemId, safeArgs(*args),
+		)
+	}
+	return localFilesystemId, remoteFilesystemId, nil
+}
 
+// transferPaths deduces the path to the top level filesystem of the branch
+// being transferred on the sending end, and from it the same path on the
+// receiving end, where the dot may have another name.
+func (d *DotmeshRPC) transferPaths(
+	ctx context.Context, client *dmclient.JsonRpcClient, args *types.TransferRequest,
+) (PathToTopLevelFilesystem, PathToTopLevelFilesystem, error) {
 	var localPath, remotePath PathToTopLevelFilesystem
+	var err error
 	if args.Direction == "push" {
 		localPath, err = d.state.registry.DeducePathToTopLevelFilesystem(
 			VolumeName{Namespace: args.LocalNamespace, Name: args.LocalName}, args.LocalBranchName,
 		)
 		if err != nil {
-			return fmt.Errorf(
+			return localPath, remotePath, fmt.Errorf(
 				"Can't deduce path to top level filesystem for %s/%s,%s: %s",
 				args.LocalNamespace, args.LocalName, args.LocalBranchName, err,
 			)
@@ -1582,7 +2923,7 @@ func (d *DotmeshRPC) Transfer(
 			Name:      args.RemoteName,
 		}
 	} else if args.Direction == "pull" {
-		err := client.CallRemote(r.Context(),
+		err = client.CallRemote(ctx,
 			"DotmeshRPC.DeducePathToTopLevelFilesystem", map[string]interface{}{
 				"RemoteNamespace":      args.RemoteNamespace,
 				"RemoteFilesystemName": args.RemoteName,
@@ -1591,7 +2932,7 @@ func (d *DotmeshRPC) Transfer(
 			&remotePath,
 		)
 		if err != nil {
-			return fmt.Errorf(
+			return localPath, remotePath, fmt.Errorf(
 				"Can't deduce path to top level filesystem for %s/%s,%s: %s",
 				args.RemoteNamespace, args.RemoteName, args.RemoteBranchName, err,
 			)
@@ -1603,9 +2944,55 @@ func (d *DotmeshRPC) Transfer(
 			Name:      args.LocalName,
 		}
 	}
+	return localPath, remotePath, nil
+}
+
+// Need both push and pull because one cluster will often be behind NAT.
+// Transfer will immediately return a transferId which can be queried until
+// completion
+func (d *DotmeshRPC) Transfer(
+	r *http.Request,
+	args *types.TransferRequest,
+	result *string,
+) error {
+	client := dmclient.NewJsonRpcClient(args.User, args.Peer, args.ApiKey, args.Port)
+
+	log.Infof("[Transfer] starting with %+v", safeArgs(*args))
+
+	localFilesystemId, remoteFilesystemId, err := d.transferEnds(r.Context(), client, args)
+	if err != nil {
+		return err
+	}
+	remoteExists := remoteFilesystemId != ""
+	localExists := localFilesystemId != ""
+
+	localPath, remotePath, err := d.transferPaths(r.Context(), client, args)
+	if err != nil {
+		return err
+	}
 
 	log.Printf("[Transfer] got paths: local=%+v remote=%+v", localPath, remotePath)
 
+	if args.TargetCommit != "" {
+		// the commit may be given as a tag of the sending end's dot
+		if args.Direction == "push" {
+			args.TargetCommit = d.state.resolveCommitRef(localFilesystemId, args.TargetCommit)
+		} else if args.Direction == "pull" {
+			var tags []types.Tag
+			err = client.CallRemote(r.Context(),
+				"DotmeshRPC.Tags", VolumeName{Namespace: args.RemoteNamespace, Name: args.RemoteName}, &tags,
+			)
+			if err != nil {
+				log.Printf("[Transfer] can't list the peer's tags, taking %s to be a commit id: %s", args.TargetCommit, err)
+			}
+			for _, tag := range tags {
+				if tag.Name == args.TargetCommit {
+					args.TargetCommit = tag.SnapshotId
+				}
+			}
+		}
+	}
+
 	var filesystemId string
 	if args.Direction == "push" && !remoteExists {
 		// pre-create the remote registry entry and pick a master for it to
@@ -1644,12 +3031,7 @@ func (d *DotmeshRPC) Transfer(
 			return err
 		}
 		filesystemId = remoteFilesystemId
-	} else if remoteExists && localExists && remoteFilesystemId != localFilesystemId {
-		return fmt.Errorf(
-			"Cannot reconcile filesystems with different ids, remote=%s, local=%s, args=%+v",
-			remoteFilesystemId, localFilesystemId, safeArgs(*args),
-		)
-	} else if remoteExists && localExists && remoteFilesystemId == localFilesystemId {
+	} else if remoteExists && localExists {
 		filesystemId = localFilesystemId
 
 		// This is an incremental update, not a new filesystem for the writer.
@@ -1785,8 +3167,10 @@ func (d *DotmeshRPC) Transfer(
 		// asynchronously consume the response, and update any in-progress
 		// transfer in error cases
 		e := <-responseChan
-		// detect success cases, ignore them - we assume that the pollResult will be updated in those cases
-		if !(e.Name == "finished-push" || e.Name == "finished-pull" || e.Name == "peer-up-to-date") {
+		// detect success and cancellation cases, ignore them - we assume that
+		// the pollResult will be updated in those cases
+		if !(e.Name == "finished-push" || e.Name == "finished-pull" || e.Name == "peer-up-to-date" ||
+			e.Name == "transfer-cancelled") {
 
 			errorPollResult := TransferPollResult{
 				TransferRequestId: requestId,
@@ -1838,6 +3222,165 @@ func (a ByAddress) Less(i, j int) bool {
 	return a[i].Addresses[0] < a[j].Addresses[0]
 }
 
+// TransferPlan works out what Transfer would do with the same args, without
+// changing anything on either cluster: which branches on the path to the top
+// level filesystem it would send, and which commits of each, how big each
+// stream would be, and whether the receiving end's commits would need to be
+// stashed. Like Transfer, it plans to send up to the latest commits.
+func (d *DotmeshRPC) TransferPlan(
+	r *http.Request,
+	args *types.TransferRequest,
+	result *types.TransferPlan,
+) error {
+	client := dmclient.NewJsonRpcClient(args.User, args.Peer, args.ApiKey, args.Port)
+
+	localFilesystemId, remoteFilesystemId, err := d.transferEnds(r.Context(), client, args)
+	if err != nil {
+		return err
+	}
+	remoteExists := remoteFilesystemId != ""
+	localExists := localFilesystemId != ""
+
+	localPath, remotePath, err := d.transferPaths(r.Context(), client, args)
+	if err != nil {
+		return err
+	}
+
+	// the commits of a branch on either end, none if it isn't there yet
+	localSnaps := func(branch, filesystemId string) ([]*types.Snapshot, error) {
+		id := d.state.registry.Exists(
+			VolumeName{Namespace: args.LocalNamespace, Name: args.LocalName}, branch,
+		)
+		if id == "" {
+			return []*types.Snapshot{}, nil
+		}
+		if id != filesystemId {
+			return nil, fmt.Errorf(
+				"Cannot reconcile filesystems with different ids for branch %q, remote=%s, local=%s",
+				branch, filesystemId, id,
+			)
+		}
+		snaps, err := d.state.SnapshotsForCurrentMaster(id)
+		if err != nil {
+			return nil, err
+		}
+		pointers := []*types.Snapshot{}
+		for i := range snaps {
+			pointers = append(pointers, &snaps[i])
+		}
+		return pointers, nil
+	}
+	remoteSnaps := func(branch, filesystemId string) ([]*types.Snapshot, error) {
+		var id string
+		err := client.CallRemote(r.Context(),
+			"DotmeshRPC.Exists", map[string]string{
+				"Namespace": args.RemoteNamespace,
+				"Name":      args.RemoteName,
+				"Branch":    branch,
+			}, &id)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			return []*types.Snapshot{}, nil
+		}
+		if id != filesystemId {
+			return nil, fmt.Errorf(
+				"Cannot reconcile filesystems with different ids for branch %q, remote=%s, local=%s",
+				branch, id, filesystemId,
+			)
+		}
+		snaps := []*types.Snapshot{}
+		err = client.CallRemote(r.Context(), "DotmeshRPC.CommitsById", id, &snaps)
+		if err != nil {
+			return nil, err
+		}
+		return snaps, nil
+	}
+
+	path, sendingSnaps, receivingSnaps := localPath, localSnaps, remoteSnaps
+	*result = types.TransferPlan{
+		Direction:      args.Direction,
+		FilesystemId:   localFilesystemId,
+		ReceiverExists: remoteExists,
+	}
+	if args.Direction == "pull" {
+		path, sendingSnaps, receivingSnaps = remotePath, remoteSnaps, localSnaps
+		result.FilesystemId = remoteFilesystemId
+		result.ReceiverExists = localExists
+	}
+	result.Path = path
+	result.Steps = []types.TransferPlanStep{}
+
+	// the steps applyPath takes: the top level filesystem up to the origin
+	// of the first clone, then each clone up to the origin of the next one,
+	// and the last up to its latest commit
+	type pathStep struct {
+		branch                           string
+		fromFilesystemId, fromSnapshotId string
+		toFilesystemId, toSnapshotId     string
+	}
+	steps := []pathStep{{toFilesystemId: path.TopLevelFilesystemId}}
+	for i, clone := range path.Clones {
+		steps[i].toSnapshotId = clone.Clone.Origin.SnapshotId
+		steps = append(steps, pathStep{
+			branch:           clone.Name,
+			fromFilesystemId: clone.Clone.Origin.FilesystemId,
+			fromSnapshotId:   clone.Clone.Origin.SnapshotId,
+			toFilesystemId:   clone.Clone.FilesystemId,
+		})
+	}
+
+	for _, s := range steps {
+		sending, err := sendingSnaps(s.branch, s.toFilesystemId)
+		if err != nil {
+			return err
+		}
+		receiving, err := receivingSnaps(s.branch, s.toFilesystemId)
+		if err != nil {
+			return err
+		}
+		step := fsm.PlanTransferStep(
+			sending, receiving, s.fromFilesystemId, s.fromSnapshotId, s.toSnapshotId, args.StashDivergence,
+		)
+		step.Branch = s.branch
+		step.FilesystemId = s.toFilesystemId
+
+		if len(step.Commits) > 0 {
+			if args.Direction == "push" {
+				err = d.PredictSize(r, &types.PredictSizeRequest{
+					FromFilesystemId: s.fromFilesystemId,
+					FromSnapshotId:   step.StartingCommit,
+					ToFilesystemId:   s.toFilesystemId,
+					ToSnapshotId:     step.TargetCommit,
+				}, &step.Size)
+			} else {
+				err = client.CallRemote(r.Context(),
+					"DotmeshRPC.PredictSize", types.PredictSizeRequest{
+						FromFilesystemId: s.fromFilesystemId,
+						FromSnapshotId:   step.StartingCommit,
+						ToFilesystemId:   s.toFilesystemId,
+						ToSnapshotId:     step.TargetCommit,
+					},
+					&step.Size,
+				)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		result.Steps = append(result.Steps, step)
+		result.Size.Raw += step.Size.Raw
+		result.Size.Wire += step.Size.Wire
+		result.StashNeeded = result.StashNeeded || step.StashNeeded
+		if step.Error != "" {
+			break
+		}
+	}
+	return nil
+}
+
 // Return data showing all volumes, their clones, along with information about
 // them such as the current state of their state machines on each server, etc.
 //
@@ -2133,13 +3676,8 @@ func (d *DotmeshRPC) DeducePathToTopLevelFilesystem(
 
 func (d *DotmeshRPC) PredictSize(
 	r *http.Request,
-	args *struct {
-		FromFilesystemId string
-		FromSnapshotId   string
-		ToFilesystemId   string
-		ToSnapshotId     string
-	},
-	result *int64,
+	args *types.PredictSizeRequest,
+	result *types.PredictedSize,
 ) error {
 
 	responseChan, err := d.state.globalFsRequest(
@@ -2150,6 +3688,7 @@ func (d *DotmeshRPC) PredictSize(
 				"FromSnapshotId":   args.FromSnapshotId,
 				"ToFilesystemId":   args.ToFilesystemId,
 				"ToSnapshotId":     args.ToSnapshotId,
+				"ResumeToken":      args.ResumeToken,
 			},
 		},
 	)
@@ -2159,7 +3698,8 @@ func (d *DotmeshRPC) PredictSize(
 
 	e := <-responseChan
 	if e.Name == "predictedSize" {
-		*result = int64((*e.Args)["size"].(float64))
+		result.Raw = int64((*e.Args)["size"].(float64))
+		result.Wire = int64((*e.Args)["wireSize"].(float64))
 	} else {
 		return maybeError(e, "predictedSize")
 	}
@@ -2284,12 +3824,12 @@ func (d *DotmeshRPC) Delete(r *http.Request, args *VolumeName, result *bool) err
 		// hopefully that will never happen.
 		if filesystem.MasterBranch.Id == fsid {
 			// master clone, so record the name to delete and no clone registry entry to delete
-			err = d.state.markFilesystemAsDeletedInEtcd(fsid, user.Name, *args, "", "")
+			err = d.state.markFilesystemAsDeletedInEtcd(fsid, user.Name, *args, "", "", "")
 		} else {
 			// Not the master clone, so don't record a name to delete, but do record a clone name for deletion
 			err = d.state.markFilesystemAsDeletedInEtcd(
 				fsid, user.Name, VolumeName{},
-				filesystem.MasterBranch.Id, names[fsid])
+				filesystem.MasterBranch.Id, names[fsid], "")
 		}
 		if err != nil {
 			return err
@@ -3035,15 +4575,35 @@ func (d *DotmeshRPC) LastModified(r *http.Request, v *types.VolumeName, result *
 	return nil
 }
 
+// Diff compares two commits of a dot, or a commit and a branch's uncommitted
+// changes, on the masters of the filesystems involved.
 func (d *DotmeshRPC) Diff(r *http.Request, q *types.RPCDiffRequest, result *types.RPCDiffResponse) error {
+	filesystemID := q.FilesystemID
+	if filesystemID == "" {
+		err := validator.IsValidVolume(q.Namespace, q.Name)
+		if err != nil {
+			return err
+		}
+		err = validator.IsValidBranchName(q.Branch)
+		if err != nil {
+			return err
+		}
+		filesystemID, err = d.state.registry.MaybeCloneFilesystemId(
+			VolumeName{Namespace: q.Namespace, Name: q.Name}, q.Branch,
+		)
+		if err != nil {
+			return err
+		}
+	}
 
-	diffFiles, err := d.state.zfs.Diff(q.FilesystemID)
+	if q.Offset < 0 || q.Limit < 0 {
+		return fmt.Errorf("Offset and Limit can't be negative")
+	}
+	diff, err := d.state.diffRefs(filesystemID, q.From, q.To, q.DiffOptions)
 	if err != nil {
 		return fmt.Errorf("diff failed: %s", err)
 	}
 
-	*result = types.RPCDiffResponse{
-		Files: diffFiles,
-	}
+	*result = *diff
 	return nil
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/dotmesh-io/dotmesh/pkg/auth"
+	"github.com/dotmesh-io/dotmesh/pkg/user"
+)
+
+func TestTransfers(t *testing.T) {
+	s := newBranchesState(t)
+	s.interclusterTransfersLock = &sync.RWMutex{}
+	s.interclusterTransfers = map[string]TransferPollResult{
+		"push-master":     {TransferRequestId: "push-master", FilesystemId: "dot-1", Status: "running", ApiKey: "secret"},
+		"push-feature":    {TransferRequestId: "push-feature", FilesystemId: "clone-feature", Status: "queued"},
+		"pull-origin":     {TransferRequestId: "pull-origin", FilesystemId: "dot-2", InitiatorFilesystemId: "clone-other", Status: "starting"},
+		"push-upstream":   {TransferRequestId: "push-upstream", FilesystemId: "dot-2", Status: "running"},
+		"push-finished":   {TransferRequestId: "push-finished", FilesystemId: "dot-1", Status: "finished"},
+		"push-failed":     {TransferRequestId: "push-failed", FilesystemId: "dot-1", Status: "error"},
+		"push-cancelled":  {TransferRequestId: "push-cancelled", FilesystemId: "clone-feature", Status: "cancelled"},
+		"push-other-dots": {TransferRequestId: "push-other-dots", FilesystemId: "dot-3", Status: "running"},
+	}
+	d := NewDotmeshRPC(s, nil)
+
+	var result []TransferPollResult
+	err := d.Transfers(nil, &VolumeName{Namespace: "admin", Name: "dot"}, &result)
+	if err != nil {
+		t.Fatalf("Transfers() failed: %s", err)
+	}
+	ids := []string{}
+	for _, transfer := range result {
+		ids = append(ids, transfer.TransferRequestId)
+		if transfer.ApiKey != "" {
+			t.Errorf("expected %s's API key to be left out", transfer.TransferRequestId)
+		}
+	}
+	// the running transfers of the dot's master and branches, including one
+	// which a branch started from another dot, by id
+	want := []string{"pull-origin", "push-feature", "push-master"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("Transfers() = %v, want %v", ids, want)
+	}
+
+	err = d.Transfers(nil, &VolumeName{Namespace: "admin", Name: "missing"}, &result)
+	if err == nil {
+		t.Errorf("expected listing the transfers of a missing dot to fail")
+	}
+}
+
+func TestAuthorizeTransfer(t *testing.T) {
+	s := newBranchesState(t)
+	d := NewDotmeshRPC(s, nil)
+	tlf, err := s.registry.LookupFilesystem(VolumeName{Namespace: "admin", Name: "dot"})
+	if err != nil {
+		t.Fatalf("failed to look up dot: %s", err)
+	}
+
+	tests := []struct {
+		name       string
+		userId     string
+		transfer   TransferPollResult
+		authorized bool
+	}{
+		{
+			name:       "the owner",
+			userId:     tlf.Owner.Id,
+			transfer:   TransferPollResult{TransferRequestId: "t", FilesystemId: "clone-feature"},
+			authorized: true,
+		},
+		{
+			name:   "the owner, of a push to another cluster's dot",
+			userId: tlf.Owner.Id,
+			transfer: TransferPollResult{
+				TransferRequestId: "t", FilesystemId: "elsewhere", InitiatorFilesystemId: "dot-1",
+			},
+			authorized: true,
+		},
+		{
+			name:       "the admin, of a dot that's gone",
+			userId:     ADMIN_USER_UUID,
+			transfer:   TransferPollResult{TransferRequestId: "t", FilesystemId: "gone"},
+			authorized: true,
+		},
+		{
+			name:       "another user",
+			userId:     "someone-else",
+			transfer:   TransferPollResult{TransferRequestId: "t", FilesystemId: "clone-feature"},
+			authorized: false,
+		},
+		{
+			name:       "the owner, of a transfer of a dot it can't find",
+			userId:     tlf.Owner.Id,
+			transfer:   TransferPollResult{TransferRequestId: "t", FilesystemId: "gone"},
+			authorized: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := auth.SetAuthenticationDetails(
+				httptest.NewRequest("POST", "/rpc", nil),
+				&user.User{Id: tt.userId}, user.AuthenticationTypeAPIKey,
+			)
+			err := d.authorizeTransfer(r, tt.transfer)
+			if tt.authorized && err != nil {
+				t.Errorf("expected to be authorized, got %s", err)
+			}
+			if !tt.authorized && err == nil {
+				t.Errorf("expected not to be authorized")
+			}
+		})
+	}
+}
+
+func TestValidateMetadata(t *testing.T) {
+	tests := []struct {
+		name  string
+		meta  map[string]string
+		valid bool
+	}{
+		{name: "none", meta: nil, valid: true},
+		{name: "lowercase names", meta: map[string]string{"ticket": "DM-1", "reviewed-by": "alice"}, valid: true},
+		{name: "an uppercase name", meta: map[string]string{"Ticket": "DM-1"}, valid: false},
+		{name: "a name starting with a digit", meta: map[string]string{"1st": "x"}, valid: false},
+		{name: "an empty name", meta: map[string]string{"": "x"}, valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMetadata(tt.meta)
+			if tt.valid && err != nil {
+				t.Errorf("expected %v to be valid, got %s", tt.meta, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("expected %v to be rejected", tt.meta)
+			}
+		})
+	}
+}
@@ -217,7 +217,7 @@ func (s *S3Handler) mountFilesystemSnapshot(filesystemId string, snapshotId stri
 	lastSnapshot := snapshots[len(snapshots)-1]
 	mountSnapshotId := lastSnapshot.Id
 	if snapshotId != "" && snapshotId != "latest" {
-		mountSnapshotId = snapshotId
+		mountSnapshotId = s.state.resolveCommitRef(filesystemId, snapshotId)
 	}
 	responseChan, err := s.state.globalFsRequest(
 		filesystemId,
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/pkg/registry"
+	"github.com/dotmesh-io/dotmesh/pkg/schedule"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+
+	"github.com/jonboulle/clockwork"
+	log "github.com/sirupsen/logrus"
+)
+
+// how often each node checks whether any of the filesystems it's the master
+// of are due a scheduled commit; cron expressions are to the minute
+const scheduleInterval = time.Minute
+
+const defaultScheduleMessage = "Scheduled commit"
+
+// the author of scheduled commits
+const scheduleAuthor = "dotmesh"
+
+// scheduleMessageData is what a commit schedule's message template is given.
+type scheduleMessageData struct {
+	Dot    string
+	Branch string
+	Time   time.Time
+}
+
+// checkCommitSchedule checks a schedule's cron expression, message template
+// and metadata before it's stored.
+func checkCommitSchedule(cs types.CommitSchedule) error {
+	_, err := schedule.Parse(cs.Cron)
+	if err != nil {
+		return err
+	}
+	_, err = scheduleMessage(cs, scheduleMessageData{Dot: "dot", Branch: DEFAULT_BRANCH, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	return validateMetadata(cs.Metadata)
+}
+
+func scheduleMessage(cs types.CommitSchedule, data scheduleMessageData) (string, error) {
+	if cs.Message == "" {
+		return defaultScheduleMessage, nil
+	}
+	tmpl, err := template.New("message").Parse(cs.Message)
+	if err != nil {
+		return "", fmt.Errorf("bad commit message template: %s", err)
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("bad commit message template: %s", err)
+	}
+	return buf.String(), nil
+}
+
+// commitSchedules returns the stored schedules, keyed by filesystem id then
+// branch ("" for the whole dot).
+func (s *InMemoryState) commitSchedules() (map[string]map[string]types.CommitSchedule, error) {
+	schedules, err := s.registryStore.ListCommitSchedules()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]map[string]types.CommitSchedule{}
+	for _, cs := range schedules {
+		if _, ok := result[cs.FilesystemId]; !ok {
+			result[cs.FilesystemId] = map[string]types.CommitSchedule{}
+		}
+		result[cs.FilesystemId][cs.Branch] = *cs
+	}
+	return result, nil
+}
+
+// commitScheduleFor returns the schedule which applies to a filesystem: its
+// branch's own, or otherwise its dot's. ok is false if there's neither.
+func (s *InMemoryState) commitScheduleFor(
+	schedules map[string]map[string]types.CommitSchedule, filesystemId string,
+) (cs types.CommitSchedule, ok bool) {
+	tlf, cloneName, err := s.registry.LookupFilesystemById(filesystemId)
+	if err != nil {
+		return types.CommitSchedule{}, false
+	}
+	branch := cloneName
+	if branch == "" {
+		branch = DEFAULT_BRANCH
+	}
+	dotSchedules := schedules[tlf.MasterBranch.Id]
+	if cs, ok = dotSchedules[branch]; ok {
+		return cs, true
+	}
+	cs, ok = dotSchedules[""]
+	return cs, ok
+}
+
+// scheduleState is what the commit scheduler needs of the node it runs on;
+// InMemoryState is one.
+type scheduleState interface {
+	NodeID() string
+	commitSchedules() (map[string]map[string]types.CommitSchedule, error)
+	commitScheduleFor(schedules map[string]map[string]types.CommitSchedule, filesystemId string) (types.CommitSchedule, bool)
+	uncommittedChanges(filesystemId string) (bool, error)
+	scheduledCommit(filesystemId string, cs types.CommitSchedule, due time.Time) error
+}
+
+// commitScheduler makes the scheduled commits of the filesystems this node is
+// the master of. Schedules are kept in the registry rather than with the
+// filesystem, and mastership is checked on every run, so when a branch moves
+// to another node its schedule moves with it.
+type commitScheduler struct {
+	state    scheduleState
+	registry registry.Registry
+	clock    clockwork.Clock
+	// when the scheduler last ran; commits due since then are made on the
+	// next run
+	last time.Time
+}
+
+func newCommitScheduler(s *InMemoryState) *commitScheduler {
+	return newCommitSchedulerWithClock(s, s.registry, clockwork.NewRealClock())
+}
+
+func newCommitSchedulerWithClock(s scheduleState, r registry.Registry, clock clockwork.Clock) *commitScheduler {
+	// cron expressions are in UTC, whatever the node's local time zone
+	return &commitScheduler{state: s, registry: r, clock: clock, last: clock.Now().UTC()}
+}
+
+func (c *commitScheduler) run() error {
+	now := c.clock.Now().UTC()
+	since := c.last
+	c.last = now
+
+	schedules, err := c.state.commitSchedules()
+	if err != nil {
+		return err
+	}
+	if len(schedules) == 0 {
+		return nil
+	}
+	for _, filesystemId := range c.registry.FilesystemIdsIncludingClones() {
+		master, ok := c.registry.GetMasterNode(filesystemId)
+		if !ok || master != c.state.NodeID() {
+			continue
+		}
+		cs, ok := c.state.commitScheduleFor(schedules, filesystemId)
+		if !ok {
+			continue
+		}
+		sched, err := schedule.Parse(cs.Cron)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":         err,
+				"filesystem_id": filesystemId,
+			}).Error("[commitScheduler] bad commit schedule")
+			continue
+		}
+		next := sched.Next(since)
+		if next.IsZero() || next.After(now) {
+			continue
+		}
+		changed, err := c.state.uncommittedChanges(filesystemId)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":         err,
+				"filesystem_id": filesystemId,
+			}).Error("[commitScheduler] failed to check for changes")
+			continue
+		}
+		if !changed {
+			log.WithFields(log.Fields{
+				"filesystem_id": filesystemId,
+			}).Debug("[commitScheduler] no changes, skipping scheduled commit")
+			continue
+		}
+		err = c.state.scheduledCommit(filesystemId, cs, next)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":         err,
+				"filesystem_id": filesystemId,
+			}).Error("[commitScheduler] failed to make scheduled commit")
+		}
+	}
+	return nil
+}
+
+// uncommittedChanges reports whether a filesystem has changed since its latest
+// commit. One with no commits yet has.
+func (s *InMemoryState) uncommittedChanges(filesystemId string) (bool, error) {
+	snapshots, err := s.SnapshotsFor(s.NodeID(), filesystemId)
+	if err != nil {
+		return false, err
+	}
+	if len(snapshots) == 0 {
+		return true, nil
+	}
+	dirty, _, err := s.zfs.GetDirtyDelta(filesystemId, snapshots[len(snapshots)-1].Id)
+	if err != nil {
+		return false, err
+	}
+	return dirty != 0, nil
+}
+
+// scheduledCommit commits a filesystem by its schedule.
+func (s *InMemoryState) scheduledCommit(filesystemId string, cs types.CommitSchedule, due time.Time) error {
+	tlf, cloneName, err := s.registry.LookupFilesystemById(filesystemId)
+	if err != nil {
+		return err
+	}
+	branch := cloneName
+	if branch == "" {
+		branch = DEFAULT_BRANCH
+	}
+	message, err := scheduleMessage(cs, scheduleMessageData{
+		Dot:    tlf.MasterBranch.Name.String(),
+		Branch: branch,
+		Time:   due,
+	})
+	if err != nil {
+		return err
+	}
+	meta := map[string]string{}
+	for name, value := range cs.Metadata {
+		meta[name] = value
+	}
+	meta["message"] = message
+	meta["author"] = scheduleAuthor
+	meta["schedule"] = cs.Cron
+
+	responseChan, err := s.globalFsRequest(
+		filesystemId,
+		&Event{Name: "snapshot",
+			Args: &EventArgs{"metadata": meta}},
+	)
+	if err != nil {
+		return err
+	}
+	e := <-responseChan
+	if e.Name != "snapshotted" {
+		return maybeError(e, "snapshotted")
+	}
+	log.WithFields(log.Fields{
+		"filesystem_id": filesystemId,
+		"snapshot_id":   (*e.Args)["SnapshotId"],
+		"message":       message,
+	}).Info("[scheduledCommit] made scheduled commit")
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/pkg/registry"
+	"github.com/dotmesh-io/dotmesh/pkg/store"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/dotmesh-io/dotmesh/pkg/user"
+
+	"github.com/jonboulle/clockwork"
+)
+
+// fakeScheduleState schedules every filesystem hourly and records the
+// scheduled commits it's asked to make.
+type fakeScheduleState struct {
+	nodeID string
+	// filesystems with nothing to commit
+	clean   map[string]bool
+	commits []string
+}
+
+func (f *fakeScheduleState) NodeID() string {
+	return f.nodeID
+}
+
+func (f *fakeScheduleState) commitSchedules() (map[string]map[string]types.CommitSchedule, error) {
+	return map[string]map[string]types.CommitSchedule{
+		"fs-1": {"": types.CommitSchedule{FilesystemId: "fs-1", Cron: "@hourly"}},
+	}, nil
+}
+
+func (f *fakeScheduleState) commitScheduleFor(
+	schedules map[string]map[string]types.CommitSchedule, filesystemId string,
+) (types.CommitSchedule, bool) {
+	cs, ok := schedules[filesystemId][""]
+	return cs, ok
+}
+
+func (f *fakeScheduleState) uncommittedChanges(filesystemId string) (bool, error) {
+	return !f.clean[filesystemId], nil
+}
+
+func (f *fakeScheduleState) scheduledCommit(filesystemId string, cs types.CommitSchedule, due time.Time) error {
+	f.commits = append(f.commits, filesystemId)
+	return nil
+}
+
+func newScheduleRegistry(t *testing.T) registry.Registry {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	um := user.New(store.NewKVDBStoreWithIndex(client, "users"))
+	owner, err := um.New("foo", "foo@bar.pub", "verysecret")
+	if err != nil {
+		t.Fatalf("failed to create new user: %s", err)
+	}
+	r := registry.NewRegistry(um, store.NewKVDBFilesystemStore(client))
+	err = r.UpdateFilesystemFromEtcd(types.VolumeName{
+		Namespace: "admin",
+		Name:      "dot",
+	}, types.RegistryFilesystem{
+		Id:      "fs-1",
+		OwnerId: owner.Id,
+	})
+	if err != nil {
+		t.Fatalf("failed to update filesystem from etcd: %s", err)
+	}
+	return r
+}
+
+func TestCommitSchedulerOnlyCommitsOnTheMaster(t *testing.T) {
+	r := newScheduleRegistry(t)
+	r.SetMasterNode("fs-1", "node-1")
+	clock := clockwork.NewFakeClockAt(time.Date(2018, 1, 1, 10, 30, 0, 0, time.UTC))
+
+	master := &fakeScheduleState{nodeID: "node-1"}
+	slave := &fakeScheduleState{nodeID: "node-2"}
+	masterScheduler := newCommitSchedulerWithClock(master, r, clock)
+	slaveScheduler := newCommitSchedulerWithClock(slave, r, clock)
+
+	clock.Advance(time.Hour)
+	masterScheduler.run()
+	slaveScheduler.run()
+
+	if len(master.commits) != 1 {
+		t.Errorf("expected the master to make 1 scheduled commit, made %d", len(master.commits))
+	}
+	if len(slave.commits) != 0 {
+		t.Errorf("expected the slave to make no scheduled commits, made %d", len(slave.commits))
+	}
+}
+
+func TestCommitSchedulerSkipsUnchangedFilesystems(t *testing.T) {
+	r := newScheduleRegistry(t)
+	r.SetMasterNode("fs-1", "node-1")
+	clock := clockwork.NewFakeClockAt(time.Date(2018, 1, 1, 10, 30, 0, 0, time.UTC))
+
+	state := &fakeScheduleState{nodeID: "node-1", clean: map[string]bool{"fs-1": true}}
+	scheduler := newCommitSchedulerWithClock(state, r, clock)
+
+	clock.Advance(time.Hour)
+	scheduler.run()
+	if len(state.commits) != 0 {
+		t.Fatalf("expected no scheduled commits of an unchanged filesystem, made %d", len(state.commits))
+	}
+
+	state.clean = nil
+	clock.Advance(time.Hour)
+	scheduler.run()
+	if len(state.commits) != 1 {
+		t.Errorf("expected 1 scheduled commit once the filesystem changed, made %d", len(state.commits))
+	}
+}
+
+func TestCommitSchedulerFollowsTheMaster(t *testing.T) {
+	r := newScheduleRegistry(t)
+	r.SetMasterNode("fs-1", "node-1")
+	clock := clockwork.NewFakeClockAt(time.Date(2018, 1, 1, 10, 30, 0, 0, time.UTC))
+
+	first := &fakeScheduleState{nodeID: "node-1"}
+	second := &fakeScheduleState{nodeID: "node-2"}
+	firstScheduler := newCommitSchedulerWithClock(first, r, clock)
+	secondScheduler := newCommitSchedulerWithClock(second, r, clock)
+
+	clock.Advance(time.Hour)
+	firstScheduler.run()
+	secondScheduler.run()
+
+	r.SetMasterNode("fs-1", "node-2")
+	clock.Advance(time.Hour)
+	firstScheduler.run()
+	secondScheduler.run()
+
+	if len(first.commits) != 1 {
+		t.Errorf("expected the first master to make 1 scheduled commit, made %d", len(first.commits))
+	}
+	if len(second.commits) != 1 {
+		t.Errorf("expected the new master to make 1 scheduled commit, made %d", len(second.commits))
+	}
+}
+
+func TestCheckCommitScheduleRejectsEmptyMetadataNames(t *testing.T) {
+	err := checkCommitSchedule(types.CommitSchedule{
+		Cron:     "@hourly",
+		Metadata: map[string]string{"": "value"},
+	})
+	if err == nil {
+		t.Errorf("expected a schedule with an empty metadata field name to be rejected")
+	}
+}
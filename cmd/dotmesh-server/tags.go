@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/pkg/store"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resolveCommitRef turns the name of one of the tags of a filesystem's dot
+// into the commit id it tags. Anything else is returned as it is, to be
+// treated as a commit id.
+func (s *InMemoryState) resolveCommitRef(filesystemId, ref string) string {
+	if ref == "" {
+		return ref
+	}
+	tlf, _, err := s.registry.LookupFilesystemById(filesystemId)
+	if err != nil {
+		return ref
+	}
+	tag, err := s.registryStore.GetTag(tlf.MasterBranch.Id, ref)
+	if err != nil {
+		return ref
+	}
+	return tag.SnapshotId
+}
+
+// checkBranchNameIsNotATag refuses a new name for one of a dot's branches
+// which is already the name of one of its tags, as refs are looked up as
+// branch names first and the branch would hide the tag.
+func (s *InMemoryState) checkBranchNameIsNotATag(topLevelFilesystemId, name string) error {
+	_, err := s.registryStore.GetTag(topLevelFilesystemId, name)
+	if err == nil {
+		return fmt.Errorf("There's already a tag called %s, please choose another name for the branch.", name)
+	}
+	if store.IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// importTags adds tags which came from another cluster with a dot's commits
+// to the dot with the given top level filesystem id. Tags of commits the dot
+// doesn't have are skipped, and so are tags it already has, since tags don't
+// move. It returns how many were added.
+func (s *InMemoryState) importTags(topLevelFilesystemId string, tags []types.Tag) (int, error) {
+	imported := 0
+	for _, tag := range tags {
+		if _, err := s.resolveDiffRef(topLevelFilesystemId, tag.SnapshotId); err != nil {
+			continue
+		}
+		existing, err := s.registryStore.GetTag(topLevelFilesystemId, tag.Name)
+		if err == nil {
+			if existing.SnapshotId != tag.SnapshotId {
+				log.Printf(
+					"[importTags] not moving tag %s of %s from %s to %s",
+					tag.Name, topLevelFilesystemId, existing.SnapshotId, tag.SnapshotId,
+				)
+			}
+			continue
+		}
+		tag.Meta = nil
+		tag.FilesystemId = topLevelFilesystemId
+		if tag.Created.IsZero() {
+			tag.Created = time.Now()
+		}
+		err = s.registryStore.SetTag(&tag, &store.SetOptions{})
+		if store.IsKeyAlreadyExist(err) {
+			continue
+		}
+		if err != nil {
+			return imported, err
+		}
+		imported++
+	}
+	return imported, nil
+}
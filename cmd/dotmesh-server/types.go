@@ -99,9 +99,22 @@ type Config struct {
 	ZPoolPath   string
 	PoolName    string
 
+	// FilesystemBackend is either types.FilesystemBackendZFS or
+	// types.FilesystemBackendDir, DirBackendRoot is only used by the latter
+	FilesystemBackend string
+	DirBackendRoot    string
+
 	// API/RPC server port
 	APIServerPort string
 
+	// TransferRateLimit caps the bytes per second of all replication streams
+	// to and from this node put together, 0 for no limit
+	TransferRateLimit int64
+
+	// MaxConcurrentTransfers is how many transfers this node runs at once,
+	// queueing the rest, 0 for no limit
+	MaxConcurrentTransfers int
+
 	NatsConfig *nats.Config
 }
 
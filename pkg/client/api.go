@@ -50,6 +50,7 @@ type Dotmesh interface {
 	CommitsById(dotID string) ([]types.Snapshot, error)
 	Diff(namespace, name string) ([]types.ZFSFileDiff, error)
 	DiffFromCommit(namespace, name, commitID string) ([]types.ZFSFileDiff, error)
+	DiffCommits(request types.RPCDiffRequest) (*types.RPCDiffResponse, error)
 	LastModified(namespace, name string) (*types.LastModified, error)
 	GetFsId(namespace, name, branch string) (string, error)
 	Get(fsId string) (types.DotmeshVolume, error)
@@ -266,6 +267,14 @@ func (dm *DotmeshAPI) setCurrentBranch(volumeName, branchName string) error {
 }
 
 func (dm *DotmeshAPI) CreateBranch(volumeName, sourceBranch, newBranch string) error {
+	return dm.CreateBranchFromCommit(volumeName, sourceBranch, "HEAD", newBranch)
+}
+
+// CreateBranchFromCommit makes a new branch starting at a commit, which can be
+// given as any ref that findCommit understands, relative to sourceBranch, or
+// as the name of a branch for its latest commit. The commit doesn't have to
+// be on sourceBranch: it can be on any branch of the volume.
+func (dm *DotmeshAPI) CreateBranchFromCommit(volumeName, sourceBranch, ref, newBranch string) error {
 	var result bool
 
 	namespace, name, err := ParseNamespacedVolume(volumeName)
@@ -273,7 +282,7 @@ func (dm *DotmeshAPI) CreateBranch(volumeName, sourceBranch, newBranch string) e
 		return err
 	}
 
-	commitId, err := dm.findCommit("HEAD", volumeName, sourceBranch)
+	commitId, err := dm.findCommit(ref, volumeName, sourceBranch)
 	if err != nil {
 		return err
 	}
@@ -283,7 +292,7 @@ func (dm *DotmeshAPI) CreateBranch(volumeName, sourceBranch, newBranch string) e
 		"DotmeshRPC.Branch",
 		struct {
 			// Create a named clone from a given volume+branch pair at a given
-			// commit (that branch's latest commit)
+			// commit, which the server looks for on the other branches too
 			Namespace, Name, SourceBranch, NewBranchName, SourceCommitId string
 		}{
 			Namespace:      namespace,
@@ -301,7 +310,61 @@ func (dm *DotmeshAPI) CreateBranch(volumeName, sourceBranch, newBranch string) e
 	*/
 }
 
+// DeleteBranch deletes a branch of a dot. Branches cloned from it are kept.
+func (dm *DotmeshAPI) DeleteBranch(volumeName, branchName string) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	var result bool
+	return dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.DeleteBranch",
+		struct{ Namespace, Name, Branch string }{
+			Namespace: namespace,
+			Name:      name,
+			Branch:    branchName,
+		},
+		&result,
+	)
+}
+
+// RenameBranch renames a branch of a volume, and updates the local
+// configuration to follow it.
+func (dm *DotmeshAPI) RenameBranch(volumeName, oldName, newName string) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	var result bool
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.RenameBranch",
+		struct{ Namespace, Name, Branch, NewBranchName string }{
+			Namespace:     namespace,
+			Name:          name,
+			Branch:        oldName,
+			NewBranchName: newName,
+		},
+		&result,
+	)
+	if err != nil {
+		return err
+	}
+	return dm.Configuration.RenameBranchFor(volumeName, oldName, newName)
+}
+
 func (dm *DotmeshAPI) CheckoutBranch(volumeName, from, to string, create bool) error {
+	return dm.checkoutBranch(volumeName, from, "HEAD", to, create)
+}
+
+// CheckoutNewBranchFromCommit makes a new branch starting at a commit, as
+// CreateBranchFromCommit does, and switches to it.
+func (dm *DotmeshAPI) CheckoutNewBranchFromCommit(volumeName, from, ref, to string) error {
+	return dm.checkoutBranch(volumeName, from, ref, to, true)
+}
+
+func (dm *DotmeshAPI) checkoutBranch(volumeName, from, ref, to string, create bool) error {
 	namespace, name, err := ParseNamespacedVolume(volumeName)
 	if err != nil {
 		return err
@@ -317,7 +380,7 @@ func (dm *DotmeshAPI) CheckoutBranch(volumeName, from, to string, create bool) e
 		if exists {
 			return fmt.Errorf("Branch already exists: %s", to)
 		}
-		if err := dm.CreateBranch(volumeName, from, to); err != nil {
+		if err := dm.CreateBranchFromCommit(volumeName, from, ref, to); err != nil {
 			return err
 		}
 	}
@@ -624,6 +687,33 @@ func deMasterify(s string) string {
 	return s
 }
 
+// ParseRate parses a transfer rate limit in bytes per second, which may have
+// a K, M or G suffix for KiB, MiB or GiB per second (eg "512K" or "10M"). An
+// empty rate is 0, meaning no limit.
+func ParseRate(rate string) (int64, error) {
+	if rate == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch strings.ToUpper(rate[len(rate)-1:]) {
+	case "K":
+		multiplier = 1024
+	case "M":
+		multiplier = 1024 * 1024
+	case "G":
+		multiplier = 1024 * 1024 * 1024
+	}
+	number := rate
+	if multiplier != 1 {
+		number = rate[:len(rate)-1]
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q, expected a number of bytes per second optionally followed by K, M or G", rate)
+	}
+	return n * multiplier, nil
+}
+
 type CommitArgs struct {
 	Namespace string
 	Name      string
@@ -692,6 +782,10 @@ func (dm *DotmeshAPI) CommitsById(dotID string) ([]types.Snapshot, error) {
 	return commits, err
 }
 
+// findCommit turns a ref into a commit id: HEAD, HEAD^ and so on are the
+// latest commits of the branch, and a tag is the commit it tags. Anything else
+// is taken to be a commit id already, as it is when the tags can't be listed,
+// such as from a server too old to have them.
 func (dm *DotmeshAPI) findCommit(ref, volumeName, branchName string) (string, error) {
 	hatRegex := regexp.MustCompile(`^HEAD\^*$`)
 	if hatRegex.MatchString(ref) {
@@ -708,9 +802,17 @@ func (dm *DotmeshAPI) findCommit(ref, volumeName, branchName string) (string, er
 			return "", fmt.Errorf("Commits don't go back that far")
 		}
 		return cs[i].Id, nil
-	} else {
+	}
+	tags, err := dm.ListTags(volumeName)
+	if err != nil {
 		return ref, nil
 	}
+	for _, tag := range tags {
+		if tag.Name == ref {
+			return tag.SnapshotId, nil
+		}
+	}
+	return ref, nil
 }
 
 func (dm *DotmeshAPI) ResetCurrentVolume(commit string) error {
@@ -754,6 +856,320 @@ func (dm *DotmeshAPI) ResetCurrentVolume(commit string) error {
 	return nil
 }
 
+// Revert makes a new commit on a branch with the contents of an earlier one,
+// which can be given as any ref that findCommit understands, keeping the
+// commits in between. It returns the new commit's id.
+func (dm *DotmeshAPI) Revert(volumeName, branchName, ref, message string) (string, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return "", err
+	}
+	commitId, err := dm.findCommit(ref, volumeName, branchName)
+	if err != nil {
+		return "", err
+	}
+	var result string
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.Revert",
+		types.RevertRequest{
+			Namespace:  namespace,
+			Name:       name,
+			Branch:     deMasterify(branchName),
+			SnapshotId: commitId,
+			Message:    message,
+		},
+		&result,
+	)
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// Restore puts the given paths of a branch back as they were in an earlier
+// commit, which can be given as any ref that findCommit understands. If
+// commit is set, it commits the result and returns the new commit's id.
+func (dm *DotmeshAPI) Restore(volumeName, branchName, ref string, paths []string, commit bool, message string) (string, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return "", err
+	}
+	commitId, err := dm.findCommit(ref, volumeName, branchName)
+	if err != nil {
+		return "", err
+	}
+	var result string
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.Restore",
+		types.RestoreRequest{
+			Namespace:  namespace,
+			Name:       name,
+			Branch:     deMasterify(branchName),
+			SnapshotId: commitId,
+			Paths:      paths,
+			Commit:     commit,
+			Message:    message,
+		},
+		&result,
+	)
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// Merge applies the changes made on sourceBranch, since it last had a commit
+// in common with branchName, to branchName and commits them there. Paths
+// changed on both are left alone and reported as conflicts.
+func (dm *DotmeshAPI) Merge(volumeName, branchName, sourceBranch, message string) (types.MergeResult, error) {
+	var result types.MergeResult
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return result, err
+	}
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.Merge",
+		types.MergeRequest{
+			Namespace:    namespace,
+			Name:         name,
+			Branch:       deMasterify(branchName),
+			SourceBranch: deMasterify(sourceBranch),
+			Message:      message,
+		},
+		&result,
+	)
+	return result, err
+}
+
+// CherryPick applies the changes the commit ref made to branchName, and
+// commits them there. ref may be a commit on any branch of the dot, a tag, or
+// a branch name for that branch's latest commit.
+func (dm *DotmeshAPI) CherryPick(volumeName, branchName, ref, message string) (types.MergeResult, error) {
+	var result types.MergeResult
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return result, err
+	}
+	commitId, err := dm.findCommit(ref, volumeName, branchName)
+	if err != nil {
+		return result, err
+	}
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.CherryPick",
+		types.CherryPickRequest{
+			Namespace: namespace,
+			Name:      name,
+			Branch:    deMasterify(branchName),
+			Commit:    commitId,
+			Message:   message,
+		},
+		&result,
+	)
+	return result, err
+}
+
+// DeleteCommit deletes one commit of a branch, which can be given as any
+// ref that findCommit understands.
+func (dm *DotmeshAPI) DeleteCommit(volumeName, branchName, ref string) (string, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return "", err
+	}
+	commitId, err := dm.findCommit(ref, volumeName, branchName)
+	if err != nil {
+		return "", err
+	}
+	var result bool
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.DeleteCommit",
+		map[string]string{
+			"Namespace":  namespace,
+			"Name":       name,
+			"Branch":     deMasterify(branchName),
+			"SnapshotId": commitId,
+		},
+		&result,
+	)
+	if err != nil {
+		return "", err
+	}
+	return commitId, nil
+}
+
+// Tag tags a commit of a volume, which can be given as any ref that
+// findCommit understands, or as the name of a branch for its latest commit.
+func (dm *DotmeshAPI) Tag(volumeName, branchName, tagName, ref string) (types.Tag, error) {
+	var result types.Tag
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return result, err
+	}
+	if strings.HasPrefix(ref, "HEAD") {
+		ref, err = dm.findCommit(ref, volumeName, branchName)
+		if err != nil {
+			return result, err
+		}
+	}
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.Tag",
+		types.TagRequest{
+			Namespace: namespace,
+			Name:      name,
+			Branch:    deMasterify(branchName),
+			Tag:       tagName,
+			Commit:    ref,
+		},
+		&result,
+	)
+	return result, err
+}
+
+func (dm *DotmeshAPI) DeleteTag(volumeName, tagName string) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	var result bool
+	return dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.DeleteTag",
+		struct{ Namespace, Name, Tag string }{
+			Namespace: namespace,
+			Name:      name,
+			Tag:       tagName,
+		},
+		&result,
+	)
+}
+
+// ListTags returns the tags of a volume, sorted by name.
+func (dm *DotmeshAPI) ListTags(volumeName string) ([]types.Tag, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	var result []types.Tag
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.Tags",
+		types.VolumeName{Namespace: namespace, Name: name},
+		&result,
+	)
+	return result, err
+}
+
+// ListStashes returns the stash branches of a volume, newest first.
+func (dm *DotmeshAPI) ListStashes(volumeName string) ([]types.Stash, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	var result []types.Stash
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.Stashes",
+		types.VolumeName{Namespace: namespace, Name: name},
+		&result,
+	)
+	return result, err
+}
+
+// GetStash returns one of the stash branches of a volume, by name.
+func (dm *DotmeshAPI) GetStash(volumeName, stashName string) (types.Stash, error) {
+	stashes, err := dm.ListStashes(volumeName)
+	if err != nil {
+		return types.Stash{}, err
+	}
+	for _, stash := range stashes {
+		if stash.Name == stashName {
+			return stash, nil
+		}
+	}
+	return types.Stash{}, fmt.Errorf("No stash called %s, try 'dm stash list'.", stashName)
+}
+
+// ApplyStash makes a new commit on the branch a stash came from with the
+// contents of the stash's latest commit, and returns its id.
+func (dm *DotmeshAPI) ApplyStash(volumeName, stashName, message string) (string, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return "", err
+	}
+	var result string
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.ApplyStash",
+		types.ApplyStashRequest{
+			Namespace: namespace,
+			Name:      name,
+			Stash:     stashName,
+			Message:   message,
+		},
+		&result,
+	)
+	return result, err
+}
+
+// DropStash deletes a stash branch, refusing to delete branches that aren't
+// stashes.
+func (dm *DotmeshAPI) DropStash(volumeName, stashName string) error {
+	_, err := dm.GetStash(volumeName, stashName)
+	if err != nil {
+		return err
+	}
+	return dm.DeleteBranch(volumeName, stashName)
+}
+
+// SetRetentionPolicy stores request.Policy as the retention policy for the
+// branch or dot in the request, or removes the policy if it's empty.
+func (dm *DotmeshAPI) SetRetentionPolicy(request types.RetentionPolicyRequest) error {
+	request.Branch = deMasterify(request.Branch)
+	var result bool
+	return dm.CallRemote(context.Background(), "DotmeshRPC.SetRetentionPolicy", request, &result)
+}
+
+// GetRetentionPolicy returns the retention policy which applies to the branch
+// or dot in the request.
+func (dm *DotmeshAPI) GetRetentionPolicy(request types.RetentionPolicyRequest) (types.RetentionPolicy, error) {
+	request.Branch = deMasterify(request.Branch)
+	var result types.RetentionPolicy
+	err := dm.CallRemote(context.Background(), "DotmeshRPC.GetRetentionPolicy", request, &result)
+	return result, err
+}
+
+// RetentionDryRun returns the commits of the branch in the request that
+// request.Policy, or otherwise the stored policy, would prune.
+func (dm *DotmeshAPI) RetentionDryRun(request types.RetentionPolicyRequest) ([]types.PrunedCommit, error) {
+	request.Branch = deMasterify(request.Branch)
+	var result []types.PrunedCommit
+	err := dm.CallRemote(context.Background(), "DotmeshRPC.RetentionDryRun", request, &result)
+	return result, err
+}
+
+// SetCommitSchedule stores request.Schedule as the commit schedule for the
+// branch or dot in the request, or removes the schedule if it has no cron
+// expression.
+func (dm *DotmeshAPI) SetCommitSchedule(request types.CommitScheduleRequest) error {
+	request.Branch = deMasterify(request.Branch)
+	var result bool
+	return dm.CallRemote(context.Background(), "DotmeshRPC.SetCommitSchedule", request, &result)
+}
+
+// GetCommitSchedule returns the commit schedule which applies to the branch
+// or dot in the request.
+func (dm *DotmeshAPI) GetCommitSchedule(request types.CommitScheduleRequest) (types.CommitSchedule, error) {
+	request.Branch = deMasterify(request.Branch)
+	var result types.CommitSchedule
+	err := dm.CallRemote(context.Background(), "DotmeshRPC.GetCommitSchedule", request, &result)
+	return result, err
+}
+
 type Container struct {
 	Id   string
 	Name string
@@ -852,7 +1268,11 @@ func (dm *DotmeshAPI) UpdateBar(result TransferPollResult, err error, started bo
 	} else {
 		dm.PB.Set64(result.Sent)
 	}
-	dm.PB.Prefix(result.Status)
+	if result.Status == "queued" {
+		dm.PB.Prefix(fmt.Sprintf("queued (%d)", result.QueuePosition))
+	} else {
+		dm.PB.Prefix(result.Status)
+	}
 	var speed string
 	if result.NanosecondsElapsed > 0 {
 		speed = fmt.Sprintf(" %.2f MiB/s",
@@ -864,7 +1284,19 @@ func (dm *DotmeshAPI) UpdateBar(result TransferPollResult, err error, started bo
 		speed = " ? MiB/s"
 	}
 	quotient := fmt.Sprintf(" (%d/%d)", result.Index, result.Total)
-	dm.PB.Postfix(speed + quotient)
+	var saved string
+	if result.Saved > 0 {
+		saved = fmt.Sprintf(" resumed, %.2f MiB saved", float64(result.Saved)/(1024*1024))
+	}
+	var compressed string
+	if result.StreamEncoding != "" || result.CompressedStream {
+		compressed = fmt.Sprintf(" compressed, ~%.2f MiB on the wire", float64(result.WireSize)/(1024*1024))
+	}
+	var limited string
+	if result.LimitRate > 0 {
+		limited = fmt.Sprintf(" throttled to %.2f MiB/s", float64(result.LimitRate)/(1024*1024))
+	}
+	dm.PB.Postfix(speed + quotient + saved + compressed + limited)
 
 	if result.Index == result.Total && result.Status == "finished" {
 		if started {
@@ -876,6 +1308,11 @@ func (dm *DotmeshAPI) UpdateBar(result TransferPollResult, err error, started bo
 			dm.PB.FinishPrint(fmt.Sprintf("error: %s", result.Message))
 		}
 	}
+	if result.Status == "cancelled" {
+		if started {
+			dm.PB.FinishPrint("Cancelled.")
+		}
+	}
 	return started
 }
 
@@ -936,9 +1373,31 @@ func (dm *DotmeshAPI) PollTransfer(transferId string, out io.Writer, callback fu
 			time.Sleep(time.Second)
 			return fmt.Errorf(result.result.Message)
 		}
+		if result.result.Status == "cancelled" {
+			return fmt.Errorf("Transfer %s was cancelled", transferId)
+		}
 	}
 }
 
+// ReorderTransfer changes where a queued transfer is in its node's queue.
+func (dm *DotmeshAPI) ReorderTransfer(request types.TransferReorderRequest) error {
+	var result bool
+	ctx, cancel := context.WithTimeout(context.Background(), RPCTimeout)
+	defer cancel()
+	return dm.CallRemote(
+		ctx, "DotmeshRPC.ReorderTransfer", request, &result,
+	)
+}
+
+func (dm *DotmeshAPI) CancelTransfer(transferId string) error {
+	var result bool
+	ctx, cancel := context.WithTimeout(context.Background(), RPCTimeout)
+	defer cancel()
+	return dm.CallRemote(
+		ctx, "DotmeshRPC.CancelTransfer", transferId, &result,
+	)
+}
+
 /*
 
 pull
@@ -968,6 +1427,8 @@ func (dm *DotmeshAPI) RequestTransfer(
 	remoteFilesystemName, remoteBranchName string,
 	prefixes []string,
 	stashDivergence bool,
+	limitRate int64,
+	priority int,
 ) (string, error) {
 	connectionInitiator := dm.Configuration.CurrentRemote
 
@@ -987,82 +1448,27 @@ func (dm *DotmeshAPI) RequestTransfer(
 		return "", err
 	}
 
-	// Let's replace any missing things with defaults.
-	// The defaults depend on whether we're pushing or pulling.
-	if direction == "push" {
-		// We are pushing, so if no local filesystem/branch is
-		// specified, take the current one.
-		if localFilesystemName == "" {
-			localFilesystemName, err = dm.Configuration.CurrentVolume()
-			if err != nil {
-				return "", err
-			}
-		}
-
-		if localBranchName == "" {
-			localBranchName, err = dm.Configuration.CurrentBranch()
-			if err != nil {
-				return "", err
-			}
-		}
-	} else if direction == "pull" {
-		// We are pulling, so if no local filesystem/branch is
-		// specified, we take the remote name but strip it of its
-		// namespace. So if we pull "bob/apples", we pull into "apples",
-		// which is really "admin/apples".
-		if localFilesystemName == "" && remoteFilesystemName != "" {
-			_, localFilesystemName, err = ParseNamespacedVolume(remoteFilesystemName)
-			if err != nil {
-				return "", err
-			}
-		}
-	}
-
-	// Split the local volume name's namespace out
-	localNamespace, localVolume, err := ParseNamespacedVolume(localFilesystemName)
+	names, err := dm.transferNames(
+		direction, peer, remote,
+		localFilesystemName, localBranchName,
+		remoteFilesystemName, remoteBranchName,
+	)
 	if err != nil {
 		return "", err
 	}
-
-	// Guess defaults for the remote filesystem
-	var remoteNamespace, remoteVolume string
-	if remoteFilesystemName == "" {
-		// No remote specified. Do we already have a default configured?
-		defaultRemoteNamespace, defaultRemoteVolume, ok := dm.Configuration.DefaultRemoteVolumeFor(peer, localNamespace, localVolume)
-		if ok {
-			// If so, use it
-			remoteNamespace = defaultRemoteNamespace
-			remoteVolume = defaultRemoteVolume
-		} else {
-			// If not, default to the un-namespaced local filesystem name.
-			// This causes it to default into the user's own namespace
-			// when we parse the name, too.
-			remoteNamespace = remote.DefaultNamespace()
-			remoteVolume = localVolume
-		}
-	} else {
-		// Default namespace for remote volume is the username on this remote
-		remoteNamespace, remoteVolume, err = ParseNamespacedVolumeWithDefault(remoteFilesystemName, remote.DefaultNamespace())
-		if err != nil {
-			return "", err
-		}
-	}
+	localNamespace, localVolume, localBranchName := names.LocalNamespace, names.LocalName, names.LocalBranchName
+	remoteNamespace, remoteVolume, remoteBranchName := names.RemoteNamespace, names.RemoteName, names.RemoteBranchName
 
 	// Remember default remote if there isn't already one
 	_, _, ok := dm.Configuration.DefaultRemoteVolumeFor(peer, localNamespace, localVolume)
 	if !ok {
 		dm.Configuration.SetDefaultRemoteVolumeFor(peer, localNamespace, localVolume, remoteNamespace, remoteVolume)
 	}
-
-	if remoteBranchName == "" {
-		remoteBranchName = localBranchName
-	}
-
-	if remoteBranchName != "" && remoteVolume == "" {
-		return "", fmt.Errorf(
-			"It's dubious to specify a remote branch name " +
-				"without specifying a remote filesystem name.",
-		)
+	// and the upstream dot 'dm status' compares with, if there isn't one yet
+	if _, isDM := remote.(*DMRemote); isDM {
+		if _, ok := dm.Configuration.UpstreamRemoteFor(localNamespace, localVolume); !ok {
+			dm.Configuration.SetUpstreamFor(peer, localNamespace, localVolume)
+		}
 	}
 
 	if direction == "push" {
@@ -1103,6 +1509,8 @@ func (dm *DotmeshAPI) RequestTransfer(
 			RemoteName:       remoteVolume,
 			RemoteBranchName: deMasterify(remoteBranchName),
 			StashDivergence:  stashDivergence,
+			LimitRate:        limitRate,
+			Priority:         priority,
 			// TODO add TargetSnapshot here, to support specifying "push to a given
 			// snapshot" rather than just "push all snapshots up to the latest"
 		}
@@ -1132,6 +1540,8 @@ func (dm *DotmeshAPI) RequestTransfer(
 				LocalName:       localVolume,
 				LocalBranchName: deMasterify(localBranchName),
 				RemoteName:      remoteVolume,
+				LimitRate:       limitRate,
+				Priority:        priority,
 				// TODO add TargetSnapshot here, to support specifying "push to a given
 				// snapshot" rather than just "push all snapshots up to the latest"
 				// todo is stash divergence needed here?? (issue dotscience-agent#88)
@@ -1154,6 +1564,105 @@ func (dm *DotmeshAPI) RequestTransfer(
 
 }
 
+// transferNames works out the dots and branches a push or pull with peer
+// would be between, filling in the defaults for any that aren't given, and
+// splits out their namespaces. Only the names are set in the TransferRequest
+// it returns.
+func (dm *DotmeshAPI) transferNames(
+	direction, peer string, remote Remote,
+	localFilesystemName, localBranchName,
+	remoteFilesystemName, remoteBranchName string,
+) (types.TransferRequest, error) {
+	var err error
+
+	// Let's replace any missing things with defaults.
+	// The defaults depend on whether we're pushing or pulling.
+	if direction == "push" {
+		// We are pushing, so if no local filesystem/branch is
+		// specified, take the current one.
+		if localFilesystemName == "" {
+			localFilesystemName, err = dm.Configuration.CurrentVolume()
+			if err != nil {
+				return types.TransferRequest{}, err
+			}
+		}
+
+		if localBranchName == "" {
+			localBranchName, err = dm.Configuration.CurrentBranch()
+			if err != nil {
+				return types.TransferRequest{}, err
+			}
+		}
+	} else if direction == "pull" {
+		// We are pulling, so if no local filesystem/branch is
+		// specified, we take the remote name but strip it of its
+		// namespace. So if we pull "bob/apples", we pull into "apples",
+		// which is really "admin/apples".
+		if localFilesystemName == "" && remoteFilesystemName != "" {
+			_, localFilesystemName, err = ParseNamespacedVolume(remoteFilesystemName)
+			if err != nil {
+				return types.TransferRequest{}, err
+			}
+		}
+	}
+
+	// Split the local volume name's namespace out
+	localNamespace, localVolume, err := ParseNamespacedVolume(localFilesystemName)
+	if err != nil {
+		return types.TransferRequest{}, err
+	}
+
+	// Guess defaults for the remote filesystem
+	var remoteNamespace, remoteVolume string
+	if remoteFilesystemName == "" {
+		// No remote specified. Do we already have a default configured?
+		defaultRemoteNamespace, defaultRemoteVolume, ok := dm.Configuration.DefaultRemoteVolumeFor(peer, localNamespace, localVolume)
+		if ok {
+			// If so, use it
+			remoteNamespace = defaultRemoteNamespace
+			remoteVolume = defaultRemoteVolume
+		} else {
+			// If not, default to the un-namespaced local filesystem name.
+			// This causes it to default into the user's own namespace
+			// when we parse the name, too.
+			remoteNamespace = remote.DefaultNamespace()
+			remoteVolume = localVolume
+		}
+	} else {
+		// Default namespace for remote volume is the username on this remote
+		remoteNamespace, remoteVolume, err = ParseNamespacedVolumeWithDefault(remoteFilesystemName, remote.DefaultNamespace())
+		if err != nil {
+			return types.TransferRequest{}, err
+		}
+	}
+
+	if remoteBranchName == "" {
+		remoteBranchName = localBranchName
+		// a renamed branch keeps its remote branch
+		defaultRemoteBranch, ok := dm.Configuration.DefaultRemoteBranchFor(peer, localNamespace, localVolume, localBranchName)
+		if ok {
+			remoteBranchName = defaultRemoteBranch
+		}
+	}
+
+	if remoteBranchName != "" && remoteVolume == "" {
+		return types.TransferRequest{}, fmt.Errorf(
+			"It's dubious to specify a remote branch name " +
+				"without specifying a remote filesystem name.",
+		)
+	}
+
+	return types.TransferRequest{
+		Direction:        direction,
+		LocalNamespace:   localNamespace,
+		LocalName:        localVolume,
+		LocalBranchName:  localBranchName,
+		RemoteNamespace:  remoteNamespace,
+		RemoteName:       remoteVolume,
+		RemoteBranchName: remoteBranchName,
+	}, nil
+}
+
 func (dm *DotmeshAPI) Transfer(request types.TransferRequest) (string, error) {
 	var transferId string
 	err := dm.CallRemote(context.Background(), "DotmeshRPC.Transfer", request, &transferId)
@@ -1166,6 +1675,126 @@ func (dm *DotmeshAPI) S3Transfer(request types.S3TransferRequest) (string, error
 	return transferId, err
 }
 
+// PlanTransfer works out what RequestTransfer, given the same names, would
+// transfer, without changing anything on either cluster, or the defaults
+// remembered for the dot.
+func (dm *DotmeshAPI) PlanTransfer(
+	direction, peer,
+	localFilesystemName, localBranchName,
+	remoteFilesystemName, remoteBranchName string,
+	stashDivergence bool,
+) (types.TransferPlan, error) {
+	var result types.TransferPlan
+	remote, err := dm.Configuration.GetRemote(peer)
+	if err != nil {
+		return result, err
+	}
+	dmRemote, ok := remote.(*DMRemote)
+	if !ok {
+		return result, fmt.Errorf("Can't plan a transfer with %s, only with dotmesh remotes", peer)
+	}
+
+	request, err := dm.transferNames(
+		direction, peer, remote,
+		localFilesystemName, localBranchName,
+		remoteFilesystemName, remoteBranchName,
+	)
+	if err != nil {
+		return result, err
+	}
+	request.Peer = dmRemote.Hostname
+	request.User = dmRemote.User
+	request.Port = dmRemote.Port
+	request.ApiKey = dmRemote.ApiKey
+	request.LocalBranchName = deMasterify(request.LocalBranchName)
+	request.RemoteBranchName = deMasterify(request.RemoteBranchName)
+	request.StashDivergence = stashDivergence
+
+	err = dm.CallRemote(context.Background(), "DotmeshRPC.TransferPlan", request, &result)
+	return result, err
+}
+
+// CompareWithRemote works out how far branchName of volumeName is ahead of, or
+// behind, the branch on peer which 'dm push' would push it to, without
+// transferring anything.
+func (dm *DotmeshAPI) CompareWithRemote(peer, volumeName, branchName string) (types.RemoteComparison, error) {
+	var result types.RemoteComparison
+	remote, err := dm.Configuration.GetRemote(peer)
+	if err != nil {
+		return result, err
+	}
+	dmRemote, ok := remote.(*DMRemote)
+	if !ok {
+		return result, fmt.Errorf("Can't compare with %s, only with dotmesh remotes", peer)
+	}
+
+	request, err := dm.transferNames("push", peer, remote, volumeName, branchName, "", "")
+	if err != nil {
+		return result, err
+	}
+	request.Peer = dmRemote.Hostname
+	request.User = dmRemote.User
+	request.Port = dmRemote.Port
+	request.ApiKey = dmRemote.ApiKey
+	request.LocalBranchName = deMasterify(request.LocalBranchName)
+	request.RemoteBranchName = deMasterify(request.RemoteBranchName)
+
+	err = dm.CallRemote(context.Background(), "DotmeshRPC.CompareWithRemote", request, &result)
+	if err != nil {
+		return result, err
+	}
+	result.Remote = peer
+	return result, nil
+}
+
+// DotStatus gathers what 'dm status' shows about branchName of volumeName.
+// Failing to compare the branch with its upstream dot doesn't fail the rest,
+// it's recorded in UpstreamError instead.
+func (dm *DotmeshAPI) DotStatus(volumeName, branchName string) (types.DotStatus, error) {
+	var result types.DotStatus
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return result, err
+	}
+	volume, err := dm.BranchInfo(namespace, name, deMasterify(branchName))
+	if err != nil {
+		return result, err
+	}
+	result = types.DotStatus{
+		Remote:       dm.Configuration.GetCurrentRemote(),
+		Namespace:    namespace,
+		Name:         name,
+		Branch:       deMasterify(branchName),
+		FilesystemId: volume.Id,
+		Master:       volume.Master,
+		SizeBytes:    volume.SizeBytes,
+		DirtyBytes:   volume.DirtyBytes,
+	}
+
+	err = dm.CallRemote(context.Background(), "DotmeshRPC.ContainersById", volume.Id, &result.Containers)
+	if err != nil {
+		return result, err
+	}
+	err = dm.CallRemote(context.Background(), "DotmeshRPC.Transfers", types.VolumeName{
+		Namespace: namespace,
+		Name:      name,
+	}, &result.Transfers)
+	if err != nil {
+		return result, err
+	}
+
+	peer, ok := dm.Configuration.UpstreamRemoteFor(namespace, name)
+	if ok {
+		upstream, err := dm.CompareWithRemote(peer, volumeName, branchName)
+		if err != nil {
+			result.UpstreamError = fmt.Sprintf("comparing with %s: %s", peer, err)
+		} else {
+			result.Upstream = &upstream
+		}
+	}
+	return result, nil
+}
+
 func (dm *DotmeshAPI) IsUserPriveledged() bool {
 	err := dm.openClient()
 
@@ -1204,10 +1833,13 @@ func ParseNamespacedVolume(name string) (string, string, error) {
 	return ParseNamespacedVolumeWithDefault(name, "admin")
 }
 
+// Diff returns the uncommitted changes on a dot's master branch.
 func (dm *DotmeshAPI) Diff(namespace, name string) ([]types.ZFSFileDiff, error) {
 	return dm.DiffFromCommit(namespace, name, "")
 }
 
+// DiffFromCommit returns the changes on a dot's master branch since a commit,
+// which may be on another branch or a fork origin, including uncommitted ones.
 func (dm *DotmeshAPI) DiffFromCommit(namespace, name, commitID string) ([]types.ZFSFileDiff, error) {
 	remoteCreds, err := dm.Configuration.CredsForRemote(dm.Configuration.CurrentRemote)
 	if err != nil {
@@ -1266,6 +1898,19 @@ func (dm *DotmeshAPI) DiffFromCommit(namespace, name, commitID string) ([]types.
 	return res, nil
 }
 
+// DiffCommits compares the commits, branches or uncommitted changes named in
+// the request. Big diffs can be fetched a page at a time with request.Offset
+// and request.Limit, up to the response's Total.
+func (dm *DotmeshAPI) DiffCommits(request types.RPCDiffRequest) (*types.RPCDiffResponse, error) {
+	request.Branch = deMasterify(request.Branch)
+	var result types.RPCDiffResponse
+	err := dm.CallRemote(context.Background(), "DotmeshRPC.Diff", request, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
 func (dm *DotmeshAPI) LastModified(namespace, name string) (*types.LastModified, error) {
 	var lastModified types.LastModified
 	err := dm.CallRemote(context.Background(), "DotmeshRPC.LastModified", &types.VolumeName{Namespace: namespace, Name: name}, &lastModified)
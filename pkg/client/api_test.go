@@ -0,0 +1,136 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/dotmesh-io/dotmesh/pkg/container"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+)
+
+// fakeDotmeshRPC answers the RPCs 'dm status' makes about admin/dot, which
+// has one running transfer, and is one commit ahead of any upstream dot.
+type fakeDotmeshRPC struct {
+	// the peers it was asked to compare with
+	compared []string
+}
+
+func (f *fakeDotmeshRPC) Lookup(r *http.Request, args *struct{ Namespace, Name, Branch string }, result *string) error {
+	if args.Namespace != "admin" || args.Name != "dot" || args.Branch != "" {
+		return fmt.Errorf("No such dot %s/%s branch %q", args.Namespace, args.Name, args.Branch)
+	}
+	*result = "dot-1"
+	return nil
+}
+
+func (f *fakeDotmeshRPC) Get(r *http.Request, filesystemId *string, result *types.DotmeshVolume) error {
+	*result = types.DotmeshVolume{Id: *filesystemId, Master: "node-1", SizeBytes: 1024, DirtyBytes: 512}
+	return nil
+}
+
+func (f *fakeDotmeshRPC) ContainersById(r *http.Request, filesystemId *string, result *[]container.DockerContainer) error {
+	*result = []container.DockerContainer{{Name: "db", Id: "container-1"}}
+	return nil
+}
+
+func (f *fakeDotmeshRPC) Transfers(r *http.Request, args *types.VolumeName, result *[]types.TransferPollResult) error {
+	*result = []types.TransferPollResult{{TransferRequestId: "transfer-1", Direction: "push", Status: "pushing"}}
+	return nil
+}
+
+func (f *fakeDotmeshRPC) CompareWithRemote(r *http.Request, args *types.TransferRequest, result *types.RemoteComparison) error {
+	f.compared = append(f.compared, args.Peer)
+	*result = types.RemoteComparison{
+		RemoteNamespace: args.RemoteNamespace,
+		RemoteName:      args.RemoteName,
+		RemoteExists:    true,
+		Ahead:           1,
+	}
+	return nil
+}
+
+// newFakeDotmeshServer serves rpcs, and points the current remote of c at it.
+func newFakeDotmeshServer(t *testing.T, c *Configuration, rpcs *fakeDotmeshRPC) *httptest.Server {
+	s := rpc.NewServer()
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+	err := s.RegisterService(rpcs, "DotmeshRPC")
+	if err != nil {
+		t.Fatalf("failed to register fake rpcs: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", s)
+	server := httptest.NewServer(mux)
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to split %s: %s", server.Listener.Addr(), err)
+	}
+	c.DMRemotes[c.CurrentRemote].Hostname = host
+	c.DMRemotes[c.CurrentRemote].Port, err = strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("failed to parse port %s: %s", port, err)
+	}
+	return server
+}
+
+func TestDotStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmConfig")
+	if err != nil {
+		t.Fatalf("making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	c := newTestConfiguration(t, dir)
+	rpcs := &fakeDotmeshRPC{}
+	server := newFakeDotmeshServer(t, c, rpcs)
+	defer server.Close()
+	dm := &DotmeshAPI{Configuration: c}
+
+	status, err := dm.DotStatus("dot", DefaultBranch)
+	if err != nil {
+		t.Fatalf("DotStatus() failed: %s", err)
+	}
+	if status.Remote != "local" || status.Namespace != "admin" || status.Name != "dot" || status.Branch != "" {
+		t.Errorf("expected the status of local's admin/dot master, got %s's %s/%s %q",
+			status.Remote, status.Namespace, status.Name, status.Branch)
+	}
+	if status.FilesystemId != "dot-1" || status.Master != "node-1" || status.SizeBytes != 1024 || status.DirtyBytes != 512 {
+		t.Errorf("expected the branch's details, got %+v", status)
+	}
+	if len(status.Containers) != 1 || status.Containers[0].Name != "db" {
+		t.Errorf("expected the db container, got %+v", status.Containers)
+	}
+	if len(status.Transfers) != 1 || status.Transfers[0].TransferRequestId != "transfer-1" {
+		t.Errorf("expected transfer-1, got %+v", status.Transfers)
+	}
+	// a and b both have a default remote volume, but neither is the upstream
+	if status.Upstream != nil || len(rpcs.compared) != 0 {
+		t.Errorf("expected no comparison without an upstream, got %+v", status.Upstream)
+	}
+
+	err = c.SetUpstreamFor("b", "admin", "dot")
+	if err != nil {
+		t.Fatalf("failed to set upstream: %s", err)
+	}
+	status, err = dm.DotStatus("dot", DefaultBranch)
+	if err != nil {
+		t.Fatalf("DotStatus() failed: %s", err)
+	}
+	if status.UpstreamError != "" {
+		t.Fatalf("expected a comparison with the upstream, got %s", status.UpstreamError)
+	}
+	if status.Upstream == nil || status.Upstream.Remote != "b" || status.Upstream.Ahead != 1 {
+		t.Errorf("expected to be 1 ahead of b, got %+v", status.Upstream)
+	}
+	if len(rpcs.compared) != 1 || rpcs.compared[0] != "b.example.com" {
+		t.Errorf("expected a comparison with b.example.com, got %v", rpcs.compared)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"reflect"
@@ -144,6 +145,12 @@ func (j *JsonRpcClient) reallyCallRemote(
 	return nil
 }
 
+// IsMethodNotFound says whether err is a server's reply that it has no such
+// RPC method, as older versions reply to methods added since.
+func IsMethodNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "rpc: can't find method")
+}
+
 func DeduceUrl(ctx context.Context, hostnames []string, mode, user, apiKey string) (string, error) {
 	// "mode" is "internal" if you're trying to connect within a cluster (e.g.
 	// directly to another node's IP address), or "external" if you're trying
@@ -152,7 +159,12 @@ func DeduceUrl(ctx context.Context, hostnames []string, mode, user, apiKey strin
 	var errs []error
 	for _, hostname := range hostnames {
 		var urlsToTry []string
-		if mode == "external" && (strings.HasSuffix(hostname, "dothub.com") || strings.HasSuffix(hostname, "dotscience.net") || strings.HasSuffix(hostname, "dotscience.com")) {
+		if _, _, err := net.SplitHostPort(hostname); err == nil {
+			// the address already says which port the server is on
+			urlsToTry = []string{
+				fmt.Sprintf("http://%s", hostname),
+			}
+		} else if mode == "external" && (strings.HasSuffix(hostname, "dothub.com") || strings.HasSuffix(hostname, "dotscience.net") || strings.HasSuffix(hostname, "dotscience.com")) {
 			urlsToTry = []string{
 				fmt.Sprintf("https://%s:443", hostname),
 			}
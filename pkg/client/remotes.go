@@ -55,6 +55,13 @@ type DMRemote struct {
 	CurrentVolume        string
 	CurrentBranches      map[string]string
 	DefaultRemoteVolumes map[string]map[string]types.VolumeName
+	// DefaultRemoteBranches maps a local namespace, volume and branch to the
+	// branch it's pushed to and pulled from, when that isn't the branch with
+	// the same name, e.g. because the local branch was renamed
+	DefaultRemoteBranches map[string]map[string]map[string]string `json:",omitempty"`
+	// Upstreams maps a namespace and volume on this remote to the remote its
+	// upstream dot is on, which 'dm status' compares it with
+	Upstreams map[string]map[string]string `json:",omitempty"`
 }
 
 func (remote DMRemote) DefaultNamespace() string {
@@ -313,6 +320,56 @@ func (c *Configuration) DefaultRemoteVolumeFor(peer, namespace, volume string) (
 
 }
 
+// UpstreamRemoteFor returns the remote the volume on the current remote has
+// its upstream dot on, as set by 'dm dot set-upstream' or its first push or
+// pull, as long as that remote is still configured.
+func (c *Configuration) UpstreamRemoteFor(namespace, volume string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	current, ok := c.DMRemotes[c.CurrentRemote]
+	if !ok {
+		return "", false
+	}
+	peer, ok := current.Upstreams[namespace][volume]
+	if !ok {
+		return "", false
+	}
+	remote, ok := c.DMRemotes[peer]
+	if !ok {
+		return "", false
+	}
+	_, _, ok = remote.DefaultRemoteVolumeFor(namespace, volume)
+	if !ok {
+		return "", false
+	}
+	return peer, true
+}
+
+// SetUpstreamFor makes peer the remote the volume on the current remote has
+// its upstream dot on.
+func (c *Configuration) SetUpstreamFor(peer, namespace, volume string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	current, ok := c.DMRemotes[c.CurrentRemote]
+	if !ok {
+		return fmt.Errorf(
+			"Unable to find remote '%s', which was apparently current",
+			c.CurrentRemote,
+		)
+	}
+	if _, ok := c.DMRemotes[peer]; !ok {
+		return fmt.Errorf("Unable to find dotmesh remote '%s'", peer)
+	}
+	if current.Upstreams == nil {
+		current.Upstreams = map[string]map[string]string{}
+	}
+	if current.Upstreams[namespace] == nil {
+		current.Upstreams[namespace] = map[string]string{}
+	}
+	current.Upstreams[namespace][volume] = peer
+	return c.save()
+}
+
 func (c *Configuration) SetPrefixesFor(peer, namespace, volume string, prefixes []string) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -392,6 +449,7 @@ func (c *Configuration) DeleteStateForVolume(volume string) error {
 	n, v, err := ParseNamespacedVolume(volume)
 	if err == nil {
 		delete(c.DMRemotes[c.CurrentRemote].DefaultRemoteVolumes[n], v)
+		delete(c.DMRemotes[c.CurrentRemote].Upstreams[n], v)
 	} else {
 		return err
 	}
@@ -415,6 +473,66 @@ func (c *Configuration) SetCurrentBranchForVolume(volume, branch string) error {
 	return c.save()
 }
 
+func (c *Configuration) DefaultRemoteBranchFor(peer, namespace, volume, branch string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	remote, ok := c.DMRemotes[peer]
+	if !ok {
+		return "", false
+	}
+	remoteBranch, ok := remote.DefaultRemoteBranches[namespace][volume][branch]
+	return remoteBranch, ok
+}
+
+// RenameBranchFor follows a branch of a volume on the current remote being
+// renamed: it stays current if it was, and keeps being pushed to and pulled
+// from the same branch of the volume's default remote volumes.
+func (c *Configuration) RenameBranchFor(volume, oldBranch, newBranch string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	current, ok := c.DMRemotes[c.CurrentRemote]
+	if !ok {
+		return fmt.Errorf(
+			"Unable to find remote '%s', which was apparently current",
+			c.CurrentRemote,
+		)
+	}
+	if current.CurrentBranches[volume] == oldBranch {
+		current.CurrentBranches[volume] = newBranch
+	}
+
+	namespace, name, err := ParseNamespacedVolume(volume)
+	if err != nil {
+		return err
+	}
+	for peer, remote := range c.DMRemotes {
+		if peer == c.CurrentRemote {
+			continue
+		}
+		if _, ok := remote.DefaultRemoteVolumes[namespace][name]; !ok {
+			continue
+		}
+		remoteBranch, ok := remote.DefaultRemoteBranches[namespace][name][oldBranch]
+		if !ok {
+			remoteBranch = oldBranch
+		}
+		if remote.DefaultRemoteBranches == nil {
+			remote.DefaultRemoteBranches = map[string]map[string]map[string]string{}
+		}
+		if remote.DefaultRemoteBranches[namespace] == nil {
+			remote.DefaultRemoteBranches[namespace] = map[string]map[string]string{}
+		}
+		if remote.DefaultRemoteBranches[namespace][name] == nil {
+			remote.DefaultRemoteBranches[namespace][name] = map[string]string{}
+		}
+		delete(remote.DefaultRemoteBranches[namespace][name], oldBranch)
+		if remoteBranch != newBranch {
+			remote.DefaultRemoteBranches[namespace][name][newBranch] = remoteBranch
+		}
+	}
+	return c.save()
+}
+
 func (c *Configuration) RemoteExists(remote string) bool {
 	_, ok := c.DMRemotes[remote]
 	if !ok {
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestConfiguration returns a configuration saved in dir, with the current
+// remote local and remotes a and b which both have a default remote volume
+// for admin/dot.
+func newTestConfiguration(t *testing.T, dir string) *Configuration {
+	c, err := NewConfiguration(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	for _, name := range []string{"local", "a", "b"} {
+		c.DMRemotes[name] = &DMRemote{User: "admin", Hostname: name + ".example.com"}
+	}
+	c.CurrentRemote = "local"
+	for _, peer := range []string{"a", "b"} {
+		err = c.SetDefaultRemoteVolumeFor(peer, "admin", "dot", "admin", "dot")
+		if err != nil {
+			t.Fatalf("failed to set default remote volume on %s: %s", peer, err)
+		}
+	}
+	return c
+}
+
+func TestUpstreamRemoteFor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmConfig")
+	if err != nil {
+		t.Fatalf("making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	c := newTestConfiguration(t, dir)
+
+	_, ok := c.UpstreamRemoteFor("admin", "dot")
+	if ok {
+		t.Errorf("expected no upstream before one is set")
+	}
+
+	err = c.SetUpstreamFor("b", "admin", "dot")
+	if err != nil {
+		t.Fatalf("failed to set upstream: %s", err)
+	}
+	peer, ok := c.UpstreamRemoteFor("admin", "dot")
+	if !ok || peer != "b" {
+		t.Errorf("UpstreamRemoteFor() = %q, %t, want %q, true", peer, ok, "b")
+	}
+	_, ok = c.UpstreamRemoteFor("admin", "other")
+	if ok {
+		t.Errorf("expected no upstream for a volume it wasn't set for")
+	}
+
+	// it's saved with the rest of the configuration
+	loaded, err := NewConfiguration(c.configPath)
+	if err != nil {
+		t.Fatalf("failed to reload config: %s", err)
+	}
+	peer, ok = loaded.UpstreamRemoteFor("admin", "dot")
+	if !ok || peer != "b" {
+		t.Errorf("UpstreamRemoteFor() after reloading = %q, %t, want %q, true", peer, ok, "b")
+	}
+
+	// the upstream is the current remote's
+	c.CurrentRemote = "a"
+	_, ok = c.UpstreamRemoteFor("admin", "dot")
+	if ok {
+		t.Errorf("expected no upstream on a remote it wasn't set on")
+	}
+	c.CurrentRemote = "local"
+
+	err = c.RemoveRemote("b")
+	if err != nil {
+		t.Fatalf("failed to remove remote: %s", err)
+	}
+	_, ok = c.UpstreamRemoteFor("admin", "dot")
+	if ok {
+		t.Errorf("expected no upstream once its remote is removed")
+	}
+}
+
+func TestSetUpstreamForMissingRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmConfig")
+	if err != nil {
+		t.Fatalf("making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	c := newTestConfiguration(t, dir)
+	err = c.SetUpstreamFor("c", "admin", "dot")
+	if err == nil {
+		t.Errorf("expected setting the upstream to a missing remote to fail")
+	}
+}
@@ -0,0 +1,135 @@
+// Package containertest provides an in-memory container.Client for tests
+// which need to run filesystem machines without a docker daemon.
+package containertest
+
+import (
+	"sync"
+
+	"github.com/dotmesh-io/dotmesh/pkg/container"
+)
+
+var _ container.Client = &FakeClient{}
+
+// FakeClient records the calls the state machines make to the container
+// runtime. Related containers are whatever the test sets with SetRelated.
+type FakeClient struct {
+	mu sync.Mutex
+
+	related  map[string][]container.DockerContainer
+	symlinks map[string]string
+	stopped  map[string]bool
+	calls    []string
+	failures map[string]error
+}
+
+func NewFakeClient() *FakeClient {
+	return &FakeClient{
+		related:  map[string][]container.DockerContainer{},
+		symlinks: map[string]string{},
+		stopped:  map[string]bool{},
+		failures: map[string]error{},
+	}
+}
+
+// SetRelated sets the containers which are using the given volume.
+func (c *FakeClient) SetRelated(volumeName string, containers []container.DockerContainer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.related[volumeName] = containers
+}
+
+// FailNext makes the next call to the named method (eg "Stop") return err.
+func (c *FakeClient) FailNext(method string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures[method] = err
+}
+
+// Calls returns the methods called so far, in the form "Stop volumeName".
+func (c *FakeClient) Calls() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.calls...)
+}
+
+// Stopped reports whether the containers of a volume are currently stopped.
+func (c *FakeClient) Stopped(volumeName string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopped[volumeName]
+}
+
+// Symlink returns the filesystem path the volume was last switched to.
+func (c *FakeClient) Symlink(volumeName string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.symlinks[volumeName]
+}
+
+// call records a call and returns the injected failure for it, if any. Must
+// be called with mu held.
+func (c *FakeClient) call(method, volumeName string) error {
+	c.calls = append(c.calls, method+" "+volumeName)
+	err, ok := c.failures[method]
+	if ok {
+		delete(c.failures, method)
+	}
+	return err
+}
+
+func (c *FakeClient) AllRelated() (map[string][]container.DockerContainer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.call("AllRelated", "")
+	if err != nil {
+		return nil, err
+	}
+	result := map[string][]container.DockerContainer{}
+	for volumeName, containers := range c.related {
+		result[volumeName] = append([]container.DockerContainer{}, containers...)
+	}
+	return result, nil
+}
+
+func (c *FakeClient) Related(volumeName string) ([]container.DockerContainer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.call("Related", volumeName)
+	if err != nil {
+		return nil, err
+	}
+	return append([]container.DockerContainer{}, c.related[volumeName]...), nil
+}
+
+func (c *FakeClient) SwitchSymlinks(volumeName, toFilesystemIdPath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.call("SwitchSymlinks", volumeName)
+	if err != nil {
+		return err
+	}
+	c.symlinks[volumeName] = toFilesystemIdPath
+	return nil
+}
+
+func (c *FakeClient) Start(volumeName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.call("Start", volumeName)
+	if err != nil {
+		return err
+	}
+	delete(c.stopped, volumeName)
+	return nil
+}
+
+func (c *FakeClient) Stop(volumeName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.call("Stop", volumeName)
+	if err != nil {
+		return err
+	}
+	c.stopped[volumeName] = true
+	return nil
+}
@@ -12,12 +12,16 @@ import (
 	"github.com/dotmesh-io/dotmesh/pkg/observer"
 	"github.com/dotmesh-io/dotmesh/pkg/registry"
 	"github.com/dotmesh-io/dotmesh/pkg/store"
+	"github.com/dotmesh-io/dotmesh/pkg/transferqueue"
 	"github.com/dotmesh-io/dotmesh/pkg/types"
 	"github.com/dotmesh-io/dotmesh/pkg/user"
+	"github.com/dotmesh-io/dotmesh/pkg/utils"
 	"github.com/dotmesh-io/dotmesh/pkg/uuid"
 	"github.com/dotmesh-io/dotmesh/pkg/zfs"
 
+	"github.com/jonboulle/clockwork"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
 )
 
 type FsConfig struct {
@@ -45,6 +49,22 @@ type FsConfig struct {
 
 	// PoolName is a required
 	PoolName string
+
+	// ZFS is the storage backend shared by all filesystem machines on this
+	// node, if it's not set a ZFS backend is created from the paths above
+	ZFS zfs.ZFS
+
+	// Clock is used for timestamps, backoffs and retries, defaults to the
+	// real clock. Tests can pass a fake one to control time.
+	Clock clockwork.Clock
+
+	// RateLimiter caps the combined rate of every replication stream on
+	// this node, nil for no limit
+	RateLimiter *utils.RateLimiter
+
+	// TransferQueue schedules the transfers this node initiates, nil to
+	// start them all straight away
+	TransferQueue *transferqueue.Queue
 }
 
 type FSM interface {
@@ -59,6 +79,9 @@ type FSM interface {
 
 	// TODO: review the call, maybe it's possible to internalize behaviour
 	PushCompleted(success bool)
+	// ResumedPushCompleted is PushCompleted for a push which carried on from
+	// an interrupted receive, and so only got as far as snapshotId.
+	ResumedPushCompleted(snapshotId string)
 	// TODO: review the call, maybe it's possible to internalize behaviour
 	PublishNewSnaps(server string, payload interface{}) error
 	// TODO: review the call, maybe it's possible to internalize behaviour
@@ -92,15 +115,27 @@ type FSM interface {
 
 	// DumpState is used for diagnostics
 	DumpState() *FSMStateDump
+
+	// CancelTransfer stops the transfer with the given id, if this machine
+	// is doing it, without waiting in line behind it like a request would.
+	CancelTransfer(transferRequestId string) bool
 }
 
 // core functions used by files ending `state` which I couldn't think of a good place for.
 func NewFilesystemMachine(cfg *FsConfig) *FsMachine {
 	// initialize the FsMachine with a filesystem struct that has bare minimum
 	// information (just the filesystem id) required to get started
-	zfsInter, err := zfs.NewZFS(cfg.ZFSPath, cfg.ZPoolPath, cfg.PoolName, cfg.MountZFS)
-	if err != nil {
-		log.Fatalf("Failed initialising zfs interface, %s", err.Error())
+	zfsInter := cfg.ZFS
+	if zfsInter == nil {
+		var err error
+		zfsInter, err = zfs.NewZFS(cfg.ZFSPath, cfg.ZPoolPath, cfg.PoolName, cfg.MountZFS)
+		if err != nil {
+			log.Fatalf("Failed initialising zfs interface, %s", err.Error())
+		}
+	}
+	clock := cfg.Clock
+	if clock == nil {
+		clock = clockwork.NewRealClock()
 	}
 	return &FsMachine{
 		filesystem: &types.Filesystem{
@@ -131,7 +166,7 @@ func NewFilesystemMachine(cfg *FsConfig) *FsMachine {
 		newSnapsOnServers:       observer.NewObserver(fmt.Sprintf("newSnapsOnServers:%s", cfg.FilesystemID)),
 		currentState:            "discovering",
 		status:                  "",
-		lastTransitionTimestamp: time.Now().UnixNano(),
+		lastTransitionTimestamp: clock.Now().UnixNano(),
 		transitionObserver:      observer.NewObserver(fmt.Sprintf("transitionObserver:%s", cfg.FilesystemID)),
 		lastTransferRequest:     types.TransferRequest{},
 		deathObserver:           cfg.DeathObserver,
@@ -147,13 +182,18 @@ func NewFilesystemMachine(cfg *FsConfig) *FsMachine {
 		// reload the list of snapshots, update etcd and coordinate our own
 		// state changes, which we do via the POST handler sending on this
 		// channel.
-		pushCompleted:   make(chan bool),
-		dirtyDelta:      0,
-		sizeBytes:       0,
-		transferUpdates: make(chan types.TransferUpdate),
+		pushCompleted:    make(chan pushCompletion),
+		dirtyDelta:       0,
+		sizeBytes:        0,
+		transferUpdates:  make(chan types.TransferUpdate),
+		transferCancelMu: &sync.Mutex{},
+		transferCancels:  map[string]context.CancelFunc{},
 
 		filesystemMetadataTimeout: cfg.FilesystemMetadataTimeout,
 		zfs:                       zfsInter,
+		clock:                     clock,
+		rateLimiter:               cfg.RateLimiter,
+		transferQueue:             cfg.TransferQueue,
 	}
 }
 
@@ -196,7 +236,11 @@ func (f *FsMachine) Unmount() (response *types.Event) {
 }
 
 func (f *FsMachine) PushCompleted(success bool) {
-	f.pushCompleted <- success
+	f.pushCompleted <- pushCompletion{success: success}
+}
+
+func (f *FsMachine) ResumedPushCompleted(snapshotId string) {
+	f.pushCompleted <- pushCompletion{success: true, snapshotId: snapshotId}
 }
 
 type FSMStateDump struct {
@@ -372,9 +416,9 @@ func (f *FsMachine) runWhileFilesystemLives(fn func() error, label string, files
 				log.Printf(
 					"Error in runWhileFilesystemLives(%s@%s), retrying in %s: %s",
 					label, filesystemId, errorBackoff, err)
-				time.Sleep(errorBackoff)
+				f.clock.Sleep(errorBackoff)
 			} else {
-				time.Sleep(successBackoff)
+				f.clock.Sleep(successBackoff)
 			}
 		}
 	}
@@ -457,6 +501,7 @@ func (f *FsMachine) updateEtcdAboutTransfers() error {
 		switch update.Kind {
 		case types.TransferStart:
 			pollResult = update.Changes
+			pollResult.InitiatorFilesystemId = f.filesystemId
 		case types.TransferGotIds:
 			pollResult.FilesystemId = update.Changes.FilesystemId
 			pollResult.StartingCommit = update.Changes.StartingCommit
@@ -464,13 +509,17 @@ func (f *FsMachine) updateEtcdAboutTransfers() error {
 		case types.TransferCalculatedSize:
 			pollResult.Status = update.Changes.Status
 			pollResult.Size = update.Changes.Size
+			pollResult.Saved += update.Changes.Saved
+			pollResult.StreamEncoding = update.Changes.StreamEncoding
+			pollResult.CompressedStream = update.Changes.CompressedStream
+			pollResult.WireSize = update.Changes.WireSize
 		case types.TransferTotalAndSize:
 			pollResult.Status = update.Changes.Status
 			pollResult.Total = update.Changes.Total
 			pollResult.Size = update.Changes.Size
 		case types.TransferProgress:
 			// never update a transfer after it's finished
-			if pollResult.Status != "finished" {
+			if pollResult.Status != "finished" && pollResult.Status != "cancelled" {
 				pollResult.Sent = update.Changes.Sent
 				if pollResult.Sent > pollResult.Size {
 					// cap at 100%, so that all our clients don't have to
@@ -478,14 +527,21 @@ func (f *FsMachine) updateEtcdAboutTransfers() error {
 				}
 				pollResult.NanosecondsElapsed = update.Changes.NanosecondsElapsed
 				pollResult.Status = update.Changes.Status
+				pollResult.LimitRate = update.Changes.LimitRate
 			}
 		case types.TransferS3Progress:
 			pollResult.Sent += update.Changes.Sent
+			pollResult.LimitRate = update.Changes.LimitRate
 		case types.TransferIncrementIndex:
 			if pollResult.Index < pollResult.Total {
 				pollResult.Index++
 			}
 			pollResult.Sent += update.Changes.Size
+			if update.Changes.LimitRate > 0 {
+				// S3 pushes measure their throughput as each file
+				// finishes
+				pollResult.LimitRate = update.Changes.LimitRate
+			}
 		case types.TransferStartS3Bucket:
 			pollResult.Index = 0
 			pollResult.Total = update.Changes.Total
@@ -511,6 +567,12 @@ func (f *FsMachine) updateEtcdAboutTransfers() error {
 			pollResult.Index = pollResult.Total
 		case types.TransferStatus:
 			pollResult.Status = update.Changes.Status
+		case types.TransferCancelled:
+			pollResult.Status = "cancelled"
+			pollResult.QueuePosition = 0
+		case types.TransferQueued:
+			pollResult.Status = update.Changes.Status
+			pollResult.QueuePosition = update.Changes.QueuePosition
 		case types.TransferGetCurrentPollResult:
 			update.GetResult <- pollResult
 			continue
@@ -598,7 +660,7 @@ func (f *FsMachine) transitionedTo(state string, status string) {
 	// these fields
 	f.snapshotsLock.Lock()
 	defer f.snapshotsLock.Unlock()
-	now := time.Now().UnixNano()
+	now := f.clock.Now().UnixNano()
 
 	metrics.TransitionCounter.WithLabelValues(f.currentState, state, status).Add(1)
 
@@ -633,6 +695,149 @@ func (f *FsMachine) transitionedTo(state string, status string) {
 	f.stateMachineMetadataMu.Unlock()
 }
 
+// deleteCommit destroys one of the filesystem's snapshots. Whether anything
+// else still needs it is checked before the request is made.
+func (f *FsMachine) deleteCommit(e *types.Event) *types.Event {
+	snapshotId, ok := (*e.Args)["snapshotId"].(string)
+	if !ok {
+		return types.NewErrorEvent("cant-delete-commit", fmt.Errorf("snapshotId not specified"))
+	}
+	found := false
+	f.snapshotsLock.Lock()
+	for _, s := range f.filesystem.Snapshots {
+		if s.Id == snapshotId {
+			found = true
+		}
+	}
+	f.snapshotsLock.Unlock()
+	if !found {
+		return types.NewErrorEvent("no-such-snapshot", fmt.Errorf("Commit %s not found", snapshotId))
+	}
+
+	output, err := f.zfs.DestroySnapshot(f.filesystemId, snapshotId)
+	if err != nil {
+		return &types.Event{
+			Name: "failed-delete-commit",
+			Args: &types.EventArgs{"err": err, "combined-output": string(output)},
+		}
+	}
+
+	f.snapshotsLock.Lock()
+	snaps := []*types.Snapshot{}
+	for _, s := range f.filesystem.Snapshots {
+		if s.Id != snapshotId {
+			snaps = append(snaps, s)
+		}
+	}
+	f.filesystem.Snapshots = snaps
+	f.snapshotsLock.Unlock()
+
+	err = f.snapshotsChanged()
+	if err != nil {
+		return types.NewErrorEvent("failed-delete-commit-snapshots-changed", err)
+	}
+	return &types.Event{Name: "commit-deleted"}
+}
+
+// promote makes the filesystem, a clone of originFilesystemId, independent of
+// it, taking over the origin's snapshots up to the one it was cloned from, so
+// that the origin can be deleted.
+func (f *FsMachine) promote(e *types.Event) *types.Event {
+	originFilesystemId, ok := (*e.Args)["originFilesystemId"].(string)
+	if !ok {
+		return types.NewErrorEvent("cant-promote", fmt.Errorf("originFilesystemId not specified"))
+	}
+	output, err := f.zfs.Promote(f.filesystemId, originFilesystemId)
+	if err != nil {
+		return &types.Event{
+			Name: "failed-promote",
+			Args: &types.EventArgs{"err": err, "combined-output": string(output)},
+		}
+	}
+	// the snapshots which moved over are ours now
+	err = f.discover()
+	if err != nil {
+		return types.NewErrorEvent("failed-promote-discover", err)
+	}
+	return &types.Event{Name: "promoted"}
+}
+
+// revert makes a new commit whose contents are those of an earlier one,
+// keeping the commits in between. Containers using the dot are stopped while
+// its contents are replaced, as they are for a rollback. The new commit's
+// metadata records which commit it reverted to, and from.
+func (f *FsMachine) revert(e *types.Event) (responseEvent *types.Event, nextState StateFn) {
+	snapshotId, ok := (*e.Args)["snapshotId"].(string)
+	if !ok {
+		return types.NewErrorEvent("cant-revert", fmt.Errorf("snapshotId not specified")), activeState
+	}
+	meta := map[string]string{}
+	if val, ok := (*e.Args)["metadata"]; ok {
+		var err error
+		meta, err = castToMetadata(val)
+		if err != nil {
+			return types.NewErrorEvent("unknown-metadata-format", err), activeState
+		}
+	}
+	found := false
+	latest := ""
+	f.snapshotsLock.Lock()
+	for _, s := range f.filesystem.Snapshots {
+		if s.Id == snapshotId {
+			found = true
+		}
+		latest = s.Id
+	}
+	f.snapshotsLock.Unlock()
+	if !found {
+		return types.NewErrorEvent("no-such-snapshot", fmt.Errorf("Commit %s not found", snapshotId)), activeState
+	}
+
+	err := f.stopContainers()
+	if err != nil {
+		log.Printf(
+			"%v while trying to stop containers during revert %s",
+			err, f.zfs.FQ(f.filesystemId),
+		)
+		return types.NewErrorEvent("failed-stop-containers-during-revert", err), backoffState
+	}
+	output, err := f.zfs.Revert(f.filesystemId, snapshotId)
+	if err != nil {
+		responseEvent = &types.Event{
+			Name: "failed-revert",
+			Args: &types.EventArgs{"err": err, "combined-output": string(output)},
+		}
+		nextState = backoffState
+	} else {
+		if meta["message"] == "" {
+			meta["message"] = fmt.Sprintf("Revert to %s", snapshotId)
+		}
+		meta["reverted-to"] = snapshotId
+		meta["reverted-from"] = latest
+		responseEvent, nextState = f.snapshot(&types.Event{
+			Name: "snapshot",
+			Args: &types.EventArgs{"metadata": meta},
+		})
+	}
+
+	// start them again whatever happened, as rollback does
+	err = f.startContainers()
+	if err != nil {
+		log.Printf(
+			"%v while trying to start containers during revert %s",
+			err, f.zfs.FQ(f.filesystemId),
+		)
+		if responseEvent.Name == "snapshotted" {
+			return types.NewErrorEvent("failed-start-containers-during-revert", err), backoffState
+		}
+	}
+	if responseEvent.Name != "snapshotted" {
+		return responseEvent, nextState
+	}
+	f.transitionedTo("active", "reverted")
+	return &types.Event{Name: "reverted", Args: responseEvent.Args}, nextState
+}
+
 func (f *FsMachine) fork(e *types.Event) (responseEvent *types.Event, nextState StateFn) {
 	forkNamespaceIf, ok := (*e.Args)["ForkNamespace"]
 	if !ok {
@@ -714,7 +919,7 @@ func (f *FsMachine) snapshot(e *types.Event) (responseEvent *types.Event, nextSt
 	} else {
 		meta = map[string]string{}
 	}
-	meta["timestamp"] = strconv.FormatInt(time.Now().UnixNano(), 10)
+	meta["timestamp"] = strconv.FormatInt(f.clock.Now().UnixNano(), 10)
 	var snapshotId string
 	snapshotIdInter, ok := (*e.Args)["snapshotId"]
 	if !ok {
@@ -899,32 +1104,27 @@ func (f *FsMachine) snapshotsChanged() error {
 	)
 }
 
-// Attempt to recover from a divergence by creating a new branch from the current position, and rolling the
-// existing branch back to rollbackTo.
-// TODO: create a new local clone (branch), then roll back to
-// rollbackTo (except, you can't roll back a snapshot
-// that a clone depends on without promoting the clone... hmmm)
-
-// step 4: Make dotmesh aware of the new branch
-// ...something something FsMachine something etcd...
-
-func (f *FsMachine) recoverFromDivergence(rollbackToId string) error {
+// Attempt to recover from a divergence by creating a new branch from the
+// current position, and rolling the existing branch back to rollbackTo. The
+// new branch is marked as a stash of this one, found by the given transfer if
+// any, and its name returned.
+func (f *FsMachine) recoverFromDivergence(rollbackToId, transferRequestId string) (string, error) {
 	// Mint an ID for the new branch
 	newFilesystemId := uuid.New().String()
 
 	// Roll back the filesystem to rollbackTo, but leaving the new filesystem pointing to its original state
 	err := f.zfs.StashBranch(f.filesystemId, newFilesystemId, rollbackToId)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	tlf, parentBranchName, err := f.registry.LookupFilesystemById(f.filesystemId)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	topLevelFilesystemId := tlf.MasterBranch.Id
-	t := time.Now().UTC()
+	t := f.clock.Now().UTC()
 	newBranchName := ""
 	if parentBranchName == "" {
 		newBranchName = fmt.Sprintf("master-DIVERGED-%s", strings.Replace(t.Format(time.RFC3339), ":", "-", -1))
@@ -932,13 +1132,20 @@ func (f *FsMachine) recoverFromDivergence(rollbackToId string) error {
 		newBranchName = fmt.Sprintf("%s-DIVERGED-%s", parentBranchName, strings.Replace(t.Format(time.RFC3339), ":", "-", -1))
 	}
 
-	errorName, err := f.state.ActivateClone(topLevelFilesystemId, f.filesystemId, rollbackToId, newFilesystemId, newBranchName)
+	// the stash is marked as one when it's registered, so that nothing sees it
+	// as an ordinary branch in between
+	stash := &types.StashInfo{
+		Branch:            parentBranchName,
+		Created:           t,
+		TransferRequestId: transferRequestId,
+	}
+	errorName, err := f.state.ActivateClone(topLevelFilesystemId, f.filesystemId, rollbackToId, newFilesystemId, newBranchName, stash)
 
 	if err != nil {
-		return fmt.Errorf("Error recovering from divergence: %+v in %s", err, errorName)
+		return "", fmt.Errorf("Error recovering from divergence: %+v in %s", err, errorName)
 	}
 
-	return nil
+	return newBranchName, nil
 }
 
 // TODO this method shouldn't really be on a FsMachine, because it is
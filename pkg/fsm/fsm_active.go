@@ -41,10 +41,21 @@ func activeState(f *FsMachine) StateFn {
 			fromSnapshotId := (*e.Args)["FromSnapshotId"].(string)
 			toFilesystemId := (*e.Args)["ToFilesystemId"].(string)
 			toSnapshotId := (*e.Args)["ToSnapshotId"].(string)
+			resumeToken, _ := (*e.Args)["ResumeToken"].(string)
 
-			size, err := f.zfs.PredictSize(
-				fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
-			)
+			var size *types.PredictedSize
+			var err error
+			if resumeToken != "" {
+				// a resumed stream is sent however the original one was,
+				// so there's no telling raw and wire sizes apart
+				var remaining int64
+				remaining, err = f.zfs.PredictResumeSize(resumeToken)
+				size = &types.PredictedSize{Raw: remaining, Wire: remaining}
+			} else {
+				size, err = f.zfs.PredictSize(
+					fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
+				)
+			}
 
 			if err != nil {
 				f.innerResponses <- &types.Event{
@@ -54,7 +65,7 @@ func activeState(f *FsMachine) StateFn {
 			} else {
 				f.innerResponses <- &types.Event{
 					Name: "predictedSize",
-					Args: &types.EventArgs{"size": int64(size)},
+					Args: &types.EventArgs{"size": size.Raw, "wireSize": size.Wire},
 				}
 			}
 			f.transitionedTo("active", "predicted size")
@@ -127,7 +138,7 @@ func activeState(f *FsMachine) StateFn {
 				return backoffState
 			}
 			f.lastTransferRequest = transferRequest
-			transferRequestId, ok := (*e.Args)["RequestId"].(string)
+			_, ok := (*e.Args)["RequestId"].(string)
 			if !ok {
 				f.innerResponses <- &types.Event{
 					Name: "cant-cast-transfer-requestid",
@@ -135,7 +146,8 @@ func activeState(f *FsMachine) StateFn {
 				}
 				return backoffState
 			}
-			f.lastTransferRequestId = transferRequestId
+			// the initiator's id for the transfer, which it cancels it by
+			f.lastTransferRequestId = peerTransferRequestId(e)
 
 			log.Printf("GOT PEER TRANSFER REQUEST %+v", f.lastTransferRequest)
 			if f.lastTransferRequest.Direction == "push" {
@@ -143,6 +155,11 @@ func activeState(f *FsMachine) StateFn {
 			} else if f.lastTransferRequest.Direction == "pull" {
 				return pullPeerState
 			}
+		} else if e.Name == "cancel-transfer" {
+			// CancelTransfer has already stopped the transfer, this tidies
+			// up after it
+			f.innerResponses <- f.abortCancelledTransfer()
+			return activeState
 		} else if e.Name == "move" {
 			// move straight into a state which doesn't allow us to take
 			// snapshots or do rollbacks
@@ -174,6 +191,42 @@ func activeState(f *FsMachine) StateFn {
 			response, state := f.diff(e)
 			f.innerResponses <- response
 			return state
+		} else if e.Name == "delete-commit" {
+			response := f.deleteCommit(e)
+			f.innerResponses <- response
+			if response.Name != "commit-deleted" {
+				return backoffState
+			}
+			f.transitionedTo("active", "deleted commit")
+			return activeState
+		} else if e.Name == "promote" {
+			response := f.promote(e)
+			f.innerResponses <- response
+			if response.Name != "promoted" {
+				return backoffState
+			}
+			f.transitionedTo("active", "promoted")
+			return activeState
+		} else if e.Name == "revert" {
+			response, state := f.revert(e)
+			f.innerResponses <- response
+			return state
+		} else if e.Name == "restore" {
+			response, state := f.restore(e)
+			f.innerResponses <- response
+			return state
+		} else if e.Name == "merge" {
+			response, state := f.merge(e)
+			f.innerResponses <- response
+			return state
+		} else if e.Name == "cherry-pick" {
+			response, state := f.cherryPick(e)
+			f.innerResponses <- response
+			return state
+		} else if e.Name == "apply-stash" {
+			response, state := f.applyStash(e)
+			f.innerResponses <- response
+			return state
 		} else if e.Name == "snapshot" {
 			response, state := f.snapshot(e)
 			f.innerResponses <- response
@@ -185,7 +238,8 @@ func activeState(f *FsMachine) StateFn {
 			return state
 		} else if e.Name == "stash" {
 			snapshotId := (*e.Args)["snapshotId"].(string)
-			err := f.recoverFromDivergence(snapshotId)
+			transferRequestId, _ := (*e.Args)["transferRequestId"].(string)
+			newBranchName, err := f.recoverFromDivergence(snapshotId, transferRequestId)
 			if err != nil {
 				f.innerResponses <- &types.Event{
 					Name: "failed-stash",
@@ -195,7 +249,7 @@ func activeState(f *FsMachine) StateFn {
 			}
 			f.innerResponses <- &types.Event{
 				Name: "stashed",
-				Args: &types.EventArgs{"NewBranchName": "TODO"},
+				Args: &types.EventArgs{"NewBranchName": newBranchName},
 			}
 			return discoveringState
 		} else if e.Name == "rollback" {
@@ -306,7 +360,7 @@ func activeState(f *FsMachine) StateFn {
 				return backoffState
 			}
 
-			errorName, err := f.state.ActivateClone(topLevelFilesystemId, originFilesystemId, originSnapshotId, newCloneFilesystemId, newBranchName)
+			errorName, err := f.state.ActivateClone(topLevelFilesystemId, originFilesystemId, originSnapshotId, newCloneFilesystemId, newBranchName, nil)
 			if err != nil {
 				f.innerResponses <- &types.Event{
 					Name: errorName, Args: &types.EventArgs{"err": err},
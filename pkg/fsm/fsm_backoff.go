@@ -10,7 +10,7 @@ func backoffStateWithReason(reason string) func(f *FsMachine) StateFn {
 	return func(f *FsMachine) StateFn {
 		f.transitionedTo("backoff", fmt.Sprintf("pausing due to %s", reason))
 		log.Printf("entering backoff state for %s", f.filesystemId)
-		time.Sleep(time.Second)
+		f.clock.Sleep(time.Second)
 		return discoveringState
 	}
 }
@@ -19,7 +19,7 @@ func backoffStateWithReasonCustomTimeout(reason string, timeout time.Duration) f
 	return func(f *FsMachine) StateFn {
 		f.transitionedTo("backoff", fmt.Sprintf("pausing due to %s", reason))
 		log.Printf("entering backoff state for %s", f.filesystemId)
-		time.Sleep(timeout)
+		f.clock.Sleep(timeout)
 		return discoveringState
 	}
 }
@@ -27,6 +27,6 @@ func backoffStateWithReasonCustomTimeout(reason string, timeout time.Duration) f
 func backoffState(f *FsMachine) StateFn {
 	f.transitionedTo("backoff", "pausing")
 	log.Printf("entering backoff state for %s", f.filesystemId)
-	time.Sleep(time.Second)
+	f.clock.Sleep(time.Second)
 	return discoveringState
 }
@@ -0,0 +1,1107 @@
+package fsm_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/pkg/fsm/fsmtest"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+)
+
+func newTestCluster(t *testing.T, nodeIds ...string) *fsmtest.Cluster {
+	c, err := fsmtest.NewCluster(nodeIds...)
+	if err != nil {
+		t.Fatalf("failed to start cluster: %s", err)
+	}
+	return c
+}
+
+func snapshot(t *testing.T, n *fsmtest.Node, filesystemId, message string) *types.Event {
+	e, err := n.Dispatch(filesystemId, &types.Event{
+		Name: "snapshot",
+		Args: &types.EventArgs{"metadata": map[string]string{"message": message}},
+	})
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	return e
+}
+
+func TestClusterSnapshotsReachOtherNodes(t *testing.T) {
+	c := newTestCluster(t, "node1", "node2")
+	defer c.Close()
+	node1, node2 := c.Node("node1"), c.Node("node2")
+
+	id, err := node1.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = node1.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node1.ZFS.WriteFile(id, "__default__/hello", []byte("world"))
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	e := snapshot(t, node1, id, "hello")
+	if e.Name != "snapshotted" {
+		t.Fatalf("expected snapshotted, got %s", e)
+	}
+
+	// the initial commit and ours are published to the other node
+	err = c.AdvanceUntil(func() bool {
+		snaps, err := node2.SnapshotsFor("node1", id)
+		return err == nil && len(snaps) == 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and node2 fetches them from node1
+	err = c.AdvanceUntil(func() bool {
+		snaps, err := node2.SnapshotsFor("node2", id)
+		fs, fsErr := node2.GetFilesystemMachine(id)
+		return err == nil && len(snaps) == 2 && fsErr == nil && fs.GetCurrentState() == "inactive"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := node2.ZFS.ReadFile(id, "", "__default__/hello")
+	if err != nil || string(contents) != "world" {
+		t.Errorf("expected replicated contents 'world', got '%s' (%v)", contents, err)
+	}
+}
+
+func TestClusterSnapshotFailureBacksOff(t *testing.T) {
+	c := newTestCluster(t, "node1")
+	defer c.Close()
+	node1 := c.Node("node1")
+
+	id, err := node1.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = node1.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node1.ZFS.FailNext("Snapshot", errors.New("out of space"))
+	e := snapshot(t, node1, id, "doomed")
+	if e.Name != "failed-snapshot" {
+		t.Fatalf("expected failed-snapshot, got %s", e)
+	}
+	// the machine stays in backoff until time moves on
+	err = node1.WaitForState(id, "backoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AdvanceUntil(func() bool {
+		fs, err := node1.GetFilesystemMachine(id)
+		return err == nil && fs.GetCurrentState() == "active"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e = snapshot(t, node1, id, "second time lucky")
+	if e.Name != "snapshotted" {
+		t.Fatalf("expected snapshotted, got %s", e)
+	}
+	if calls := node1.ZFS.Calls("Snapshot"); calls != 3 {
+		t.Errorf("expected 3 calls to Snapshot, got %d", calls)
+	}
+}
+
+func TestClusterDeleteCommit(t *testing.T) {
+	c := newTestCluster(t, "node1", "node2")
+	defer c.Close()
+	node1, node2 := c.Node("node1"), c.Node("node2")
+
+	id, err := node1.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = node1.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"one", "two"} {
+		err = node1.ZFS.WriteFile(id, "__default__/hello", []byte(message))
+		if err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+		e := snapshot(t, node1, id, message)
+		if e.Name != "snapshotted" {
+			t.Fatalf("expected snapshotted, got %s", e)
+		}
+	}
+	err = c.AdvanceUntil(func() bool {
+		snaps, err := node2.SnapshotsFor("node1", id)
+		return err == nil && len(snaps) == 3
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AdvanceUntil(func() bool {
+		snaps, err := node2.SnapshotsFor("node2", id)
+		fs, fsErr := node2.GetFilesystemMachine(id)
+		return err == nil && len(snaps) == 3 && fsErr == nil && fs.GetCurrentState() == "inactive"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snaps, err := node1.SnapshotsFor("node1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := snaps[1].Id
+	deleteCommit := &types.Event{
+		Name: "delete-commit",
+		Args: &types.EventArgs{"snapshotId": deleted},
+	}
+
+	// the master deletes its own, and the other node hears about it
+	e, err := node1.Dispatch(id, deleteCommit)
+	if err != nil {
+		t.Fatalf("failed to delete commit: %s", err)
+	}
+	if e.Name != "commit-deleted" {
+		t.Fatalf("expected commit-deleted, got %s", e)
+	}
+	err = c.AdvanceUntil(func() bool {
+		snaps, err := node2.SnapshotsFor("node1", id)
+		return err == nil && len(snaps) == 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hearing about it may have sent the replica round receiving and backoff
+	err = c.AdvanceUntil(func() bool {
+		fs, err := node2.GetFilesystemMachine(id)
+		return err == nil && fs.GetCurrentState() == "inactive"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// then the replica is asked to delete its copy
+	e, err = node2.Dispatch(id, deleteCommit)
+	if err != nil {
+		t.Fatalf("failed to delete replica's commit: %s", err)
+	}
+	if e.Name != "commit-deleted" {
+		t.Fatalf("expected commit-deleted on the replica, got %s", e)
+	}
+	snaps, err = node2.SnapshotsFor("node2", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range snaps {
+		if s.Id == deleted {
+			t.Errorf("expected %s to be gone from the replica, got %v", deleted, snaps)
+		}
+	}
+
+	e, err = node1.Dispatch(id, deleteCommit)
+	if err != nil {
+		t.Fatalf("failed to delete commit: %s", err)
+	}
+	if e.Name != "no-such-snapshot" {
+		t.Errorf("expected no-such-snapshot deleting it again, got %s", e)
+	}
+}
+
+func TestClusterDiffCommits(t *testing.T) {
+	c := newTestCluster(t, "node1")
+	defer c.Close()
+	node1 := c.Node("node1")
+
+	id, err := node1.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = node1.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"one", "two"} {
+		err = node1.ZFS.WriteFile(id, "__default__/"+name, []byte(name))
+		if err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+		e := snapshot(t, node1, id, name)
+		if e.Name != "snapshotted" {
+			t.Fatalf("expected snapshotted, got %s", e)
+		}
+	}
+	err = node1.ZFS.WriteFile(id, "__default__/three", []byte("three"))
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	snaps, err := node1.SnapshotsFor("node1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the initial commit, then ours
+	one, two := snaps[1].Id, snaps[2].Id
+
+	for _, tc := range []struct {
+		to       string
+		expected []string
+	}{
+		{to: two, expected: []string{"two"}},
+		// uncommitted changes too
+		{to: "", expected: []string{"three", "two"}},
+	} {
+		e, err := node1.Dispatch(id, &types.Event{
+			Name:         "diff",
+			FilesystemID: id,
+			Args: &types.EventArgs{
+				"from_filesystem_id": id,
+				"from_snapshot_id":   one,
+				"to_snapshot_id":     tc.to,
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to diff: %s", err)
+		}
+		if e.Name != "diffed" {
+			t.Fatalf("expected diffed, got %s", e)
+		}
+		files, err := types.DecodeZFSFileDiff((*e.Args)["files"].(string))
+		if err != nil {
+			t.Fatalf("failed to decode diff: %s", err)
+		}
+		names := []string{}
+		for _, f := range files {
+			if f.Change != types.FileChangeAdded {
+				t.Errorf("expected %s to be added, got %s", f.Filename, f.Change)
+			}
+			names = append(names, f.Filename)
+		}
+		if strings.Join(names, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("diffing %s to %q: expected %v, got %v", one, tc.to, tc.expected, names)
+		}
+	}
+}
+
+func TestClusterRevert(t *testing.T) {
+	c := newTestCluster(t, "node1")
+	defer c.Close()
+	node1 := c.Node("node1")
+
+	id, err := node1.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = node1.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"one", "two"} {
+		err = node1.ZFS.WriteFile(id, "__default__/"+name, []byte(name))
+		if err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+		e := snapshot(t, node1, id, name)
+		if e.Name != "snapshotted" {
+			t.Fatalf("expected snapshotted, got %s", e)
+		}
+	}
+	snaps, err := node1.SnapshotsFor("node1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, two := snaps[1].Id, snaps[2].Id
+
+	e, err := node1.Dispatch(id, &types.Event{
+		Name: "revert",
+		Args: &types.EventArgs{"snapshotId": one},
+	})
+	if err != nil {
+		t.Fatalf("failed to revert: %s", err)
+	}
+	if e.Name != "reverted" {
+		t.Fatalf("expected reverted, got %s", e)
+	}
+
+	// the commits in between are kept, and the new one says where it came
+	// from
+	snaps, err = node1.SnapshotsFor("node1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 4 || snaps[2].Id != two {
+		t.Fatalf("expected a fourth commit after %s, got %v", two, snaps)
+	}
+	reverted := snaps[3]
+	if reverted.Id != (*e.Args)["SnapshotId"] {
+		t.Errorf("expected the new commit %s, got %v", reverted.Id, (*e.Args)["SnapshotId"])
+	}
+	if reverted.Metadata["reverted-to"] != one || reverted.Metadata["reverted-from"] != two {
+		t.Errorf("unexpected metadata on the revert: %v", reverted.Metadata)
+	}
+	if _, err := node1.ZFS.ReadFile(id, "", "__default__/two"); err == nil {
+		t.Errorf("expected the file added by %s to be gone", two)
+	}
+	if calls := strings.Join(node1.Containers.Calls(), ","); !strings.Contains(calls, "Stop data,Start data") {
+		t.Errorf("expected the containers to be stopped and started, got %s", calls)
+	}
+
+	e, err = node1.Dispatch(id, &types.Event{
+		Name: "revert",
+		Args: &types.EventArgs{"snapshotId": "nonexistent"},
+	})
+	if err != nil {
+		t.Fatalf("failed to revert: %s", err)
+	}
+	if e.Name != "no-such-snapshot" {
+		t.Errorf("expected no-such-snapshot, got %s", e)
+	}
+}
+
+func TestClusterPromote(t *testing.T) {
+	c := newTestCluster(t, "node1")
+	defer c.Close()
+	node1 := c.Node("node1")
+
+	id, err := node1.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = node1.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"one", "two"} {
+		e := snapshot(t, node1, id, name)
+		if e.Name != "snapshotted" {
+			t.Fatalf("expected snapshotted, got %s", e)
+		}
+	}
+	snaps, err := node1.SnapshotsFor("node1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial, one, two := snaps[0].Id, snaps[1].Id, snaps[2].Id
+
+	e, err := node1.Dispatch(id, &types.Event{
+		Name: "clone",
+		Args: &types.EventArgs{
+			"topLevelFilesystemId": id,
+			"originFilesystemId":   id,
+			"originSnapshotId":     one,
+			"newBranchName":        "branch",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to clone: %s", err)
+	}
+	if e.Name != "cloned" {
+		t.Fatalf("expected cloned, got %s", e)
+	}
+	cloneId := (*e.Args)["newFilesystemId"].(string)
+	err = node1.WaitForState(cloneId, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = snapshot(t, node1, cloneId, "three")
+	if e.Name != "snapshotted" {
+		t.Fatalf("expected snapshotted, got %s", e)
+	}
+
+	e, err = node1.Dispatch(cloneId, &types.Event{
+		Name: "promote",
+		Args: &types.EventArgs{"originFilesystemId": id},
+	})
+	if err != nil {
+		t.Fatalf("failed to promote: %s", err)
+	}
+	if e.Name != "promoted" {
+		t.Fatalf("expected promoted, got %s", e)
+	}
+
+	// the clone has taken over the commits up to the one it was cloned from
+	snaps, err = node1.SnapshotsFor("node1", cloneId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, s := range snaps {
+		ids = append(ids, s.Id)
+	}
+	if len(ids) != 3 || ids[0] != initial || ids[1] != one {
+		t.Errorf("expected the clone to have %s, %s and its own commit, got %v", initial, one, ids)
+	}
+	// and the filesystem it was cloned from is now a clone of it
+	fs, err := node1.ZFS.DiscoverSystem(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.Snapshots) != 1 || fs.Snapshots[0].Id != two || fs.Origin.FilesystemId != cloneId {
+		t.Errorf("expected %s to keep just %s as a clone of %s, got %+v", id, two, cloneId, fs)
+	}
+}
+
+// clone makes a branch of a dot from a commit of one of its filesystems,
+// returning the new branch's filesystem id, or the failure event.
+func clone(t *testing.T, n *fsmtest.Node, topLevelFilesystemId, filesystemId, snapshotId, name string) (string, *types.Event) {
+	e, err := n.Dispatch(filesystemId, &types.Event{
+		Name: "clone",
+		Args: &types.EventArgs{
+			"topLevelFilesystemId": topLevelFilesystemId,
+			"originFilesystemId":   filesystemId,
+			"originSnapshotId":     snapshotId,
+			"newBranchName":        name,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to clone: %s", err)
+	}
+	if e.Name != "cloned" {
+		return "", e
+	}
+	cloneId := (*e.Args)["newFilesystemId"].(string)
+	err = n.WaitForState(cloneId, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cloneId, e
+}
+
+func TestClusterBranchFromAnotherBranch(t *testing.T) {
+	c := newTestCluster(t, "node1")
+	defer c.Close()
+	node1 := c.Node("node1")
+
+	id, err := node1.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = node1.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAndSnapshot(t, node1, id, "on master")
+	snaps, err := node1.SnapshotsFor("node1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	featureId, e := clone(t, node1, id, id, snaps[len(snaps)-1].Id, "feature")
+	if featureId == "" {
+		t.Fatalf("expected cloned, got %s", e)
+	}
+	writeAndSnapshot(t, node1, featureId, "on feature")
+	featureSnaps, err := node1.SnapshotsFor("node1", featureId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	featureCommit := featureSnaps[len(featureSnaps)-1].Id
+
+	// a commit of feature is only on feature's filesystem, so that's where
+	// a branch from it is cloned from, whichever branch asked for it
+	_, e = clone(t, node1, id, id, featureCommit, "wrong")
+	if e.Name == "cloned" {
+		t.Errorf("expected cloning master from a commit of feature to fail")
+	}
+	branchId, e := clone(t, node1, id, featureId, featureCommit, "from-feature")
+	if branchId == "" {
+		t.Fatalf("expected cloned, got %s", e)
+	}
+	contents, err := node1.ZFS.ReadFile(branchId, "", "__default__/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "on feature" {
+		t.Errorf("expected the new branch to start with feature's contents, got %q", contents)
+	}
+	fs, err := node1.ZFS.DiscoverSystem(branchId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.Origin.FilesystemId != featureId || fs.Origin.SnapshotId != featureCommit {
+		t.Errorf("expected the new branch to be a clone of %s@%s, got %+v", featureId, featureCommit, fs.Origin)
+	}
+}
+
+func TestClusterMerge(t *testing.T) {
+	c := newTestCluster(t, "node1")
+	defer c.Close()
+	node1 := c.Node("node1")
+
+	id, err := node1.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = node1.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := snapshot(t, node1, id, "one")
+	if e.Name != "snapshotted" {
+		t.Fatalf("expected snapshotted, got %s", e)
+	}
+	snaps, err := node1.SnapshotsFor("node1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := snaps[1].Id
+
+	e, err = node1.Dispatch(id, &types.Event{
+		Name: "clone",
+		Args: &types.EventArgs{
+			"topLevelFilesystemId": id,
+			"originFilesystemId":   id,
+			"originSnapshotId":     one,
+			"newBranchName":        "branch",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to clone: %s", err)
+	}
+	if e.Name != "cloned" {
+		t.Fatalf("expected cloned, got %s", e)
+	}
+	cloneId := (*e.Args)["newFilesystemId"].(string)
+	err = node1.WaitForState(cloneId, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = snapshot(t, node1, cloneId, "two")
+	if e.Name != "snapshotted" {
+		t.Fatalf("expected snapshotted, got %s", e)
+	}
+	two := (*e.Args)["SnapshotId"].(string)
+
+	merge := func() types.MergeResult {
+		e, err := node1.Dispatch(id, &types.Event{
+			Name: "merge",
+			Args: &types.EventArgs{
+				"sourceFilesystemId": cloneId,
+				"metadata":           map[string]string{"message": "Merge branch"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to merge: %s", err)
+		}
+		if e.Name != "merged" {
+			t.Fatalf("expected merged, got %s", e)
+		}
+		var result types.MergeResult
+		err = json.Unmarshal([]byte((*e.Args)["result"].(string)), &result)
+		if err != nil {
+			t.Fatalf("failed to decode the merge result: %s", err)
+		}
+		return result
+	}
+
+	// the branch's history goes back through master to the commit it was
+	// cloned from
+	result := merge()
+	if result.UpToDate || result.Base != one || result.SourceCommit != two {
+		t.Errorf("expected to merge %s since %s, got %+v", two, one, result)
+	}
+	snaps, err = node1.SnapshotsFor("node1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := snaps[len(snaps)-1]
+	if merged.Id != result.SnapshotId || merged.Metadata["merged-commit"] != two {
+		t.Errorf("expected a merge commit recording %s, got %+v", two, merged)
+	}
+
+	// so merging again finds nothing new
+	result = merge()
+	if !result.UpToDate || result.SnapshotId != "" {
+		t.Errorf("expected master to be up to date with the branch, got %+v", result)
+	}
+}
+
+func TestClusterCherryPick(t *testing.T) {
+	c := newTestCluster(t, "node1")
+	defer c.Close()
+	node1 := c.Node("node1")
+
+	id, err := node1.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = node1.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := snapshot(t, node1, id, "one")
+	if e.Name != "snapshotted" {
+		t.Fatalf("expected snapshotted, got %s", e)
+	}
+	one := (*e.Args)["SnapshotId"].(string)
+
+	e, err = node1.Dispatch(id, &types.Event{
+		Name: "clone",
+		Args: &types.EventArgs{
+			"topLevelFilesystemId": id,
+			"originFilesystemId":   id,
+			"originSnapshotId":     one,
+			"newBranchName":        "hotfix",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to clone: %s", err)
+	}
+	if e.Name != "cloned" {
+		t.Fatalf("expected cloned, got %s", e)
+	}
+	cloneId := (*e.Args)["newFilesystemId"].(string)
+	err = node1.WaitForState(cloneId, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = snapshot(t, node1, cloneId, "the fix")
+	if e.Name != "snapshotted" {
+		t.Fatalf("expected snapshotted, got %s", e)
+	}
+	fix := (*e.Args)["SnapshotId"].(string)
+
+	cherryPick := func(filesystemId, sourceFilesystemId, snapshotId string) *types.Event {
+		e, err := node1.Dispatch(filesystemId, &types.Event{
+			Name: "cherry-pick",
+			Args: &types.EventArgs{
+				"sourceFilesystemId": sourceFilesystemId,
+				"snapshotId":         snapshotId,
+				"metadata":           map[string]string{},
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to cherry-pick: %s", err)
+		}
+		return e
+	}
+
+	// the fix is compared with the commit before it, which is on master
+	e = cherryPick(id, cloneId, fix)
+	if e.Name != "cherry-picked" {
+		t.Fatalf("expected cherry-picked, got %s", e)
+	}
+	var result types.MergeResult
+	err = json.Unmarshal([]byte((*e.Args)["result"].(string)), &result)
+	if err != nil {
+		t.Fatalf("failed to decode the cherry-pick result: %s", err)
+	}
+	if result.Base != one || result.SourceCommit != fix {
+		t.Errorf("expected to pick %s since %s, got %+v", fix, one, result)
+	}
+	snaps, err := node1.SnapshotsFor("node1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	picked := snaps[len(snaps)-1]
+	if picked.Id != result.SnapshotId || picked.Metadata["cherry-picked-from"] != fix || picked.Metadata["message"] != "the fix" {
+		t.Errorf("expected a commit pointing back to %s, got %+v", fix, picked)
+	}
+
+	// the hotfix branch already has master's commit
+	e = cherryPick(cloneId, id, one)
+	if e.Name != "already-on-branch" {
+		t.Errorf("expected already-on-branch, got %s", e)
+	}
+}
+
+func TestClusterStash(t *testing.T) {
+	c := newTestCluster(t, "node1")
+	defer c.Close()
+	node1 := c.Node("node1")
+
+	id, err := node1.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = node1.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"one", "two"} {
+		e := snapshot(t, node1, id, name)
+		if e.Name != "snapshotted" {
+			t.Fatalf("expected snapshotted, got %s", e)
+		}
+	}
+	snaps, err := node1.SnapshotsFor("node1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, two := snaps[1].Id, snaps[2].Id
+
+	e, err := node1.Dispatch(id, &types.Event{
+		Name: "stash",
+		Args: &types.EventArgs{"snapshotId": one, "transferRequestId": "transfer-1"},
+	})
+	if err != nil {
+		t.Fatalf("failed to stash: %s", err)
+	}
+	if e.Name != "stashed" {
+		t.Fatalf("expected stashed, got %s", e)
+	}
+
+	// the new branch is marked as a stash of master, found by the transfer
+	name := (*e.Args)["NewBranchName"].(string)
+	clone, err := node1.Registry.LookupClone(id, name)
+	if err != nil {
+		t.Fatalf("expected a branch called %s: %s", name, err)
+	}
+	if clone.Stash == nil || clone.Stash.Branch != "" || clone.Stash.TransferRequestId != "transfer-1" {
+		t.Fatalf("expected %s to be marked as a stash of master, got %+v", name, clone.Stash)
+	}
+	if !clone.Stash.Created.Equal(c.Clock.Now().UTC()) || clone.Origin.SnapshotId != one {
+		t.Errorf("unexpected stash %+v from %+v", clone.Stash, clone.Origin)
+	}
+	err = node1.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node1.WaitForState(clone.FilesystemId, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// applying it commits the stash's contents on master
+	e, err = node1.Dispatch(id, &types.Event{
+		Name: "apply-stash",
+		Args: &types.EventArgs{
+			"sourceFilesystemId": clone.FilesystemId,
+			"snapshotId":         two,
+			"metadata":           map[string]string{"message": "Apply stash"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to apply stash: %s", err)
+	}
+	if e.Name != "stash-applied" {
+		t.Fatalf("expected stash-applied, got %s", e)
+	}
+	snaps, err = node1.SnapshotsFor("node1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := snaps[len(snaps)-1]
+	if len(snaps) != 3 || applied.Metadata["applied-stash-commit"] != two {
+		t.Errorf("expected a new commit after %s recording %s, got %v", one, two, snaps)
+	}
+}
+
+// waitForTransfer moves the clock on, so that retries aren't kept waiting,
+// until the transfer's initiator responds. The clocks of peers, whose
+// machines back off when a receive fails, move with it.
+func waitForTransfer(t *testing.T, c *fsmtest.Cluster, done chan *types.Event, peers ...*fsmtest.Cluster) *types.Event {
+	var e *types.Event
+	err := c.AdvanceUntil(func() bool {
+		for _, peer := range peers {
+			peer.Clock.Advance(time.Second)
+		}
+		select {
+		case e = <-done:
+			return true
+		default:
+			return false
+		}
+	})
+	if err != nil {
+		t.Fatalf("transfer didn't finish: %s", err)
+	}
+	return e
+}
+
+func transferRequest(direction string, peer *fsmtest.Cluster, peerNode *fsmtest.Node) types.TransferRequest {
+	host, port := peerNode.Peer()
+	return types.TransferRequest{
+		Peer:            host,
+		Port:            port,
+		User:            peer.Admin.Name,
+		ApiKey:          peer.Admin.ApiKey,
+		Direction:       direction,
+		LocalNamespace:  "admin",
+		LocalName:       "data",
+		RemoteNamespace: "admin",
+		RemoteName:      "data",
+	}
+}
+
+func TestClusterPushToAnotherCluster(t *testing.T) {
+	here := newTestCluster(t, "here")
+	defer here.Close()
+	there := newTestCluster(t, "there")
+	defer there.Close()
+	local, remote := here.Node("here"), there.Node("there")
+
+	id, err := local.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = local.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = local.ZFS.WriteFile(id, "__default__/hello", []byte("world"))
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	e := snapshot(t, local, id, "hello")
+	if e.Name != "snapshotted" {
+		t.Fatalf("expected snapshotted, got %s", e)
+	}
+
+	// the server registers the dot on the peer before it starts the push
+	err = remote.RegisterFilesystem("data", id)
+	if err != nil {
+		t.Fatalf("failed to register filesystem on the peer: %s", err)
+	}
+	transferRequestId, done, err := local.StartTransfer(id, transferRequest("push", there, remote))
+	if err != nil {
+		t.Fatalf("failed to start push: %s", err)
+	}
+	e = waitForTransfer(t, here, done)
+	if e.Name != "finished-push" {
+		t.Fatalf("expected finished-push, got %s", e)
+	}
+
+	contents, err := remote.ZFS.ReadFile(id, "", "__default__/hello")
+	if err != nil || string(contents) != "world" {
+		t.Errorf("expected pushed contents 'world', got '%s' (%v)", contents, err)
+	}
+	transfer, ok := local.Transfer(transferRequestId)
+	if !ok || transfer.Status != "finished" {
+		t.Errorf("expected the push to be finished, got %+v", transfer)
+	}
+	if transfer.StreamEncoding == "" {
+		t.Errorf("expected the peer to agree a stream encoding, got %+v", transfer)
+	}
+
+	// pushing again finds the peer has everything
+	_, done, err = local.StartTransfer(id, transferRequest("push", there, remote))
+	if err != nil {
+		t.Fatalf("failed to start push: %s", err)
+	}
+	e = waitForTransfer(t, here, done)
+	if e.Name != "peer-up-to-date" {
+		t.Errorf("expected peer-up-to-date, got %s", e)
+	}
+}
+
+func TestClusterPushToOldPeer(t *testing.T) {
+	here := newTestCluster(t, "here")
+	defer here.Close()
+	there := newTestCluster(t, "there")
+	defer there.Close()
+	local, remote := here.Node("here"), there.Node("there")
+	// servers from before NegotiateTransfer only have RegisterTransfer
+	remote.DisableRPC("DotmeshRPC.NegotiateTransfer")
+
+	id, err := local.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = local.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = local.ZFS.WriteFile(id, "__default__/hello", []byte("world"))
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	e := snapshot(t, local, id, "hello")
+	if e.Name != "snapshotted" {
+		t.Fatalf("expected snapshotted, got %s", e)
+	}
+
+	err = remote.RegisterFilesystem("data", id)
+	if err != nil {
+		t.Fatalf("failed to register filesystem on the peer: %s", err)
+	}
+	transferRequestId, done, err := local.StartTransfer(id, transferRequest("push", there, remote))
+	if err != nil {
+		t.Fatalf("failed to start push: %s", err)
+	}
+	e = waitForTransfer(t, here, done)
+	if e.Name != "finished-push" {
+		t.Fatalf("expected finished-push, got %s", e)
+	}
+
+	contents, err := remote.ZFS.ReadFile(id, "", "__default__/hello")
+	if err != nil || string(contents) != "world" {
+		t.Errorf("expected pushed contents 'world', got '%s' (%v)", contents, err)
+	}
+	transfer, ok := local.Transfer(transferRequestId)
+	if !ok || transfer.Status != "finished" {
+		t.Errorf("expected the push to be finished, got %+v", transfer)
+	}
+	if transfer.StreamEncoding != "" || transfer.CompressedStream {
+		t.Errorf("expected an uncompressed stream to the old peer, got %+v", transfer)
+	}
+}
+
+func TestClusterPullFromAnotherCluster(t *testing.T) {
+	here := newTestCluster(t, "here")
+	defer here.Close()
+	there := newTestCluster(t, "there")
+	defer there.Close()
+	local, remote := here.Node("here"), there.Node("there")
+
+	id, err := remote.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = remote.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = remote.ZFS.WriteFile(id, "__default__/hello", []byte("world"))
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	e := snapshot(t, remote, id, "hello")
+	if e.Name != "snapshotted" {
+		t.Fatalf("expected snapshotted, got %s", e)
+	}
+
+	// the server registers the dot locally before it starts the pull
+	err = local.RegisterFilesystem("data", id)
+	if err != nil {
+		t.Fatalf("failed to register filesystem: %s", err)
+	}
+	_, done, err := local.StartTransfer(id, transferRequest("pull", there, remote))
+	if err != nil {
+		t.Fatalf("failed to start pull: %s", err)
+	}
+	e = waitForTransfer(t, here, done)
+	if e.Name != "finished-pull" {
+		t.Fatalf("expected finished-pull, got %s", e)
+	}
+	contents, err := local.ZFS.ReadFile(id, "", "__default__/hello")
+	if err != nil || string(contents) != "world" {
+		t.Errorf("expected pulled contents 'world', got '%s' (%v)", contents, err)
+	}
+}
+
+// writeAndSnapshot writes contents to a file in the filesystem and commits it.
+func writeAndSnapshot(t *testing.T, n *fsmtest.Node, filesystemId, contents string) {
+	err := n.ZFS.WriteFile(filesystemId, "__default__/hello", []byte(contents))
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	e := snapshot(t, n, filesystemId, contents)
+	if e.Name != "snapshotted" {
+		t.Fatalf("expected snapshotted, got %s", e)
+	}
+}
+
+func TestClusterResumeInterruptedPush(t *testing.T) {
+	here := newTestCluster(t, "here")
+	defer here.Close()
+	there := newTestCluster(t, "there")
+	defer there.Close()
+	local, remote := here.Node("here"), there.Node("there")
+
+	id, err := local.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = local.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAndSnapshot(t, local, id, "hello")
+	writeAndSnapshot(t, local, id, "hello again")
+	snaps, err := local.SnapshotsFor("here", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := snaps[len(snaps)-1]
+
+	err = remote.RegisterFilesystem("data", id)
+	if err != nil {
+		t.Fatalf("failed to register filesystem on the peer: %s", err)
+	}
+	// the first attempt gets the first commit across, and part of the
+	// second
+	remote.ZFS.InterruptNextRecv()
+	transferRequestId, done, err := local.StartTransfer(id, transferRequest("push", there, remote))
+	if err != nil {
+		t.Fatalf("failed to start push: %s", err)
+	}
+	e := waitForTransfer(t, here, done, there)
+	if e.Name != "finished-push" {
+		t.Fatalf("expected finished-push, got %s", e)
+	}
+
+	contents, err := remote.ZFS.ReadFile(id, latest.Id, "__default__/hello")
+	if err != nil || string(contents) != "hello again" {
+		t.Errorf("expected pushed contents 'hello again', got '%s' (%v)", contents, err)
+	}
+	transfer, ok := local.Transfer(transferRequestId)
+	if !ok || transfer.Status != "finished" {
+		t.Errorf("expected the push to be finished, got %+v", transfer)
+	}
+	if transfer.Saved <= 0 {
+		t.Errorf("expected resuming to save sending some of %s again, got %+v", latest.Id, transfer)
+	}
+	token, err := remote.ZFS.ReceiveResumeToken(id)
+	if err != nil || token != "" {
+		t.Errorf("expected no partial receive left on the peer, got %q (%v)", token, err)
+	}
+}
+
+func TestClusterResumeInterruptedPull(t *testing.T) {
+	here := newTestCluster(t, "here")
+	defer here.Close()
+	there := newTestCluster(t, "there")
+	defer there.Close()
+	local, remote := here.Node("here"), there.Node("there")
+
+	id, err := remote.CreateFilesystem("data")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	err = remote.WaitForState(id, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAndSnapshot(t, remote, id, "hello")
+	writeAndSnapshot(t, remote, id, "hello again")
+	snaps, err := remote.SnapshotsFor("there", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := snaps[len(snaps)-1]
+
+	err = local.RegisterFilesystem("data", id)
+	if err != nil {
+		t.Fatalf("failed to register filesystem: %s", err)
+	}
+	local.ZFS.InterruptNextRecv()
+	transferRequestId, done, err := local.StartTransfer(id, transferRequest("pull", there, remote))
+	if err != nil {
+		t.Fatalf("failed to start pull: %s", err)
+	}
+	e := waitForTransfer(t, here, done)
+	if e.Name != "finished-pull" {
+		t.Fatalf("expected finished-pull, got %s", e)
+	}
+
+	contents, err := local.ZFS.ReadFile(id, latest.Id, "__default__/hello")
+	if err != nil || string(contents) != "hello again" {
+		t.Errorf("expected pulled contents 'hello again', got '%s' (%v)", contents, err)
+	}
+	transfer, ok := local.Transfer(transferRequestId)
+	if !ok || transfer.Status != "finished" {
+		t.Errorf("expected the pull to be finished, got %+v", transfer)
+	}
+	if transfer.Saved <= 0 {
+		t.Errorf("expected resuming to save sending some of %s again, got %+v", latest.Id, transfer)
+	}
+}
@@ -14,7 +14,32 @@ func (f *FsMachine) diff(e *types.Event) (responseEvent *types.Event, nextState
 		return types.NewErrorEvent("cannot-diff", fmt.Errorf("filesystem_id not specified")), activeState
 	}
 
-	diffFiles, err := f.zfs.Diff(e.FilesystemID)
+	var diffFiles []types.ZFSFileDiff
+	var total int
+	var err error
+	if e.Args != nil && (*e.Args)["from_snapshot_id"] != nil {
+		// compare two commits, the second of which is on this filesystem
+		// ("" for its uncommitted changes) and the first on this or a related
+		// one
+		fromFilesystemID, ok := getStringVal(*e.Args, "from_filesystem_id")
+		if !ok {
+			return types.NewErrorEvent("cannot-diff", fmt.Errorf("from_filesystem_id not specified")), activeState
+		}
+		fromSnapshotID, ok := getStringVal(*e.Args, "from_snapshot_id")
+		if !ok {
+			return types.NewErrorEvent("cannot-diff", fmt.Errorf("from_snapshot_id not specified")), activeState
+		}
+		toSnapshotID, _ := (*e.Args)["to_snapshot_id"].(string)
+		opts := types.DiffOptions{
+			Offset: getIntVal(*e.Args, "offset"),
+			Limit:  getIntVal(*e.Args, "limit"),
+		}
+		opts.Hunks, _ = (*e.Args)["hunks"].(bool)
+		diffFiles, total, err = f.zfs.DiffSnapshots(fromFilesystemID, fromSnapshotID, e.FilesystemID, toSnapshotID, opts)
+	} else {
+		diffFiles, err = f.zfs.Diff(e.FilesystemID)
+		total = len(diffFiles)
+	}
 	if err != nil {
 		return types.NewErrorEvent("zfs-diff-failed", fmt.Errorf("diff failed: %s", err)), activeState
 	}
@@ -28,10 +53,24 @@ func (f *FsMachine) diff(e *types.Event) (responseEvent *types.Event, nextState
 		Name: "diffed",
 		Args: &types.EventArgs{
 			"files": encoded,
+			"total": total,
 		},
 	}, activeState
 }
 
+// getIntVal returns an optional number, which will have become a float64 if
+// the event came over the wire.
+func getIntVal(vals map[string]interface{}, key string) int {
+	switch val := vals[key].(type) {
+	case int:
+		return val
+	case float64:
+		return int(val)
+	default:
+		return 0
+	}
+}
+
 func getStringVal(vals map[string]interface{}, key string) (string, bool) {
 	val, ok := vals[key]
 	if !ok {
@@ -33,6 +33,22 @@ func inactiveState(f *FsMachine) StateFn {
 			f.innerResponses <- event
 			return true, nextState
 
+		} else if e.Name == "cancel-transfer" {
+			// CancelTransfer has already stopped the transfer, this tidies
+			// up after it
+			f.innerResponses <- f.abortCancelledTransfer()
+			return true, inactiveState
+
+		} else if e.Name == "delete-commit" {
+			// the master has already deleted it
+			f.innerResponses <- f.deleteCommit(e)
+			return true, inactiveState
+
+		} else if e.Name == "promote" {
+			// the filesystem it was cloned from is about to be deleted
+			f.innerResponses <- f.promote(e)
+			return true, inactiveState
+
 		} else if e.Name == "unmount" {
 			f.innerResponses <- &types.Event{
 				Name: "unmounted",
@@ -0,0 +1,556 @@
+package fsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/dotmesh-io/dotmesh/pkg/utils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// merge applies the changes made on another branch, since the two last had a
+// commit in common, to the live filesystem and commits the result. Paths this
+// branch has changed too are left alone unless both sides made the same
+// change, and reported as conflicts. The merge commit records the commit
+// merged, so that merging the same branch again only picks up what's new,
+// unless there were conflicts: then merging again offers their changes again.
+func (f *FsMachine) merge(e *types.Event) (responseEvent *types.Event, nextState StateFn) {
+	sourceFilesystemId, ok := (*e.Args)["sourceFilesystemId"].(string)
+	if !ok {
+		return types.NewErrorEvent("cant-merge", fmt.Errorf("sourceFilesystemId not specified")), activeState
+	}
+	if sourceFilesystemId == f.filesystemId {
+		return types.NewErrorEvent("cant-merge", fmt.Errorf("can't merge a branch into itself")), activeState
+	}
+	meta := map[string]string{}
+	if val, ok := (*e.Args)["metadata"]; ok {
+		var err error
+		meta, err = castToMetadata(val)
+		if err != nil {
+			return types.NewErrorEvent("unknown-metadata-format", err), activeState
+		}
+	}
+
+	theirs, theirsOn, err := f.branchHistory(sourceFilesystemId)
+	if err != nil {
+		return types.NewErrorEvent("failed-listing-commits", err), activeState
+	}
+	ours, _, err := f.branchHistory(f.filesystemId)
+	if err != nil {
+		return types.NewErrorEvent("failed-listing-commits", err), activeState
+	}
+	base, err := mergeBase(theirs, ours)
+	switch err.(type) {
+	case nil:
+	case *ToSnapsUpToDate, *ToSnapsAhead:
+		return mergedEvent(&types.MergeResult{UpToDate: true}), activeState
+	case *NoCommonSnapshots:
+		return types.NewErrorEvent("no-common-commits", fmt.Errorf("the branches have no commits in common")), activeState
+	default:
+		return types.NewErrorEvent("cant-merge", err), activeState
+	}
+	source := theirs[len(theirs)-1]
+
+	meta["merged-commit"] = source.Id
+	meta["merge-base"] = base.Id
+	return f.mergeCommit(theirsOn[base.Id], base.Id, theirsOn[source.Id], source.Id, meta)
+}
+
+// cherryPick applies the changes one commit made, since the commit before it
+// on its branch, to the live filesystem and commits the result, recording the
+// commit picked. It's a merge of that one commit, so paths this branch has
+// changed differently since the commit before it are left alone and reported
+// as conflicts.
+func (f *FsMachine) cherryPick(e *types.Event) (responseEvent *types.Event, nextState StateFn) {
+	sourceFilesystemId, ok := (*e.Args)["sourceFilesystemId"].(string)
+	if !ok {
+		return types.NewErrorEvent("cant-cherry-pick", fmt.Errorf("sourceFilesystemId not specified")), activeState
+	}
+	snapshotId, ok := (*e.Args)["snapshotId"].(string)
+	if !ok {
+		return types.NewErrorEvent("cant-cherry-pick", fmt.Errorf("snapshotId not specified")), activeState
+	}
+	meta := map[string]string{}
+	if val, ok := (*e.Args)["metadata"]; ok {
+		var err error
+		meta, err = castToMetadata(val)
+		if err != nil {
+			return types.NewErrorEvent("unknown-metadata-format", err), activeState
+		}
+	}
+
+	ours, _, err := f.branchHistory(f.filesystemId)
+	if err != nil {
+		return types.NewErrorEvent("failed-listing-commits", err), activeState
+	}
+	for _, s := range ours {
+		if s.Id == snapshotId {
+			return types.NewErrorEvent(
+				"already-on-branch", fmt.Errorf("commit %s is already on this branch", snapshotId),
+			), activeState
+		}
+	}
+	history, on, err := f.branchHistory(sourceFilesystemId)
+	if err != nil {
+		return types.NewErrorEvent("failed-listing-commits", err), activeState
+	}
+	history, err = restrictSnapshots(history, snapshotId)
+	if err != nil {
+		return types.NewErrorEvent("no-such-snapshot", fmt.Errorf("Commit %s not found", snapshotId)), activeState
+	}
+	if len(history) < 2 {
+		return types.NewErrorEvent(
+			"cant-cherry-pick", fmt.Errorf("commit %s is the first one, there's nothing before it to compare it with", snapshotId),
+		), activeState
+	}
+	picked, parent := history[len(history)-1], history[len(history)-2]
+
+	if meta["message"] == "" {
+		meta["message"] = picked.Metadata["message"]
+	}
+	meta["cherry-picked-from"] = picked.Id
+	responseEvent, nextState = f.mergeCommit(on[parent.Id], parent.Id, on[picked.Id], picked.Id, meta)
+	if responseEvent.Name == "merged" {
+		responseEvent.Name = "cherry-picked"
+	}
+	return responseEvent, nextState
+}
+
+// mergeCommit applies the changes from one commit (base) to another (source),
+// which may be on other filesystems, to the live filesystem, except where
+// they conflict with the changes this filesystem has made since base, and
+// commits the result with the given metadata. Anything uncommitted counts as
+// one of this filesystem's changes, and is committed along with the merge.
+func (f *FsMachine) mergeCommit(
+	baseFilesystemId, baseId, sourceFilesystemId, sourceId string, meta map[string]string,
+) (responseEvent *types.Event, nextState StateFn) {
+	theirChanges, _, err := f.zfs.DiffSnapshots(baseFilesystemId, baseId, sourceFilesystemId, sourceId, types.DiffOptions{})
+	if err != nil {
+		return types.NewErrorEvent("zfs-diff-failed", err), activeState
+	}
+	ourChanges, _, err := f.zfs.DiffSnapshots(baseFilesystemId, baseId, f.filesystemId, "", types.DiffOptions{})
+	if err != nil {
+		return types.NewErrorEvent("zfs-diff-failed", err), activeState
+	}
+
+	mounted, state := f.mountSnapOf(sourceFilesystemId, sourceId, true)
+	if mounted.Name != "mounted" {
+		return mounted, state
+	}
+	fromRoot := filepath.Join((*mounted.Args)["mount-path"].(string), "__default__")
+	toRoot := filepath.Join(utils.Mnt(f.filesystemId), "__default__")
+
+	applied, conflicts, err := mergeChanges(ourChanges, theirChanges, func(p string) (bool, error) {
+		return sameFile(fromRoot, toRoot, p)
+	})
+	if err != nil {
+		return types.NewErrorEvent("failed-merge", err), activeState
+	}
+	result := &types.MergeResult{
+		Base:         baseId,
+		SourceCommit: sourceId,
+		Applied:      applied,
+		Conflicts:    conflicts,
+	}
+
+	responseEvent, nextState = f.applyAndCommit(fromRoot, toRoot, applied, conflictedMetadata(meta, conflicts))
+	if responseEvent.Name == "snapshotted" {
+		result.SnapshotId, _ = (*responseEvent.Args)["SnapshotId"].(string)
+		responseEvent = mergedEvent(result)
+		f.transitionedTo("active", "merged")
+	}
+	return responseEvent, nextState
+}
+
+// applyAndCommit makes the given changes to the live filesystem, copying
+// what's added or modified from fromRoot, and commits the result with the
+// given metadata, responding "snapshotted" if it all worked. Containers using
+// the dot are stopped while the files are changed.
+func (f *FsMachine) applyAndCommit(
+	fromRoot, toRoot string, changes []types.ZFSFileDiff, meta map[string]string,
+) (responseEvent *types.Event, nextState StateFn) {
+	err := f.stopContainers()
+	if err != nil {
+		log.Printf(
+			"%v while trying to stop containers applying changes to %s",
+			err, f.zfs.FQ(f.filesystemId),
+		)
+		return types.NewErrorEvent("failed-stop-containers-during-apply", err), backoffState
+	}
+	err = applyChanges(fromRoot, toRoot, changes)
+	if err != nil {
+		responseEvent, nextState = types.NewErrorEvent("failed-apply", err), activeState
+	} else {
+		responseEvent, nextState = f.snapshot(&types.Event{
+			Name: "snapshot",
+			Args: &types.EventArgs{"metadata": meta},
+		})
+	}
+
+	err = f.startContainers()
+	if err != nil {
+		log.Printf(
+			"%v while trying to start containers applying changes to %s",
+			err, f.zfs.FQ(f.filesystemId),
+		)
+		if responseEvent.Name == "snapshotted" {
+			return types.NewErrorEvent("failed-start-containers-during-apply", err), backoffState
+		}
+	}
+	return responseEvent, nextState
+}
+
+// conflictedMetadata returns the metadata of a merge commit given the
+// conflicts the merge left. A merge with conflicts records the commit it
+// merged as merged-with-conflicts rather than merged-commit, so that mergeBase
+// doesn't move past the changes which weren't applied.
+func conflictedMetadata(meta map[string]string, conflicts []types.MergeConflict) map[string]string {
+	merged, ok := meta["merged-commit"]
+	if len(conflicts) == 0 || !ok {
+		return meta
+	}
+	result := map[string]string{}
+	for k, v := range meta {
+		result[k] = v
+	}
+	delete(result, "merged-commit")
+	result["merged-with-conflicts"] = merged
+	return result
+}
+
+func mergedEvent(result *types.MergeResult) *types.Event {
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return types.NewErrorEvent("merge-encode-failed", err)
+	}
+	return &types.Event{
+		Name: "merged",
+		Args: &types.EventArgs{"SnapshotId": result.SnapshotId, "result": string(encoded)},
+	}
+}
+
+// branchHistory returns every commit of a branch, oldest first: those of the
+// branch it was cloned from up to the origin, and then its own. It also
+// returns the filesystem each commit is on.
+func (f *FsMachine) branchHistory(filesystemId string) ([]*types.Snapshot, map[string]string, error) {
+	snaps, err := f.state.SnapshotsForCurrentMaster(filesystemId)
+	if err != nil {
+		return nil, nil, err
+	}
+	history := []*types.Snapshot{}
+	on := map[string]string{}
+	clone, err := f.registry.LookupCloneById(filesystemId)
+	if err == nil && clone.Origin.FilesystemId != "" && clone.Origin.FilesystemId != filesystemId {
+		history, on, err = f.branchHistory(clone.Origin.FilesystemId)
+		if err != nil {
+			return nil, nil, err
+		}
+		history, err = restrictSnapshots(history, clone.Origin.SnapshotId)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for i := range snaps {
+		history = append(history, &snaps[i])
+		on[snaps[i].Id] = filesystemId
+	}
+	return history, on, nil
+}
+
+// mergeBase works out which commit to merge the changes on theirs since: the
+// latest commit the two branches have in common, as canApply finds it, or a
+// later commit of theirs which one of ours records having merged. It returns
+// ToSnapsUpToDate or ToSnapsAhead when there's nothing to merge.
+func mergeBase(theirs, ours []*types.Snapshot) (*types.Snapshot, error) {
+	var base *types.Snapshot
+	snapRange, err := canApply(theirs, ours)
+	switch err := err.(type) {
+	case nil:
+		base = snapRange.fromSnap
+	case *ToSnapsDiverged:
+		base = &err.latestCommonSnapshot
+	default:
+		return nil, err
+	}
+	if base == nil {
+		return nil, &NoCommonSnapshots{FromSnaps: theirs, ToSnaps: ours}
+	}
+
+	merged := map[string]bool{}
+	for _, s := range ours {
+		if id := s.Metadata["merged-commit"]; id != "" {
+			merged[id] = true
+		}
+	}
+	for i := len(theirs) - 1; i >= 0 && theirs[i].Id != base.Id; i-- {
+		if merged[theirs[i].Id] {
+			if i == len(theirs)-1 {
+				return nil, &ToSnapsUpToDate{}
+			}
+			return theirs[i], nil
+		}
+	}
+	return base, nil
+}
+
+// mergeChanges works out which of their changes to apply on top of ours,
+// given both sides' changes since a common commit. A change is applied unless
+// ours changed the same path, or removed (or replaced with something that
+// isn't a directory) a directory it's in, or it removes a directory ours
+// changed something in. Those are conflicts, unless same says that both
+// sides ended up with the same thing at the path.
+//
+// Directories which are still directories on both sides are only compared
+// by their contents, so changes to their permissions aren't merged.
+func mergeChanges(ours, theirs []types.ZFSFileDiff, same func(path string) (bool, error)) ([]types.ZFSFileDiff, []types.MergeConflict, error) {
+	ourChanges := map[string]types.ZFSFileDiff{}
+	for _, c := range ours {
+		if !isDirectoryChange(c) {
+			ourChanges[c.Filename] = c
+		}
+	}
+	// our change to the path, or to the nearest directory above it which
+	// ours no longer has as a directory
+	ourChange := func(p string) (types.ZFSFileDiff, bool) {
+		if c, ok := ourChanges[p]; ok {
+			return c, true
+		}
+		for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if c, ok := ourChanges[dir]; ok && removesDirectory(c) {
+				return c, true
+			}
+		}
+		return types.ZFSFileDiff{}, false
+	}
+	// whether ours changed anything under the path
+	oursUnder := func(p string) bool {
+		for name := range ourChanges {
+			if strings.HasPrefix(name, p+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	applied := []types.ZFSFileDiff{}
+	conflicts := []types.MergeConflict{}
+	for _, c := range theirs {
+		if isDirectoryChange(c) {
+			continue
+		}
+		o, changed := ourChange(c.Filename)
+		if !changed && removesDirectory(c) && oursUnder(c.Filename) {
+			o, changed = types.ZFSFileDiff{Change: types.FileChangeModified}, true
+		}
+		if !changed {
+			applied = append(applied, c)
+			continue
+		}
+		if o.Filename == c.Filename {
+			if o.Change == types.FileChangeRemoved && c.Change == types.FileChangeRemoved {
+				continue
+			}
+			if o.New != nil && c.New != nil && o.New.Type == types.FileTypeDirectory && c.New.Type == types.FileTypeDirectory {
+				// both made a directory here, what's in it is merged
+				// separately
+				continue
+			}
+			identical, err := same(c.Filename)
+			if err != nil {
+				return nil, nil, err
+			}
+			if identical {
+				continue
+			}
+		}
+		conflicts = append(conflicts, types.MergeConflict{Path: c.Filename, Ours: o.Change, Theirs: c.Change})
+	}
+	return applied, conflicts, nil
+}
+
+// isDirectoryChange says whether a change is only to a directory's
+// metadata, which happens whenever something in it changes.
+func isDirectoryChange(c types.ZFSFileDiff) bool {
+	return c.Old != nil && c.New != nil &&
+		c.Old.Type == types.FileTypeDirectory && c.New.Type == types.FileTypeDirectory
+}
+
+// removesDirectory says whether a change leaves no directory where there was
+// one, or might have been.
+func removesDirectory(c types.ZFSFileDiff) bool {
+	if c.Change == types.FileChangeRemoved {
+		return true
+	}
+	return c.Old != nil && c.Old.Type == types.FileTypeDirectory &&
+		c.New != nil && c.New.Type != types.FileTypeDirectory
+}
+
+// sameFile says whether a path is the same under both roots: missing from
+// both, or the same type of thing with the same permissions and contents.
+func sameFile(oneRoot, otherRoot, p string) (bool, error) {
+	one, err := pathUnder(oneRoot, p)
+	if err != nil {
+		return false, err
+	}
+	other, err := pathUnder(otherRoot, p)
+	if err != nil {
+		return false, err
+	}
+	oneInfo, oneErr := os.Lstat(one)
+	otherInfo, otherErr := os.Lstat(other)
+	if os.IsNotExist(oneErr) || os.IsNotExist(otherErr) {
+		return os.IsNotExist(oneErr) && os.IsNotExist(otherErr), nil
+	}
+	if oneErr != nil {
+		return false, oneErr
+	}
+	if otherErr != nil {
+		return false, otherErr
+	}
+	if oneInfo.Mode() != otherInfo.Mode() {
+		return false, nil
+	}
+	switch types.FileTypeOf(oneInfo.Mode()) {
+	case types.FileTypeDirectory:
+		return true, nil
+	case types.FileTypeSymlink:
+		oneTarget, err := os.Readlink(one)
+		if err != nil {
+			return false, err
+		}
+		otherTarget, err := os.Readlink(other)
+		if err != nil {
+			return false, err
+		}
+		return oneTarget == otherTarget, nil
+	case types.FileTypeFile:
+		if oneInfo.Size() != otherInfo.Size() {
+			return false, nil
+		}
+		return sameContents(one, other)
+	default:
+		return false, nil
+	}
+}
+
+func sameContents(one, other string) (bool, error) {
+	oneFile, err := os.Open(one)
+	if err != nil {
+		return false, err
+	}
+	defer oneFile.Close()
+	otherFile, err := os.Open(other)
+	if err != nil {
+		return false, err
+	}
+	defer otherFile.Close()
+
+	oneBuf, otherBuf := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		n, oneErr := io.ReadFull(oneFile, oneBuf)
+		m, otherErr := io.ReadFull(otherFile, otherBuf)
+		if n != m || !bytes.Equal(oneBuf[:n], otherBuf[:m]) {
+			return false, nil
+		}
+		if oneErr == io.EOF || oneErr == io.ErrUnexpectedEOF {
+			return otherErr == io.EOF || otherErr == io.ErrUnexpectedEOF, nil
+		}
+		if oneErr != nil {
+			return false, oneErr
+		}
+		if otherErr != nil {
+			return false, otherErr
+		}
+	}
+}
+
+// applyChanges makes the given changes under toRoot, copying anything added
+// or modified from the same path under fromRoot. Removals go first, deepest
+// first, and then everything else parents first, so that a file can replace a
+// directory and the other way round.
+func applyChanges(fromRoot, toRoot string, changes []types.ZFSFileDiff) error {
+	removals, copies := []string{}, []string{}
+	for _, c := range changes {
+		if c.Change == types.FileChangeRemoved {
+			removals = append(removals, c.Filename)
+		} else {
+			copies = append(copies, c.Filename)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(removals)))
+	sort.Strings(copies)
+
+	for _, p := range removals {
+		to, err := pathUnder(toRoot, p)
+		if err != nil {
+			return err
+		}
+		if to == filepath.Clean(toRoot) {
+			return fmt.Errorf("refusing to remove the whole dot")
+		}
+		err = os.RemoveAll(to)
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range copies {
+		from, err := pathUnder(fromRoot, p)
+		if err != nil {
+			return err
+		}
+		to, err := pathUnder(toRoot, p)
+		if err != nil {
+			return err
+		}
+		if to == filepath.Clean(toRoot) {
+			continue
+		}
+		info, err := os.Lstat(from)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// just the directory, what's in it comes as changes of its own
+			existing, err := os.Lstat(to)
+			if err == nil && existing.IsDir() {
+				continue
+			}
+			err = os.RemoveAll(to)
+			if err != nil {
+				return err
+			}
+			err = os.MkdirAll(to, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			err = os.Chmod(to, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = os.RemoveAll(to)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(to), 0775)
+		if err != nil {
+			return err
+		}
+		out, err := exec.Command("cp", "-a", "--reflink=auto", from, to).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %s %s", from, to, err, out)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package fsm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+)
+
+func snaps(ids ...string) []*types.Snapshot {
+	result := []*types.Snapshot{}
+	for _, id := range ids {
+		result = append(result, &types.Snapshot{Id: id, Metadata: map[string]string{}})
+	}
+	return result
+}
+
+func TestMergeBase(t *testing.T) {
+	base, err := mergeBase(snaps("A", "B", "C", "D"), snaps("A", "B", "E"))
+	if err != nil || base.Id != "B" {
+		t.Errorf("expected diverged branches to merge from B, got %v, %v", base, err)
+	}
+	base, err = mergeBase(snaps("A", "B", "C"), snaps("A", "B"))
+	if err != nil || base.Id != "B" {
+		t.Errorf("expected a branch behind to merge from B, got %v, %v", base, err)
+	}
+	_, err = mergeBase(snaps("A", "B"), snaps("A", "B", "C"))
+	if _, ok := err.(*ToSnapsAhead); !ok {
+		t.Errorf("expected nothing to merge into a branch ahead, got %v", err)
+	}
+	_, err = mergeBase(snaps("A", "B"), snaps("C"))
+	if _, ok := err.(*NoCommonSnapshots); !ok {
+		t.Errorf("expected no common commits, got %v", err)
+	}
+
+	// a merge commit moves the base on to the commit it merged
+	ours := snaps("A", "B", "E", "F")
+	ours[3].Metadata["merged-commit"] = "C"
+	base, err = mergeBase(snaps("A", "B", "C", "D"), ours)
+	if err != nil || base.Id != "C" {
+		t.Errorf("expected to merge from the commit merged before, got %v, %v", base, err)
+	}
+	ours[3].Metadata["merged-commit"] = "D"
+	_, err = mergeBase(snaps("A", "B", "C", "D"), ours)
+	if _, ok := err.(*ToSnapsUpToDate); !ok {
+		t.Errorf("expected everything to have been merged already, got %v", err)
+	}
+
+	// but a merge which left conflicts doesn't
+	ours[3].Metadata = conflictedMetadata(map[string]string{"merged-commit": "D"}, []types.MergeConflict{{Path: "x"}})
+	base, err = mergeBase(snaps("A", "B", "C", "D"), ours)
+	if err != nil || base.Id != "B" {
+		t.Errorf("expected a merge with conflicts to leave the base at B, got %v, %v", base, err)
+	}
+	if ours[3].Metadata["merged-with-conflicts"] != "D" {
+		t.Errorf("expected the merge with conflicts to record D, got %v", ours[3].Metadata)
+	}
+	meta := conflictedMetadata(map[string]string{"merged-commit": "D"}, nil)
+	if meta["merged-commit"] != "D" {
+		t.Errorf("expected a merge without conflicts to record D as merged, got %v", meta)
+	}
+}
+
+func fileChange(change types.FileChange, name string, old, new types.FileType) types.ZFSFileDiff {
+	c := types.ZFSFileDiff{Change: change, Filename: name}
+	if old != "" {
+		c.Old = &types.DiffFileInfo{Type: old}
+	}
+	if new != "" {
+		c.New = &types.DiffFileInfo{Type: new}
+	}
+	return c
+}
+
+func TestMergeChanges(t *testing.T) {
+	file, dir := types.FileTypeFile, types.FileTypeDirectory
+	ours := []types.ZFSFileDiff{
+		fileChange(types.FileChangeModified, "ours", dir, dir),
+		fileChange(types.FileChangeModified, "ours/a.csv", file, file),
+		fileChange(types.FileChangeModified, "shared.txt", file, file),
+		fileChange(types.FileChangeModified, "same.txt", file, file),
+		fileChange(types.FileChangeRemoved, "gone", dir, ""),
+		fileChange(types.FileChangeRemoved, "gone/x", file, ""),
+		fileChange(types.FileChangeAdded, "dropped/new", "", file),
+	}
+	theirs := []types.ZFSFileDiff{
+		fileChange(types.FileChangeModified, "theirs", dir, dir),
+		fileChange(types.FileChangeModified, "theirs/b.csv", file, file),
+		fileChange(types.FileChangeAdded, "theirs/c.csv", "", file),
+		fileChange(types.FileChangeModified, "shared.txt", file, file),
+		fileChange(types.FileChangeModified, "same.txt", file, file),
+		fileChange(types.FileChangeAdded, "gone/y", "", file),
+		fileChange(types.FileChangeRemoved, "dropped", dir, ""),
+	}
+	applied, conflicts, err := mergeChanges(ours, theirs, func(p string) (bool, error) {
+		return p == "same.txt", nil
+	})
+	if err != nil {
+		t.Fatalf("failed to merge: %s", err)
+	}
+	names := []string{}
+	for _, c := range applied {
+		names = append(names, c.Filename)
+	}
+	if strings.Join(names, ",") != "theirs/b.csv,theirs/c.csv" {
+		t.Errorf("expected only the changes to theirs to be applied, got %v", names)
+	}
+	names = []string{}
+	for _, c := range conflicts {
+		names = append(names, c.Path)
+	}
+	if strings.Join(names, ",") != "shared.txt,gone/y,dropped" {
+		t.Errorf("unexpected conflicts %v", conflicts)
+	}
+	if conflicts[1].Ours != types.FileChangeRemoved || conflicts[1].Theirs != types.FileChangeAdded {
+		t.Errorf("expected a file added to a removed directory to say so, got %v", conflicts[1])
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+	fromRoot, err := ioutil.TempDir("", "mergeFrom")
+	if err != nil {
+		t.Fatalf("making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(fromRoot)
+	toRoot, err := ioutil.TempDir("", "mergeTo")
+	if err != nil {
+		t.Fatalf("making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(toRoot)
+
+	for path, contents := range map[string]string{
+		"new/table.db": "theirs",
+		"changed.txt":  "theirs",
+		"was-dir":      "now a file",
+	} {
+		err = createTestFile(fromRoot, path, []byte(contents))
+		if err != nil {
+			t.Fatalf("creating %s: %v", path, err)
+		}
+	}
+	for path, contents := range map[string]string{
+		"changed.txt":   "ours",
+		"removed.txt":   "ours",
+		"was-dir/a.txt": "ours",
+		"kept.txt":      "ours",
+	} {
+		err = createTestFile(toRoot, path, []byte(contents))
+		if err != nil {
+			t.Fatalf("creating %s: %v", path, err)
+		}
+	}
+
+	file, dir := types.FileTypeFile, types.FileTypeDirectory
+	err = applyChanges(fromRoot, toRoot, []types.ZFSFileDiff{
+		fileChange(types.FileChangeModified, "changed.txt", file, file),
+		fileChange(types.FileChangeRemoved, "removed.txt", file, ""),
+		fileChange(types.FileChangeAdded, "new/table.db", "", file),
+		fileChange(types.FileChangeAdded, "new", "", dir),
+		fileChange(types.FileChangeModified, "was-dir", dir, file),
+		fileChange(types.FileChangeRemoved, "was-dir/a.txt", file, ""),
+	})
+	if err != nil {
+		t.Fatalf("failed to apply changes: %v", err)
+	}
+	for path, expected := range map[string]string{
+		"new/table.db": "theirs",
+		"changed.txt":  "theirs",
+		"was-dir":      "now a file",
+		"kept.txt":     "ours",
+	} {
+		contents, err := ioutil.ReadFile(filepath.Join(toRoot, path))
+		if err != nil || string(contents) != expected {
+			t.Errorf("expected %s to be %q, got %q (%v)", path, expected, contents, err)
+		}
+	}
+	_, err = os.Stat(filepath.Join(toRoot, "removed.txt"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected removed.txt to be gone, got %v", err)
+	}
+}
+
+func TestSameFile(t *testing.T) {
+	oneRoot, err := ioutil.TempDir("", "sameOne")
+	if err != nil {
+		t.Fatalf("making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(oneRoot)
+	otherRoot, err := ioutil.TempDir("", "sameOther")
+	if err != nil {
+		t.Fatalf("making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(otherRoot)
+
+	for _, root := range []string{oneRoot, otherRoot} {
+		err = createTestFile(root, "same.txt", []byte("contents"))
+		if err != nil {
+			t.Fatalf("creating same.txt: %v", err)
+		}
+	}
+	err = createTestFile(oneRoot, "different.txt", []byte("one"))
+	if err != nil {
+		t.Fatalf("creating different.txt: %v", err)
+	}
+	err = createTestFile(otherRoot, "different.txt", []byte("two"))
+	if err != nil {
+		t.Fatalf("creating different.txt: %v", err)
+	}
+
+	for p, expected := range map[string]bool{
+		"same.txt":      true,
+		"different.txt": false,
+		"missing.txt":   true,
+	} {
+		same, err := sameFile(oneRoot, otherRoot, p)
+		if err != nil || same != expected {
+			t.Errorf("expected %s to be the same: %v, got %v (%v)", p, expected, same, err)
+		}
+	}
+}
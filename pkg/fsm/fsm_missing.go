@@ -196,7 +196,7 @@ func missingState(f *FsMachine) StateFn {
 				return backoffState
 			}
 			f.lastTransferRequest = transferRequest
-			transferRequestId, ok := (*e.Args)["RequestId"].(string)
+			_, ok := (*e.Args)["RequestId"].(string)
 			if !ok {
 				f.innerResponses <- &types.Event{
 					Name: "cant-cast-transfer-requestid",
@@ -204,7 +204,8 @@ func missingState(f *FsMachine) StateFn {
 				}
 				return backoffState
 			}
-			f.lastTransferRequestId = transferRequestId
+			// the initiator's id for the transfer, which it cancels it by
+			f.lastTransferRequestId = peerTransferRequestId(e)
 
 			if f.lastTransferRequest.Direction == "pull" {
 				// Can't provide for an initiator trying to pull when we're missing.
@@ -259,6 +260,11 @@ func missingState(f *FsMachine) StateFn {
 				return nextState
 			}
 
+		} else if e.Name == "cancel-transfer" {
+			// CancelTransfer has already stopped the transfer, this tidies
+			// up after it, perhaps a filesystem that was half-received
+			f.innerResponses <- f.abortCancelledTransfer()
+			return missingState
 		} else if e.Name == "mount" {
 			f.innerResponses <- &types.Event{
 				Name: "nothing-to-mount",
@@ -6,6 +6,8 @@ import (
 	"io"
 	"log"
 	"net/http"
+	neturl "net/url"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
@@ -43,6 +45,8 @@ func pullInitiatorState(f *FsMachine) StateFn {
 
 	transferRequest := f.lastTransferRequest
 	transferRequestId := f.lastTransferRequestId
+	ctx, done := f.transferContext(transferRequestId)
+	defer done()
 
 	// TODO dedupe what follows wrt pushInitiatorState!
 	client := dmclient.NewJsonRpcClient(
@@ -55,7 +59,7 @@ func pullInitiatorState(f *FsMachine) StateFn {
 	var path types.PathToTopLevelFilesystem
 	// XXX Not propagating context here; not needed for auth, but would be nice
 	// for inter-cluster opentracing.
-	err = client.CallRemote(context.Background(),
+	err = client.CallRemote(ctx,
 		"DotmeshRPC.DeducePathToTopLevelFilesystem", map[string]interface{}{
 			"RemoteNamespace":      transferRequest.RemoteNamespace,
 			"RemoteFilesystemName": transferRequest.RemoteName,
@@ -72,13 +76,22 @@ func pullInitiatorState(f *FsMachine) StateFn {
 	}
 
 	// register a poll result object.
+	start := TransferPollResultFromTransferRequest(
+		transferRequestId, transferRequest, f.state.NodeID(),
+		1, 1+len(path.Clones), "syncing metadata",
+	)
 	f.transferUpdates <- types.TransferUpdate{
-		Kind: types.TransferStart,
-		Changes: TransferPollResultFromTransferRequest(
-			transferRequestId, transferRequest, f.state.NodeID(),
-			1, 1+len(path.Clones), "syncing metadata",
-		),
+		Kind:    types.TransferStart,
+		Changes: start,
+	}
+	release, err := f.waitForTransferSlot(ctx, "pullInitiatorState", transferRequestId, transferRequest.Priority)
+	if err != nil {
+		// only cancelling the transfer stops it waiting
+		responseEvent, nextState := f.cancelledTransfer()
+		f.innerResponses <- responseEvent
+		return nextState
 	}
+	defer release()
 
 	// iterate over the path, attempting to pull each clone in turn.
 	responseEvent, nextState := f.applyPath(path, func(f *FsMachine,
@@ -87,8 +100,15 @@ func pullInitiatorState(f *FsMachine) StateFn {
 		client *dmclient.JsonRpcClient, transferRequest *types.TransferRequest,
 	) (*types.Event, StateFn) {
 		return f.retryPull(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
-			transferRequestId, client, transferRequest)
+			transferRequestId, client, transferRequest, ctx)
 	}, transferRequestId, client, &transferRequest)
+	if ctx.Err() != nil && responseEvent.Name != "transfer-cancelled" {
+		// cancelled before it got as far as the retry loop noticing
+		responseEvent, nextState = f.cancelledTransfer()
+	}
+	if responseEvent.Name == "finished-pull" || responseEvent.Name == "peer-up-to-date" {
+		f.pullTags(ctx, client, path, transferRequest)
+	}
 
 	f.innerResponses <- responseEvent
 	return nextState
@@ -97,9 +117,11 @@ func pullInitiatorState(f *FsMachine) StateFn {
 func (f *FsMachine) pull(
 	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
 	snapRange *snapshotRange,
+	resume *resumption,
 	transferRequest *types.TransferRequest,
 	transferRequestId *string,
 	client *dmclient.JsonRpcClient,
+	ctx context.Context,
 ) (responseEvent *types.Event, nextState StateFn) {
 	// IMPORTANT NOTE:
 
@@ -122,15 +144,32 @@ func (f *FsMachine) pull(
 	toFilesystemId = pr.FilesystemId
 	fromSnapshotId = pr.StartingCommit
 
-	// 1. Do an RPC to estimate the send size and update pollResult
-	// accordingly.
-	var size int64
-	err := client.CallRemote(context.Background(),
+	// a resumed stream only goes as far as the snapshot that was
+	// interrupted, the rest follows in another pull
+	streamToSnapshotId := toSnapshotId
+	if resume != nil {
+		streamToSnapshotId = resume.snapshot.Id
+	} else {
+		// a fresh stream can't be received on top of what's left of an
+		// interrupted one
+		err := f.zfs.AbortReceive(toFilesystemId)
+		if err != nil {
+			return &types.Event{
+				Name: "failed-aborting-partial-receive",
+				Args: &types.EventArgs{"err": err, "filesystemId": toFilesystemId},
+			}, backoffState
+		}
+	}
+
+	// 1. Do an RPC to estimate the send size, to update pollResult with once
+	// we know how the stream is being sent.
+	var size types.PredictedSize
+	err := client.CallRemote(ctx,
 		"DotmeshRPC.PredictSize", map[string]interface{}{
 			"FromFilesystemId": fromFilesystemId,
 			"FromSnapshotId":   fromSnapshotId,
 			"ToFilesystemId":   toFilesystemId,
-			"ToSnapshotId":     toSnapshotId,
+			"ToSnapshotId":     streamToSnapshotId,
 		},
 		&size,
 	)
@@ -140,14 +179,23 @@ func (f *FsMachine) pull(
 			Args: &types.EventArgs{"err": err},
 		}, backoffState
 	}
-	log.Printf("[pull] size: %d", size)
-
-	f.transferUpdates <- types.TransferUpdate{
-		Kind: types.TransferCalculatedSize,
-		Changes: types.TransferPollResult{
-			Status: "pulling",
-			Size:   size,
-		},
+	var remaining types.PredictedSize
+	if resume != nil {
+		// size is the whole of the interrupted snapshot, the sender can
+		// tell us how much of it is left
+		err := client.CallRemote(ctx,
+			"DotmeshRPC.PredictSize", map[string]interface{}{
+				"ToFilesystemId": toFilesystemId,
+				"ResumeToken":    resume.token,
+			},
+			&remaining,
+		)
+		if err != nil {
+			return &types.Event{
+				Name: "error-rpc-predict-size",
+				Args: &types.EventArgs{"err": err},
+			}, backoffState
+		}
 	}
 
 	// 2. Perform GET, as receivingState does. Update as we go, similar to how
@@ -155,7 +203,7 @@ func (f *FsMachine) pull(
 	var url string
 	if transferRequest.Port == 0 {
 		url, err = dmclient.DeduceUrl(
-			context.Background(),
+			ctx,
 			[]string{transferRequest.Peer},
 			// pulls are between clusters, so use external address where
 			// appropriate
@@ -178,16 +226,33 @@ func (f *FsMachine) pull(
 		url,
 		toFilesystemId,
 		fromSnapshotId,
-		toSnapshotId,
+		streamToSnapshotId,
 	)
+	if resume != nil {
+		url += "?resumeToken=" + neturl.QueryEscape(resume.token)
+	}
 	log.Printf("Pulling from %s", url)
 	req, err := http.NewRequest(
 		"GET", url, nil,
 	)
+	if err != nil {
+		return &types.Event{
+			Name: "error-starting-get-when-pulling",
+			Args: &types.EventArgs{"err": err},
+		}, backoffState
+	}
+	// cancelling the transfer aborts the request, which ends the stream into
+	// zfs recv
+	req = req.WithContext(ctx)
 	req.SetBasicAuth(
 		transferRequest.User,
 		transferRequest.ApiKey,
 	)
+	// tell the sender how we can receive the stream
+	req.Header.Set(utils.StreamAcceptEncodingHeader, strings.Join(utils.StreamEncodings, ","))
+	if f.zfs.CompressedStreams() {
+		req.Header.Set(utils.AcceptCompressedStreamHeader, "true")
+	}
 	getClient := new(http.Client)
 	resp, err := getClient.Do(req)
 	if err != nil {
@@ -197,6 +262,34 @@ func (f *FsMachine) pull(
 			Args: &types.EventArgs{"err": err, "filesystemId": toFilesystemId},
 		}, backoffState
 	}
+	// and find out how it's sending it, which is the original uncompressed
+	// framing if it doesn't say
+	format := streamFormat{
+		encoding:   resp.Header.Get(utils.StreamEncodingHeader),
+		compressed: resp.Header.Get(utils.CompressedStreamHeader) == "true",
+	}
+	streamSize, wireSize := format.sizes(&size)
+	var saved int64
+	if resume != nil {
+		saved = savedByResuming(streamSize, remaining.Raw)
+		streamSize, wireSize = remaining.Raw, remaining.Raw
+	}
+	log.Printf(
+		"[pull] size: %d, on the wire: %d (%+v), saved by resuming: %d",
+		streamSize, wireSize, format, saved,
+	)
+
+	f.transferUpdates <- types.TransferUpdate{
+		Kind: types.TransferCalculatedSize,
+		Changes: types.TransferPollResult{
+			Status:           "pulling",
+			Size:             streamSize,
+			Saved:            saved,
+			StreamEncoding:   format.encoding,
+			CompressedStream: format.compressed,
+			WireSize:         wireSize,
+		},
+	}
 	log.Printf(
 		"Debug: curl -u admin:[pw] %s",
 		url,
@@ -221,8 +314,10 @@ func (f *FsMachine) pull(
 	pipeReader, pipeWriter := io.Pipe()
 	defer pipeReader.Close()
 	defer pipeWriter.Close()
+	throughput := &utils.Throughput{}
 	go utils.Pipe(
-		resp.Body, fmt.Sprintf("http response body for %s", toFilesystemId),
+		f.throttle(transferRequest.LimitRate).MeasuredReader(resp.Body, throughput),
+		fmt.Sprintf("http response body for %s", toFilesystemId),
 		pipeWriter, "stdin of zfs recv",
 		finished,
 
@@ -237,6 +332,7 @@ func (f *FsMachine) pull(
 					Status:             "pulling",
 					Sent:               bytes,
 					NanosecondsElapsed: t,
+					LimitRate:          throughput.Rate(),
 				},
 			}
 
@@ -269,7 +365,7 @@ func (f *FsMachine) pull(
 			}
 
 		},
-		"decompress",
+		utils.DecompressMode(format.encoding),
 	)
 
 	log.Printf("[pull] about to start consuming prelude on %v", pipeReader)
@@ -309,7 +405,13 @@ func (f *FsMachine) pull(
 		}, backoffState
 	}
 
-	log.Printf("Successfully received %s => %s for %s", fromSnapshotId, toSnapshotId, toFilesystemId)
+	log.Printf("Successfully received %s => %s for %s", fromSnapshotId, streamToSnapshotId, toFilesystemId)
+	if streamToSnapshotId != toSnapshotId {
+		return &types.Event{
+			Name: "resumed-pull",
+			Args: &types.EventArgs{"snapshotId": streamToSnapshotId},
+		}, backoffState
+	}
 	return &types.Event{
 		Name: "finished-pull",
 	}, discoveringAfterTransferInitiatorState
@@ -319,13 +421,14 @@ func (f *FsMachine) retryPull(
 	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
 	transferRequestId string,
 	client *dmclient.JsonRpcClient, transferRequest *types.TransferRequest,
+	ctx context.Context,
 ) (*types.Event, StateFn) {
 	// TODO refactor the following with respect to retryPush!
 
 	// Let's go!
 	var remoteSnaps []*types.Snapshot
 	err := client.CallRemote(
-		context.Background(),
+		ctx,
 		"DotmeshRPC.CommitsById",
 		toFilesystemId,
 		&remoteSnaps,
@@ -394,7 +497,7 @@ func (f *FsMachine) retryPull(
 		case *ToSnapsDiverged:
 			if transferRequest.StashDivergence {
 				fmt.Printf("[retryPull] hit divergence case, have permission to stash - will stash local changes")
-				e := f.recoverFromDivergence(typedErr.latestCommonSnapshot.Id)
+				_, e := f.recoverFromDivergence(typedErr.latestCommonSnapshot.Id, transferRequestId)
 				if e != nil {
 					return &types.Event{
 						Name: "failed-stashing",
@@ -447,16 +550,52 @@ func (f *FsMachine) retryPull(
 	var retry int
 	var responseEvent *types.Event
 	var nextState StateFn
+	// the resume token of the last attempt, to spot when resuming isn't
+	// getting anywhere
+	var lastResumeToken string
 	for retry < 5 {
+		if ctx.Err() != nil {
+			return f.cancelPull(toFilesystemId)
+		}
+		if retry > 0 {
+			snapRange = f.pulledSoFar(toFilesystemId, remoteSnaps, snapRange)
+		}
+		// carry on from an interrupted receive, if an earlier attempt (or
+		// pull) left one behind
+		resumeToken, err := f.zfs.ReceiveResumeToken(toFilesystemId)
+		if err != nil {
+			log.Printf("[retryPull] unable to get resume token for %s, starting over: %s", toFilesystemId, err)
+			resumeToken = ""
+		}
+		resume := f.resumptionFor(resumeToken, lastResumeToken, remoteSnaps, snapRange)
+		lastResumeToken = resumeToken
+
 		// XXX XXX XXX REFACTOR (retryPush)
 		responseEvent, nextState = f.pull(
 			fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
-			snapRange, transferRequest, &transferRequestId, client,
+			snapRange, resume, transferRequest, &transferRequestId, client, ctx,
 		)
 		if responseEvent.Name == "finished-pull" || responseEvent.Name == "peer-up-to-date" {
 			log.Printf("[actualPull] Successful pull!")
 			return responseEvent, nextState
 		}
+		if ctx.Err() != nil {
+			return f.cancelPull(toFilesystemId)
+		}
+		if responseEvent.Name == "resumed-pull" {
+			// we have the interrupted snapshot now, so go round again
+			// straight away for the rest, this wasn't a failure
+			snapRange = &snapshotRange{fromSnap: resume.snapshot, toSnap: snapRange.toSnap}
+			f.transferUpdates <- types.TransferUpdate{
+				Kind: types.TransferGotIds,
+				Changes: types.TransferPollResult{
+					FilesystemId:   toFilesystemId,
+					StartingCommit: resume.snapshot.Id,
+					TargetCommit:   snapRange.toSnap.Id,
+				},
+			}
+			continue
+		}
 		retry++
 		f.updateTransfer(
 			fmt.Sprintf("retry %d", retry),
@@ -467,7 +606,7 @@ func (f *FsMachine) retryPull(
 				"got a %s (which tried to put us into %+v)...",
 			retry, retry, responseEvent, nextState,
 		)
-		time.Sleep(time.Duration(retry) * time.Second)
+		f.clock.Sleep(time.Duration(retry) * time.Second)
 	}
 	log.Printf(
 		"[actualPull] Maximum retry attempts exceeded, "+
@@ -478,3 +617,54 @@ func (f *FsMachine) retryPull(
 		Name: "maximum-retry-attempts-exceeded", Args: &types.EventArgs{"responseEvent": responseEvent},
 	}, backoffState
 }
+
+// pulledSoFar moves the start of snapRange on past the snapshots a failed
+// attempt to pull it received before it stopped, as a stream of several
+// snapshots keeps the ones it got to the end of. The stream for the next
+// attempt, and the snapshot an interrupted receive was partway through, come
+// after those.
+func (f *FsMachine) pulledSoFar(
+	toFilesystemId string, remoteSnaps []*types.Snapshot, snapRange *snapshotRange,
+) *snapshotRange {
+	filesystem, err := f.zfs.DiscoverSystem(toFilesystemId)
+	if err != nil {
+		log.Printf("[pulledSoFar] unable to list snapshots of %s, assuming none were received: %s", toFilesystemId, err)
+		return snapRange
+	}
+	if len(filesystem.Snapshots) == 0 {
+		return snapRange
+	}
+	latest := filesystem.Snapshots[len(filesystem.Snapshots)-1].Id
+	if snapRange.fromSnap != nil && latest == snapRange.fromSnap.Id {
+		return snapRange
+	}
+	for _, s := range remoteSnaps {
+		if s.Id == snapRange.toSnap.Id {
+			// that's everything, which a failed attempt can't have got
+			break
+		}
+		if s.Id == latest {
+			f.transferUpdates <- types.TransferUpdate{
+				Kind: types.TransferGotIds,
+				Changes: types.TransferPollResult{
+					FilesystemId:   toFilesystemId,
+					StartingCommit: s.Id,
+					TargetCommit:   snapRange.toSnap.Id,
+				},
+			}
+			return &snapshotRange{fromSnap: s, toSnap: snapRange.toSnap}
+		}
+	}
+	return snapRange
+}
+
+// cancelPull stops a pull which has been cancelled, throwing away what it had
+// received of the interrupted snapshot rather than keeping it to resume from.
+func (f *FsMachine) cancelPull(toFilesystemId string) (*types.Event, StateFn) {
+	log.Printf("[cancelPull] pull into %s was cancelled", toFilesystemId)
+	err := f.zfs.AbortReceive(toFilesystemId)
+	if err != nil {
+		log.Printf("[cancelPull] unable to abort partial receive of %s: %s", toFilesystemId, err)
+	}
+	return f.cancelledTransfer()
+}
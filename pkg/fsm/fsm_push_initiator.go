@@ -7,6 +7,8 @@ import (
 
 	// "log"
 	"net/http"
+	neturl "net/url"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
@@ -14,6 +16,7 @@ import (
 	dmclient "github.com/dotmesh-io/dotmesh/pkg/client"
 	"github.com/dotmesh-io/dotmesh/pkg/types"
 	"github.com/dotmesh-io/dotmesh/pkg/utils"
+	"github.com/dotmesh-io/dotmesh/pkg/zfs"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -55,12 +58,13 @@ func pushInitiatorState(f *FsMachine) StateFn {
 		return backoffState
 	}
 
+	start := TransferPollResultFromTransferRequest(
+		transferRequestId, transferRequest, f.state.NodeID(),
+		1, 1+len(path.Clones), "syncing metadata",
+	)
 	f.transferUpdates <- types.TransferUpdate{
-		Kind: types.TransferStart,
-		Changes: TransferPollResultFromTransferRequest(
-			transferRequestId, transferRequest, f.state.NodeID(),
-			1, 1+len(path.Clones), "syncing metadata",
-		),
+		Kind:    types.TransferStart,
+		Changes: start,
 	}
 
 	// Also RPC to remote cluster to set up a similar record there.
@@ -78,7 +82,17 @@ func pushInitiatorState(f *FsMachine) StateFn {
 	// for "up to latest")
 
 	// TODO tidy up argument passing here.
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	transferCtx, done := f.transferContext(transferRequestId)
+	defer done()
+	release, err := f.waitForTransferSlot(transferCtx, "pushInitiatorState", transferRequestId, transferRequest.Priority)
+	if err != nil {
+		// only cancelling the transfer stops it waiting
+		responseEvent, nextState := f.cancelledTransfer()
+		f.innerResponses <- responseEvent
+		return nextState
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(transferCtx, 10*time.Minute)
 	defer cancel()
 	responseEvent, nextState := f.applyPath(path, func(f *FsMachine,
 		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
@@ -87,9 +101,16 @@ func pushInitiatorState(f *FsMachine) StateFn {
 	) (*types.Event, StateFn) {
 		return f.retryPush(
 			fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
-			transferRequestId, client, transferRequest, ctx,
+			transferRequestId, client, transferRequest, ctx, transferCtx,
 		)
 	}, transferRequestId, client, &transferRequest)
+	if transferCtx.Err() != nil && responseEvent.Name != "transfer-cancelled" {
+		// cancelled before it got as far as the retry loop noticing
+		responseEvent, nextState = f.cancelPush(transferRequestId, client)
+	}
+	if responseEvent.Name == "finished-push" || responseEvent.Name == "peer-up-to-date" {
+		f.pushTags(ctx, client, transferRequest)
+	}
 
 	f.innerResponses <- responseEvent
 	if nextState == nil {
@@ -101,15 +122,26 @@ func pushInitiatorState(f *FsMachine) StateFn {
 func (f *FsMachine) push(
 	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
 	snapRange *snapshotRange,
+	resume *resumption,
+	format streamFormat,
 	transferRequest *types.TransferRequest,
 	transferRequestId *string,
 	client *dmclient.JsonRpcClient,
-	ctx context.Context,
+	ctx, transferCtx context.Context,
 ) (responseEvent *types.Event, nextState StateFn) {
 	filesystemId := toFilesystemId
 	fromSnapshotId = f.getCurrentPollResult().StartingCommit
 	f.updateTransfer("calculating size", "")
 
+	// a resumed stream only goes as far as the snapshot that was
+	// interrupted, the rest follows in another push
+	streamToSnapshotId := snapRange.toSnap.Id
+	sendOptions := zfs.SendOptions{Compressed: format.compressed}
+	if resume != nil {
+		streamToSnapshotId = resume.snapshot.Id
+		sendOptions.ResumeToken = resume.token
+	}
+
 	postReader, postWriter := io.Pipe()
 
 	defer postWriter.Close()
@@ -141,8 +173,11 @@ func (f *FsMachine) push(
 		url,
 		filesystemId,
 		fromSnapshotId,
-		snapRange.toSnap.Id,
+		streamToSnapshotId,
 	)
+	if resume != nil {
+		url += "?resumeToken=" + neturl.QueryEscape(resume.token)
+	}
 	log.Printf("Pushing to %s", url)
 	req, err := http.NewRequest(
 		"POST", url,
@@ -155,6 +190,12 @@ func (f *FsMachine) push(
 			Args: &types.EventArgs{"err": err},
 		}, backoffState
 	}
+	// cancelling the transfer aborts the request, which closes the pipe and
+	// so stops zfs send
+	req = req.WithContext(transferCtx)
+	if format.encoding != "" {
+		req.Header.Set(utils.StreamEncodingHeader, format.encoding)
+	}
 
 	// https://github.com/zfsonlinux/zfs/pull/5189
 	//
@@ -172,7 +213,11 @@ func (f *FsMachine) push(
 			Args: &types.EventArgs{"err": err, "filesystemId": toFilesystemId},
 		}, backoffState
 	}
-	prelude, err := CalculatePrelude(snaps, toSnapshotId)
+	preludeToSnapshotId := toSnapshotId
+	if resume != nil {
+		preludeToSnapshotId = resume.snapshot.Id
+	}
+	prelude, err := CalculatePrelude(snaps, preludeToSnapshotId)
 	if err != nil {
 		return &types.Event{
 			Name: "error-calculating-prelude",
@@ -181,9 +226,21 @@ func (f *FsMachine) push(
 	}
 
 	// XXX this doesn't need to happen every push(), just once above.
-	size, err := f.zfs.PredictSize(
-		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
-	)
+	var size, wireSize, saved int64
+	if resume != nil {
+		size, saved, err = f.predictResumedSize(
+			fromFilesystemId, fromSnapshotId, toFilesystemId, resume, format,
+		)
+		wireSize = size
+	} else {
+		var predicted *types.PredictedSize
+		predicted, err = f.zfs.PredictSize(
+			fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
+		)
+		if err == nil {
+			size, wireSize = format.sizes(predicted)
+		}
+	}
 	if err != nil {
 		return &types.Event{
 			Name: "error-predicting",
@@ -191,13 +248,20 @@ func (f *FsMachine) push(
 		}, backoffState
 	}
 
-	log.Printf("[actualPush:%s] size: %d", filesystemId, size)
+	log.Printf(
+		"[actualPush:%s] size: %d, on the wire: %d (%+v), saved by resuming: %d",
+		filesystemId, size, wireSize, format, saved,
+	)
 
 	f.transferUpdates <- types.TransferUpdate{
 		Kind: types.TransferCalculatedSize,
 		Changes: types.TransferPollResult{
-			Status: "pushing",
-			Size:   size,
+			Status:           "pushing",
+			Size:             size,
+			Saved:            saved,
+			StreamEncoding:   format.encoding,
+			CompressedStream: format.compressed,
+			WireSize:         wireSize,
 		},
 	}
 	// we will write this to the pipe first, in the goroutine which writes
@@ -209,11 +273,13 @@ func (f *FsMachine) push(
 		}, backoffState
 	}
 
-	pipeReader, errch := f.zfs.Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId, preludeEncoded)
+	pipeReader, errch := f.zfs.Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId, sendOptions, preludeEncoded)
 
 	finished := make(chan bool)
+	throughput := &utils.Throughput{}
 	go utils.Pipe(
-		pipeReader, fmt.Sprintf("stdout of zfs send for %s", filesystemId),
+		f.throttle(transferRequest.LimitRate).MeasuredReader(pipeReader, throughput),
+		fmt.Sprintf("stdout of zfs send for %s", filesystemId),
 		postWriter, "http request body",
 		finished,
 
@@ -228,6 +294,7 @@ func (f *FsMachine) push(
 					Status:             "pushing",
 					Sent:               bytes,
 					NanosecondsElapsed: t,
+					LimitRate:          throughput.Rate(),
 				},
 			}
 			f.transitionedTo("pushInitiatorState",
@@ -259,7 +326,7 @@ func (f *FsMachine) push(
 			}
 
 		},
-		"compress",
+		utils.CompressMode(format.encoding),
 	)
 
 	req.SetBasicAuth(
@@ -353,6 +420,17 @@ func (f *FsMachine) push(
 
 	pipeReader.Close()
 
+	if streamToSnapshotId != snapRange.toSnap.Id {
+		log.Infof(
+			"[actualPush:%s] resumed push reached %s, the rest up to %s is still to go",
+			filesystemId, streamToSnapshotId, snapRange.toSnap.Id,
+		)
+		return &types.Event{
+			Name: "resumed-push",
+			Args: &types.EventArgs{"snapshotId": streamToSnapshotId},
+		}, backoffState
+	}
+
 	// TODO update the transfer record, release the peer state machines
 	return &types.Event{
 		Name: "finished-push",
@@ -360,14 +438,62 @@ func (f *FsMachine) push(
 	}, discoveringAfterTransferInitiatorState
 }
 
-func stash(filesystemId, snapId string, client *dmclient.JsonRpcClient, ctx context.Context) (*types.Event, StateFn) {
+// pushedSoFar moves the start of snapRange on past the snapshots a failed
+// attempt to push it got across before it stopped, as a stream of several
+// snapshots keeps the ones it got to the end of. The commits the peer listed
+// before may not include them yet, but by the time it's ready for another
+// push it has caught up with what it received.
+func (f *FsMachine) pushedSoFar(
+	ctx context.Context, client *dmclient.JsonRpcClient, toFilesystemId string,
+	localSnaps []*types.Snapshot, snapRange *snapshotRange,
+) *snapshotRange {
+	var remoteSnaps []*types.Snapshot
+	err := client.CallRemote(ctx, "DotmeshRPC.CommitsById", toFilesystemId, &remoteSnaps)
+	if err != nil {
+		log.Printf("[pushedSoFar] unable to list the peer's snapshots of %s, assuming none were received: %s", toFilesystemId, err)
+		return snapRange
+	}
+	received, err := canApply(localSnaps, remoteSnaps)
+	if err != nil || received.fromSnap == nil {
+		return snapRange
+	}
+	if snapRange.fromSnap != nil && received.fromSnap.Id == snapRange.fromSnap.Id {
+		return snapRange
+	}
+	f.transferUpdates <- types.TransferUpdate{
+		Kind: types.TransferGotIds,
+		Changes: types.TransferPollResult{
+			FilesystemId:   toFilesystemId,
+			StartingCommit: received.fromSnap.Id,
+			TargetCommit:   snapRange.toSnap.Id,
+		},
+	}
+	return received
+}
+
+// cancelPush stops a push which has been cancelled, telling the remote so it
+// stops waiting for the rest of it and throws away what it has received.
+func (f *FsMachine) cancelPush(transferRequestId string, client *dmclient.JsonRpcClient) (*types.Event, StateFn) {
+	log.Infof("[cancelPush:%s] transfer %s was cancelled", f.filesystemId, transferRequestId)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var cancelled bool
+	err := client.CallRemote(ctx, "DotmeshRPC.CancelTransfer", transferRequestId, &cancelled)
+	if err != nil {
+		log.Warnf("[cancelPush:%s] couldn't cancel transfer %s on the remote: %s", f.filesystemId, transferRequestId, err)
+	}
+	return f.cancelledTransfer()
+}
+
+func stash(filesystemId, snapId, transferRequestId string, client *dmclient.JsonRpcClient, ctx context.Context) (*types.Event, StateFn) {
 	var newBranch string
 	e := client.CallRemote(
 		ctx,
 		"DotmeshRPC.StashAfter",
 		types.StashRequest{
-			FilesystemId: filesystemId,
-			SnapshotId:   snapId,
+			FilesystemId:      filesystemId,
+			SnapshotId:        snapId,
+			TransferRequestId: transferRequestId,
 		},
 		&newBranch,
 	)
@@ -379,21 +505,39 @@ func stash(filesystemId, snapId string, client *dmclient.JsonRpcClient, ctx cont
 	return nil, discoveringState
 }
 
+// registerPush registers a push with the peer, offering how we can send it,
+// and returns the transfer as the peer sees it. Peers too old to negotiate
+// only have RegisterTransfer, which replies with a bool, in which case the
+// result is empty: nothing to resume, and no compression.
+func registerPush(ctx context.Context, client *dmclient.JsonRpcClient, offer types.TransferPollResult) (types.TransferPollResult, error) {
+	var peerTransfer types.TransferPollResult
+	err := client.CallRemote(ctx, "DotmeshRPC.NegotiateTransfer", offer, &peerTransfer)
+	if !dmclient.IsMethodNotFound(err) {
+		return peerTransfer, err
+	}
+	log.Printf("[registerPush] peer can't negotiate, falling back to RegisterTransfer")
+	var registered bool
+	err = client.CallRemote(ctx, "DotmeshRPC.RegisterTransfer", offer, &registered)
+	return types.TransferPollResult{}, err
+}
+
 func (f *FsMachine) retryPush(
 	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
 	transferRequestId string,
-	client *dmclient.JsonRpcClient, transferRequest *types.TransferRequest, ctx context.Context,
+	client *dmclient.JsonRpcClient, transferRequest *types.TransferRequest,
+	ctx, transferCtx context.Context,
 ) (*types.Event, StateFn) {
 	// Let's go!
 	var retry int
 	var responseEvent *types.Event
 	nextState := backoffState
+	// the resume token of the last attempt, to spot when resuming isn't
+	// getting anywhere
+	var lastResumeToken string
 
 	for retry < 5 {
-		select {
-		case <-ctx.Done():
-			break
-		default:
+		if transferCtx.Err() != nil {
+			return f.cancelPush(transferRequestId, client)
 		}
 		// TODO refactor this wrt retryPull
 		responseEvent, nextState = func() (*types.Event, StateFn) {
@@ -459,7 +603,7 @@ func (f *FsMachine) retryPush(
 				// here we tell the other end to get it's house in order, then return an error so we go round the loop again to get the commit list etc.
 				case *ToSnapsDiverged:
 					if transferRequest.StashDivergence {
-						event, state := stash(toFilesystemId, err.latestCommonSnapshot.Id, client, ctx)
+						event, state := stash(toFilesystemId, err.latestCommonSnapshot.Id, transferRequestId, client, ctx)
 						if event != nil {
 							return event, state
 						} else {
@@ -483,7 +627,7 @@ func (f *FsMachine) retryPush(
 			}
 			// TODO peer may error out of pushPeerState, wouldn't we like to get them
 			// back into it somehow? we could attempt to do that with by sending a new
-			// RegisterTransfer rpc if necessary. or they could retry also.
+			// NegotiateTransfer rpc if necessary. or they could retry also.
 
 			var fromSnap string
 			if snapRange.fromSnap == nil {
@@ -507,28 +651,51 @@ func (f *FsMachine) retryPush(
 				},
 			}
 
-			// tell the remote what snapshot to expect
-			var result bool
-			log.Printf("[retryPush] calling RegisterTransfer")
-			err = client.CallRemote(
-				ctx, "DotmeshRPC.RegisterTransfer", f.getCurrentPollResult(), &result,
-			)
+			// tell the remote what snapshot to expect and how we can send
+			// it, and find out how it wants it sent and whether it kept
+			// anything from an interrupted attempt
+			offer := f.getCurrentPollResult()
+			offer.StreamEncoding = strings.Join(utils.StreamEncodings, ",")
+			offer.CompressedStream = f.zfs.CompressedStreams()
+			log.Printf("[retryPush] calling NegotiateTransfer")
+			peerTransfer, err := registerPush(ctx, client, offer)
 			if err != nil {
 				return &types.Event{
 					Name: "push-initiator-cant-register-transfer", Args: &types.EventArgs{"err": err},
 				}, backoffState
 			}
 
+			if peerTransfer.ResumeToken != "" {
+				snapRange = f.pushedSoFar(ctx, client, toFilesystemId, localSnaps, snapRange)
+			}
+			resume := f.resumptionFor(peerTransfer.ResumeToken, lastResumeToken, localSnaps, snapRange)
+			lastResumeToken = peerTransfer.ResumeToken
+
+			// a peer too old to negotiate leaves peerTransfer empty, which
+			// is the uncompressed stream every version understands
+			format := streamFormat{
+				encoding:   utils.NegotiateStreamEncoding(peerTransfer.StreamEncoding),
+				compressed: offer.CompressedStream && peerTransfer.CompressedStream,
+			}
+
 			return f.push(
 				fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
-				snapRange, transferRequest, &transferRequestId, client,
-				ctx,
+				snapRange, resume, format, transferRequest, &transferRequestId, client,
+				ctx, transferCtx,
 			)
 		}()
 		if responseEvent.Name == "finished-push" || responseEvent.Name == "peer-up-to-date" {
 			log.Printf("[actualPush] Successful push!")
 			return responseEvent, nextState
 		}
+		if transferCtx.Err() != nil {
+			return f.cancelPush(transferRequestId, client)
+		}
+		if responseEvent.Name == "resumed-push" {
+			// go round again straight away for the rest, this wasn't a
+			// failure
+			continue
+		}
 		retry++
 		f.updateTransfer(
 			fmt.Sprintf("retry %d", retry),
@@ -539,7 +706,7 @@ func (f *FsMachine) retryPush(
 				"got a %s (which tried to put us into state %p)...",
 			retry, retry, responseEvent, nextState,
 		)
-		time.Sleep(time.Duration(retry) * time.Second)
+		f.clock.Sleep(time.Duration(retry) * time.Second)
 	}
 	log.Printf(
 		"[actualPush] Maximum retry attempts exceeded, "+
@@ -75,6 +75,9 @@ func pushPeerState(f *FsMachine) StateFn {
 		}
 	}
 
+	ctx, done := f.transferContext(f.lastTransferRequestId)
+	defer done()
+
 	timeoutTimer := time.NewTimer(600 * time.Second)
 	finished := make(chan bool)
 
@@ -130,12 +133,21 @@ func pushPeerState(f *FsMachine) StateFn {
 		}()
 	}()
 
+	// If an earlier attempt was interrupted, tell the initiator where we got
+	// to so it doesn't have to send everything again. Not being able to find
+	// out just means starting over, so isn't worth failing for.
+	resumeToken, err := f.zfs.ReceiveResumeToken(f.filesystemId)
+	if err != nil {
+		log.Warnf("[pushPeerState:%s] unable to get resume token: %s", f.filesystemId, err)
+		resumeToken = ""
+	}
+
 	// Here we are about to block, so confirm we are ready at this
 	// point or the caller won't start to push and unblock us
 	log.Infof("[pushPeerState:%s] clearing peer to send", f.filesystemId)
 	f.innerResponses <- &types.Event{
 		Name: "awaiting-transfer",
-		Args: &types.EventArgs{},
+		Args: &types.EventArgs{"ResumeToken": resumeToken},
 	}
 
 	log.Infof("[pushPeerState:%s] blocking for ZFSReceiver to tell us to proceed via pushCompleted", f.filesystemId)
@@ -147,15 +159,36 @@ func pushPeerState(f *FsMachine) StateFn {
 			f.filesystemId,
 		)
 		return backoffState
-	case success := <-f.pushCompleted:
+	case <-ctx.Done():
+		// the ZFSReceiver still has to tell us it's finished, or it'd tell
+		// the next pushPeerState instead. An initiator which has been
+		// cancelled drops the stream, so that doesn't take long.
+		log.Infof("[pushPeerState:%s] transfer cancelled, waiting for the receive to stop", f.filesystemId)
+		select {
+		case <-timeoutTimer.C:
+			log.Warnf("[pushPeerState:%s] Timed out waiting for cancelled receive to stop", f.filesystemId)
+		case <-f.pushCompleted:
+		}
+		return discoveringState
+	case completion := <-f.pushCompleted:
 		// onwards!
-		if !success {
+		if !completion.success {
 			log.Printf(
 				"[pushPeerState:%s] ZFS receive failed.",
 				f.filesystemId,
 			)
 			return backoffState
 		}
+		if completion.snapshotId != "" {
+			// a resumed receive only finishes the snapshot it was partway
+			// through, the initiator will register another transfer for
+			// the rest
+			log.Infof(
+				"[pushPeerState:%s] resumed receive finished at %s, short of %s",
+				f.filesystemId, completion.snapshotId, targetSnapshot,
+			)
+			targetSnapshot = completion.snapshotId
+		}
 	}
 	log.Infof("[pushPeerState:%s] ZFS receive succeeded.", f.filesystemId)
 
@@ -40,7 +40,7 @@ func receivingState(f *FsMachine) StateFn {
 		case *ToSnapsAhead:
 			log.Printf("receivingState: ToSnapsAhead %s got %s", f.filesystemId, err)
 			// erk, slave is ahead of master
-			errx := f.recoverFromDivergence(err.latestCommonSnapshot.Id)
+			_, errx := f.recoverFromDivergence(err.latestCommonSnapshot.Id, "")
 			if errx != nil {
 				return backoffStateWithReason(fmt.Sprintf("receivingState(%s): Unable to recover from divergence: %+v", f.filesystemId, errx))
 			}
@@ -48,7 +48,7 @@ func receivingState(f *FsMachine) StateFn {
 			return discoveringState
 		case *ToSnapsDiverged:
 			log.Printf("receivingState: ToSnapsDiverged %s got %s", f.filesystemId, err)
-			errx := f.recoverFromDivergence(err.latestCommonSnapshot.Id)
+			_, errx := f.recoverFromDivergence(err.latestCommonSnapshot.Id, "")
 			if errx != nil {
 				return backoffStateWithReason(fmt.Sprintf("receivingState(%s): Unable to recover from divergence: %+v", f.filesystemId, errx))
 			}
@@ -89,6 +89,14 @@ func receivingState(f *FsMachine) StateFn {
 		fromSnap = snapRange.fromSnap.Id
 	}
 
+	// Replicas just start over rather than resuming, so throw away anything
+	// left by an interrupted receive, which would otherwise refuse the
+	// stream.
+	err = f.zfs.AbortReceive(f.filesystemId)
+	if err != nil {
+		return backoffStateWithReason(fmt.Sprintf("receivingState: error aborting partial receive into %s: %+v", f.filesystemId, err))
+	}
+
 	masterNode, err := f.registry.CurrentMasterNode(f.filesystemId)
 	if err != nil {
 		return backoffStateWithReason(fmt.Sprintf("receivingState: can't find current master of %s", f.filesystemId))
@@ -148,7 +156,8 @@ func receivingState(f *FsMachine) StateFn {
 	finished := make(chan bool)
 
 	go utils.Pipe(
-		resp.Body, fmt.Sprintf("http response body for %s", f.filesystemId),
+		utils.Throttle{f.rateLimiter}.Reader(resp.Body),
+		fmt.Sprintf("http response body for %s", f.filesystemId),
 		pipeWriter, "stdin of zfs recv",
 		finished,
 		f.innerRequests,
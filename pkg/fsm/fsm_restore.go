@@ -0,0 +1,228 @@
+package fsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/dotmesh-io/dotmesh/pkg/utils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// restore copies some paths of the default subdot from one of the
+// filesystem's snapshots into the live filesystem, replacing what's there,
+// and optionally commits the result. Containers using the dot are stopped
+// while the files are replaced.
+func (f *FsMachine) restore(e *types.Event) (responseEvent *types.Event, nextState StateFn) {
+	snapshotId, ok := (*e.Args)["snapshotId"].(string)
+	if !ok {
+		return types.NewErrorEvent("cant-restore", fmt.Errorf("snapshotId not specified")), activeState
+	}
+	paths, err := castToStrings((*e.Args)["paths"])
+	if err != nil {
+		return types.NewErrorEvent("cant-restore", err), activeState
+	}
+	if len(paths) == 0 {
+		return types.NewErrorEvent("cant-restore", fmt.Errorf("no paths to restore")), activeState
+	}
+	commit, _ := (*e.Args)["commit"].(bool)
+	meta := map[string]string{}
+	if val, ok := (*e.Args)["metadata"]; ok {
+		meta, err = castToMetadata(val)
+		if err != nil {
+			return types.NewErrorEvent("unknown-metadata-format", err), activeState
+		}
+	}
+
+	found := false
+	f.snapshotsLock.Lock()
+	for _, s := range f.filesystem.Snapshots {
+		if s.Id == snapshotId {
+			found = true
+		}
+	}
+	f.snapshotsLock.Unlock()
+	if !found {
+		return types.NewErrorEvent("no-such-snapshot", fmt.Errorf("Commit %s not found", snapshotId)), activeState
+	}
+
+	mounted, state := f.mountSnap(snapshotId, true)
+	if mounted.Name != "mounted" {
+		return mounted, state
+	}
+	fromRoot := filepath.Join((*mounted.Args)["mount-path"].(string), "__default__")
+	toRoot := filepath.Join(utils.Mnt(f.filesystemId), "__default__")
+
+	err = f.stopContainers()
+	if err != nil {
+		log.Printf(
+			"%v while trying to stop containers during restore %s",
+			err, f.zfs.FQ(f.filesystemId),
+		)
+		return types.NewErrorEvent("failed-stop-containers-during-restore", err), backoffState
+	}
+	err = restorePaths(fromRoot, toRoot, paths)
+	if err != nil {
+		responseEvent, nextState = types.NewErrorEvent("failed-restore", err), activeState
+	} else if commit {
+		if meta["message"] == "" {
+			meta["message"] = fmt.Sprintf("Restore %s from %s", strings.Join(paths, ", "), snapshotId)
+		}
+		meta["restored-from"] = snapshotId
+		responseEvent, nextState = f.snapshot(&types.Event{
+			Name: "snapshot",
+			Args: &types.EventArgs{"metadata": meta},
+		})
+		if responseEvent.Name == "snapshotted" {
+			responseEvent = &types.Event{Name: "restored", Args: responseEvent.Args}
+		}
+	} else {
+		responseEvent, nextState = &types.Event{Name: "restored", Args: &types.EventArgs{}}, activeState
+	}
+
+	err = f.startContainers()
+	if err != nil {
+		log.Printf(
+			"%v while trying to start containers during restore %s",
+			err, f.zfs.FQ(f.filesystemId),
+		)
+		if responseEvent.Name == "restored" {
+			return types.NewErrorEvent("failed-start-containers-during-restore", err), backoffState
+		}
+	}
+	if responseEvent.Name == "restored" {
+		f.transitionedTo("active", "restored")
+	}
+	return responseEvent, nextState
+}
+
+// restorePaths replaces each of the paths under toRoot with a copy of the
+// same path under fromRoot. Every path must exist under fromRoot, and none of
+// them may be the root itself. Everything is copied next to where it's going
+// before anything is replaced, so a failed copy leaves toRoot as it was.
+func restorePaths(fromRoot, toRoot string, paths []string) error {
+	type pathCopy struct{ path, from, to, staged string }
+	copies := []pathCopy{}
+	// check them all before touching anything
+	for _, p := range paths {
+		from, err := pathUnder(fromRoot, p)
+		if err != nil {
+			return err
+		}
+		if from == filepath.Clean(fromRoot) {
+			return fmt.Errorf("can't restore the whole dot, revert to the commit instead")
+		}
+		_, err = os.Lstat(from)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s doesn't exist in the commit", p)
+		} else if err != nil {
+			return err
+		}
+		to, err := pathUnder(toRoot, p)
+		if err != nil {
+			return err
+		}
+		copies = append(copies, pathCopy{path: p, from: from, to: to})
+	}
+	// a path inside another one being restored comes with it
+	sort.Slice(copies, func(i, j int) bool { return copies[i].to < copies[j].to })
+	outermost := []pathCopy{}
+	for _, c := range copies {
+		if len(outermost) > 0 {
+			last := outermost[len(outermost)-1].to
+			if c.to == last || strings.HasPrefix(c.to, last+string(filepath.Separator)) {
+				continue
+			}
+		}
+		outermost = append(outermost, c)
+	}
+	copies = outermost
+
+	defer func() {
+		for _, c := range copies {
+			if c.staged != "" {
+				os.RemoveAll(filepath.Dir(c.staged))
+			}
+		}
+	}()
+	for i, c := range copies {
+		err := os.MkdirAll(filepath.Dir(c.to), 0775)
+		if err != nil {
+			return err
+		}
+		stagingDir, err := ioutil.TempDir(filepath.Dir(c.to), ".dotmesh-restore-")
+		if err != nil {
+			return err
+		}
+		copies[i].staged = filepath.Join(stagingDir, filepath.Base(c.to))
+		out, err := exec.Command("cp", "-a", "--reflink=auto", c.from, copies[i].staged).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %s %s", c.from, c.to, err, out)
+		}
+	}
+
+	replaced := []string{}
+	for _, c := range copies {
+		err := os.RemoveAll(c.to)
+		if err == nil {
+			err = os.Rename(c.staged, c.to)
+		}
+		if err != nil {
+			if len(replaced) == 0 {
+				return fmt.Errorf("failed to replace %s: %s", c.path, err)
+			}
+			return fmt.Errorf(
+				"failed to replace %s, after replacing %s: %s",
+				c.path, strings.Join(replaced, ", "), err,
+			)
+		}
+		replaced = append(replaced, c.path)
+	}
+	return nil
+}
+
+// pathUnder joins a path onto root without letting it escape root, like
+// securejoin.SecureJoin, but leaves a symlink at the end of the path alone so
+// that it's the link which is copied or replaced, not what it points to.
+func pathUnder(root, p string) (string, error) {
+	p = filepath.Clean("/" + p)
+	if p == "/" {
+		return filepath.Clean(root), nil
+	}
+	dir, err := securejoin.SecureJoin(root, filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(p)), nil
+}
+
+// castToStrings returns a list of strings, which will have become a list of
+// interface{}s if the event came over the wire.
+func castToStrings(val interface{}) ([]string, error) {
+	switch v := val.(type) {
+	case []string:
+		return v, nil
+	case []interface{}:
+		result := []string{}
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a string, got %#v", item)
+			}
+			result = append(result, s)
+		}
+		return result, nil
+	case nil:
+		return []string{}, nil
+	default:
+		return nil, fmt.Errorf("expected a list of strings, got %#v", val)
+	}
+}
@@ -0,0 +1,96 @@
+package fsm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestorePaths(t *testing.T) {
+	fromRoot, err := ioutil.TempDir("", "restoreFrom")
+	if err != nil {
+		t.Fatalf("making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(fromRoot)
+	toRoot, err := ioutil.TempDir("", "restoreTo")
+	if err != nil {
+		t.Fatalf("making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(toRoot)
+
+	for path, contents := range map[string]string{
+		"table.db":        "good",
+		"conf/app.yaml":   "port: 1",
+		"untouched.txt":   "old",
+		"conf/other.yaml": "x",
+		"logs/today.log":  "z",
+	} {
+		err = createTestFile(fromRoot, path, []byte(contents))
+		if err != nil {
+			t.Fatalf("creating %s: %v", path, err)
+		}
+	}
+	for path, contents := range map[string]string{
+		"table.db":        "corrupt",
+		"conf/app.yaml":   "port: 2",
+		"conf/added.yaml": "y",
+		"untouched.txt":   "new",
+		"logs":            "not a directory",
+	} {
+		err = createTestFile(toRoot, path, []byte(contents))
+		if err != nil {
+			t.Fatalf("creating %s: %v", path, err)
+		}
+	}
+
+	// nothing is touched if any of the paths are bad
+	for _, paths := range [][]string{{"table.db", "missing"}, {"table.db", "."}, {"../.."}} {
+		err = restorePaths(fromRoot, toRoot, paths)
+		if err == nil {
+			t.Errorf("expected restoring %v to fail", paths)
+		}
+		contents, _ := ioutil.ReadFile(filepath.Join(toRoot, "table.db"))
+		if string(contents) != "corrupt" {
+			t.Fatalf("expected table.db to be left alone restoring %v, got %q", paths, contents)
+		}
+	}
+
+	// nor if one of them can't be copied, here because the live dot has a
+	// file where the commit has a directory
+	err = restorePaths(fromRoot, toRoot, []string{"table.db", "logs/today.log"})
+	if err == nil {
+		t.Errorf("expected restoring into a file to fail")
+	}
+	contents, _ := ioutil.ReadFile(filepath.Join(toRoot, "table.db"))
+	if string(contents) != "corrupt" {
+		t.Fatalf("expected table.db to be left alone when another path can't be copied, got %q", contents)
+	}
+
+	err = restorePaths(fromRoot, toRoot, []string{"table.db", "/conf/", "conf/app.yaml"})
+	if err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	for path, expected := range map[string]string{
+		"table.db":        "good",
+		"conf/app.yaml":   "port: 1",
+		"conf/other.yaml": "x",
+		"untouched.txt":   "new",
+	} {
+		contents, err := ioutil.ReadFile(filepath.Join(toRoot, path))
+		if err != nil || string(contents) != expected {
+			t.Errorf("expected %s to be %q, got %q (%v)", path, expected, contents, err)
+		}
+	}
+	_, err = os.Stat(filepath.Join(toRoot, "conf/added.yaml"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the restored directory to lose files added since, got %v", err)
+	}
+	// nothing is left behind from copying
+	for _, dir := range []string{toRoot, filepath.Join(toRoot, "conf")} {
+		names, err := filepath.Glob(filepath.Join(dir, ".dotmesh-restore-*"))
+		if err != nil || len(names) != 0 {
+			t.Errorf("expected no copies left in %s, got %v (%v)", dir, names, err)
+		}
+	}
+}
@@ -13,6 +13,8 @@ func s3PullInitiatorState(f *FsMachine) StateFn {
 	f.transitionedTo("s3PullInitiatorState", "requesting")
 	transferRequest := f.lastS3TransferRequest
 	transferRequestId := f.lastTransferRequestId
+	ctx, done := f.transferContext(transferRequestId)
+	defer done()
 	containers, err := f.containersRunning()
 	if err != nil {
 		f.errorDuringTransfer("error-listing-containers-during-pull", err)
@@ -44,8 +46,17 @@ func s3PullInitiatorState(f *FsMachine) StateFn {
 			InitiatorNodeId:   f.state.NodeID(),
 			Index:             0,
 			Status:            "starting",
+			Priority:          transferRequest.Priority,
 		},
 	}
+	release, err := f.waitForTransferSlot(ctx, "s3PullInitiatorState", transferRequestId, transferRequest.Priority)
+	if err != nil {
+		// only cancelling the transfer stops it waiting
+		event, nextState := f.cancelledTransfer()
+		f.innerResponses <- event
+		return nextState
+	}
+	defer release()
 
 	latestMeta := make(map[string]string)
 	latestSnap, err := f.getLastNonMetadataSnapshot()
@@ -67,7 +78,10 @@ func s3PullInitiatorState(f *FsMachine) StateFn {
 		}
 	}
 	destPath := fmt.Sprintf("%s/%s", utils.Mnt(f.filesystemId), "__default__")
-	bucketChanged, keyVersions, err := downloadS3Bucket(f, svc, transferRequest.RemoteName, destPath, transferRequestId, transferRequest.Prefixes, latestMeta)
+	bucketChanged, keyVersions, err := downloadS3Bucket(ctx, f, svc, transferRequest.RemoteName, destPath, transferRequestId, transferRequest.Prefixes, latestMeta)
+	if ctx.Err() != nil {
+		return f.cancelS3Pull()
+	}
 	if err != nil {
 		f.errorDuringTransfer("cant-pull-from-s3", err)
 		return backoffState
@@ -108,3 +122,23 @@ func s3PullInitiatorState(f *FsMachine) StateFn {
 	}
 	return discoveringState
 }
+
+// cancelS3Pull stops a pull from S3 which has been cancelled, rolling back
+// whatever it had downloaded so far into the (otherwise clean) filesystem.
+func (f *FsMachine) cancelS3Pull() StateFn {
+	snaps, err := f.state.SnapshotsForCurrentMaster(f.filesystemId)
+	if err != nil {
+		f.errorDuringTransfer("cant-get-snapshots-to-roll-back-cancelled-pull", err)
+		return backoffState
+	}
+	if len(snaps) > 0 {
+		output, err := f.zfs.Rollback(f.filesystemId, snaps[len(snaps)-1].Id)
+		if err != nil {
+			f.errorDuringTransfer("cant-roll-back-cancelled-pull", fmt.Errorf("%s: %s", err, output))
+			return backoffState
+		}
+	}
+	event, nextState := f.cancelledTransfer()
+	f.innerResponses <- event
+	return nextState
+}
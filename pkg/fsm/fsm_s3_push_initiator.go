@@ -13,6 +13,8 @@ func s3PushInitiatorState(f *FsMachine) StateFn {
 	f.transitionedTo("s3PushInitiatorState", "requesting")
 	transferRequest := f.lastS3TransferRequest
 	transferRequestId := f.lastTransferRequestId
+	ctx, done := f.transferContext(transferRequestId)
+	defer done()
 
 	f.transferUpdates <- types.TransferUpdate{
 		Kind: types.TransferStart,
@@ -22,8 +24,17 @@ func s3PushInitiatorState(f *FsMachine) StateFn {
 			InitiatorNodeId:   f.state.NodeID(),
 			Index:             0,
 			Status:            "starting",
+			Priority:          transferRequest.Priority,
 		},
 	}
+	release, err := f.waitForTransferSlot(ctx, "s3PushInitiatorState", transferRequestId, transferRequest.Priority)
+	if err != nil {
+		// only cancelling the transfer stops it waiting
+		event, nextState := f.cancelledTransfer()
+		f.innerResponses <- event
+		return nextState
+	}
+	defer release()
 
 	latestSnap, err := f.getLastNonMetadataSnapshot()
 	if err != nil {
@@ -98,7 +109,14 @@ func s3PushInitiatorState(f *FsMachine) StateFn {
 		}
 
 		keyToVersionIds := make(map[string]string)
-		keyToVersionIds, err = updateS3Files(f, keyToVersionIds, fileItemsResponse.Items, pathToMount, transferRequestId, transferRequest.RemoteName, transferRequest.Prefixes, svc)
+		keyToVersionIds, err = updateS3Files(ctx, f, keyToVersionIds, fileItemsResponse.Items, pathToMount, transferRequestId, transferRequest.RemoteName, transferRequest.Prefixes, svc)
+		if ctx.Err() != nil {
+			// what's been uploaded stays in the bucket, but without the
+			// metadata commit the next push sends it all again
+			event, nextState := f.cancelledTransfer()
+			f.innerResponses <- event
+			return nextState
+		}
 		if err != nil {
 			f.errorDuringTransfer("error-updating-s3-objects", err)
 			return backoffState
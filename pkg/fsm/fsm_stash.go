@@ -0,0 +1,61 @@
+package fsm
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/dotmesh-io/dotmesh/pkg/utils"
+)
+
+// applyStash makes a new commit whose contents are those of a commit on
+// another filesystem, such as the latest commit of a stash of this one. The
+// live filesystem is changed file by file to match it, so it should have no
+// uncommitted changes, which would be lost.
+func (f *FsMachine) applyStash(e *types.Event) (responseEvent *types.Event, nextState StateFn) {
+	sourceFilesystemId, ok := (*e.Args)["sourceFilesystemId"].(string)
+	if !ok {
+		return types.NewErrorEvent("cant-apply-stash", fmt.Errorf("sourceFilesystemId not specified")), activeState
+	}
+	snapshotId, ok := (*e.Args)["snapshotId"].(string)
+	if !ok {
+		return types.NewErrorEvent("cant-apply-stash", fmt.Errorf("snapshotId not specified")), activeState
+	}
+	meta := map[string]string{}
+	if val, ok := (*e.Args)["metadata"]; ok {
+		var err error
+		meta, err = castToMetadata(val)
+		if err != nil {
+			return types.NewErrorEvent("unknown-metadata-format", err), activeState
+		}
+	}
+
+	f.snapshotsLock.Lock()
+	latest := ""
+	if len(f.filesystem.Snapshots) > 0 {
+		latest = f.filesystem.Snapshots[len(f.filesystem.Snapshots)-1].Id
+	}
+	f.snapshotsLock.Unlock()
+	if latest == "" {
+		return types.NewErrorEvent("cant-apply-stash", fmt.Errorf("%s has no commits", f.filesystemId)), activeState
+	}
+
+	changes, _, err := f.zfs.DiffSnapshots(f.filesystemId, latest, sourceFilesystemId, snapshotId, types.DiffOptions{})
+	if err != nil {
+		return types.NewErrorEvent("zfs-diff-failed", err), activeState
+	}
+	mounted, state := f.mountSnapOf(sourceFilesystemId, snapshotId, true)
+	if mounted.Name != "mounted" {
+		return mounted, state
+	}
+	fromRoot := filepath.Join((*mounted.Args)["mount-path"].(string), "__default__")
+	toRoot := filepath.Join(utils.Mnt(f.filesystemId), "__default__")
+
+	meta["applied-stash-commit"] = snapshotId
+	responseEvent, nextState = f.applyAndCommit(fromRoot, toRoot, changes, meta)
+	if responseEvent.Name == "snapshotted" {
+		responseEvent = &types.Event{Name: "stash-applied", Args: responseEvent.Args}
+		f.transitionedTo("active", "applied stash")
+	}
+	return responseEvent, nextState
+}
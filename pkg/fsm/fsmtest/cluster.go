@@ -0,0 +1,585 @@
+// Package fsmtest runs filesystem machines for a simulated multi-node cluster
+// inside `go test`, with in-memory pools, stores and container runtimes and a
+// fake clock.
+//
+// Each Node plays the part of the dotmesh server's InMemoryState: it
+// implements fsm.StateManager and keeps its registry and filesystem machines
+// up to date by watching the shared KV store, the same way the server's etcd
+// watchers do.
+//
+// Each node serves the replication stream handlers and the RPCs a push or
+// pull makes to its peer over HTTP on 127.0.0.1, so other nodes of the same
+// cluster receive its snapshots, and nodes of another Cluster can push to and
+// pull from it. Files the state machines write through mount paths, such as
+// commit metadata, go to a temporary MOUNT_PREFIX rather than into the fake
+// pools.
+package fsmtest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/pkg/auth"
+	"github.com/dotmesh-io/dotmesh/pkg/container/containertest"
+	"github.com/dotmesh-io/dotmesh/pkg/fsm"
+	"github.com/dotmesh-io/dotmesh/pkg/observer"
+	"github.com/dotmesh-io/dotmesh/pkg/registry"
+	"github.com/dotmesh-io/dotmesh/pkg/store"
+	"github.com/dotmesh-io/dotmesh/pkg/store/storetest"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/dotmesh-io/dotmesh/pkg/user"
+	"github.com/dotmesh-io/dotmesh/pkg/uuid"
+	"github.com/dotmesh-io/dotmesh/pkg/zfs/zfstest"
+
+	"github.com/jonboulle/clockwork"
+	log "github.com/sirupsen/logrus"
+)
+
+// how long to wait, in real time, for a state machine to respond
+const waitTimeout = 10 * time.Second
+
+// FilesystemMetadataTimeout is passed to every filesystem machine, it's long
+// enough that the live marker isn't refreshed unless the clock is advanced.
+const FilesystemMetadataTimeout = 60
+
+type Cluster struct {
+	Clock       clockwork.FakeClock
+	Stores      *storetest.Stores
+	UserManager user.UserManager
+	// Admin owns the filesystems created with Node.CreateFilesystem
+	Admin *user.User
+
+	nodes       map[string]*Node
+	mountPrefix string
+}
+
+// NewCluster starts a cluster with the given node ids, which are also their
+// pool ids.
+func NewCluster(nodeIds ...string) (*Cluster, error) {
+	stores, err := storetest.NewMemStores()
+	if err != nil {
+		return nil, err
+	}
+	um := user.New(store.NewKVDBStoreWithIndex(stores.Client, user.UsersPrefix))
+	admin, err := um.New("admin", "admin@example.com", "password")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		Clock:       clockwork.NewFakeClock(),
+		Stores:      stores,
+		UserManager: um,
+		Admin:       admin,
+		nodes:       map[string]*Node{},
+	}
+	if os.Getenv("MOUNT_PREFIX") == "" {
+		c.mountPrefix, err = ioutil.TempDir("", "fsmtest")
+		if err != nil {
+			return nil, err
+		}
+		os.Setenv("MOUNT_PREFIX", filepath.Join(c.mountPrefix, "mnt"))
+	}
+
+	for _, id := range nodeIds {
+		n := newNode(c, id)
+		c.nodes[id] = n
+		err = n.serve()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		err = n.watch()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close stops the nodes' servers and removes the temporary MOUNT_PREFIX, if
+// NewCluster made one.
+func (c *Cluster) Close() {
+	for _, n := range c.nodes {
+		if n.server != nil {
+			n.server.Close()
+		}
+	}
+	if c.mountPrefix != "" {
+		os.Unsetenv("MOUNT_PREFIX")
+		os.RemoveAll(c.mountPrefix)
+	}
+}
+
+// Node returns the node with the given id, or nil.
+func (c *Cluster) Node(id string) *Node {
+	return c.nodes[id]
+}
+
+// Context returns a context authenticated as the admin user, as the RPC
+// handlers would have.
+func (c *Cluster) Context() context.Context {
+	return auth.SetAuthenticationDetailsCtx(context.Background(), c.Admin, user.AuthenticationTypePassword)
+}
+
+// SetMaster moves a filesystem to a node, as `dm` moving a volume between
+// nodes would.
+func (c *Cluster) SetMaster(filesystemId, nodeId string) error {
+	return c.Stores.FilesystemStore.SetMaster(&types.FilesystemMaster{
+		FilesystemID: filesystemId,
+		NodeID:       nodeId,
+	}, &store.SetOptions{})
+}
+
+// AdvanceUntil moves the clock forward a second at a time, giving the state
+// machines a moment of real time after each step, until cond returns true.
+func (c *Cluster) AdvanceUntil(cond func() bool) error {
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out advancing the clock")
+		}
+		c.Clock.Advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// Node is one simulated dotmesh server.
+type Node struct {
+	cluster *Cluster
+	id      string
+
+	ZFS        *zfstest.FakeZFS
+	Containers *containertest.FakeClient
+	Registry   *registry.DefaultRegistry
+
+	newSnapsOnMaster     observer.Observer
+	localReceiveProgress observer.Observer
+	deathObserver        observer.Observer
+
+	filesystems     map[string]fsm.FSM
+	filesystemsLock sync.RWMutex
+
+	transfers     map[string]types.TransferPollResult
+	transfersLock sync.Mutex
+
+	server           *httptest.Server
+	disabledRPCs     map[string]bool
+	disabledRPCsLock sync.Mutex
+}
+
+var _ fsm.StateManager = &Node{}
+
+func newNode(c *Cluster, id string) *Node {
+	return &Node{
+		cluster:              c,
+		id:                   id,
+		ZFS:                  zfstest.NewFakeZFS(id),
+		Containers:           containertest.NewFakeClient(),
+		Registry:             registry.NewRegistry(c.UserManager, c.Stores.RegistryStore),
+		newSnapsOnMaster:     observer.NewObserver("newSnapsOnMaster:" + id),
+		localReceiveProgress: observer.NewObserver("localReceiveProgress:" + id),
+		deathObserver:        observer.NewObserver("deathObserver:" + id),
+		filesystems:          map[string]fsm.FSM{},
+		transfers:            map[string]types.TransferPollResult{},
+		disabledRPCs:         map[string]bool{},
+	}
+}
+
+// watch follows the shared stores like the server's etcd watchers.
+func (n *Node) watch() error {
+	err := n.cluster.Stores.RegistryStore.WatchFilesystems(0, func(rf *types.RegistryFilesystem) error {
+		vn := types.VolumeName{Namespace: rf.OwnerId, Name: rf.Name}
+		if rf.Meta.Action == types.KVDelete {
+			n.Registry.DeleteFilesystemFromEtcd(vn)
+			return nil
+		}
+		return n.Registry.UpdateFilesystemFromEtcd(vn, *rf)
+	})
+	if err != nil {
+		return err
+	}
+	err = n.cluster.Stores.RegistryStore.WatchClones(0, func(c *types.Clone) error {
+		if c.Meta.Action == types.KVDelete {
+			n.Registry.DeleteCloneFromEtcd(c.Name, c.FilesystemId)
+		} else {
+			n.Registry.UpdateCloneFromEtcd(c.Name, c.TopLevelFilesystemId, *c)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = n.cluster.Stores.FilesystemStore.WatchMasters(0, n.processFilesystemMaster)
+	if err != nil {
+		return err
+	}
+	return n.cluster.Stores.ServerStore.WatchSnapshots(0, func(ss *types.ServerSnapshots) error {
+		if ss.Meta.Action == types.KVDelete {
+			return n.UpdateSnapshotsFromKnownState(ss.ID, ss.FilesystemID, []*types.Snapshot{})
+		}
+		return n.UpdateSnapshotsFromKnownState(ss.ID, ss.FilesystemID, ss.Snapshots)
+	})
+}
+
+func (n *Node) processFilesystemMaster(fm *types.FilesystemMaster) error {
+	if fm.Meta.Action == types.KVDelete {
+		n.Registry.DeleteMasterNode(fm.FilesystemID)
+		return nil
+	}
+	masterNode, ok := n.Registry.GetMasterNode(fm.FilesystemID)
+	if ok && masterNode == fm.NodeID {
+		return nil
+	}
+	n.Registry.SetMasterNode(fm.FilesystemID, fm.NodeID)
+	if fm.NodeID == "" {
+		return nil
+	}
+	fs, err := n.InitFilesystemMachine(fm.FilesystemID)
+	if err != nil {
+		return err
+	}
+	name := "unmount"
+	if fm.NodeID == n.id {
+		name = "mount"
+	}
+	responseChan, err := fs.Submit(&types.Event{Name: name}, "")
+	if err != nil {
+		return err
+	}
+	go func() {
+		e := <-responseChan
+		log.Debugf("[fsmtest:%s] filesystem %s %s response %#v", n.id, fm.FilesystemID, name, e)
+	}()
+	return nil
+}
+
+// RegisterFilesystem registers a top level filesystem owned by the admin
+// user and makes this node its master, without creating it, as the server
+// does for a dot which is about to be pushed to it.
+func (n *Node) RegisterFilesystem(name, filesystemId string) error {
+	vn := types.VolumeName{Namespace: n.cluster.Admin.Name, Name: name}
+	err := n.Registry.RegisterFilesystem(n.cluster.Context(), vn, filesystemId)
+	if err != nil {
+		return err
+	}
+	err = n.cluster.Stores.FilesystemStore.SetMaster(&types.FilesystemMaster{
+		FilesystemID: filesystemId,
+		NodeID:       n.id,
+	}, &store.SetOptions{})
+	if err != nil {
+		return err
+	}
+	n.Registry.SetMasterNode(filesystemId, n.id)
+	return nil
+}
+
+// CreateFilesystem registers a top level filesystem owned by the admin user,
+// makes this node its master and creates it.
+func (n *Node) CreateFilesystem(name string) (string, error) {
+	filesystemId := uuid.New().String()
+	err := n.RegisterFilesystem(name, filesystemId)
+	if err != nil {
+		return "", err
+	}
+
+	e, err := n.Dispatch(filesystemId, &types.Event{Name: "create"})
+	if err != nil {
+		return "", err
+	}
+	if e.Name != "created" {
+		return "", fmt.Errorf("failed to create %s: %s", name, e)
+	}
+	return filesystemId, nil
+}
+
+// Dispatch sends an event to a filesystem machine on this node, starting it
+// if necessary, and waits for the response.
+func (n *Node) Dispatch(filesystemId string, e *types.Event) (*types.Event, error) {
+	fs, err := n.InitFilesystemMachine(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+	responseChan, err := fs.Submit(e, "")
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case response := <-responseChan:
+		return response, nil
+	case <-time.After(waitTimeout):
+		return nil, fmt.Errorf("timed out waiting for %s to respond to %s", filesystemId, e.Name)
+	}
+}
+
+// StartTransfer asks the machine for a filesystem on this node to push or
+// pull it, as the server's Transfer RPC does once it has checked the request.
+// It returns the transfer's id, and a channel which gets the machine's
+// response once the transfer has finished or failed.
+func (n *Node) StartTransfer(filesystemId string, request types.TransferRequest) (string, chan *types.Event, error) {
+	fs, err := n.InitFilesystemMachine(filesystemId)
+	if err != nil {
+		return "", nil, err
+	}
+	transfer, err := jsonArg(request)
+	if err != nil {
+		return "", nil, err
+	}
+	transferRequestId := uuid.New().String()
+	responseChan, err := fs.Submit(&types.Event{
+		Name: "transfer",
+		Args: &types.EventArgs{"Transfer": transfer},
+	}, transferRequestId)
+	if err != nil {
+		return "", nil, err
+	}
+	return transferRequestId, responseChan, nil
+}
+
+// WaitForState waits until the filesystem machine on this node is in the
+// given state.
+func (n *Node) WaitForState(filesystemId, state string) error {
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		fs, err := n.GetFilesystemMachine(filesystemId)
+		if err == nil && fs.GetCurrentState() == state {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			current := "not running"
+			if err == nil {
+				current = fs.GetCurrentState()
+			}
+			return fmt.Errorf("timed out waiting for %s to be %s on %s, it's %s", filesystemId, state, n.id, current)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Transfer returns the last progress reported for an intercluster transfer.
+func (n *Node) Transfer(transferRequestId string) (types.TransferPollResult, bool) {
+	n.transfersLock.Lock()
+	defer n.transfersLock.Unlock()
+	result, ok := n.transfers[transferRequestId]
+	return result, ok
+}
+
+func (n *Node) isFilesystemDeleted(filesystemId string) (bool, error) {
+	_, err := n.cluster.Stores.FilesystemStore.GetDeleted(filesystemId)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (n *Node) InitFilesystemMachine(filesystemId string) (fsm.FSM, error) {
+	n.filesystemsLock.Lock()
+	defer n.filesystemsLock.Unlock()
+	fs, ok := n.filesystems[filesystemId]
+	if ok {
+		return fs, nil
+	}
+	deleted, err := n.isFilesystemDeleted(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+	if deleted {
+		return nil, fmt.Errorf("filesystem %s was deleted", filesystemId)
+	}
+
+	c := n.cluster
+	fs = fsm.NewFilesystemMachine(&fsm.FsConfig{
+		FilesystemID:              filesystemId,
+		StateManager:              n,
+		Registry:                  n.Registry,
+		UserManager:               c.UserManager,
+		RegistryStore:             c.Stores.RegistryStore,
+		FilesystemStore:           c.Stores.FilesystemStore,
+		ServerStore:               c.Stores.ServerStore,
+		ContainerClient:           n.Containers,
+		LocalReceiveProgress:      n.localReceiveProgress,
+		NewSnapsOnMaster:          n.newSnapsOnMaster,
+		DeathObserver:             n.deathObserver,
+		FilesystemMetadataTimeout: FilesystemMetadataTimeout,
+		ZFS:                       n.ZFS,
+		Clock:                     c.Clock,
+	})
+	n.filesystems[filesystemId] = fs
+	go fs.Run()
+	return fs, nil
+}
+
+func (n *Node) GetFilesystemMachine(filesystemId string) (fsm.FSM, error) {
+	n.filesystemsLock.RLock()
+	defer n.filesystemsLock.RUnlock()
+	fs, ok := n.filesystems[filesystemId]
+	if !ok {
+		return nil, fmt.Errorf("No such filesystem id %s", filesystemId)
+	}
+	return fs, nil
+}
+
+func (n *Node) AlignMountStateWithMasters(filesystemId string) error {
+	fs, err := n.GetFilesystemMachine(filesystemId)
+	if err != nil {
+		return err
+	}
+	masterNode, err := n.Registry.CurrentMasterNode(filesystemId)
+	if err != nil {
+		return err
+	}
+	if masterNode == n.id && !fs.Mounted() {
+		e := fs.Mount()
+		if e.Name != "mounted" {
+			return fmt.Errorf("Couldn't mount filesystem: %v", e)
+		}
+	}
+	if masterNode != n.id && fs.Mounted() {
+		e := fs.Unmount()
+		if e.Name != "unmounted" {
+			return fmt.Errorf("Couldn't unmount filesystem: %v", e)
+		}
+	}
+	return nil
+}
+
+func (n *Node) ActivateClone(topLevelFilesystemId, originFilesystemId, originSnapshotId, newCloneFilesystemId, newBranchName string, stash *types.StashInfo) (string, error) {
+	err := n.Registry.RegisterClone(newBranchName, topLevelFilesystemId, types.Clone{
+		FilesystemId: newCloneFilesystemId,
+		Origin: types.Origin{
+			FilesystemId: originFilesystemId,
+			SnapshotId:   originSnapshotId,
+		},
+		Stash: stash,
+	})
+	if err != nil {
+		return "failed-clone-registration", err
+	}
+	_, err = n.InitFilesystemMachine(newCloneFilesystemId)
+	if err != nil {
+		return "failed-to-initialize-state-machine", err
+	}
+	err = n.cluster.Stores.FilesystemStore.SetMaster(&types.FilesystemMaster{
+		FilesystemID: newCloneFilesystemId,
+		NodeID:       n.id,
+	}, &store.SetOptions{})
+	if err != nil {
+		return "failed-make-cloner-master", err
+	}
+	return "", nil
+}
+
+func (n *Node) DeleteFilesystem(filesystemId string) error {
+	n.DeleteFilesystemFromMap(filesystemId)
+	err := n.ZFS.DeleteFilesystemInZFS(filesystemId)
+	if err != nil {
+		log.Errorf("[fsmtest:%s] error deleting %s: %s", n.id, filesystemId, err)
+	}
+	return nil
+}
+
+func (n *Node) DeleteFilesystemFromMap(filesystemId string) {
+	n.filesystemsLock.Lock()
+	delete(n.filesystems, filesystemId)
+	n.filesystemsLock.Unlock()
+}
+
+func (n *Node) NodeID() string {
+	return n.id
+}
+
+func (n *Node) UpdateSnapshotsFromKnownState(server, filesystem string, snapshots []*types.Snapshot) error {
+	fs, err := n.InitFilesystemMachine(filesystem)
+	if err != nil {
+		return err
+	}
+	fs.SetSnapshots(server, snapshots)
+
+	masterNode, err := n.Registry.CurrentMasterNode(filesystem)
+	if err != nil {
+		return err
+	}
+	if masterNode == server && len(snapshots) > 0 {
+		latest := snapshots[len(snapshots)-1]
+		go n.newSnapsOnMaster.Publish(filesystem, latest)
+	}
+	go fs.PublishNewSnaps(server, true)
+	return nil
+}
+
+func (n *Node) SnapshotsFor(server string, filesystemId string) ([]types.Snapshot, error) {
+	fs, err := n.GetFilesystemMachine(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+	snaps := []types.Snapshot{}
+	for _, s := range fs.GetSnapshots(server) {
+		snaps = append(snaps, *s)
+	}
+	return snaps, nil
+}
+
+func (n *Node) SnapshotsForCurrentMaster(filesystemId string) ([]types.Snapshot, error) {
+	master, err := n.Registry.CurrentMasterNode(filesystemId)
+	if err != nil {
+		return []types.Snapshot{}, err
+	}
+	return n.SnapshotsFor(master, filesystemId)
+}
+
+func (n *Node) AddressesForServer(server string) []string {
+	node, ok := n.cluster.nodes[server]
+	if !ok {
+		return []string{}
+	}
+	return []string{node.Address()}
+}
+
+func (n *Node) RegisterNewFork(originFilesystemId, originSnapshotId, forkNamespace, forkName, forkFilesystemId string) error {
+	_, err := n.cluster.Stores.RegistryStore.GetFilesystem(forkNamespace, forkName)
+	switch {
+	case err != nil && err != store.ErrNotFound:
+		return err
+	case err == nil:
+		return fmt.Errorf("The name %s/%s is already in use", forkNamespace, forkName)
+	}
+	err = n.Registry.RegisterFork(originFilesystemId, originSnapshotId, types.VolumeName{Namespace: forkNamespace, Name: forkName}, forkFilesystemId)
+	if err != nil {
+		return err
+	}
+	err = n.cluster.Stores.FilesystemStore.SetMaster(&types.FilesystemMaster{
+		FilesystemID: forkFilesystemId,
+		NodeID:       n.id,
+	}, &store.SetOptions{})
+	if err != nil {
+		return err
+	}
+	n.Registry.SetMasterNode(forkFilesystemId, n.id)
+	return nil
+}
+
+func (n *Node) UpdateInterclusterTransfer(transferRequestId string, pollResult types.TransferPollResult) {
+	n.transfersLock.Lock()
+	defer n.transfersLock.Unlock()
+	n.transfers[transferRequestId] = pollResult
+}
+
+func (n *Node) MarkFilesystemAsLiveInEtcd(topLevelFilesystemId string) error {
+	return n.cluster.Stores.FilesystemStore.SetLive(&types.FilesystemLive{
+		FilesystemID: topLevelFilesystemId,
+		NodeID:       n.id,
+	}, &store.SetOptions{
+		TTL: FilesystemMetadataTimeout,
+	})
+}
@@ -0,0 +1,386 @@
+package fsmtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+
+	"github.com/dotmesh-io/dotmesh/pkg/fsm"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/dotmesh-io/dotmesh/pkg/utils"
+	"github.com/dotmesh-io/dotmesh/pkg/zfs"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/rpc/v2"
+	rpcjson "github.com/gorilla/rpc/v2/json2"
+	log "github.com/sirupsen/logrus"
+)
+
+// serve starts the node's HTTP server, which has the parts of the dotmesh
+// server's API that filesystem machines use to reach other nodes and other
+// clusters: the replication stream handlers, and the RPCs a push or pull
+// makes to its peer. Requests aren't authenticated.
+func (n *Node) serve() error {
+	r := rpc.NewServer()
+	r.RegisterCodec(rpcjson.NewCodec(), "application/json")
+	err := r.RegisterService(&nodeRPC{node: n}, "DotmeshRPC")
+	if err != nil {
+		return err
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/rpc", n.withoutDisabledRPCs(r))
+	router.HandleFunc("/filesystems/{filesystem}/{fromSnap}/{toSnap}", n.sendFilesystem).Methods("GET")
+	router.HandleFunc("/filesystems/{filesystem}/{fromSnap}/{toSnap}", n.receiveFilesystem).Methods("POST")
+	n.server = httptest.NewServer(router)
+	return nil
+}
+
+// DisableRPC makes the node's server reply to calls of an RPC method, such as
+// "DotmeshRPC.NegotiateTransfer", as an older server without it would.
+func (n *Node) DisableRPC(method string) {
+	n.disabledRPCsLock.Lock()
+	defer n.disabledRPCsLock.Unlock()
+	n.disabledRPCs[method] = true
+}
+
+func (n *Node) withoutDisabledRPCs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var call struct {
+			Method string
+			Id     *json.RawMessage
+		}
+		json.Unmarshal(body, &call)
+		n.disabledRPCsLock.Lock()
+		disabled := n.disabledRPCs[call.Method]
+		n.disabledRPCsLock.Unlock()
+		if disabled {
+			// what gorilla/rpc replies for a method it doesn't have
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"error": &rpcjson.Error{
+					Code:    rpcjson.E_SERVER,
+					Message: fmt.Sprintf("rpc: can't find method %q", call.Method),
+				},
+				"id": call.Id,
+			})
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Address is the host:port the node's server listens on, which the other
+// nodes of the cluster reach it by.
+func (n *Node) Address() string {
+	return n.server.Listener.Addr().String()
+}
+
+// Peer returns the Peer and Port of a TransferRequest for pushing to or
+// pulling from this node from another cluster.
+func (n *Node) Peer() (string, int) {
+	host, port, err := net.SplitHostPort(n.Address())
+	if err != nil {
+		panic(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		panic(err)
+	}
+	return host, p
+}
+
+// dispatchToMaster sends an event to the machine on the filesystem's current
+// master, or on this node if it has none yet, as the server's
+// globalFsRequest does.
+func (n *Node) dispatchToMaster(filesystemId string, e *types.Event) (*types.Event, error) {
+	target := n
+	master, err := n.Registry.CurrentMasterNode(filesystemId)
+	if err == nil && n.cluster.nodes[master] != nil {
+		target = n.cluster.nodes[master]
+	}
+	return target.Dispatch(filesystemId, e)
+}
+
+// jsonArg turns a struct into what the state machines find in event args
+// which have been through etcd.
+func jsonArg(v interface{}) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var decoded map[string]interface{}
+	err = json.Unmarshal(encoded, &decoded)
+	return decoded, err
+}
+
+// sendFilesystem answers a GET for a replication stream, like the server's
+// ZFSSender, except that it doesn't proxy to the master.
+func (n *Node) sendFilesystem(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	filesystemId, fromSnap, toSnap := vars["filesystem"], vars["fromSnap"], vars["toSnap"]
+
+	master, err := n.Registry.CurrentMasterNode(filesystemId)
+	if err != nil || master != n.id {
+		http.Error(w, fmt.Sprintf("%s is not the master of %s", n.id, filesystemId), http.StatusNotFound)
+		return
+	}
+	snaps, err := n.SnapshotsFor(n.id, filesystemId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	prelude, err := fsm.CalculatePrelude(snaps, toSnap)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	preludeEncoded, err := fsm.EncodePrelude(prelude)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	encoding := utils.NegotiateStreamEncoding(r.Header.Get(utils.StreamAcceptEncodingHeader))
+	if encoding != "" {
+		w.Header().Set(utils.StreamEncodingHeader, encoding)
+	}
+	pipeReader, errch := n.ZFS.Send(
+		"", fromSnap, filesystemId, toSnap,
+		zfs.SendOptions{ResumeToken: r.URL.Query().Get("resumeToken")},
+		preludeEncoded,
+	)
+	defer pipeReader.Close()
+
+	finished := make(chan bool)
+	go utils.Pipe(
+		pipeReader, "send stream", w, "http response body", finished,
+		make(chan *types.Event), func(e *types.Event, c chan *types.Event) {},
+		func(bytes int64, t int64) {},
+		utils.CompressMode(encoding),
+	)
+	err = <-errch
+	if err != nil {
+		log.Errorf("[fsmtest:%s] error sending %s: %s", n.id, filesystemId, err)
+	}
+	<-finished
+}
+
+// receiveFilesystem takes a POSTed replication stream for a filesystem whose
+// machine is waiting for it in pushPeerState, like the server's ZFSReceiver,
+// except that it doesn't proxy to the master.
+func (n *Node) receiveFilesystem(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	filesystemId, toSnap := vars["filesystem"], vars["toSnap"]
+	resumeToken := r.URL.Query().Get("resumeToken")
+
+	fs, err := n.GetFilesystemMachine(filesystemId)
+	if err != nil || fs.GetCurrentState() != "pushPeerState" {
+		http.Error(w, fmt.Sprintf("%s isn't waiting for a push", filesystemId), http.StatusNotFound)
+		return
+	}
+
+	err = func() error {
+		if resumeToken == "" {
+			err := n.ZFS.AbortReceive(filesystemId)
+			if err != nil {
+				return err
+			}
+		}
+		pipeReader, pipeWriter := io.Pipe()
+		defer pipeReader.Close()
+		defer pipeWriter.Close()
+		finished := make(chan bool)
+		go utils.Pipe(
+			r.Body, "http request body", pipeWriter, "receive stream", finished,
+			make(chan *types.Event), func(e *types.Event, c chan *types.Event) {},
+			func(bytes int64, t int64) {},
+			utils.DecompressMode(r.Header.Get(utils.StreamEncodingHeader)),
+		)
+		prelude, err := fsm.ConsumePrelude(pipeReader)
+		if err != nil {
+			pipeReader.Close()
+			<-finished
+			return err
+		}
+		errBuffer := &bytes.Buffer{}
+		err = n.ZFS.Recv(pipeReader, filesystemId, errBuffer)
+		pipeReader.Close()
+		<-finished
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, errBuffer.String())
+		}
+		return n.ZFS.ApplyPrelude(prelude, filesystemId)
+	}()
+	if err != nil {
+		log.Errorf("[fsmtest:%s] error receiving %s: %s", n.id, filesystemId, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		go fs.PushCompleted(false)
+		return
+	}
+	if resumeToken != "" {
+		go fs.ResumedPushCompleted(toSnap)
+		return
+	}
+	go fs.PushCompleted(true)
+}
+
+// nodeRPC is the part of DotmeshRPC which one cluster's filesystem machines
+// call on another's during a push or pull. Tags aren't kept, which pushes
+// and pulls shrug off.
+type nodeRPC struct {
+	node *Node
+}
+
+func (d *nodeRPC) Ping(r *http.Request, args *struct{}, result *bool) error {
+	*result = true
+	return nil
+}
+
+func (d *nodeRPC) CommitsById(r *http.Request, filesystemId *string, result *[]types.Snapshot) error {
+	_, err := d.node.InitFilesystemMachine(*filesystemId)
+	if err != nil {
+		return err
+	}
+	snapshots, err := d.node.SnapshotsForCurrentMaster(*filesystemId)
+	if err != nil {
+		return err
+	}
+	*result = snapshots
+	return nil
+}
+
+func (d *nodeRPC) DeducePathToTopLevelFilesystem(
+	r *http.Request,
+	args *struct {
+		RemoteNamespace      string
+		RemoteFilesystemName string
+		RemoteCloneName      string
+	},
+	result *types.PathToTopLevelFilesystem,
+) error {
+	path, err := d.node.Registry.DeducePathToTopLevelFilesystem(
+		types.VolumeName{Namespace: args.RemoteNamespace, Name: args.RemoteFilesystemName},
+		args.RemoteCloneName,
+	)
+	if err != nil {
+		return err
+	}
+	*result = path
+	return nil
+}
+
+func (d *nodeRPC) PredictSize(
+	r *http.Request,
+	args *types.PredictSizeRequest,
+	result *types.PredictedSize,
+) error {
+	e, err := d.node.dispatchToMaster(args.ToFilesystemId, &types.Event{
+		Name: "predictSize",
+		Args: &types.EventArgs{
+			"FromFilesystemId": args.FromFilesystemId,
+			"FromSnapshotId":   args.FromSnapshotId,
+			"ToFilesystemId":   args.ToFilesystemId,
+			"ToSnapshotId":     args.ToSnapshotId,
+			"ResumeToken":      args.ResumeToken,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if e.Name != "predictedSize" {
+		return fmt.Errorf("predicting size: %s", e)
+	}
+	result.Raw = (*e.Args)["size"].(int64)
+	result.Wire = (*e.Args)["wireSize"].(int64)
+	return nil
+}
+
+func (d *nodeRPC) RegisterTransfer(r *http.Request, args *types.TransferPollResult, result *bool) error {
+	_, err := d.registerTransfer(args)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+func (d *nodeRPC) NegotiateTransfer(r *http.Request, args *types.TransferPollResult, result *types.TransferPollResult) error {
+	resumeToken, err := d.registerTransfer(args)
+	if err != nil {
+		return err
+	}
+	*result = *args
+	result.ResumeToken = resumeToken
+	return nil
+}
+
+func (d *nodeRPC) registerTransfer(args *types.TransferPollResult) (string, error) {
+	args.StreamEncoding = utils.NegotiateStreamEncoding(args.StreamEncoding)
+	args.CompressedStream = args.CompressedStream && d.node.ZFS.CompressedStreams()
+	d.node.UpdateInterclusterTransfer(args.TransferRequestId, *args)
+
+	transfer, err := jsonArg(args)
+	if err != nil {
+		return "", err
+	}
+	e, err := d.node.dispatchToMaster(args.FilesystemId, &types.Event{
+		Name: "peer-transfer",
+		Args: &types.EventArgs{"Transfer": transfer},
+	})
+	if err != nil {
+		return "", err
+	}
+	if e.Name != "awaiting-transfer" {
+		return "", fmt.Errorf("Error requesting peer transfer: %s", e)
+	}
+	resumeToken, _ := (*e.Args)["ResumeToken"].(string)
+	return resumeToken, nil
+}
+
+func (d *nodeRPC) CancelTransfer(r *http.Request, args *string, result *bool) error {
+	transfer, ok := d.node.Transfer(*args)
+	if !ok {
+		return fmt.Errorf("No such intercluster transfer %s", *args)
+	}
+	e, err := d.node.dispatchToMaster(transfer.FilesystemId, &types.Event{
+		Name: "cancel-transfer",
+		Args: &types.EventArgs{"TransferRequestId": *args},
+	})
+	if err != nil {
+		return err
+	}
+	if e.Name != "transfer-cancelled" {
+		return fmt.Errorf("cancelling transfer: %s", e)
+	}
+	*result = true
+	return nil
+}
+
+func (d *nodeRPC) StashAfter(r *http.Request, args *types.StashRequest, newBranch *string) error {
+	e, err := d.node.dispatchToMaster(args.FilesystemId, &types.Event{
+		Name: "stash",
+		Args: &types.EventArgs{"snapshotId": args.SnapshotId, "transferRequestId": args.TransferRequestId},
+	})
+	if err != nil {
+		return err
+	}
+	if e.Name != "stashed" {
+		return fmt.Errorf("stashing: %s", e)
+	}
+	*newBranch = (*e.Args)["NewBranchName"].(string)
+	return nil
+}
@@ -16,9 +16,15 @@ import (
 // TODO: remove that environment getter and replace with parameter
 
 func (f *FsMachine) mountSnap(snapId string, readonly bool) (responseEvent *types.Event, nextState StateFn) {
+	return f.mountSnapOf(f.filesystemId, snapId, readonly)
+}
+
+// mountSnapOf mounts a snapshot of another filesystem, such as a branch's
+// origin, which must be on this node.
+func (f *FsMachine) mountSnapOf(filesystemId, snapId string, readonly bool) (responseEvent *types.Event, nextState StateFn) {
 	// only try to use mount.zfs if it's not already present in the output
 	// of calling "mount"
-	fullId := zfs.FullIdWithSnapshot(f.filesystemId, snapId)
+	fullId := zfs.FullIdWithSnapshot(filesystemId, snapId)
 	mounted, err := utils.IsFilesystemMounted(fullId)
 	mountPath := utils.Mnt(fullId)
 	if err != nil {
@@ -33,7 +39,7 @@ func (f *FsMachine) mountSnap(snapId string, readonly bool) (responseEvent *type
 			options += ",ro"
 		}
 		if snapId == "" {
-			out, err := f.zfs.SetCanmount(f.filesystemId, snapId)
+			out, err := f.zfs.SetCanmount(filesystemId, snapId)
 			if err != nil {
 				return &types.Event{
 					Name: "failed-settings-canmount-noauto",
@@ -41,7 +47,7 @@ func (f *FsMachine) mountSnap(snapId string, readonly bool) (responseEvent *type
 				}, backoffState
 			}
 		}
-		out, err := f.zfs.Mount(f.filesystemId, snapId, options, mountPath)
+		out, err := f.zfs.Mount(filesystemId, snapId, options, mountPath)
 		if err != nil {
 			if strings.Contains(string(out), "already mounted") {
 				// This can happen when the filesystem is mounted in some other
@@ -111,7 +117,7 @@ func (f *FsMachine) mountSnap(snapId string, readonly bool) (responseEvent *type
 				// mount this time?
 				//
 				// TODO limit recursion depth
-				return f.mountSnap(snapId, readonly)
+				return f.mountSnapOf(filesystemId, snapId, readonly)
 			}
 			// if there is an error - it means we could not mount so don't
 			// update the filesystem with mounted = true
@@ -208,17 +208,17 @@ func getS3Client(transferRequest types.S3TransferRequest) (*s3.S3, error) {
 	return svc, nil
 }
 
-func downloadS3Bucket(f *FsMachine, svc *s3.S3, bucketName, destPath, transferRequestId string, prefixes []string, currentKeyVersions map[string]string) (bool, map[string]string, error) {
+func downloadS3Bucket(ctx context.Context, f *FsMachine, svc *s3.S3, bucketName, destPath, transferRequestId string, prefixes []string, currentKeyVersions map[string]string) (bool, map[string]string, error) {
 	log.Debugf("[downloadS3Bucket] Prefixes: %#v, len: %d", prefixes, len(prefixes))
 	if len(prefixes) == 0 {
-		return downloadPartialS3Bucket(f, svc, bucketName, destPath, transferRequestId, "", currentKeyVersions)
+		return downloadPartialS3Bucket(ctx, f, svc, bucketName, destPath, transferRequestId, "", currentKeyVersions)
 	}
 	var changed bool
 	var err error
 
 	for _, prefix := range prefixes {
 		log.Debugf("[downloadS3Bucket] Pulling down objects prefixed %s", prefix)
-		changed, currentKeyVersions, err = downloadPartialS3Bucket(f, svc, bucketName, destPath, transferRequestId, prefix, currentKeyVersions)
+		changed, currentKeyVersions, err = downloadPartialS3Bucket(ctx, f, svc, bucketName, destPath, transferRequestId, prefix, currentKeyVersions)
 		if err != nil {
 			return false, nil, err
 		}
@@ -227,7 +227,7 @@ func downloadS3Bucket(f *FsMachine, svc *s3.S3, bucketName, destPath, transferRe
 	return changed, currentKeyVersions, nil
 }
 
-func downloadPartialS3Bucket(f *FsMachine, svc *s3.S3, bucketName, destPath, transferRequestId, prefix string, currentKeyVersions map[string]string) (bool, map[string]string, error) {
+func downloadPartialS3Bucket(ctx context.Context, f *FsMachine, svc *s3.S3, bucketName, destPath, transferRequestId, prefix string, currentKeyVersions map[string]string) (bool, map[string]string, error) {
 	// for every version in the bucket
 	// 1. Delete anything locally that's been deleted in S3.
 	// 2. Download new versions of things that have changed
@@ -253,7 +253,7 @@ func downloadPartialS3Bucket(f *FsMachine, svc *s3.S3, bucketName, destPath, tra
 	// loop over objects in the bucket and add them to the delete or download collection
 	log.Debugf("Started collecting files to download and delete...")
 	var totalSize int64 = 0
-	err := svc.ListObjectVersionsPages(params,
+	err := svc.ListObjectVersionsPagesWithContext(ctx, params,
 		func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
 			for _, item := range page.DeleteMarkers {
 				latestMeta := currentKeyVersions[*item.Key]
@@ -302,6 +302,9 @@ func downloadPartialS3Bucket(f *FsMachine, svc *s3.S3, bucketName, destPath, tra
 	log.Debugf("[pkg/fsm/s3.go.downloadPartialS3Bucket] Ok, files deleted. Will download files now.")
 	completed := make(chan types.ItemData, len(filesToDownload))
 	sem := make(chan bool, 100)
+	// shared by all the concurrent downloads
+	throttle := f.throttle(f.lastS3TransferRequest.LimitRate)
+	throughput := &utils.Throughput{}
 	// loop over the files marked for download
 	for _, item := range filesToDownload {
 		sem <- true
@@ -328,7 +331,7 @@ func downloadPartialS3Bucket(f *FsMachine, svc *s3.S3, bucketName, destPath, tra
 					<-sem
 					return
 				}
-				innerError = downloadS3Object(f.transferUpdates, downloader, sent, startTime, *item.Key, *item.VersionId, bucketName, destPath, *item.Size)
+				innerError = downloadS3Object(ctx, f.transferUpdates, downloader, throttle, throughput, sent, startTime, *item.Key, *item.VersionId, bucketName, destPath, *item.Size)
 				if innerError == nil {
 					f.transferUpdates <- types.TransferUpdate{
 						Kind: types.TransferFinishedS3File,
@@ -345,6 +348,10 @@ func downloadPartialS3Bucket(f *FsMachine, svc *s3.S3, bucketName, destPath, tra
 					<-sem
 					return
 				}
+				if ctx.Err() != nil {
+					// cancelled, not stuck, so don't retry
+					break
+				}
 				f.transferUpdates <- types.TransferUpdate{
 					Kind: types.TransferS3Stuck,
 					Changes: types.TransferPollResult{
@@ -395,14 +402,17 @@ func downloadPartialS3Bucket(f *FsMachine, svc *s3.S3, bucketName, destPath, tra
 }
 
 type progressWriter struct {
-	key       string
-	written   int64
-	writer    io.WriterAt
-	startTime time.Time
-	updates   chan types.TransferUpdate
+	key        string
+	written    int64
+	writer     io.WriterAt
+	startTime  time.Time
+	updates    chan types.TransferUpdate
+	throttle   utils.Throttle
+	throughput *utils.Throughput
 }
 
 func (pw *progressWriter) WriteAt(p []byte, off int64) (int, error) {
+	pw.throttle.MeasuredWait(len(p), pw.throughput)
 	atomic.AddInt64(&pw.written, int64(len(p)))
 	elapsed := time.Since(pw.startTime).Nanoseconds()
 	pw.updates <- types.TransferUpdate{
@@ -412,13 +422,14 @@ func (pw *progressWriter) WriteAt(p []byte, off int64) (int, error) {
 			Sent:               int64(len(p)),
 			NanosecondsElapsed: elapsed,
 			Message:            "Downloading " + pw.key,
+			LimitRate:          pw.throughput.Rate(),
 		},
 	}
 
 	return pw.writer.WriteAt(p, off)
 }
 
-func downloadS3Object(updates chan types.TransferUpdate, downloader *s3manager.Downloader, startSent int64, startTime time.Time, key, versionId, bucket, destPath string, fileSize int64) error {
+func downloadS3Object(ctx context.Context, updates chan types.TransferUpdate, downloader *s3manager.Downloader, throttle utils.Throttle, throughput *utils.Throughput, startSent int64, startTime time.Time, key, versionId, bucket, destPath string, fileSize int64) error {
 	fpath := fmt.Sprintf("%s/%s", destPath, key)
 	directoryPath := fpath[:strings.LastIndex(fpath, "/")]
 	err := os.MkdirAll(directoryPath, 0666)
@@ -431,16 +442,19 @@ func downloadS3Object(updates chan types.TransferUpdate, downloader *s3manager.D
 		return err
 	}
 	writer := &progressWriter{
-		key:       key,
-		writer:    file,
-		updates:   updates,
-		startTime: startTime,
+		key:        key,
+		writer:     file,
+		updates:    updates,
+		startTime:  startTime,
+		throttle:   throttle,
+		throughput: throughput,
 	}
 	var size int64
-	context, cancel := context.WithCancel(context.Background())
+	downloadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	done := make(chan error)
 	go func() {
-		_, err := downloader.DownloadWithContext(context, writer, &s3.GetObjectInput{
+		_, err := downloader.DownloadWithContext(downloadCtx, writer, &s3.GetObjectInput{
 			Bucket:    &bucket,
 			Key:       &key,
 			VersionId: &versionId,
@@ -529,9 +543,11 @@ func removeOldPrefixedS3Files(keyToVersionIds map[string]string, files []types.L
 	return keyToVersionIds, nil
 }
 
-func updateS3Files(f *FsMachine, keyToVersionIds map[string]string, files []types.ListFileItem, pathToMount, transferRequestId, bucket string, prefixes []string, svc *s3.S3) (map[string]string, error) {
+func updateS3Files(ctx context.Context, f *FsMachine, keyToVersionIds map[string]string, files []types.ListFileItem, pathToMount, transferRequestId, bucket string, prefixes []string, svc *s3.S3) (map[string]string, error) {
 	// push every key up to s3 and then send back a map of object key -> s3 version id
 	uploader := s3manager.NewUploaderWithClient(svc)
+	throttle := f.throttle(f.lastS3TransferRequest.LimitRate)
+	throughput := &utils.Throughput{}
 	// filter out any paths we don't care about in an S3 remote
 	//filtered := make(map[string]os.FileInfo)
 	var filtered []types.ListFileItem
@@ -548,7 +564,7 @@ func updateS3Files(f *FsMachine, keyToVersionIds map[string]string, files []type
 	}
 	for _, file := range filtered {
 		path := fmt.Sprintf("%s/%s", pathToMount, file.Key)
-		versionId, err := uploadFileToS3(path, file.Key, bucket, uploader)
+		versionId, err := uploadFileToS3(ctx, path, file.Key, bucket, uploader, throttle, throughput)
 		if err != nil {
 			return nil, err
 		}
@@ -557,24 +573,25 @@ func updateS3Files(f *FsMachine, keyToVersionIds map[string]string, files []type
 		f.transferUpdates <- types.TransferUpdate{
 			Kind: types.TransferIncrementIndex,
 			Changes: types.TransferPollResult{
-				Sent: file.Size,
+				Sent:      file.Size,
+				LimitRate: throughput.Rate(),
 			},
 		}
 	}
 	return keyToVersionIds, nil
 }
 
-func uploadFileToS3(path, key, bucket string, uploader *s3manager.Uploader) (string, error) {
+func uploadFileToS3(ctx context.Context, path, key, bucket string, uploader *s3manager.Uploader, throttle utils.Throttle, throughput *utils.Throughput) (string, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
-	output, err := uploader.Upload(&s3manager.UploadInput{
+	output, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
-		Body:   file,
+		Body:   throttle.MeasuredReader(file, throughput),
 	})
 	if err != nil {
 		return "", err
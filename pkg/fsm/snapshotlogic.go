@@ -205,3 +205,152 @@ func restrictSnapshots(localSnaps []*types.Snapshot, toSnapshotId string) ([]*ty
 	}
 	return localSnaps, nil
 }
+
+// resumedSnapshot returns the snapshot that an interrupted receive of
+// snapRange was partway through. Snapshots are sent in order, so it is the one
+// after the latest snapshot to have made it across, which is where canApply
+// starts the range.
+func resumedSnapshot(snaps []*types.Snapshot, snapRange *snapshotRange) (*types.Snapshot, error) {
+	if snapRange.fromSnap == nil {
+		if len(snaps) == 0 {
+			return nil, &NoFromSnaps{}
+		}
+		return snaps[0], nil
+	}
+	for i, s := range snaps {
+		if s.Id == snapRange.fromSnap.Id {
+			if i+1 == len(snaps) {
+				return nil, fmt.Errorf("Nothing after %s to resume", s.Id)
+			}
+			return snaps[i+1], nil
+		}
+	}
+	return nil, fmt.Errorf("Unable to find %s in %+v", snapRange.fromSnap.Id, snaps)
+}
+
+// CompareSnapshots says how a branch whose snapshots are localSnaps stands
+// against a copy of it elsewhere with snapshots remoteSnaps: how many snapshots
+// each has after the latest one they have in common, which canApply finds as
+// it would for a pull, and that snapshot's id. With no snapshot in common, the
+// counts are of all the snapshots on each side, and commonAncestor is "".
+func CompareSnapshots(localSnaps, remoteSnaps []*types.Snapshot) (ahead, behind int, commonAncestor string) {
+	snapRange, err := canApply(remoteSnaps, localSnaps)
+	switch err := err.(type) {
+	case nil:
+		if snapRange.fromSnap == nil {
+			return 0, len(remoteSnaps), ""
+		}
+		return 0, snapshotsAfter(remoteSnaps, snapRange.fromSnap.Id), snapRange.fromSnap.Id
+	case *NoFromSnaps:
+		return len(localSnaps), 0, ""
+	case *ToSnapsUpToDate:
+		return 0, 0, localSnaps[len(localSnaps)-1].Id
+	case *ToSnapsAhead:
+		common := err.latestCommonSnapshot.Id
+		return snapshotsAfter(localSnaps, common), 0, common
+	case *ToSnapsDiverged:
+		common := err.latestCommonSnapshot.Id
+		return snapshotsAfter(localSnaps, common), snapshotsAfter(remoteSnaps, common), common
+	default:
+		return len(localSnaps), len(remoteSnaps), ""
+	}
+}
+
+func snapshotsAfter(snaps []*types.Snapshot, snapshotId string) int {
+	for i, s := range snaps {
+		if s.Id == snapshotId {
+			return len(snaps) - i - 1
+		}
+	}
+	return len(snaps)
+}
+
+// PlanTransferStep works out what a push or pull would send of one branch on
+// its path, from the snapshots on the sending and receiving ends, as
+// retryPush and retryPull do: the snapshots after the latest one the
+// receiving end has, up to toSnapshotId, or the latest if it's "". The stream
+// starts from the origin fromFilesystemId@fromSnapshotId when the receiving
+// end has none of them. The step's size isn't predicted.
+func PlanTransferStep(
+	sendingSnaps, receivingSnaps []*types.Snapshot,
+	fromFilesystemId, fromSnapshotId, toSnapshotId string,
+	stashDivergence bool,
+) types.TransferPlanStep {
+	step := types.TransferPlanStep{}
+	if toSnapshotId == "" {
+		if len(sendingSnaps) == 0 {
+			step.Error = "there are no commits to send"
+			return step
+		}
+		toSnapshotId = sendingSnaps[len(sendingSnaps)-1].Id
+	}
+	sendingSnaps, err := restrictSnapshots(sendingSnaps, toSnapshotId)
+	if err != nil {
+		step.Error = err.Error()
+		return step
+	}
+
+	snapRange, err := canApply(sendingSnaps, receivingSnaps)
+	switch err := err.(type) {
+	case nil:
+	case *ToSnapsUpToDate:
+		step.UpToDate = true
+		return step
+	case *ToSnapsAhead:
+		if stashDivergence {
+			// transfers allowed to stash take this as having nothing to do
+			step.UpToDate = true
+		} else {
+			step.Error = fmt.Sprintf(
+				"the receiving end has %d commits after %s, the latest commit to send",
+				snapshotsAfter(receivingSnaps, err.latestCommonSnapshot.Id), err.latestCommonSnapshot.Id,
+			)
+		}
+		return step
+	case *ToSnapsDiverged:
+		step.StashNeeded = true
+		if !stashDivergence {
+			step.Error = fmt.Sprintf(
+				"the receiving end has diverged since %s, its %d commits after it would need stashing",
+				err.latestCommonSnapshot.Id, snapshotsAfter(receivingSnaps, err.latestCommonSnapshot.Id),
+			)
+			return step
+		}
+		// once they're stashed, the receiving end is rolled back to the
+		// latest common snapshot
+		receivingSnaps, err2 := restrictSnapshots(receivingSnaps, err.latestCommonSnapshot.Id)
+		if err2 != nil {
+			step.Error = err2.Error()
+			return step
+		}
+		snapRange, err2 = canApply(sendingSnaps, receivingSnaps)
+		if err2 != nil {
+			step.Error = err2.Error()
+			return step
+		}
+	case *NoCommonSnapshots:
+		step.Error = "the sending and receiving ends have no commits in common"
+		return step
+	default:
+		step.Error = err.Error()
+		return step
+	}
+
+	first := 0
+	if snapRange.fromSnap == nil {
+		step.StartingCommit = "START"
+		if fromFilesystemId != "" {
+			// This is a send from a clone origin
+			step.StartingCommit = fmt.Sprintf("%s@%s", fromFilesystemId, fromSnapshotId)
+		}
+	} else {
+		step.StartingCommit = snapRange.fromSnap.Id
+		first = len(sendingSnaps) - snapshotsAfter(sendingSnaps, snapRange.fromSnap.Id)
+	}
+	step.TargetCommit = snapRange.toSnap.Id
+	step.Commits = []types.Snapshot{}
+	for _, s := range sendingSnaps[first:] {
+		step.Commits = append(step.Commits, *s)
+	}
+	return step
+}
@@ -0,0 +1,66 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompareSnapshots(t *testing.T) {
+	for _, c := range []struct {
+		name           string
+		local, remote  []string
+		ahead, behind  int
+		commonAncestor string
+	}{
+		{"up to date", []string{"A", "B"}, []string{"A", "B"}, 0, 0, "B"},
+		{"ahead", []string{"A", "B", "C", "D"}, []string{"A", "B"}, 2, 0, "B"},
+		{"behind", []string{"A"}, []string{"A", "B", "C"}, 0, 2, "A"},
+		{"diverged", []string{"A", "B", "C", "D", "E"}, []string{"A", "B", "F"}, 3, 1, "B"},
+		{"no common commits", []string{"A", "B"}, []string{"C"}, 2, 1, ""},
+		{"nothing on the remote", []string{"A", "B"}, []string{}, 2, 0, ""},
+		{"nothing locally", []string{}, []string{"A", "B"}, 0, 2, ""},
+	} {
+		ahead, behind, commonAncestor := CompareSnapshots(snaps(c.local...), snaps(c.remote...))
+		if ahead != c.ahead || behind != c.behind || commonAncestor != c.commonAncestor {
+			t.Errorf("%s: expected ahead %d, behind %d since %q, got ahead %d, behind %d since %q",
+				c.name, c.ahead, c.behind, c.commonAncestor, ahead, behind, commonAncestor)
+		}
+	}
+}
+
+func TestPlanTransferStep(t *testing.T) {
+	for _, c := range []struct {
+		name                 string
+		sending, receiving   []string
+		fromFilesystemId     string
+		toSnapshotId         string
+		stashDivergence      bool
+		startingCommit       string
+		commits              string
+		upToDate, stash, err bool
+	}{
+		{name: "new", sending: []string{"A", "B", "C"}, startingCommit: "START", commits: "A,B,C"},
+		{name: "new clone", sending: []string{"A", "B"}, fromFilesystemId: "origin", startingCommit: "origin@O", commits: "A,B"},
+		{name: "behind", sending: []string{"A", "B", "C"}, receiving: []string{"A"}, startingCommit: "A", commits: "B,C"},
+		{name: "up to a commit", sending: []string{"A", "B", "C"}, receiving: []string{"A"}, toSnapshotId: "B", startingCommit: "A", commits: "B"},
+		{name: "up to date", sending: []string{"A", "B"}, receiving: []string{"A", "B"}, upToDate: true},
+		{name: "ahead", sending: []string{"A"}, receiving: []string{"A", "B"}, err: true},
+		{name: "ahead with stashing", sending: []string{"A"}, receiving: []string{"A", "B"}, stashDivergence: true, upToDate: true},
+		{name: "diverged", sending: []string{"A", "B", "C"}, receiving: []string{"A", "D"}, stash: true, err: true},
+		{name: "diverged with stashing", sending: []string{"A", "B", "C"}, receiving: []string{"A", "D"}, stashDivergence: true, stash: true, startingCommit: "A", commits: "B,C"},
+		{name: "no common commits", sending: []string{"A"}, receiving: []string{"B"}, err: true},
+		{name: "nothing to send", err: true},
+	} {
+		step := PlanTransferStep(
+			snaps(c.sending...), snaps(c.receiving...), c.fromFilesystemId, "O", c.toSnapshotId, c.stashDivergence,
+		)
+		ids := []string{}
+		for _, s := range step.Commits {
+			ids = append(ids, s.Id)
+		}
+		if step.StartingCommit != c.startingCommit || strings.Join(ids, ",") != c.commits ||
+			step.UpToDate != c.upToDate || step.StashNeeded != c.stash || (step.Error != "") != c.err {
+			t.Errorf("%s: unexpected plan %+v", c.name, step)
+		}
+	}
+}
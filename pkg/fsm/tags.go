@@ -0,0 +1,111 @@
+package fsm
+
+import (
+	"golang.org/x/net/context"
+
+	dmclient "github.com/dotmesh-io/dotmesh/pkg/client"
+	"github.com/dotmesh-io/dotmesh/pkg/store"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pushTags sends the tags of the dot which has just been pushed to the peer,
+// which keeps the ones for commits it now has. Tags are a nicety, so failing
+// to send them doesn't fail the push.
+func (f *FsMachine) pushTags(ctx context.Context, client *dmclient.JsonRpcClient, transferRequest types.TransferRequest) {
+	tlf, err := f.registry.LookupFilesystem(types.VolumeName{
+		Namespace: transferRequest.LocalNamespace,
+		Name:      transferRequest.LocalName,
+	})
+	if err != nil {
+		log.Printf("[pushTags] can't find %s/%s: %s", transferRequest.LocalNamespace, transferRequest.LocalName, err)
+		return
+	}
+	tags, err := f.registryStore.ListTags(tlf.MasterBranch.Id)
+	if err != nil {
+		log.Printf("[pushTags] can't list the tags of %s: %s", tlf.MasterBranch.Id, err)
+		return
+	}
+	if len(tags) == 0 {
+		return
+	}
+	request := types.ImportTagsRequest{
+		Namespace: transferRequest.RemoteNamespace,
+		Name:      transferRequest.RemoteName,
+	}
+	for _, tag := range tags {
+		request.Tags = append(request.Tags, *tag)
+	}
+	var imported int
+	err = client.CallRemote(ctx, "DotmeshRPC.ImportTags", request, &imported)
+	if err != nil {
+		log.Printf("[pushTags] can't send the tags of %s to the peer: %s", tlf.MasterBranch.Id, err)
+		return
+	}
+	log.Printf("[pushTags] peer added %d of the %d tags of %s", imported, len(tags), tlf.MasterBranch.Id)
+}
+
+// pullTags adds the peer's tags of the dot which has just been pulled, for
+// the commits which are now here. Tags which are already here are left
+// alone, since tags don't move. Failing to get them doesn't fail the pull.
+func (f *FsMachine) pullTags(
+	ctx context.Context, client *dmclient.JsonRpcClient,
+	path types.PathToTopLevelFilesystem, transferRequest types.TransferRequest,
+) {
+	var tags []types.Tag
+	err := client.CallRemote(ctx, "DotmeshRPC.Tags", types.VolumeName{
+		Namespace: transferRequest.RemoteNamespace,
+		Name:      transferRequest.RemoteName,
+	}, &tags)
+	if err != nil {
+		log.Printf("[pullTags] can't list the peer's tags of %s/%s: %s", transferRequest.RemoteNamespace, transferRequest.RemoteName, err)
+		return
+	}
+	if len(tags) == 0 {
+		return
+	}
+	tlf, err := f.registry.LookupFilesystem(types.VolumeName{
+		Namespace: transferRequest.LocalNamespace,
+		Name:      transferRequest.LocalName,
+	})
+	if err != nil {
+		log.Printf("[pullTags] can't find %s/%s: %s", transferRequest.LocalNamespace, transferRequest.LocalName, err)
+		return
+	}
+
+	// everything on the path was pulled onto this node
+	commits := map[string]bool{}
+	filesystemIds := []string{path.TopLevelFilesystemId}
+	for _, clone := range path.Clones {
+		filesystemIds = append(filesystemIds, clone.Clone.FilesystemId)
+	}
+	for _, filesystemId := range filesystemIds {
+		filesystem, err := f.zfs.DiscoverSystem(filesystemId)
+		if err != nil {
+			continue
+		}
+		for _, snapshot := range filesystem.Snapshots {
+			commits[snapshot.Id] = true
+		}
+	}
+
+	imported := 0
+	for _, tag := range tags {
+		if !commits[tag.SnapshotId] {
+			continue
+		}
+		tag.Meta = nil
+		tag.FilesystemId = tlf.MasterBranch.Id
+		err = f.registryStore.SetTag(&tag, &store.SetOptions{})
+		if store.IsKeyAlreadyExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("[pullTags] can't add tag %s to %s: %s", tag.Name, tlf.MasterBranch.Id, err)
+			return
+		}
+		imported++
+	}
+	log.Printf("[pullTags] added %d of the peer's %d tags to %s", imported, len(tags), tlf.MasterBranch.Id)
+}
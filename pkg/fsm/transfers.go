@@ -5,8 +5,10 @@ import (
 
 	dmclient "github.com/dotmesh-io/dotmesh/pkg/client"
 	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/dotmesh-io/dotmesh/pkg/utils"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
 )
 
 // stuff used to do transfers, both for DM and S3
@@ -24,6 +26,14 @@ func s3TransferRequestify(in interface{}) (types.S3TransferRequest, error) {
 	for _, pref := range prefixInter {
 		prefixes = append(prefixes, pref.(string))
 	}
+	var limitRate int64
+	if typed["LimitRate"] != nil {
+		limitRate = int64(typed["LimitRate"].(float64))
+	}
+	var priority int
+	if typed["Priority"] != nil {
+		priority = int(typed["Priority"].(float64))
+	}
 	return types.S3TransferRequest{
 		KeyID:           typed["KeyID"].(string),
 		SecretKey:       typed["SecretKey"].(string),
@@ -34,6 +44,8 @@ func s3TransferRequestify(in interface{}) (types.S3TransferRequest, error) {
 		LocalName:       typed["LocalName"].(string),
 		LocalBranchName: typed["LocalBranchName"].(string),
 		RemoteName:      typed["RemoteName"].(string),
+		LimitRate:       limitRate,
+		Priority:        priority,
 	}, nil
 }
 
@@ -60,6 +72,15 @@ func transferRequestify(in interface{}) (types.TransferRequest, error) {
 	} else {
 		stash = typed["StashDivergence"].(bool)
 	}
+
+	var limitRate int64
+	if typed["LimitRate"] != nil {
+		limitRate = int64(typed["LimitRate"].(float64))
+	}
+	var priority int
+	if typed["Priority"] != nil {
+		priority = int(typed["Priority"].(float64))
+	}
 	return types.TransferRequest{
 		Peer:             typed["Peer"].(string),
 		User:             typed["User"].(string),
@@ -74,6 +95,8 @@ func transferRequestify(in interface{}) (types.TransferRequest, error) {
 		RemoteBranchName: typed["RemoteBranchName"].(string),
 		TargetCommit:     typed["TargetCommit"].(string),
 		StashDivergence:  stash,
+		LimitRate:        limitRate,
+		Priority:         priority,
 	}, nil
 }
 
@@ -174,6 +197,9 @@ func (f *FsMachine) applyPath(path types.PathToTopLevelFilesystem, transferFn tr
 		"", "", path.TopLevelFilesystemId, firstSnapshot,
 		transferRequestId, client, transferRequest,
 	)
+	if responseEvent.Name == "transfer-cancelled" {
+		return responseEvent, nextState
+	}
 	if !(responseEvent.Name == "finished-push" ||
 		responseEvent.Name == "finished-pull" || responseEvent.Name == "peer-up-to-date") {
 		msg := fmt.Sprintf(
@@ -221,6 +247,9 @@ func (f *FsMachine) applyPath(path types.PathToTopLevelFilesystem, transferFn tr
 			clone.Clone.FilesystemId, nextOrigin.SnapshotId,
 			transferRequestId, client, transferRequest,
 		)
+		if responseEvent.Name == "transfer-cancelled" {
+			return responseEvent, nextState
+		}
 		if !(responseEvent.Name == "finished-push" ||
 			responseEvent.Name == "finished-pull" || responseEvent.Name == "peer-up-to-date") {
 			msg := fmt.Sprintf(
@@ -278,6 +307,7 @@ func TransferPollResultFromTransferRequest(
 		// the case of a multi-host target cluster, possibly...
 		FilesystemId:    "",
 		InitiatorNodeId: nodeId,
+		Priority:        transferRequest.Priority,
 		// XXX re-inventing a wheel here? Maybe we can just use the state
 		// "status" fields for this? We're using that already for inter-cluster
 		// replication.
@@ -286,3 +316,221 @@ func TransferPollResultFromTransferRequest(
 		Status: status,
 	}
 }
+
+// resumption is an interrupted receive which a transfer carries on from,
+// rather than sending everything again.
+type resumption struct {
+	token string
+	// the snapshot the receive was partway through
+	snapshot *types.Snapshot
+}
+
+// resumptionFor decides whether a transfer of snapRange can carry on from the
+// interrupted receive that resumeToken was taken from. It won't when the last
+// attempt was given the same token, as resuming from it got nowhere (perhaps
+// the sender no longer has the snapshot it refers to), so the receiver will
+// have to start that snapshot over.
+func (f *FsMachine) resumptionFor(
+	resumeToken, lastResumeToken string, snaps []*types.Snapshot, snapRange *snapshotRange,
+) *resumption {
+	if resumeToken == "" {
+		return nil
+	}
+	if resumeToken == lastResumeToken {
+		log.Warnf(
+			"[resumptionFor:%s] resuming the last attempt made no progress, starting over",
+			f.filesystemId,
+		)
+		return nil
+	}
+	snapshot, err := resumedSnapshot(snaps, snapRange)
+	if err != nil {
+		log.Warnf(
+			"[resumptionFor:%s] can't tell which snapshot to resume, starting over: %s",
+			f.filesystemId, err,
+		)
+		return nil
+	}
+	return &resumption{token: resumeToken, snapshot: snapshot}
+}
+
+// predictResumedSize returns how much is left to send of the snapshot that
+// resume was partway through, and how much of it was saved sending again.
+func (f *FsMachine) predictResumedSize(
+	fromFilesystemId, fromSnapshotId, toFilesystemId string, resume *resumption, format streamFormat,
+) (int64, int64, error) {
+	size, err := f.zfs.PredictSize(fromFilesystemId, fromSnapshotId, toFilesystemId, resume.snapshot.Id)
+	if err != nil {
+		return 0, 0, err
+	}
+	full, _ := format.sizes(size)
+	remaining, err := f.zfs.PredictResumeSize(resume.token)
+	if err != nil {
+		return 0, 0, err
+	}
+	return remaining, savedByResuming(full, remaining), nil
+}
+
+func savedByResuming(full, remaining int64) int64 {
+	if remaining > full {
+		// the estimates don't quite agree, don't report a negative saving
+		return 0
+	}
+	return full - remaining
+}
+
+// throttle returns the limits on a stream for a transfer limited to
+// limitRate bytes per second, which also gets a share of the node's limit.
+func (f *FsMachine) throttle(limitRate int64) utils.Throttle {
+	return utils.Throttle{utils.NewRateLimiter(limitRate), f.rateLimiter}
+}
+
+// streamFormat is how a replication stream is sent, as agreed between the two
+// ends of a transfer.
+type streamFormat struct {
+	// one of utils.StreamEncodings, or "" for uncompressed
+	encoding string
+	// whether zfs sends blocks as they're compressed on disk
+	compressed bool
+}
+
+// sizes returns how many bytes of stream zfs will send in this format, which
+// is what transfer progress is measured in, and how many are expected to go
+// over the wire.
+func (s streamFormat) sizes(size *types.PredictedSize) (stream int64, wire int64) {
+	stream = size.Raw
+	if s.compressed {
+		stream = size.Wire
+	}
+	wire = stream
+	if s.encoding != "" {
+		wire = size.Wire
+	}
+	return stream, wire
+}
+
+// transferContext returns a context for doing the transfer with the given id,
+// which CancelTransfer cancels. Call done when the transfer is over.
+func (f *FsMachine) transferContext(transferRequestId string) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.transferCancelMu.Lock()
+	defer f.transferCancelMu.Unlock()
+	f.transferCancels[transferRequestId] = cancel
+	return ctx, func() {
+		f.transferCancelMu.Lock()
+		defer f.transferCancelMu.Unlock()
+		delete(f.transferCancels, transferRequestId)
+		cancel()
+	}
+}
+
+// CancelTransfer cancels the context of the transfer with the given id, if
+// this machine is doing it, which stops its streams and sends its state back
+// through discovering. It returns whether there was such a transfer.
+func (f *FsMachine) CancelTransfer(transferRequestId string) bool {
+	f.transferCancelMu.Lock()
+	defer f.transferCancelMu.Unlock()
+	cancel, ok := f.transferCancels[transferRequestId]
+	if ok {
+		log.Infof("[CancelTransfer:%s] cancelling transfer %s", f.filesystemId, transferRequestId)
+		cancel()
+	}
+	return ok
+}
+
+// cancelledTransfer marks the transfer cancelled, for an initiator state to
+// return once it has stopped. Anything left half-received is thrown away when
+// the cancel-transfer request which follows reaches the machine.
+func (f *FsMachine) cancelledTransfer() (*types.Event, StateFn) {
+	f.transferUpdates <- types.TransferUpdate{
+		Kind: types.TransferCancelled,
+		Changes: types.TransferPollResult{
+			Message: "cancelled",
+		},
+	}
+	return &types.Event{Name: "transfer-cancelled"}, discoveringState
+}
+
+// abortCancelledTransfer handles the cancel-transfer request which follows
+// CancelTransfer, once the machine is free, by throwing away anything the
+// transfer left half-received into this filesystem.
+func (f *FsMachine) abortCancelledTransfer() *types.Event {
+	err := f.zfs.AbortReceive(f.filesystemId)
+	if err != nil {
+		return types.NewErrorEvent("cant-abort-partial-receive", err)
+	}
+	return &types.Event{Name: "transfer-cancelled"}
+}
+
+// peerTransferRequestId is the id the initiator gave a transfer registered
+// with us, which it cancels the transfer by, rather than the id of the
+// request which registered it.
+func peerTransferRequestId(e *types.Event) string {
+	transfer, _ := (*e.Args)["Transfer"].(map[string]interface{})
+	id, _ := transfer["TransferRequestId"].(string)
+	if id == "" {
+		id, _ = (*e.Args)["RequestId"].(string)
+	}
+	return id
+}
+
+// waitForTransferSlot waits until the node's transfer queue lets the transfer
+// with the given id run, keeping its poll result up to date with its place in
+// the queue. Requests are turned away meanwhile, as they are while the
+// transfer runs. Call release when the transfer is over.
+func (f *FsMachine) waitForTransferSlot(
+	ctx context.Context, state, transferRequestId string, priority int,
+) (release func(), err error) {
+	if f.transferQueue == nil {
+		return func() {}, nil
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-f.innerRequests:
+				f.innerResponses <- &types.Event{
+					Name: "busy-transferring",
+					Args: &types.EventArgs{"currentState": state, "queued": true},
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	var queued bool
+	release, err = f.transferQueue.Acquire(ctx, transferRequestId, priority, func(position int) {
+		queued = true
+		f.transferUpdates <- types.TransferUpdate{
+			Kind: types.TransferQueued,
+			Changes: types.TransferPollResult{
+				Status:        "queued",
+				QueuePosition: position,
+				Message:       fmt.Sprintf("number %d in the queue", position),
+			},
+		}
+		f.transitionedTo(state, fmt.Sprintf("queued at position %d", position))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if queued {
+		f.transferUpdates <- types.TransferUpdate{
+			Kind: types.TransferQueued,
+			Changes: types.TransferPollResult{
+				Status:  "starting",
+				Message: "left the queue",
+			},
+		}
+		f.transitionedTo(state, "running")
+	}
+	return release, nil
+}
@@ -0,0 +1,123 @@
+package fsm
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"golang.org/x/net/context"
+)
+
+func testSnaps(ids ...string) []*types.Snapshot {
+	snaps := []*types.Snapshot{}
+	for _, id := range ids {
+		snaps = append(snaps, &types.Snapshot{Id: id})
+	}
+	return snaps
+}
+
+func TestResumedSnapshot(t *testing.T) {
+	snaps := testSnaps("a", "b", "c")
+
+	// nothing made it across, so the first snapshot was interrupted
+	s, err := resumedSnapshot(snaps, &snapshotRange{toSnap: snaps[2]})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.Id != "a" {
+		t.Errorf("expected a, got %s", s.Id)
+	}
+
+	// a made it, b was interrupted
+	s, err = resumedSnapshot(snaps, &snapshotRange{fromSnap: snaps[0], toSnap: snaps[2]})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.Id != "b" {
+		t.Errorf("expected b, got %s", s.Id)
+	}
+
+	_, err = resumedSnapshot(snaps, &snapshotRange{fromSnap: snaps[2], toSnap: snaps[2]})
+	if err == nil {
+		t.Errorf("expected an error resuming after the last snapshot")
+	}
+	_, err = resumedSnapshot(snaps, &snapshotRange{fromSnap: &types.Snapshot{Id: "z"}, toSnap: snaps[2]})
+	if err == nil {
+		t.Errorf("expected an error resuming after an unknown snapshot")
+	}
+}
+
+func TestResumptionFor(t *testing.T) {
+	f := &FsMachine{filesystemId: "fs"}
+	snaps := testSnaps("a", "b")
+	snapRange := &snapshotRange{fromSnap: snaps[0], toSnap: snaps[1]}
+
+	if r := f.resumptionFor("", "", snaps, snapRange); r != nil {
+		t.Errorf("expected no resumption without a token, got %+v", r)
+	}
+	r := f.resumptionFor("token-2", "token-1", snaps, snapRange)
+	if r == nil || r.token != "token-2" || r.snapshot.Id != "b" {
+		t.Errorf("expected to resume b with token-2, got %+v", r)
+	}
+	// the same token again means the last attempt got nowhere
+	if r := f.resumptionFor("token-2", "token-2", snaps, snapRange); r != nil {
+		t.Errorf("expected to start over with a stale token, got %+v", r)
+	}
+}
+
+func TestSavedByResuming(t *testing.T) {
+	if saved := savedByResuming(100, 30); saved != 70 {
+		t.Errorf("expected 70, got %d", saved)
+	}
+	if saved := savedByResuming(100, 120); saved != 0 {
+		t.Errorf("expected 0, got %d", saved)
+	}
+}
+
+func TestCancelTransfer(t *testing.T) {
+	f := &FsMachine{
+		filesystemId:     "fs",
+		transferCancelMu: &sync.Mutex{},
+		transferCancels:  map[string]context.CancelFunc{},
+	}
+
+	if f.CancelTransfer("t1") {
+		t.Errorf("cancelled a transfer that wasn't going")
+	}
+
+	ctx, done := f.transferContext("t1")
+	if ctx.Err() != nil {
+		t.Fatalf("transfer cancelled before it started")
+	}
+	if f.CancelTransfer("t2") {
+		t.Errorf("cancelled the wrong transfer")
+	}
+	if ctx.Err() != nil {
+		t.Errorf("cancelling another transfer cancelled this one")
+	}
+	if !f.CancelTransfer("t1") {
+		t.Errorf("didn't find the transfer to cancel")
+	}
+	if ctx.Err() == nil {
+		t.Errorf("transfer not cancelled")
+	}
+
+	done()
+	if f.CancelTransfer("t1") {
+		t.Errorf("cancelled a transfer that had finished")
+	}
+}
+
+func TestPeerTransferRequestId(t *testing.T) {
+	e := &types.Event{Args: &types.EventArgs{
+		"RequestId": "request",
+		"Transfer":  map[string]interface{}{"TransferRequestId": "transfer"},
+	}}
+	if id := peerTransferRequestId(e); id != "transfer" {
+		t.Errorf("expected the initiator's transfer id, got %s", id)
+	}
+	e = &types.Event{Args: &types.EventArgs{"RequestId": "request"}}
+	if id := peerTransferRequestId(e); id != "request" {
+		t.Errorf("expected the request id, got %s", id)
+	}
+}
@@ -9,9 +9,14 @@ import (
 	"github.com/dotmesh-io/dotmesh/pkg/observer"
 	"github.com/dotmesh-io/dotmesh/pkg/registry"
 	"github.com/dotmesh-io/dotmesh/pkg/store"
+	"github.com/dotmesh-io/dotmesh/pkg/transferqueue"
 	"github.com/dotmesh-io/dotmesh/pkg/types"
 	"github.com/dotmesh-io/dotmesh/pkg/user"
+	"github.com/dotmesh-io/dotmesh/pkg/utils"
 	"github.com/dotmesh-io/dotmesh/pkg/zfs"
+
+	"github.com/jonboulle/clockwork"
+	"golang.org/x/net/context"
 )
 
 // state machinery
@@ -23,7 +28,9 @@ type StateManager interface {
 
 	// ActivateFilesystem(filesystemId string) error
 	AlignMountStateWithMasters(filesystemId string) error
-	ActivateClone(topLevelFilesystemId, originFilesystemId, originSnapshotId, newCloneFilesystemId, newBranchName string) (string, error)
+	// ActivateClone registers a new clone, marked as a stash if stash is set,
+	// and starts its state machine here.
+	ActivateClone(topLevelFilesystemId, originFilesystemId, originSnapshotId, newCloneFilesystemId, newBranchName string, stash *types.StashInfo) (string, error)
 	DeleteFilesystem(filesystemId string) error
 	DeleteFilesystemFromMap(filesystemId string)
 	// current node ID
@@ -101,12 +108,15 @@ type FsMachine struct {
 	lastS3TransferRequest   types.S3TransferRequest
 	lastTransferRequest     types.TransferRequest
 	lastTransferRequestId   string
-	pushCompleted           chan bool
+	pushCompleted           chan pushCompletion
 	dirtyDelta              int64
 	sizeBytes               int64
 	transferUpdates         chan types.TransferUpdate
 	// only to be accessed via the updateEtcdAboutTransfers goroutine!
 	currentPollResult types.TransferPollResult
+	// cancels the transfers this machine is doing, by transfer id
+	transferCancelMu *sync.Mutex
+	transferCancels  map[string]context.CancelFunc
 
 	// state machine metadata
 	// Moved from InMemoryState:
@@ -124,6 +134,22 @@ type FsMachine struct {
 	filesystemMetadataTimeout int64
 
 	zfs zfs.ZFS
+
+	clock clockwork.Clock
+
+	// shared by every replication stream on the node
+	rateLimiter *utils.RateLimiter
+	// shared by every transfer the node initiates
+	transferQueue *transferqueue.Queue
+}
+
+// pushCompletion is how the ZFSReceiver tells a machine in pushPeerState that
+// the stream it was waiting for has been received, or not.
+type pushCompletion struct {
+	success bool
+	// if set, the stream carried on from an interrupted receive and ended
+	// at this snapshot, short of the transfer's target
+	snapshotId string
 }
 
 type dirtyInfo struct {
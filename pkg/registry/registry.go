@@ -40,6 +40,8 @@ type Registry interface {
 
 	UpdateCollaborators(ctx context.Context, tlf types.TopLevelFilesystem, newCollaborators []user.SafeUser) error
 	RegisterClone(name string, topLevelFilesystemId string, clone types.Clone) error
+	UpdateClone(name string, topLevelFilesystemId string, clone types.Clone) error
+	RenameClone(topLevelFilesystemId, oldName, newName string) error
 	RegisterFork(originFilesystemId string, originSnapshotId string, forkName types.VolumeName, forkFilesystemId string) error
 
 	// TODO: why ..FromEtcd?
@@ -350,6 +352,33 @@ func (r *DefaultRegistry) RegisterClone(name string, topLevelFilesystemId string
 	return r.registryStore.SetClone(&clone, &store.SetOptions{})
 }
 
+// overwrite an existing clone, eg when its origin changes, including updating
+// etcd and our local record
+func (r *DefaultRegistry) UpdateClone(name string, topLevelFilesystemId string, clone types.Clone) error {
+	clone.Name = name
+	clone.TopLevelFilesystemId = topLevelFilesystemId
+
+	err := r.registryStore.SetClone(&clone, &store.SetOptions{Force: true})
+	if err != nil {
+		return err
+	}
+	r.UpdateCloneFromEtcd(name, topLevelFilesystemId, clone)
+	return nil
+}
+
+// give a clone a new name, including updating etcd and our local record. The
+// old name is kept in the clone's FormerNames, so MaybeCloneFilesystemId still
+// finds it by that name until another branch takes it.
+func (r *DefaultRegistry) RenameClone(topLevelFilesystemId, oldName, newName string) error {
+	clone, err := r.registryStore.RenameClone(topLevelFilesystemId, oldName, newName)
+	if err != nil {
+		return err
+	}
+	r.DeleteCloneFromEtcd(oldName, topLevelFilesystemId)
+	r.UpdateCloneFromEtcd(newName, topLevelFilesystemId, *clone)
+	return nil
+}
+
 func (r *DefaultRegistry) DeleteFilesystemFromEtcd(name types.VolumeName) {
 	r.topLevelFilesystemsLock.Lock()
 	delete(r.topLevelFilesystems, name)
@@ -400,14 +429,28 @@ func (r *DefaultRegistry) UpdateCloneFromEtcd(name string, topLevelFilesystemId
 	if _, ok := r.clones[topLevelFilesystemId]; !ok {
 		r.clones[topLevelFilesystemId] = map[string]types.Clone{}
 	}
-	r.clones[topLevelFilesystemId][name] = clone
+	clones := r.clones[topLevelFilesystemId]
+	// while a branch is being renamed it's under both names, and is known by
+	// the new one as soon as that's been written
+	if clone.RenamingTo != "" {
+		if renamed, ok := clones[clone.RenamingTo]; ok && renamed.FilesystemId == clone.FilesystemId {
+			delete(clones, name)
+			return
+		}
+	}
+	for oldName, old := range clones {
+		if old.RenamingTo == name && old.FilesystemId == clone.FilesystemId {
+			delete(clones, oldName)
+		}
+	}
+	clones[name] = clone
 }
 
 func (r *DefaultRegistry) DeleteCloneFromEtcd(name string, topLevelFilesystemId string) {
 	r.clonesLock.Lock()
 	defer r.clonesLock.Unlock()
 
-	delete(r.clones, topLevelFilesystemId)
+	delete(r.clones[topLevelFilesystemId], name)
 }
 
 func (r *DefaultRegistry) LookupFilesystem(name types.VolumeName) (types.TopLevelFilesystem, error) {
@@ -524,13 +567,31 @@ func (r *DefaultRegistry) MaybeCloneFilesystemId(name types.VolumeName, cloneNam
 		// potentially resolve a clone's filesystem id, clobbering filesystemId
 		clone, err := r.LookupClone(tlfId, cloneName)
 		if err != nil {
-			return "", err
+			renamed, ok := r.lookupCloneByFormerName(tlfId, cloneName)
+			if !ok {
+				return "", err
+			}
+			clone = renamed
 		}
 		tlfId = clone.FilesystemId
 	}
 	return tlfId, nil
 }
 
+// find a clone which used to be called cloneName before it was renamed
+func (r *DefaultRegistry) lookupCloneByFormerName(topLevelFilesystemId, cloneName string) (types.Clone, bool) {
+	r.clonesLock.RLock()
+	defer r.clonesLock.RUnlock()
+	for _, clone := range r.clones[topLevelFilesystemId] {
+		for _, name := range clone.FormerNames {
+			if name == cloneName {
+				return clone, true
+			}
+		}
+	}
+	return types.Clone{}, false
+}
+
 func (r *DefaultRegistry) DumpTopLevelFilesystems() []*types.TopLevelFilesystem {
 	r.topLevelFilesystemsLock.RLock()
 	defer r.topLevelFilesystemsLock.RUnlock()
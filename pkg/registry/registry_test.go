@@ -236,3 +236,168 @@ func TestGetFilesystemByID(t *testing.T) {
 		t.Errorf("unexpected clone origin fs ID: %s", foundClone.Origin.FilesystemId)
 	}
 }
+
+func TestUpdateAndDeleteClone(t *testing.T) {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	idxStore := store.NewKVDBStoreWithIndex(client, "users")
+	um := user.New(idxStore)
+	kvClient := store.NewKVDBFilesystemStore(client)
+	registry := NewRegistry(um, kvClient)
+
+	for _, name := range []string{"a", "b"} {
+		err = registry.RegisterClone(name, "id-1", types.Clone{
+			FilesystemId: "clone-" + name,
+			Origin:       types.Origin{FilesystemId: "id-1", SnapshotId: "snap-1"},
+		})
+		if err != nil {
+			t.Fatalf("failed to create clone: %s", err)
+		}
+	}
+
+	err = registry.UpdateClone("b", "id-1", types.Clone{
+		FilesystemId: "clone-b",
+		Origin:       types.Origin{FilesystemId: "clone-a", SnapshotId: "snap-1"},
+	})
+	if err != nil {
+		t.Fatalf("failed to update clone: %s", err)
+	}
+	clone, err := registry.LookupClone("id-1", "b")
+	if err != nil {
+		t.Fatalf("failed to look up clone: %s", err)
+	}
+	if clone.Origin.FilesystemId != "clone-a" {
+		t.Errorf("expected b to be a clone of clone-a, got %+v", clone.Origin)
+	}
+	clones, err := kvClient.ListClones()
+	if err != nil {
+		t.Fatalf("failed to list clones: %s", err)
+	}
+	for _, c := range clones {
+		if c.Name == "b" && c.Origin.FilesystemId != "clone-a" {
+			t.Errorf("expected the stored origin of b to be updated, got %+v", c.Origin)
+		}
+	}
+
+	registry.DeleteCloneFromEtcd("a", "id-1")
+	if _, err := registry.LookupClone("id-1", "b"); err != nil {
+		t.Errorf("expected deleting a to leave b, got %s", err)
+	}
+	if _, err := registry.LookupClone("id-1", "a"); err == nil {
+		t.Errorf("expected a to be gone")
+	}
+}
+
+func TestRenameClone(t *testing.T) {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	idxStore := store.NewKVDBStoreWithIndex(client, "users")
+	um := user.New(idxStore)
+	kvClient := store.NewKVDBFilesystemStore(client)
+	registry := NewRegistry(um, kvClient)
+
+	userA, err := um.New("foo", "foo@bar.pub", "verysecret")
+	if err != nil {
+		t.Fatalf("failed to create new user: %s", err)
+	}
+	volumeName := types.VolumeName{Namespace: "def", Name: "n"}
+	err = registry.UpdateFilesystemFromEtcd(volumeName, types.RegistryFilesystem{Id: "id-1", OwnerId: userA.Id})
+	if err != nil {
+		t.Fatalf("failed to update filesystem from etcd: %s", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		err = registry.RegisterClone(name, "id-1", types.Clone{
+			FilesystemId: "clone-" + name,
+			Origin:       types.Origin{FilesystemId: "id-1", SnapshotId: "snap-1"},
+		})
+		if err != nil {
+			t.Fatalf("failed to create clone: %s", err)
+		}
+	}
+
+	err = registry.RenameClone("id-1", "a", "b")
+	if err == nil {
+		t.Errorf("expected renaming a over b to fail")
+	}
+	err = registry.RenameClone("id-1", "a", "c")
+	if err != nil {
+		t.Fatalf("failed to rename clone: %s", err)
+	}
+	if _, err := registry.LookupClone("id-1", "a"); err == nil {
+		t.Errorf("expected a to be gone")
+	}
+	clone, err := registry.LookupClone("id-1", "c")
+	if err != nil {
+		t.Fatalf("failed to look up renamed clone: %s", err)
+	}
+	if clone.FilesystemId != "clone-a" || clone.Name != "c" {
+		t.Errorf("unexpected renamed clone %+v", clone)
+	}
+
+	// the old name still finds the branch...
+	fsId, err := registry.MaybeCloneFilesystemId(volumeName, "a")
+	if err != nil || fsId != "clone-a" {
+		t.Errorf("expected a to still resolve to clone-a, got %q, %v", fsId, err)
+	}
+	// ...until another branch is given it
+	err = registry.RegisterClone("a", "id-1", types.Clone{
+		FilesystemId: "clone-new",
+		Origin:       types.Origin{FilesystemId: "id-1", SnapshotId: "snap-1"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create clone: %s", err)
+	}
+	fsId, err = registry.MaybeCloneFilesystemId(volumeName, "a")
+	if err != nil || fsId != "clone-new" {
+		t.Errorf("expected a to resolve to clone-new, got %q, %v", fsId, err)
+	}
+
+	clones, err := kvClient.ListClones()
+	if err != nil {
+		t.Fatalf("failed to list clones: %s", err)
+	}
+	if len(clones) != 3 {
+		t.Errorf("expected three stored clones, got %v", clones)
+	}
+}
+
+func TestRenameCloneInProgress(t *testing.T) {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	um := user.New(store.NewKVDBStoreWithIndex(client, "users"))
+	registry := NewRegistry(um, store.NewKVDBFilesystemStore(client))
+
+	old := types.Clone{FilesystemId: "clone-a", Name: "a", RenamingTo: "c"}
+	renamed := types.Clone{FilesystemId: "clone-a", Name: "c", FormerNames: []string{"a"}}
+
+	// marked for renaming, but the new entry hasn't been written yet
+	registry.UpdateCloneFromEtcd("a", "id-1", old)
+	if _, err := registry.LookupClone("id-1", "a"); err != nil {
+		t.Errorf("expected a to be found until it's been renamed, got %s", err)
+	}
+	registry.UpdateCloneFromEtcd("c", "id-1", renamed)
+	if _, err := registry.LookupClone("id-1", "a"); err == nil {
+		t.Errorf("expected a to be gone once c was written")
+	}
+
+	// and the other way round, as when they're listed at startup
+	registry.UpdateCloneFromEtcd("a", "id-1", old)
+	if _, err := registry.LookupClone("id-1", "a"); err == nil {
+		t.Errorf("expected a to be left out once c was written")
+	}
+	if len(registry.ClonesFor("id-1")) != 1 {
+		t.Errorf("expected only c, got %v", registry.ClonesFor("id-1"))
+	}
+}
@@ -0,0 +1,80 @@
+// Package retention works out which commits a retention policy prunes.
+package retention
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+)
+
+// the type of the commits S3 pushes and pulls keep their state in
+const metadataOnlyType = "dotmesh.metadata_only"
+
+// Expired returns the snapshots, oldest first, which the policy doesn't keep
+// at the given time. Besides what the policy keeps, the latest snapshot,
+// snapshots without a timestamp and the metadata only commits of S3 remotes
+// are always kept.
+func Expired(policy types.RetentionPolicy, snapshots []types.Snapshot, now time.Time) []types.Snapshot {
+	expired := []types.Snapshot{}
+	if policy.Empty() || len(snapshots) == 0 {
+		return expired
+	}
+
+	keep := map[string]bool{}
+	keep[snapshots[len(snapshots)-1].Id] = true
+	for i := len(snapshots) - policy.KeepLast; i < len(snapshots); i++ {
+		if i >= 0 {
+			keep[snapshots[i].Id] = true
+		}
+	}
+
+	today := day(now)
+	days := map[time.Time]bool{}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := snapshots[i]
+		created, ok := timestamp(s)
+		if !ok || s.Metadata["type"] == metadataOnlyType || matches(s, policy.KeepMetadata) {
+			keep[s.Id] = true
+			continue
+		}
+		d := day(created)
+		age := int(today.Sub(d).Hours() / 24)
+		if age < policy.KeepDaily && !days[d] {
+			// the latest commit of the day, as we're going backwards
+			days[d] = true
+			keep[s.Id] = true
+		}
+	}
+
+	for _, s := range snapshots {
+		if !keep[s.Id] {
+			expired = append(expired, s)
+		}
+	}
+	return expired
+}
+
+func timestamp(s types.Snapshot) (time.Time, bool) {
+	nanos, err := strconv.ParseInt(s.Metadata["timestamp"], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+func day(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+func matches(s types.Snapshot, metadata map[string]string) bool {
+	if len(metadata) == 0 {
+		return false
+	}
+	for k, v := range metadata {
+		if s.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package retention
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+)
+
+var now = time.Date(2018, 6, 10, 12, 0, 0, 0, time.UTC)
+
+func commit(id string, at time.Time, meta ...string) types.Snapshot {
+	metadata := map[string]string{"timestamp": strconv.FormatInt(at.UnixNano(), 10)}
+	for i := 0; i+1 < len(meta); i += 2 {
+		metadata[meta[i]] = meta[i+1]
+	}
+	return types.Snapshot{Id: id, Metadata: metadata}
+}
+
+func ids(snapshots []types.Snapshot) []string {
+	result := []string{}
+	for _, s := range snapshots {
+		result = append(result, s.Id)
+	}
+	return result
+}
+
+// hourly returns a commit every hour for the given number of hours up to now
+func hourly(hours int) []types.Snapshot {
+	snapshots := []types.Snapshot{}
+	for i := hours - 1; i >= 0; i-- {
+		snapshots = append(snapshots, commit(fmt.Sprintf("c%d", i), now.Add(-time.Duration(i)*time.Hour)))
+	}
+	return snapshots
+}
+
+func TestEmptyPolicyKeepsEverything(t *testing.T) {
+	expired := Expired(types.RetentionPolicy{}, hourly(10), now)
+	if len(expired) != 0 {
+		t.Errorf("expected nothing to expire, got %v", ids(expired))
+	}
+}
+
+func TestKeepLast(t *testing.T) {
+	expired := Expired(types.RetentionPolicy{KeepLast: 3}, hourly(5), now)
+	if !reflect.DeepEqual(ids(expired), []string{"c4", "c3"}) {
+		t.Errorf("expected the oldest two to expire, got %v", ids(expired))
+	}
+	expired = Expired(types.RetentionPolicy{KeepLast: 10}, hourly(5), now)
+	if len(expired) != 0 {
+		t.Errorf("expected nothing to expire, got %v", ids(expired))
+	}
+}
+
+func TestKeepDaily(t *testing.T) {
+	// three days of commits every 12 hours: 00:00 and 12:00 on the 8th,
+	// 9th and 10th
+	snapshots := hourly(61)
+	kept := []types.Snapshot{}
+	for _, s := range snapshots {
+		created, _ := timestamp(s)
+		if created.Hour() == 0 || created.Hour() == 12 {
+			kept = append(kept, s)
+		}
+	}
+	expired := Expired(types.RetentionPolicy{KeepDaily: 2}, kept, now)
+	// the 8th is too old, and only 12:00 survives on the 9th; the 10th's
+	// 12:00 is the latest of both days
+	if !reflect.DeepEqual(ids(expired), []string{"c60", "c48", "c36", "c12"}) {
+		t.Errorf("unexpected expired commits %v", ids(expired))
+	}
+}
+
+func TestKeepMetadata(t *testing.T) {
+	snapshots := []types.Snapshot{
+		commit("a", now.Add(-3*time.Hour), "tag", "release"),
+		commit("b", now.Add(-2*time.Hour)),
+		commit("c", now.Add(-1*time.Hour), "tag", "nightly"),
+		commit("d", now),
+	}
+	expired := Expired(types.RetentionPolicy{KeepMetadata: map[string]string{"tag": "release"}}, snapshots, now)
+	if !reflect.DeepEqual(ids(expired), []string{"b", "c"}) {
+		t.Errorf("expected b and c to expire, got %v", ids(expired))
+	}
+}
+
+func TestAlwaysKept(t *testing.T) {
+	snapshots := []types.Snapshot{
+		{Id: "undated", Metadata: map[string]string{}},
+		commit("s3", now.Add(-2*time.Hour), "type", "dotmesh.metadata_only"),
+		commit("old", now.Add(-time.Hour)),
+		commit("latest", now),
+	}
+	expired := Expired(types.RetentionPolicy{KeepLast: 1}, snapshots, now)
+	if !reflect.DeepEqual(ids(expired), []string{"old"}) {
+		t.Errorf("expected only old to expire, got %v", ids(expired))
+	}
+}
@@ -0,0 +1,69 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func at(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestNext(t *testing.T) {
+	for _, c := range []struct {
+		expr, from, next string
+	}{
+		{"* * * * *", "2018-06-10 12:00", "2018-06-10 12:01"},
+		{"*/15 * * * *", "2018-06-10 12:07", "2018-06-10 12:15"},
+		{"0 * * * *", "2018-06-10 12:00", "2018-06-10 13:00"},
+		{"@daily", "2018-06-10 12:00", "2018-06-11 00:00"},
+		{"30 2 * * 1-5", "2018-06-08 03:00", "2018-06-11 02:30"},
+		{"0 9 1,15 * *", "2018-06-02 00:00", "2018-06-15 09:00"},
+		{"0 0 * * 7", "2018-06-10 12:00", "2018-06-17 00:00"},
+		// either the day of the month or the day of the week will do
+		{"0 0 13 * 5", "2018-06-10 12:00", "2018-06-13 00:00"},
+		{"0 0 1 1 *", "2018-06-10 12:00", "2019-01-01 00:00"},
+		{"5/20 10-11 * * *", "2018-06-10 10:30", "2018-06-10 10:45"},
+	} {
+		s, err := Parse(c.expr)
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", c.expr, err)
+			continue
+		}
+		next := s.Next(at(c.from))
+		if !next.Equal(at(c.next)) {
+			t.Errorf("%q after %s: expected %s, got %s", c.expr, c.from, c.next, next)
+		}
+	}
+}
+
+func TestNeverFires(t *testing.T) {
+	s, err := Parse("0 0 31 2 *")
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if next := s.Next(at("2018-06-10 12:00")); !next.IsZero() {
+		t.Errorf("expected it never to fire, got %s", next)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("expected an error parsing %q", expr)
+		}
+	}
+}
@@ -39,7 +39,26 @@ func (s *KVDBFilesystemStore) SetClone(c *types.Clone, opts *SetOptions) error {
 		return err
 	}
 
-	_, err = s.client.Create(RegistryClonesPrefix+c.TopLevelFilesystemId+"/"+c.Name, bts, 0)
+	key := RegistryClonesPrefix + c.TopLevelFilesystemId + "/" + c.Name
+	_, err = s.client.Create(key, bts, 0)
+	if err != kvdb.ErrExist {
+		return err
+	}
+	// the entry a rename cut short left under its old name doesn't keep
+	// the name from being used again
+	kvp, getErr := s.client.Get(key)
+	if getErr != nil {
+		return err
+	}
+	var existing types.Clone
+	if s.decode(kvp.Value, &existing) != nil || existing.RenamingTo == "" {
+		return err
+	}
+	_, err = s.client.CompareAndSet(&kvdb.KVPair{
+		Key:           key,
+		Value:         bts,
+		ModifiedIndex: kvp.ModifiedIndex,
+	}, kvdb.KVModifiedIndex, nil)
 	return err
 }
 
@@ -70,6 +89,94 @@ func (s *KVDBFilesystemStore) DeleteClone(filesystemID, cloneName string) error
 	return err
 }
 
+// RenameClone moves a clone to a new name, remembering the old one in its
+// FormerNames. The kv store can't do that in one step, so the entry under the
+// old name is first marked as RenamingTo the new one, which fails without
+// changing anything if the clone changed meanwhile, and the new entry is then
+// written and the old one deleted. If the new name is taken the mark is taken
+// off again. Renaming again after a rename was cut short finishes it.
+func (s *KVDBFilesystemStore) RenameClone(filesystemID, oldName, newName string) (*types.Clone, error) {
+	oldKey := RegistryClonesPrefix + filesystemID + "/" + oldName
+	newKey := RegistryClonesPrefix + filesystemID + "/" + newName
+
+	kvp, err := s.client.Get(oldKey)
+	if err != nil {
+		return nil, err
+	}
+	var c types.Clone
+	err = s.decode(kvp.Value, &c)
+	if err != nil {
+		return nil, err
+	}
+	if c.RenamingTo != "" && c.RenamingTo != newName {
+		return nil, fmt.Errorf("branch %s is already being renamed to %s", oldName, c.RenamingTo)
+	}
+	resuming := c.RenamingTo != ""
+	unmarked := kvp
+	if !resuming {
+		c.RenamingTo = newName
+		bts, err := s.encode(&c)
+		if err != nil {
+			return nil, err
+		}
+		kvp, err = s.client.CompareAndSet(&kvdb.KVPair{
+			Key:           oldKey,
+			Value:         bts,
+			ModifiedIndex: kvp.ModifiedIndex,
+		}, kvdb.KVModifiedIndex, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.Name = newName
+	c.RenamingTo = ""
+	formerNames := []string{}
+	for _, name := range c.FormerNames {
+		if name != newName && name != oldName {
+			formerNames = append(formerNames, name)
+		}
+	}
+	c.FormerNames = append(formerNames, oldName)
+
+	bts, err := s.encode(&c)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.client.Create(newKey, bts, 0)
+	if err != nil && !(resuming && s.isCloneAt(newKey, c.FilesystemId)) {
+		if !resuming {
+			_, unmarkErr := s.client.CompareAndSet(&kvdb.KVPair{
+				Key:           oldKey,
+				Value:         unmarked.Value,
+				ModifiedIndex: kvp.ModifiedIndex,
+			}, kvdb.KVModifiedIndex, nil)
+			if unmarkErr != nil {
+				log.WithFields(log.Fields{
+					"error": unmarkErr,
+					"key":   oldKey,
+				}).Error("[RenameClone] failed to unmark old clone after failing to create the new one")
+			}
+		}
+		return nil, err
+	}
+	_, err = s.client.Delete(oldKey)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// isCloneAt says whether the clone stored under key is filesystemID.
+func (s *KVDBFilesystemStore) isCloneAt(key, filesystemID string) bool {
+	kvp, err := s.client.Get(key)
+	if err != nil {
+		return false
+	}
+	var c types.Clone
+	return s.decode(kvp.Value, &c) == nil && c.FilesystemId == filesystemID
+}
+
 func (s *KVDBFilesystemStore) WatchClones(idx uint64, cb WatchRegistryClonesCB) error {
 	watchFunc := func(prefix string, opaque interface{}, kvp *kvdb.KVPair, err error) error {
 		if err != nil {
@@ -343,3 +450,187 @@ func (s *KVDBFilesystemStore) ImportFilesystems(fs []*types.RegistryFilesystem,
 	}
 	return nil
 }
+
+// Retention policies and commit schedules, which are kept per branch
+
+// the key of a dot's policy or schedule for every branch, which can't clash
+// with a branch name
+const allBranchesKey = "*"
+
+func branchKey(prefix, filesystemID, branch string) string {
+	if branch == "" {
+		branch = allBranchesKey
+	}
+	return prefix + filesystemID + "/" + branch
+}
+
+func (s *KVDBFilesystemStore) SetRetentionPolicy(p *types.RetentionPolicy, opts *SetOptions) error {
+	if p.FilesystemId == "" {
+		return ErrIDNotSet
+	}
+	bts, err := s.encode(p)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Put(branchKey(RegistryRetentionPrefix, p.FilesystemId, p.Branch), bts, 0)
+	return err
+}
+
+func (s *KVDBFilesystemStore) GetRetentionPolicy(filesystemID, branch string) (*types.RetentionPolicy, error) {
+	node, err := s.client.Get(branchKey(RegistryRetentionPrefix, filesystemID, branch))
+	if err != nil {
+		return nil, err
+	}
+	var p types.RetentionPolicy
+	err = s.decode(node.Value, &p)
+
+	p.Meta = getMeta(node)
+
+	return &p, err
+}
+
+func (s *KVDBFilesystemStore) DeleteRetentionPolicy(filesystemID, branch string) error {
+	_, err := s.client.Delete(branchKey(RegistryRetentionPrefix, filesystemID, branch))
+	return err
+}
+
+func (s *KVDBFilesystemStore) ListRetentionPolicies() ([]*types.RetentionPolicy, error) {
+	pairs, err := s.client.Enumerate(RegistryRetentionPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var result []*types.RetentionPolicy
+
+	for _, kvp := range pairs {
+		var val types.RetentionPolicy
+
+		err = json.Unmarshal(kvp.Value, &val)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"key":   kvp.Key,
+				"value": string(kvp.Value),
+			}).Error("failed to unmarshal value")
+			continue
+		}
+
+		val.Meta = getMeta(kvp)
+
+		result = append(result, &val)
+	}
+
+	return result, nil
+}
+
+func (s *KVDBFilesystemStore) SetCommitSchedule(cs *types.CommitSchedule, opts *SetOptions) error {
+	if cs.FilesystemId == "" {
+		return ErrIDNotSet
+	}
+	bts, err := s.encode(cs)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Put(branchKey(RegistrySchedulesPrefix, cs.FilesystemId, cs.Branch), bts, 0)
+	return err
+}
+
+func (s *KVDBFilesystemStore) DeleteCommitSchedule(filesystemID, branch string) error {
+	_, err := s.client.Delete(branchKey(RegistrySchedulesPrefix, filesystemID, branch))
+	return err
+}
+
+func (s *KVDBFilesystemStore) ListCommitSchedules() ([]*types.CommitSchedule, error) {
+	pairs, err := s.client.Enumerate(RegistrySchedulesPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var result []*types.CommitSchedule
+
+	for _, kvp := range pairs {
+		var val types.CommitSchedule
+
+		err = json.Unmarshal(kvp.Value, &val)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"key":   kvp.Key,
+				"value": string(kvp.Value),
+			}).Error("failed to unmarshal value")
+			continue
+		}
+
+		val.Meta = getMeta(kvp)
+
+		result = append(result, &val)
+	}
+
+	return result, nil
+}
+
+// SetTag creates a tag. Tags don't move, so it fails if the tag already
+// exists unless opts.Force is set.
+func (s *KVDBFilesystemStore) SetTag(t *types.Tag, opts *SetOptions) error {
+	if t.FilesystemId == "" {
+		return ErrIDNotSet
+	}
+	if t.Name == "" {
+		return fmt.Errorf("name not set")
+	}
+	bts, err := s.encode(t)
+	if err != nil {
+		return err
+	}
+	if opts.Force {
+		_, err = s.client.Put(RegistryTagsPrefix+t.FilesystemId+"/"+t.Name, bts, 0)
+		return err
+	}
+	_, err = s.client.Create(RegistryTagsPrefix+t.FilesystemId+"/"+t.Name, bts, 0)
+	return err
+}
+
+func (s *KVDBFilesystemStore) GetTag(filesystemID, name string) (*types.Tag, error) {
+	node, err := s.client.Get(RegistryTagsPrefix + filesystemID + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	var t types.Tag
+	err = s.decode(node.Value, &t)
+
+	t.Meta = getMeta(node)
+
+	return &t, err
+}
+
+func (s *KVDBFilesystemStore) DeleteTag(filesystemID, name string) error {
+	_, err := s.client.Delete(RegistryTagsPrefix + filesystemID + "/" + name)
+	return err
+}
+
+// ListTags returns the tags of one dot.
+func (s *KVDBFilesystemStore) ListTags(filesystemID string) ([]*types.Tag, error) {
+	pairs, err := s.client.Enumerate(RegistryTagsPrefix + filesystemID + "/")
+	if err != nil {
+		return nil, err
+	}
+	var result []*types.Tag
+
+	for _, kvp := range pairs {
+		var val types.Tag
+
+		err = json.Unmarshal(kvp.Value, &val)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"key":   kvp.Key,
+				"value": string(kvp.Value),
+			}).Error("failed to unmarshal value")
+			continue
+		}
+
+		val.Meta = getMeta(kvp)
+
+		result = append(result, &val)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,237 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+)
+
+func TestRetentionPolicies(t *testing.T) {
+	client, err := getKVDBClient(&KVDBConfig{
+		Type: KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	kvdb := NewKVDBFilesystemStore(client)
+
+	fsID := "123456789"
+	for _, p := range []*types.RetentionPolicy{
+		{FilesystemId: fsID, KeepLast: 50},
+		{FilesystemId: fsID, Branch: "ci", KeepDaily: 30},
+	} {
+		err = kvdb.SetRetentionPolicy(p, &SetOptions{})
+		if err != nil {
+			t.Fatalf("failed to set retention policy: %s", err)
+		}
+	}
+
+	p, err := kvdb.GetRetentionPolicy(fsID, "")
+	if err != nil {
+		t.Fatalf("failed to get retention policy: %s", err)
+	}
+	if p.KeepLast != 50 || p.Branch != "" {
+		t.Errorf("unexpected dot policy %#v", p)
+	}
+	p, err = kvdb.GetRetentionPolicy(fsID, "ci")
+	if err != nil {
+		t.Fatalf("failed to get retention policy: %s", err)
+	}
+	if p.KeepDaily != 30 || p.Branch != "ci" {
+		t.Errorf("unexpected branch policy %#v", p)
+	}
+
+	err = kvdb.DeleteRetentionPolicy(fsID, "")
+	if err != nil {
+		t.Fatalf("failed to delete retention policy: %s", err)
+	}
+	policies, err := kvdb.ListRetentionPolicies()
+	if err != nil {
+		t.Fatalf("failed to list retention policies: %s", err)
+	}
+	if len(policies) != 1 || policies[0].Branch != "ci" {
+		t.Errorf("expected only the branch policy to be left, got %v", policies)
+	}
+}
+
+func TestCommitSchedules(t *testing.T) {
+	client, err := getKVDBClient(&KVDBConfig{
+		Type: KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	kvdb := NewKVDBFilesystemStore(client)
+
+	fsID := "123456789"
+	err = kvdb.SetCommitSchedule(&types.CommitSchedule{FilesystemId: fsID, Cron: "@daily"}, &SetOptions{})
+	if err != nil {
+		t.Fatalf("failed to set commit schedule: %s", err)
+	}
+	err = kvdb.SetCommitSchedule(&types.CommitSchedule{FilesystemId: fsID, Branch: "dev", Cron: "@hourly"}, &SetOptions{})
+	if err != nil {
+		t.Fatalf("failed to set commit schedule: %s", err)
+	}
+	schedules, err := kvdb.ListCommitSchedules()
+	if err != nil {
+		t.Fatalf("failed to list commit schedules: %s", err)
+	}
+	if len(schedules) != 2 {
+		t.Fatalf("expected two schedules, got %v", schedules)
+	}
+
+	err = kvdb.DeleteCommitSchedule(fsID, "dev")
+	if err != nil {
+		t.Fatalf("failed to delete commit schedule: %s", err)
+	}
+	schedules, err = kvdb.ListCommitSchedules()
+	if err != nil {
+		t.Fatalf("failed to list commit schedules: %s", err)
+	}
+	if len(schedules) != 1 || schedules[0].Cron != "@daily" {
+		t.Errorf("expected only the dot's schedule to be left, got %v", schedules)
+	}
+}
+
+func TestTags(t *testing.T) {
+	client, err := getKVDBClient(&KVDBConfig{
+		Type: KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	kvdb := NewKVDBFilesystemStore(client)
+
+	for _, tag := range []*types.Tag{
+		{FilesystemId: "dot-1", Name: "v1", SnapshotId: "snap-1"},
+		{FilesystemId: "dot-1", Name: "v2", SnapshotId: "snap-2"},
+		{FilesystemId: "dot-2", Name: "v1", SnapshotId: "snap-3"},
+	} {
+		err = kvdb.SetTag(tag, &SetOptions{})
+		if err != nil {
+			t.Fatalf("failed to set tag: %s", err)
+		}
+	}
+
+	err = kvdb.SetTag(&types.Tag{FilesystemId: "dot-1", Name: "v1", SnapshotId: "snap-2"}, &SetOptions{})
+	if err == nil {
+		t.Errorf("expected moving an existing tag to fail")
+	}
+	tag, err := kvdb.GetTag("dot-1", "v1")
+	if err != nil {
+		t.Fatalf("failed to get tag: %s", err)
+	}
+	if tag.SnapshotId != "snap-1" {
+		t.Errorf("expected v1 to still be snap-1, got %#v", tag)
+	}
+
+	tags, err := kvdb.ListTags("dot-1")
+	if err != nil {
+		t.Fatalf("failed to list tags: %s", err)
+	}
+	if len(tags) != 2 {
+		t.Errorf("expected the two tags of dot-1, got %v", tags)
+	}
+
+	err = kvdb.DeleteTag("dot-1", "v1")
+	if err != nil {
+		t.Fatalf("failed to delete tag: %s", err)
+	}
+	_, err = kvdb.GetTag("dot-1", "v1")
+	if !IsKeyNotFound(err) {
+		t.Errorf("expected v1 to be gone, got %v", err)
+	}
+	tags, err = kvdb.ListTags("dot-2")
+	if err != nil {
+		t.Fatalf("failed to list tags: %s", err)
+	}
+	if len(tags) != 1 || tags[0].SnapshotId != "snap-3" {
+		t.Errorf("expected dot-2's tag to be left alone, got %v", tags)
+	}
+}
+
+func TestRenameCloneCutShort(t *testing.T) {
+	client, err := getKVDBClient(&KVDBConfig{
+		Type: KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	kvdb := NewKVDBFilesystemStore(client)
+
+	clonesByName := func() map[string]*types.Clone {
+		clones, err := kvdb.ListClones()
+		if err != nil {
+			t.Fatalf("failed to list clones: %s", err)
+		}
+		result := map[string]*types.Clone{}
+		for _, c := range clones {
+			result[c.Name] = c
+		}
+		return result
+	}
+
+	for _, c := range []*types.Clone{
+		{TopLevelFilesystemId: "dot-1", FilesystemId: "clone-a", Name: "a"},
+		{TopLevelFilesystemId: "dot-1", FilesystemId: "clone-b", Name: "b"},
+	} {
+		err = kvdb.SetClone(c, &SetOptions{})
+		if err != nil {
+			t.Fatalf("failed to set clone: %s", err)
+		}
+	}
+
+	// renaming over a branch leaves both as they were
+	_, err = kvdb.RenameClone("dot-1", "a", "b")
+	if err == nil {
+		t.Errorf("expected renaming a over b to fail")
+	}
+	clones := clonesByName()
+	if clones["a"] == nil || clones["a"].RenamingTo != "" || clones["b"].FilesystemId != "clone-b" {
+		t.Errorf("expected a and b to be unchanged, got %v", clones)
+	}
+
+	// a rename cut short after writing the new entry is finished by renaming
+	// again
+	err = kvdb.SetClone(&types.Clone{
+		TopLevelFilesystemId: "dot-1", FilesystemId: "clone-a", Name: "a", RenamingTo: "c",
+	}, &SetOptions{Force: true})
+	if err != nil {
+		t.Fatalf("failed to set clone: %s", err)
+	}
+	err = kvdb.SetClone(&types.Clone{
+		TopLevelFilesystemId: "dot-1", FilesystemId: "clone-a", Name: "c", FormerNames: []string{"a"},
+	}, &SetOptions{})
+	if err != nil {
+		t.Fatalf("failed to set clone: %s", err)
+	}
+	_, err = kvdb.RenameClone("dot-1", "a", "d")
+	if err == nil {
+		t.Errorf("expected renaming a branch part way through being renamed to something else to fail")
+	}
+	renamed, err := kvdb.RenameClone("dot-1", "a", "c")
+	if err != nil {
+		t.Fatalf("failed to finish rename: %s", err)
+	}
+	clones = clonesByName()
+	if clones["a"] != nil || clones["c"] == nil || renamed.FilesystemId != "clone-a" || renamed.RenamingTo != "" {
+		t.Errorf("expected only c to be left of a, got %v", clones)
+	}
+
+	// and an old name left marked doesn't keep it from being used again
+	err = kvdb.SetClone(&types.Clone{
+		TopLevelFilesystemId: "dot-1", FilesystemId: "clone-b", Name: "b", RenamingTo: "e",
+	}, &SetOptions{Force: true})
+	if err != nil {
+		t.Fatalf("failed to set clone: %s", err)
+	}
+	err = kvdb.SetClone(&types.Clone{
+		TopLevelFilesystemId: "dot-1", FilesystemId: "clone-new", Name: "b",
+	}, &SetOptions{})
+	if err != nil {
+		t.Fatalf("failed to reuse the old name: %s", err)
+	}
+	if clones = clonesByName(); clones["b"].FilesystemId != "clone-new" {
+		t.Errorf("expected b to be clone-new, got %v", clones["b"])
+	}
+}
@@ -65,6 +65,7 @@ type (
 type RegistryStore interface {
 	SetClone(c *types.Clone, opts *SetOptions) error
 	DeleteClone(filesystemID, cloneName string) error
+	RenameClone(filesystemID, oldName, newName string) (*types.Clone, error)
 	WatchClones(idx uint64, cb WatchRegistryClonesCB) error
 	ListClones() ([]*types.Clone, error)
 
@@ -76,6 +77,23 @@ type RegistryStore interface {
 	WatchFilesystems(idx uint64, cb WatchRegistryFilesystemsCB) error
 	ListFilesystems() ([]*types.RegistryFilesystem, error)
 
+	// registry/retention/<filesystem id>/<branch>
+	SetRetentionPolicy(p *types.RetentionPolicy, opts *SetOptions) error
+	GetRetentionPolicy(filesystemID, branch string) (*types.RetentionPolicy, error)
+	DeleteRetentionPolicy(filesystemID, branch string) error
+	ListRetentionPolicies() ([]*types.RetentionPolicy, error)
+
+	// registry/schedules/<filesystem id>/<branch>
+	SetCommitSchedule(cs *types.CommitSchedule, opts *SetOptions) error
+	DeleteCommitSchedule(filesystemID, branch string) error
+	ListCommitSchedules() ([]*types.CommitSchedule, error)
+
+	// registry/tags/<filesystem id>/<tag>
+	SetTag(t *types.Tag, opts *SetOptions) error
+	GetTag(filesystemID, name string) (*types.Tag, error)
+	DeleteTag(filesystemID, name string) error
+	ListTags(filesystemID string) ([]*types.Tag, error)
+
 	// Misc
 	ImportClones(clones []*types.Clone, opts *ImportOptions) error
 	ImportFilesystems(fs []*types.RegistryFilesystem, opts *ImportOptions) error
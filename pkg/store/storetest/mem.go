@@ -0,0 +1,35 @@
+// Package storetest provides in-memory stores for tests.
+package storetest
+
+import (
+	"github.com/dotmesh-io/dotmesh/pkg/store"
+
+	"github.com/portworx/kvdb"
+)
+
+// Stores are the filesystem, registry and server stores of a cluster, all
+// backed by one in-memory KV store so that watches see every write, as they
+// would with etcd.
+type Stores struct {
+	Client kvdb.Kvdb
+
+	FilesystemStore store.FilesystemStore
+	RegistryStore   store.RegistryStore
+	ServerStore     store.ServerStore
+}
+
+func NewMemStores() (*Stores, error) {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		return nil, err
+	}
+	kvdbStore := store.NewKVDBFilesystemStore(client)
+	return &Stores{
+		Client:          client,
+		FilesystemStore: kvdbStore,
+		RegistryStore:   kvdbStore,
+		ServerStore:     store.NewKVServerStore(client),
+	}, nil
+}
@@ -13,6 +13,9 @@ const (
 const (
 	RegistryClonesPrefix      = "registry/clones/"
 	RegistryFilesystemsPrefix = "registry/filesystems/"
+	RegistryRetentionPrefix   = "registry/retention/"
+	RegistrySchedulesPrefix   = "registry/schedules/"
+	RegistryTagsPrefix        = "registry/tags/"
 )
 
 type KVType string
@@ -0,0 +1,257 @@
+// Package transferqueue schedules the transfers a node initiates, so that
+// only so many of them run at once and the rest wait their turn in order of
+// priority.
+package transferqueue
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Queue lets up to a maximum number of transfers run at once. A nil *Queue
+// lets everything run straight away.
+type Queue struct {
+	maxConcurrent int
+
+	mu      sync.Mutex
+	running map[string]*entry
+	// highest priority first, and first come first served within a
+	// priority
+	waiting []*entry
+}
+
+type entry struct {
+	id       string
+	priority int
+	// closed when the transfer may start
+	ready chan struct{}
+	// signalled when the transfer's place in the queue may have changed
+	moved chan struct{}
+}
+
+// Entry describes a transfer in the queue.
+type Entry struct {
+	TransferRequestId string
+	Priority          int
+	// place in the queue, 1 being the next to run, or 0 if it's running
+	Position int
+}
+
+// New returns a Queue which runs up to maxConcurrent transfers at once, or
+// nil, which doesn't queue at all, if maxConcurrent isn't positive.
+func New(maxConcurrent int) *Queue {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return &Queue{
+		maxConcurrent: maxConcurrent,
+		running:       map[string]*entry{},
+	}
+}
+
+// MaxConcurrent is how many transfers can run at once, or 0 for no limit.
+func (q *Queue) MaxConcurrent() int {
+	if q == nil {
+		return 0
+	}
+	return q.maxConcurrent
+}
+
+// Acquire blocks until the transfer with the given id may run, calling
+// queued with its place in the queue whenever that changes while it waits.
+// Call release when the transfer is over. If ctx is done first, the transfer
+// leaves the queue and ctx's error is returned.
+func (q *Queue) Acquire(
+	ctx context.Context, transferRequestId string, priority int, queued func(position int),
+) (release func(), err error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	e := &entry{
+		id:       transferRequestId,
+		priority: priority,
+		ready:    make(chan struct{}),
+		moved:    make(chan struct{}, 1),
+	}
+	q.mu.Lock()
+	q.insert(e)
+	q.schedule()
+	q.mu.Unlock()
+
+	release = func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		delete(q.running, transferRequestId)
+		q.schedule()
+	}
+
+	lastPosition := 0
+	for {
+		select {
+		case <-e.ready:
+			return release, nil
+		default:
+		}
+		q.mu.Lock()
+		position := q.position(e)
+		q.mu.Unlock()
+		if position > 0 && position != lastPosition {
+			queued(position)
+			lastPosition = position
+		}
+		select {
+		case <-e.ready:
+			return release, nil
+		case <-e.moved:
+		case <-ctx.Done():
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			select {
+			case <-e.ready:
+				// started just as it was given up on, so let
+				// something else have the slot
+				delete(q.running, transferRequestId)
+			default:
+				q.remove(e)
+			}
+			q.schedule()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Reprioritise gives a waiting transfer a new priority, which moves it
+// behind any others waiting with the same priority.
+func (q *Queue) Reprioritise(transferRequestId string, priority int) error {
+	if q == nil {
+		return fmt.Errorf("Transfers aren't queued on this node")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, err := q.find(transferRequestId)
+	if err != nil {
+		return err
+	}
+	q.remove(e)
+	e.priority = priority
+	q.insert(e)
+	q.notify()
+	return nil
+}
+
+// Move puts a waiting transfer at the given place in the queue, 1 being the
+// next to run. Its priority changes as much as it has to for the queue to
+// stay in order of priority.
+func (q *Queue) Move(transferRequestId string, position int) error {
+	if q == nil {
+		return fmt.Errorf("Transfers aren't queued on this node")
+	}
+	if position < 1 {
+		return fmt.Errorf("Position must be at least 1, not %d", position)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, err := q.find(transferRequestId)
+	if err != nil {
+		return err
+	}
+	q.remove(e)
+	i := position - 1
+	if i > len(q.waiting) {
+		i = len(q.waiting)
+	}
+	if i > 0 && e.priority > q.waiting[i-1].priority {
+		e.priority = q.waiting[i-1].priority
+	}
+	if i < len(q.waiting) && e.priority < q.waiting[i].priority {
+		e.priority = q.waiting[i].priority
+	}
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = e
+	q.notify()
+	return nil
+}
+
+// List returns the running transfers, then the waiting ones in the order
+// they'll run.
+func (q *Queue) List() []Entry {
+	if q == nil {
+		return []Entry{}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries := []Entry{}
+	for _, e := range q.running {
+		entries = append(entries, Entry{TransferRequestId: e.id, Priority: e.priority})
+	}
+	for i, e := range q.waiting {
+		entries = append(entries, Entry{TransferRequestId: e.id, Priority: e.priority, Position: i + 1})
+	}
+	return entries
+}
+
+// the rest are called with q.mu held
+
+func (q *Queue) insert(e *entry) {
+	i := 0
+	for i < len(q.waiting) && q.waiting[i].priority >= e.priority {
+		i++
+	}
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = e
+}
+
+func (q *Queue) remove(e *entry) {
+	for i, w := range q.waiting {
+		if w == e {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *Queue) find(transferRequestId string) (*entry, error) {
+	for _, e := range q.waiting {
+		if e.id == transferRequestId {
+			return e, nil
+		}
+	}
+	if _, ok := q.running[transferRequestId]; ok {
+		return nil, fmt.Errorf("Transfer %s is already running", transferRequestId)
+	}
+	return nil, fmt.Errorf("Transfer %s isn't queued on this node", transferRequestId)
+}
+
+func (q *Queue) position(e *entry) int {
+	for i, w := range q.waiting {
+		if w == e {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// schedule starts as many waiting transfers as there's room for
+func (q *Queue) schedule() {
+	for len(q.running) < q.maxConcurrent && len(q.waiting) > 0 {
+		e := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running[e.id] = e
+		close(e.ready)
+	}
+	q.notify()
+}
+
+// notify tells everything waiting that its place may have changed
+func (q *Queue) notify() {
+	for _, e := range q.waiting {
+		select {
+		case e.moved <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package transferqueue
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// acquire starts waiting for a slot in the background, returning a channel
+// which gets the release func once there is one, and one which gets the
+// positions it's told about on the way.
+func acquire(q *Queue, ctx context.Context, id string, priority int) (chan func(), chan int) {
+	started := make(chan func(), 1)
+	positions := make(chan int, 100)
+	go func() {
+		release, err := q.Acquire(ctx, id, priority, func(position int) {
+			positions <- position
+		})
+		if err == nil {
+			started <- release
+		}
+		close(positions)
+	}()
+	return started, positions
+}
+
+func waitStarted(t *testing.T, started chan func(), id string) func() {
+	select {
+	case release := <-started:
+		return release
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s didn't start", id)
+		return nil
+	}
+}
+
+func assertWaiting(t *testing.T, started chan func(), id string) {
+	select {
+	case <-started:
+		t.Fatalf("%s started when it should be waiting", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func assertOrder(t *testing.T, q *Queue, ids ...string) {
+	waiting := []string{}
+	for _, e := range q.List() {
+		if e.Position > 0 {
+			waiting = append(waiting, e.TransferRequestId)
+		}
+	}
+	if len(waiting) != len(ids) {
+		t.Fatalf("expected %v waiting, got %v", ids, waiting)
+	}
+	for i := range ids {
+		if waiting[i] != ids[i] {
+			t.Fatalf("expected %v waiting, got %v", ids, waiting)
+		}
+	}
+}
+
+func TestNilQueue(t *testing.T) {
+	q := New(0)
+	if q != nil {
+		t.Fatalf("expected no queue without a limit")
+	}
+	release, err := q.Acquire(context.Background(), "a", 0, func(int) {
+		t.Errorf("shouldn't queue")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	release()
+	if err := q.Move("a", 1); err == nil {
+		t.Errorf("expected an error moving without a queue")
+	}
+}
+
+func TestQueueConcurrencyAndPriority(t *testing.T) {
+	q := New(1)
+	ctx := context.Background()
+
+	aStarted, _ := acquire(q, ctx, "a", 0)
+	releaseA := waitStarted(t, aStarted, "a")
+
+	bStarted, bPositions := acquire(q, ctx, "b", 0)
+	assertWaiting(t, bStarted, "b")
+	cStarted, _ := acquire(q, ctx, "c", 5)
+	assertWaiting(t, cStarted, "c")
+
+	// c jumps ahead of b for its higher priority
+	assertOrder(t, q, "c", "b")
+
+	releaseA()
+	releaseC := waitStarted(t, cStarted, "c")
+	assertWaiting(t, bStarted, "b")
+	releaseC()
+	releaseB := waitStarted(t, bStarted, "b")
+	releaseB()
+
+	// b was told it was first, then second once c arrived, then first again
+	expected := []int{1, 2, 1}
+	got := []int{}
+	for p := range bPositions {
+		got = append(got, p)
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected positions %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected positions %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestQueueReorder(t *testing.T) {
+	q := New(1)
+	ctx := context.Background()
+
+	aStarted, _ := acquire(q, ctx, "a", 0)
+	releaseA := waitStarted(t, aStarted, "a")
+	for _, id := range []string{"b", "c", "d"} {
+		started, _ := acquire(q, ctx, id, 0)
+		assertWaiting(t, started, id)
+	}
+	assertOrder(t, q, "b", "c", "d")
+
+	if err := q.Move("d", 1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertOrder(t, q, "d", "b", "c")
+
+	if err := q.Reprioritise("c", 10); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertOrder(t, q, "c", "d", "b")
+
+	// moving behind something with a lower priority lowers it to match
+	if err := q.Move("c", 3); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertOrder(t, q, "d", "b", "c")
+	for _, e := range q.List() {
+		if e.TransferRequestId == "c" && e.Priority != 0 {
+			t.Errorf("expected c's priority to drop to 0, got %d", e.Priority)
+		}
+	}
+
+	if err := q.Move("a", 1); err == nil {
+		t.Errorf("expected an error moving a running transfer")
+	}
+	if err := q.Reprioritise("z", 1); err == nil {
+		t.Errorf("expected an error reprioritising an unknown transfer")
+	}
+	releaseA()
+}
+
+func TestQueueCancelWhileWaiting(t *testing.T) {
+	q := New(1)
+
+	aStarted, _ := acquire(q, context.Background(), "a", 0)
+	releaseA := waitStarted(t, aStarted, "a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bStarted, bPositions := acquire(q, ctx, "b", 0)
+	assertWaiting(t, bStarted, "b")
+	cancel()
+	for range bPositions {
+	}
+	assertOrder(t, q)
+
+	releaseA()
+	cStarted, _ := acquire(q, context.Background(), "c", 0)
+	waitStarted(t, cStarted, "c")()
+}
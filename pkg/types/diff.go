@@ -5,6 +5,8 @@ import (
 	"encoding/base64"
 	"encoding/gob"
 	"fmt"
+	"os"
+	"time"
 )
 
 type FileChange uint
@@ -32,11 +34,63 @@ func (c FileChange) String() string {
 	}
 }
 
+type FileType string
+
+const (
+	FileTypeFile      FileType = "file"
+	FileTypeDirectory FileType = "directory"
+	FileTypeSymlink   FileType = "symlink"
+	FileTypeOther     FileType = "other"
+)
+
+// FileTypeOf returns the type of file a mode is for.
+func FileTypeOf(mode os.FileMode) FileType {
+	switch {
+	case mode.IsRegular():
+		return FileTypeFile
+	case mode.IsDir():
+		return FileTypeDirectory
+	case mode&os.ModeSymlink != 0:
+		return FileTypeSymlink
+	default:
+		return FileTypeOther
+	}
+}
+
+// DiffFileInfo describes a file on one side of a diff.
+type DiffFileInfo struct {
+	Type FileType `json:"type"`
+	Size int64    `json:"size"`
+	// permission bits
+	Mode  os.FileMode `json:"mode"`
+	Mtime time.Time   `json:"mtime"`
+}
+
 type ZFSFileDiff struct {
 	Change   FileChange `json:"change"`
 	Filename string     `json:"filename"`
+	// the file before and after the change, nil on the side it's missing
+	// from
+	Old *DiffFileInfo `json:"old,omitempty"`
+	New *DiffFileInfo `json:"new,omitempty"`
+	// for small text files, and only if asked for, the change to the
+	// contents as unified diff hunks
+	Hunks string `json:"hunks,omitempty"`
+}
+
+// DiffOptions say what to include in a diff.
+type DiffOptions struct {
+	// include Hunks for text files of up to MaxHunkFileSize bytes
+	Hunks bool
+	// page through big diffs: skip the first Offset entries, and return at
+	// most Limit of them (0 for all)
+	Offset int
+	Limit  int
 }
 
+// MaxHunkFileSize is the biggest file a diff includes Hunks for.
+const MaxHunkFileSize = 64 * 1024
+
 func EncodeZFSFileDiff(files []ZFSFileDiff) (string, error) {
 	buf := bytes.Buffer{}
 	enc := gob.NewEncoder(&buf)
@@ -59,10 +113,33 @@ func DecodeZFSFileDiff(data string) ([]ZFSFileDiff, error) {
 	return files, err
 }
 
+// RPCDiffRequest asks for the changes between two commits, or between a
+// commit and a branch's uncommitted state. From and To are each a commit id,
+// or a branch name for the branch's latest commit. Commits are looked for on
+// the branch, then the dot's other branches, then the dot's fork origins.
 type RPCDiffRequest struct {
+	// the branch to look up From and To on, by filesystem id, or else by
+	// name below
 	FilesystemID string
+
+	Namespace string
+	Name      string
+	// "" for master, as elsewhere
+	Branch string
+
+	// what to diff from, "" for the branch's latest commit
+	From string
+	// what to diff to, "" for the branch's uncommitted changes
+	To string
+
+	DiffOptions
 }
 
 type RPCDiffResponse struct {
-	Files []ZFSFileDiff
+	// the commits compared; ToCommit is "" for uncommitted changes
+	FromCommit string
+	ToCommit   string
+	Files      []ZFSFileDiff
+	// how many entries the whole diff has, when Files is a page of it
+	Total int
 }
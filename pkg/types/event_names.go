@@ -3,4 +3,7 @@ package types
 const (
 	EventNameResetRegistry         = "reset-registry"
 	EventNameResetRegistryComplete = "reset-registry-complete"
+	// sent to every node once the master has deleted a commit, so that the
+	// replicas delete theirs
+	EventNameDeleteCommit = "delete-commit"
 )
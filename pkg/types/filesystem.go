@@ -50,6 +50,11 @@ type FilesystemDeletionAudit struct {
 	Name                 VolumeName `json:"name"`
 	TopLevelFilesystemId string     `json:"top_level_filesystem_id"`
 	Clone                string     `json:"clone"`
+
+	// Promote is a clone of the filesystem which each node promotes before
+	// deleting its copy, so that the clones depending on the filesystem's
+	// snapshots survive it.
+	Promote string `json:"promote,omitempty"`
 }
 
 type FilesystemLive struct {
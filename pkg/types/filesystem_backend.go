@@ -0,0 +1,15 @@
+package types
+
+const EnvFilesystemBackend = "DOTMESH_FILESYSTEM_BACKEND"
+const EnvDirBackendRoot = "DOTMESH_DIR_BACKEND_ROOT"
+
+const (
+	FilesystemBackendZFS = "zfs"
+	// FilesystemBackendDir stores filesystems as plain directories, for
+	// hosts without ZFS
+	FilesystemBackendDir = "dir"
+)
+
+const (
+	DefaultDirBackendRoot = "/var/lib/dotmesh/dirs"
+)
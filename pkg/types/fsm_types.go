@@ -80,6 +80,8 @@ const (
 	TransferSent
 	TransferFinished
 	TransferStatus
+	TransferCancelled
+	TransferQueued
 
 	TransferGetCurrentPollResult
 )
@@ -118,6 +120,10 @@ type TransferPollResult struct {
 	// discovery id (although that is only for bootstrap... hmmm).
 	InitiatorNodeId string
 	PeerNodeId      string
+	// The filesystem whose state machine on the initiator is doing the
+	// transfer, which is where it's cancelled. FilesystemId can differ, as it
+	// follows the transfer through the origins of a branch.
+	InitiatorFilesystemId string
 
 	// XXX a Transfer that spans multiple filesystem ids won't have a unique
 	// starting/target snapshot, so this is in the wrong place right now.
@@ -128,11 +134,47 @@ type TransferPollResult struct {
 
 	Index              int    // i.e. transfer 1/4 (Index=1)
 	Total              int    //                   (Total=4)
-	Status             string // one of "starting", "running", "finished", "error"
+	Status             string // one of "queued", "starting", "running", "finished", "error", "cancelled"
 	NanosecondsElapsed int64
 	Size               int64 // size of current segment in bytes
 	Sent               int64 // number of bytes of current segment sent so far
 	Message            string
+
+	// Set by the receiving end of a push when it has kept the partial state
+	// of an interrupted receive, which the sender can carry on from.
+	ResumeToken string
+	// number of bytes that resuming interrupted receives saved sending again
+	Saved int64
+
+	// How the stream is compressed on the wire: one of utils.StreamEncodings,
+	// or "" for uncompressed. In a push's NegotiateTransfer call, the initiator
+	// offers a comma separated list and the peer replies with its choice.
+	StreamEncoding string
+	// Whether zfs sends blocks as they are compressed on disk. Offered by the
+	// initiator of a push and agreed by the peer, as with StreamEncoding.
+	CompressedStream bool
+	// expected size of current segment on the wire, once compressed
+	WireSize int64
+	// bytes per second the transfer has been getting through since a rate
+	// limit, its own LimitRate or the node's, first held it back, or 0 if
+	// none has. It can be well under either limit, when the node's is shared
+	// with other transfers.
+	LimitRate int64
+	// Priority in the initiating node's transfer queue, higher goes first
+	Priority int
+	// place in the initiating node's transfer queue while Status is
+	// "queued", 1 being the next to run
+	QueuePosition int
+}
+
+// PredictedSize is how big a replication stream is expected to be.
+type PredictedSize struct {
+	// bytes of the stream as zfs sends it without compression
+	Raw int64
+	// bytes expected on the wire with compression: the size of a compressed
+	// send where zfs supports them, or otherwise estimated from how well the
+	// data compresses on disk
+	Wire int64
 }
 
 func (t TransferPollResult) String() string {
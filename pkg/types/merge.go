@@ -0,0 +1,57 @@
+package types
+
+// MergeRequest asks for the changes made on one branch, since it last shared
+// a commit with another, to be applied to the other and committed there.
+type MergeRequest struct {
+	Namespace string
+	Name      string
+	// the branch to merge into, "" for master
+	Branch string
+	// the branch to merge from, "" for master
+	SourceBranch string
+	// the merge commit's message, "" for "Merge <SourceBranch>"
+	Message  string
+	Metadata map[string]string
+}
+
+// CherryPickRequest asks for the changes one commit made, since the commit
+// before it on its branch, to be applied to a branch and committed there.
+type CherryPickRequest struct {
+	Namespace string
+	Name      string
+	// the branch to apply the changes to, "" for master
+	Branch string
+	// the commit to pick, which may be on any branch of the dot
+	Commit string
+	// the new commit's message, "" for the picked commit's message
+	Message  string
+	Metadata map[string]string
+}
+
+// MergeConflict is a path changed on both sides of a merge, to different
+// things. The merge leaves it as it was on the branch merged into.
+type MergeConflict struct {
+	Path string `json:"path"`
+	// how the path (or, for a removed directory, the directory) changed on
+	// the branch merged into, and on the one merged from
+	Ours   FileChange `json:"ours"`
+	Theirs FileChange `json:"theirs"`
+}
+
+// MergeResult says what a merge or cherry-pick did.
+type MergeResult struct {
+	// the merge commit, "" when there was nothing to merge
+	SnapshotId string
+	// true when the branch merged into already has everything from the
+	// other one
+	UpToDate bool
+	// the commit the changes were worked out since: the latest one both
+	// branches have, or the latest one merged before, or for a cherry-pick
+	// the commit before the one picked
+	Base string
+	// the latest commit of the branch merged from, or the commit picked
+	SourceCommit string
+	// the changes from the branch merged from which were applied
+	Applied   []ZFSFileDiff
+	Conflicts []MergeConflict
+}
@@ -0,0 +1,48 @@
+package types
+
+// RetentionPolicy says which commits of a dot, or of one of its branches, the
+// master prunes. A commit is kept if any of the rules keep it, and the latest
+// commit is always kept. A policy with no rules keeps everything.
+type RetentionPolicy struct {
+	// Meta is populated by the KV store implementer
+	Meta *KVMeta `json:"-"`
+
+	// the dot's top level filesystem id
+	FilesystemId string
+	// the branch the policy is for, or "" for every branch of the dot which
+	// doesn't have a policy of its own
+	Branch string `json:",omitempty"`
+
+	// keep the latest KeepLast commits
+	KeepLast int `json:",omitempty"`
+	// keep the latest commit of each of the last KeepDaily days (UTC),
+	// today included
+	KeepDaily int `json:",omitempty"`
+	// keep commits whose metadata has all of these values, e.g.
+	// {"tag": "release"}
+	KeepMetadata map[string]string `json:",omitempty"`
+}
+
+// Empty reports whether the policy has no rules, and so keeps everything.
+func (p RetentionPolicy) Empty() bool {
+	return p.KeepLast == 0 && p.KeepDaily == 0 && len(p.KeepMetadata) == 0
+}
+
+// PrunedCommit is a commit which a retention policy doesn't keep.
+type PrunedCommit struct {
+	Snapshot Snapshot
+	// why it can't be deleted after all, if something else needs it
+	Protected string `json:",omitempty"`
+}
+
+// RetentionPolicyRequest says which retention policy an RPC is about.
+type RetentionPolicyRequest struct {
+	Namespace string
+	Name      string
+	// "" for master, as elsewhere
+	Branch string
+	// the dot's policy for every branch, rather than Branch's own
+	AllBranches bool
+	// the policy to set, or to dry-run instead of the stored one
+	Policy *RetentionPolicy
+}
@@ -0,0 +1,34 @@
+package types
+
+// CommitSchedule makes the master of a dot's branch commit it on a schedule,
+// whenever it has changed since the last commit.
+type CommitSchedule struct {
+	// Meta is populated by the KV store implementer
+	Meta *KVMeta `json:"-"`
+
+	// the dot's top level filesystem id
+	FilesystemId string
+	// the branch the schedule is for, or "" for every branch of the dot
+	// which doesn't have a schedule of its own
+	Branch string `json:",omitempty"`
+
+	// when to commit, as a five field cron expression in UTC
+	Cron string
+	// text/template for the commit message, given the .Dot, .Branch and
+	// .Time of the commit
+	Message string `json:",omitempty"`
+	// added to each commit's metadata
+	Metadata map[string]string `json:",omitempty"`
+}
+
+// CommitScheduleRequest says which commit schedule an RPC is about.
+type CommitScheduleRequest struct {
+	Namespace string
+	Name      string
+	// "" for master, as elsewhere
+	Branch string
+	// the dot's schedule for every branch, rather than Branch's own
+	AllBranches bool
+	// the schedule to set, or nil to remove it
+	Schedule *CommitSchedule
+}
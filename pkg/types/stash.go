@@ -0,0 +1,41 @@
+package types
+
+import "time"
+
+// StashInfo says where a stash branch came from. Dotmesh makes one when a
+// branch has diverged from a copy it's being brought up to date with: the
+// commits only the branch had are moved onto the stash, which is cloned from
+// the latest commit the two have in common, and the branch carries on from
+// there.
+type StashInfo struct {
+	// the branch the commits were moved off, "" for master
+	Branch  string
+	Created time.Time
+	// the transfer which found the divergence, "" if it was found while
+	// replicating within the cluster
+	TransferRequestId string `json:",omitempty"`
+}
+
+// Stash describes a stash branch of a dot.
+type Stash struct {
+	// the stash branch's name
+	Name         string
+	FilesystemId string
+	StashInfo
+	// the commit the stash was cloned from, which the branch it came from
+	// still has
+	BaseCommit string
+	// the commits only the stash has, oldest first
+	Commits []Snapshot
+}
+
+// ApplyStashRequest asks for the branch a stash came from to be given the
+// contents of the stash's latest commit, as a new commit.
+type ApplyStashRequest struct {
+	Namespace string
+	Name      string
+	// the stash branch's name
+	Stash string
+	// the new commit's message, "" for "Apply stash <Stash>"
+	Message string
+}
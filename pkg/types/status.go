@@ -0,0 +1,29 @@
+package types
+
+import (
+	"github.com/dotmesh-io/dotmesh/pkg/container"
+)
+
+// DotStatus is where a branch of a dot is, what's using it and what's
+// happening to it, as 'dm status' shows.
+type DotStatus struct {
+	// the remote, in the client's configuration, which has the dot
+	Remote    string
+	Namespace string
+	Name      string
+	// "" for master
+	Branch       string
+	FilesystemId string
+	// the node the branch's master copy is on
+	Master     string
+	SizeBytes  int64
+	DirtyBytes int64
+	Containers []container.DockerContainer
+	// the transfers of any of the dot's branches which are still going
+	Transfers []TransferPollResult
+	// how the branch stands against its upstream dot, nil when it has none
+	Upstream *RemoteComparison `json:",omitempty"`
+	// why Upstream couldn't be worked out, when the upstream remote couldn't
+	// be reached for example
+	UpstreamError string `json:",omitempty"`
+}
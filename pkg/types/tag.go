@@ -0,0 +1,36 @@
+package types
+
+import "time"
+
+// Tag names one commit of a dot. Tags are stored per dot, so any branch's
+// commits can be tagged, and they don't move once they're made.
+type Tag struct {
+	// Meta is populated by the KV store implementer
+	Meta *KVMeta `json:"-"`
+
+	// the dot's top level filesystem id
+	FilesystemId string
+	Name         string
+	SnapshotId   string
+	Author       string    `json:",omitempty"`
+	Created      time.Time `json:",omitempty"`
+}
+
+// TagRequest asks for a commit of a dot to be tagged. The commit can be given
+// as a commit id, a branch name for its latest commit, or another tag; ""
+// means the latest commit of Branch.
+type TagRequest struct {
+	Namespace string
+	Name      string
+	Branch    string
+	Tag       string
+	Commit    string
+}
+
+// ImportTagsRequest carries a dot's tags to another cluster along with its
+// commits.
+type ImportTagsRequest struct {
+	Namespace string
+	Name      string
+	Tags      []Tag
+}
@@ -0,0 +1,46 @@
+package types
+
+// TransferPlan is what a push or pull would transfer, worked out without
+// changing anything on either cluster.
+type TransferPlan struct {
+	Direction string
+	// the branch being transferred, which is the same on both clusters
+	FilesystemId string
+	// false when the receiving cluster has no such dot or branch yet, as
+	// for a clone
+	ReceiverExists bool
+	// the branches the branch being transferred was made from, which are
+	// transferred first, and the dot's master branch
+	Path  PathToTopLevelFilesystem
+	Steps []TransferPlanStep
+	// true when the receiving end has commits which would be moved to a
+	// stash branch for the transfer to go ahead
+	StashNeeded bool
+	// the total of the steps' sizes
+	Size PredictedSize
+}
+
+// TransferPlanStep is what a transfer would send of one branch on its path,
+// in the order applyPath goes through them. A transfer stops at the first
+// step with an Error, so no steps follow one.
+type TransferPlanStep struct {
+	// "" for master
+	Branch       string
+	FilesystemId string
+	// what the stream would start after: "START" for the beginning of the
+	// branch, "<filesystem id>@<commit>" for the commit it was made from, or
+	// the latest commit the receiving end already has
+	StartingCommit string
+	TargetCommit   string
+	// the commits which would be sent, oldest first
+	Commits []Snapshot
+	Size    PredictedSize
+	// true when the receiving end has everything already, or more than the
+	// sending end with stashing allowed
+	UpToDate bool
+	// true when the receiving end has commits after the latest one both
+	// have, which would be moved to a stash branch
+	StashNeeded bool
+	// why the transfer would fail at this step, "" if it wouldn't
+	Error string
+}
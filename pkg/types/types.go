@@ -126,6 +126,16 @@ type Clone struct {
 	FilesystemId         string
 	Name                 string
 	Origin               Origin
+	// FormerNames are names the branch had before it was renamed, which
+	// still find it, so that anything that used the old name keeps working
+	FormerNames []string `json:",omitempty"`
+	// RenamingTo marks the entry under a branch's old name while it's being
+	// renamed, before the entry under its new name is written, so that a
+	// rename cut short part way through isn't taken for two branches
+	RenamingTo string `json:",omitempty"`
+	// Stash is set on branches dotmesh made to keep commits out of the way
+	// when a branch diverged
+	Stash *StashInfo `json:",omitempty"`
 }
 
 type S3TransferRequest struct {
@@ -138,6 +148,11 @@ type S3TransferRequest struct {
 	LocalName       string
 	LocalBranchName string
 	RemoteName      string
+	// bytes per second to limit the transfer to, 0 for no limit
+	LimitRate int64
+	// transfers with higher priorities run first when the initiating node
+	// has too many to run at once
+	Priority int
 }
 
 func (transferRequest S3TransferRequest) String() string {
@@ -154,6 +169,29 @@ func (transferRequest S3TransferRequest) String() string {
 	return toString
 }
 
+// TransferReorderRequest changes where a queued transfer is in the queue of
+// the node which initiated it.
+type TransferReorderRequest struct {
+	TransferRequestId string
+	// new priority for the transfer, if set
+	Priority *int
+	// place in the queue to move the transfer to, 1 being the next to run,
+	// or 0 to leave it where its priority puts it
+	Position int
+}
+
+// PredictSizeRequest asks how big the stream sending a filesystem from one
+// commit, on it or on the filesystem it was cloned from, to another will be.
+type PredictSizeRequest struct {
+	FromFilesystemId string
+	FromSnapshotId   string
+	ToFilesystemId   string
+	ToSnapshotId     string
+	// If set, predict what's left of the interrupted receive this was
+	// taken from instead.
+	ResumeToken string
+}
+
 type TransferRequest struct {
 	Peer             string // hostname
 	User             string
@@ -169,6 +207,11 @@ type TransferRequest struct {
 	// TODO could also include SourceSnapshot here
 	TargetCommit    string // optional, "" means "latest"
 	StashDivergence bool
+	// bytes per second to limit the transfer to, 0 for no limit
+	LimitRate int64
+	// transfers with higher priorities run first when the initiating node
+	// has too many to run at once
+	Priority int
 }
 
 func (transferRequest TransferRequest) String() string {
@@ -185,9 +228,31 @@ func (transferRequest TransferRequest) String() string {
 	return toString
 }
 
+// RemoteComparison says how a branch stands against the branch on a remote
+// which it's pushed to and pulled from, worked out from the two branches'
+// commits without transferring anything.
+type RemoteComparison struct {
+	// the remote's name in the client's configuration
+	Remote          string
+	RemoteNamespace string
+	RemoteName      string
+	// "" for master
+	RemoteBranch string
+	// false when the remote has no such dot or branch yet
+	RemoteExists bool
+	// commits the local branch has that the remote one doesn't, and the
+	// other way round
+	Ahead  int
+	Behind int
+	// the latest commit both branches have, "" when they have none in common
+	CommonAncestor string
+}
+
 type StashRequest struct {
 	FilesystemId string
 	SnapshotId   string
+	// the transfer which found the divergence, to record on the stash
+	TransferRequestId string
 }
 
 // type Config struct {
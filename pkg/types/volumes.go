@@ -52,6 +52,34 @@ type RollbackRequest struct {
 	SnapshotId string
 }
 
+// RevertRequest asks for a new commit on a branch whose contents are those
+// of an earlier commit, keeping the commits in between.
+type RevertRequest struct {
+	Namespace  string
+	Name       string
+	Branch     string
+	SnapshotId string
+	// the new commit's message, "" for "Revert to <SnapshotId>"
+	Message  string
+	Metadata map[string]string
+}
+
+// RestoreRequest asks for some paths of a branch's default subdot to be put
+// back as they were in one of its commits, leaving everything else alone.
+type RestoreRequest struct {
+	Namespace  string
+	Name       string
+	Branch     string
+	SnapshotId string
+	// relative to the default subdot, as in diffs
+	Paths []string
+	// whether to commit the result
+	Commit bool
+	// the commit's message, "" for "Restore <paths> from <SnapshotId>"
+	Message  string
+	Metadata map[string]string
+}
+
 type ForkRequest struct {
 	MasterBranchId string
 	ForkNamespace  string
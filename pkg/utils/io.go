@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"compress/gzip"
 	"fmt"
 	"github.com/dotmesh-io/dotmesh/pkg/types"
 	log "github.com/sirupsen/logrus"
@@ -52,6 +51,11 @@ func GetLogfile(logfile string) *os.File {
 // Events flow over the canceller chan.
 //
 // if the writer implements http.Flusher, Flush() is called after each write.
+// a compressing writer is flushed at most once a second, and when it's closed.
+//
+// compressMode is "compress" or "decompress" for the stream framing every
+// version of dotmesh speaks, which may be followed by ":" and one of
+// StreamEncodings to actually compress, or "none".
 
 // TODO: pipe would be better named Copy
 func Pipe(
@@ -91,9 +95,17 @@ func Pipe(
 		}
 	}
 
+	var lastFlush int64 // in UnixNano
+	flushLimit := func(f func()) {
+		if time.Now().UnixNano()-lastFlush > 1e+9 {
+			f()
+			lastFlush = time.Now().UnixNano()
+		}
+	}
+
 	handleErr := func(message string, r io.Reader, w io.Writer, r2 io.Reader, w2 io.Writer) {
 		if message != "" {
-			log.Printf("[pipe:handleErr] " + message)
+			log.Printf("[pipe:handleErr] %s", message)
 		}
 		// NB: c.Close returns unhandled err here, and below.
 		if c, ok := r.(io.Closer); ok {
@@ -117,17 +129,17 @@ func Pipe(
 
 	log.Printf("[PIPE] reader %s => writer %s, COMPRESSMODE=%s", rDesc, wDesc, compressMode)
 
-	if compressMode == "compress" {
-		writer, err = gzip.NewWriterLevel(w, gzip.NoCompression)
+	if encoding, ok := modeEncoding(compressMode, "compress"); ok {
+		writer, err = newStreamWriter(w, encoding)
 		if err != nil {
-			handleErr(fmt.Sprintf("Unable to create gzip writer: %s", err), r, w, r, w)
+			handleErr(fmt.Sprintf("Unable to create compressing writer: %s", err), r, w, r, w)
 			return
 		}
 		reader = r
-	} else if compressMode == "decompress" {
-		reader, err = gzip.NewReader(r)
+	} else if encoding, ok := modeEncoding(compressMode, "decompress"); ok {
+		reader, err = newStreamReader(r, encoding)
 		if err != nil {
-			handleErr(fmt.Sprintf("Unable to create gzip reader: %s", err), r, w, r, w)
+			handleErr(fmt.Sprintf("Unable to create decompressing reader: %s", err), r, w, r, w)
 			return
 		}
 		writer = w
@@ -139,7 +151,7 @@ func Pipe(
 		handleErr(
 			fmt.Sprintf(
 				"Unsupported compression mode %s, choose one of 'compress', "+
-					"'decompress' or 'none'",
+					"'decompress' (optionally followed by ':<encoding>') or 'none'",
 				compressMode,
 			), r, w, r, w,
 		)
@@ -172,11 +184,14 @@ func Pipe(
 			if f, ok := writer.(http.Flusher); ok {
 				f.Flush()
 			}
-			if f, ok := writer.(*gzip.Writer); ok {
-				// special case, we know we might have to flush the writer in
-				// case of a small replication stream (and we're not speaking
-				// directly to an http.Flusher any more)
-				f.Flush()
+			if f, ok := writer.(interface{ Flush() error }); ok {
+				// a compressing writer holds on to what it's given to
+				// compress it in bigger blocks, and flushing ends a block,
+				// so only do it now and then to keep a slow stream moving.
+				// Closing it at the end of the stream flushes the rest.
+				flushLimit(func() {
+					f.Flush()
+				})
 			}
 			totalBytes += int64(nr)
 			rateLimit(func() {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/dotmesh-io/dotmesh/pkg/types"
 	"regexp"
+	"strings"
 )
 
 const keyRegex = "[a-z]+[a-z0-9-]*"
@@ -39,3 +40,27 @@ func EncodeMetadata(meta map[string]string) ([]string, error) {
 	}
 	return metadataEncoded, nil
 }
+
+func DecodeMetadata(metadataEncoded []string) (map[string]string, error) {
+	/*
+	   Decode the output of EncodeMetadata back into a map of key value
+	   pairs, for storage backends which aren't zfs and so have to keep
+	   commit metadata themselves.
+	*/
+	meta := map[string]string{}
+	for _, arg := range metadataEncoded {
+		if arg == "-o" {
+			continue
+		}
+		shrapnel := strings.SplitN(strings.TrimPrefix(arg, types.MetaKeyPrefix), "=", 2)
+		if len(shrapnel) != 2 {
+			return nil, fmt.Errorf("malformed metadata argument %s", arg)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(shrapnel[1])
+		if err != nil {
+			return nil, fmt.Errorf("unable to base64 decode metadata value for %s: %s", shrapnel[0], err)
+		}
+		meta[shrapnel[0]] = string(decoded)
+	}
+	return meta, nil
+}
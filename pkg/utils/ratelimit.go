@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+)
+
+// RateLimiter caps how many bytes per second flow through it, shared between
+// everything it throttles. A nil RateLimiter doesn't limit anything.
+type RateLimiter struct {
+	bytesPerSecond int64
+	limiter        *rate.Limiter
+}
+
+// NewRateLimiter returns a limiter for bytesPerSecond, or nil (no limit) if
+// it isn't positive.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		bytesPerSecond: bytesPerSecond,
+		// allow a whole replication buffer at once, so that slow rates don't
+		// chop reads up any further
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), types.BufLength),
+	}
+}
+
+// Rate returns the limit in bytes per second, or 0 for no limit.
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.bytesPerSecond
+}
+
+func (l *RateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	for n > 0 {
+		chunk := n
+		if chunk > types.BufLength {
+			chunk = types.BufLength
+		}
+		// can only fail if chunk is over the burst size, or the context is
+		// done, neither of which can happen
+		l.limiter.WaitN(context.Background(), chunk)
+		n -= chunk
+	}
+}
+
+// Throttle is all the limits on a stream, eg its transfer's own limit and
+// the one for the whole node, the lowest of which wins.
+type Throttle []*RateLimiter
+
+// Rate returns the lowest limit in bytes per second, or 0 if there isn't one.
+func (t Throttle) Rate() int64 {
+	var lowest int64
+	for _, l := range t {
+		if r := l.Rate(); r > 0 && (lowest == 0 || r < lowest) {
+			lowest = r
+		}
+	}
+	return lowest
+}
+
+// Wait blocks until all of the limits allow n more bytes through.
+func (t Throttle) Wait(n int) {
+	t.MeasuredWait(n, nil)
+}
+
+// MeasuredWait is Wait, which also counts the n bytes towards throughput, if
+// it isn't nil.
+func (t Throttle) MeasuredWait(n int, throughput *Throughput) {
+	start := time.Now()
+	for _, l := range t {
+		l.wait(n)
+	}
+	throughput.add(n, time.Since(start) > heldBack)
+}
+
+// Reader returns r throttled, or r itself if there are no limits. Closing the
+// throttled reader closes r, if it can be closed.
+func (t Throttle) Reader(r io.Reader) io.Reader {
+	return t.MeasuredReader(r, nil)
+}
+
+// MeasuredReader is Reader, which also measures what's read in throughput,
+// if it isn't nil.
+func (t Throttle) MeasuredReader(r io.Reader, throughput *Throughput) io.Reader {
+	if t.Rate() == 0 {
+		return r
+	}
+	return &throttledReader{r: r, throttle: t, throughput: throughput}
+}
+
+type throttledReader struct {
+	r          io.Reader
+	throttle   Throttle
+	throughput *Throughput
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > types.BufLength {
+		p = p[:types.BufLength]
+	}
+	n, err := t.r.Read(p)
+	t.throttle.MeasuredWait(n, t.throughput)
+	return n, err
+}
+
+func (t *throttledReader) Close() error {
+	if c, ok := t.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// a wait longer than this means a limit held the stream back, rather than
+// just checking it had room
+const heldBack = time.Millisecond
+
+// Throughput measures how fast a throttled stream gets through. The rate a
+// stream is limited to isn't what it gets when it's sharing a node's limit
+// with others, or when it's slower than its limit anyway. The zero
+// Throughput is ready to use, and a nil one measures nothing.
+type Throughput struct {
+	mu    sync.Mutex
+	start time.Time
+	bytes int64
+	held  bool
+}
+
+func (m *Throughput) add(n int, held bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.start.IsZero() {
+		m.start = time.Now()
+	}
+	m.bytes += int64(n)
+	m.held = m.held || held
+}
+
+// Rate returns the bytes per second that have got through since the first,
+// once a limit has held the stream back, or 0 until then.
+func (m *Throughput) Rate() int64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elapsed := time.Since(m.start)
+	if !m.held || elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(m.bytes) / elapsed.Seconds())
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+)
+
+func TestThrottleRate(t *testing.T) {
+	if rate := (Throttle{nil, nil}).Rate(); rate != 0 {
+		t.Errorf("expected no limit, got %d", rate)
+	}
+	if rate := (Throttle{NewRateLimiter(0), NewRateLimiter(2048), NewRateLimiter(1024)}).Rate(); rate != 1024 {
+		t.Errorf("expected the lowest limit 1024, got %d", rate)
+	}
+}
+
+func TestThrottleReader(t *testing.T) {
+	r := bytes.NewReader(make([]byte, 1024))
+	if (Throttle{nil}).Reader(r) != r {
+		t.Errorf("expected an unlimited throttle to return the reader as is")
+	}
+
+	// a whole buffer can go straight through, so send twice the limit after
+	// draining it
+	limiter := NewRateLimiter(64 * 1024)
+	limiter.wait(types.BufLength)
+	start := time.Now()
+	out, err := ioutil.ReadAll(Throttle{limiter}.Reader(bytes.NewReader(make([]byte, 128*1024))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 128*1024 {
+		t.Errorf("expected %d bytes, got %d", 128*1024, len(out))
+	}
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("expected 128KiB at 64KiB/s to take about 2s, took %s", elapsed)
+	}
+}
+
+func TestThroughputSharingALimit(t *testing.T) {
+	// two streams share a node's limit, so each gets about half of it
+	node := NewRateLimiter(64 * 1024)
+	node.wait(types.BufLength)
+	throughputs := []*Throughput{{}, {}}
+	done := make(chan bool)
+	for _, throughput := range throughputs {
+		go func(throughput *Throughput) {
+			ioutil.ReadAll(Throttle{nil, node}.MeasuredReader(bytes.NewReader(make([]byte, 64*1024)), throughput))
+			done <- true
+		}(throughput)
+	}
+	<-done
+	<-done
+	for i, throughput := range throughputs {
+		if rate := throughput.Rate(); rate <= 0 || rate > 48*1024 {
+			t.Errorf("stream %d: expected well under the 64KiB/s limit, got %d bytes/s", i, rate)
+		}
+	}
+
+	// a limit that never holds a stream back isn't throttling it
+	var unheld Throughput
+	ioutil.ReadAll(Throttle{NewRateLimiter(1024 * 1024 * 1024)}.MeasuredReader(bytes.NewReader(make([]byte, 1024)), &unheld))
+	if rate := unheld.Rate(); rate != 0 {
+		t.Errorf("expected no throttled rate for a stream under its limit, got %d", rate)
+	}
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Replication streams are framed as gzip without any compression unless both
+// ends agree on something better. Pullers list the encodings they can decode
+// in StreamAcceptEncodingHeader and senders say which one they picked in
+// StreamEncodingHeader; pushers find out what the receiver can decode when
+// they register the transfer, and say which one they picked in
+// StreamEncodingHeader. We don't use the standard Accept-Encoding and
+// Content-Encoding headers because net/http handles those itself.
+const (
+	StreamAcceptEncodingHeader = "Dotmesh-Accept-Stream-Encoding"
+	StreamEncodingHeader       = "Dotmesh-Stream-Encoding"
+	// whether zfs can receive (in a request) or has sent (in a response)
+	// blocks as they are compressed on disk
+	AcceptCompressedStreamHeader = "Dotmesh-Accept-Compressed-Stream"
+	CompressedStreamHeader       = "Dotmesh-Compressed-Stream"
+)
+
+// StreamEncodings are the encodings we can compress replication streams with
+// on the wire, most preferred first.
+var StreamEncodings = []string{"zstd", "gzip"}
+
+// NegotiateStreamEncoding picks the first of our StreamEncodings which is in
+// the comma separated list offered by the other end, or "" for the original
+// uncompressed framing if there isn't one (including when the other end is an
+// older version which doesn't offer anything).
+func NegotiateStreamEncoding(offered string) string {
+	for _, ours := range StreamEncodings {
+		for _, theirs := range strings.Split(offered, ",") {
+			if strings.TrimSpace(theirs) == ours {
+				return ours
+			}
+		}
+	}
+	return ""
+}
+
+// CompressMode is the Pipe mode which compresses with encoding.
+func CompressMode(encoding string) string {
+	if encoding == "" {
+		return "compress"
+	}
+	return "compress:" + encoding
+}
+
+// DecompressMode is the Pipe mode which decompresses encoding.
+func DecompressMode(encoding string) string {
+	if encoding == "" {
+		return "decompress"
+	}
+	return "decompress:" + encoding
+}
+
+// modeEncoding returns the encoding of a Pipe mode made by CompressMode or
+// DecompressMode (according to kind), if mode is one.
+func modeEncoding(mode, kind string) (string, bool) {
+	if mode == kind {
+		return "", true
+	}
+	if strings.HasPrefix(mode, kind+":") {
+		return strings.TrimPrefix(mode, kind+":"), true
+	}
+	return "", false
+}
+
+// CopyStreamHeaders copies the stream negotiation headers, for proxying
+// replication requests and responses between nodes.
+func CopyStreamHeaders(dst, src http.Header) {
+	for _, header := range []string{
+		StreamAcceptEncodingHeader, StreamEncodingHeader,
+		AcceptCompressedStreamHeader, CompressedStreamHeader,
+	} {
+		if value := src.Get(header); value != "" {
+			dst.Set(header, value)
+		}
+	}
+}
+
+func newStreamWriter(w io.Writer, encoding string) (io.Writer, error) {
+	switch encoding {
+	case "":
+		return gzip.NewWriterLevel(w, gzip.NoCompression)
+	case "gzip":
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported stream encoding %s", encoding)
+}
+
+func newStreamReader(r io.Reader, encoding string) (io.Reader, error) {
+	switch encoding {
+	case "", "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader{d}, nil
+	}
+	return nil, fmt.Errorf("unsupported stream encoding %s", encoding)
+}
+
+// zstdReader makes a zstd.Decoder an io.Closer, so that Pipe stops its
+// goroutines when it's done.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (z zstdReader) Close() error {
+	z.Decoder.Close()
+	return nil
+}
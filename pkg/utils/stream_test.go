@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+)
+
+func TestNegotiateStreamEncoding(t *testing.T) {
+	for offered, expected := range map[string]string{
+		"":           "",
+		"zstd,gzip":  "zstd",
+		"gzip, zstd": "zstd",
+		"gzip":       "gzip",
+		"brotli":     "",
+	} {
+		if actual := NegotiateStreamEncoding(offered); actual != expected {
+			t.Errorf("offered %q, expected %q, got %q", offered, expected, actual)
+		}
+	}
+}
+
+// pipe runs r through Pipe in mode and returns what came out.
+func pipe(t *testing.T, r io.Reader, mode string) []byte {
+	pr, pw := io.Pipe()
+	finished := make(chan bool)
+	go Pipe(
+		r, "test input", pw, "test output", finished,
+		make(chan *types.Event),
+		func(e *types.Event, c chan *types.Event) {},
+		func(bytes int64, t int64) {},
+		mode,
+	)
+	out, err := ioutil.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("error reading from pipe in mode %s: %s", mode, err)
+	}
+	<-finished
+	return out
+}
+
+func TestPipeStreamEncodingsRoundTrip(t *testing.T) {
+	stream := []byte(strings.Repeat("a replication stream, ", 100000))
+	for _, encoding := range append([]string{""}, StreamEncodings...) {
+		compressed := pipe(t, bytes.NewReader(stream), CompressMode(encoding))
+		if encoding != "" && len(compressed) >= len(stream) {
+			t.Errorf("%s didn't compress: %d bytes in, %d out", encoding, len(stream), len(compressed))
+		}
+		out := pipe(t, bytes.NewReader(compressed), DecompressMode(encoding))
+		if !bytes.Equal(out, stream) {
+			t.Errorf("%q didn't round trip: %d bytes in, %d out", encoding, len(stream), len(out))
+		}
+	}
+}
+
+// countingWriter counts the writes made to it.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(p)
+}
+
+func TestPipeCompressesAcrossReads(t *testing.T) {
+	stream := []byte(strings.Repeat("a replication stream, ", 500))
+	for _, encoding := range StreamEncodings {
+		out := &countingWriter{}
+		finished := make(chan bool)
+		go Pipe(
+			iotest.OneByteReader(bytes.NewReader(stream)), "test input", out, "test output", finished,
+			make(chan *types.Event),
+			func(e *types.Event, c chan *types.Event) {},
+			func(bytes int64, t int64) {},
+			CompressMode(encoding),
+		)
+		<-finished
+		// flushing after every read would end a compressed block, and write
+		// it out, for every byte
+		if out.writes > 10 {
+			t.Errorf("%s: expected a few writes of what %d one byte reads compressed to, got %d", encoding, len(stream), out.writes)
+		}
+		decompressed := pipe(t, bytes.NewReader(out.Bytes()), DecompressMode(encoding))
+		if !bytes.Equal(decompressed, stream) {
+			t.Errorf("%s didn't round trip: %d bytes in, %d out", encoding, len(stream), len(decompressed))
+		}
+	}
+}
@@ -20,6 +20,7 @@ const (
 	BranchPattern          string = `^[a-zA-Z0-9_\-]{1,64}$`
 	SubDotPattern          string = `^[a-zA-Z0-9_\-]{1,64}$`
 	SnapshotPattern        string = `^[a-zA-Z0-9_\-]{1,64}$`
+	TagPattern             string = `^[a-zA-Z0-9_\-]{1,64}$`
 )
 
 var (
@@ -31,6 +32,7 @@ var (
 	rxBranch      = regexp.MustCompile(BranchPattern)
 	rxSubdot      = regexp.MustCompile(SubDotPattern)
 	rxSnapshot    = regexp.MustCompile(SnapshotPattern)
+	rxTag         = regexp.MustCompile(TagPattern)
 )
 
 // errors
@@ -44,6 +46,9 @@ var (
 	ErrInvalidBranchName    = fmt.Errorf("invalid branch name, should match pattern: %s", BranchPattern)
 	ErrInvalidSubdotName    = fmt.Errorf("invalid subdot name, should match pattern: %s", SubDotPattern)
 	ErrInvalidSnapshotName  = fmt.Errorf("invalid snapshot name, should match pattern: %s", SnapshotPattern)
+	ErrEmptyTag             = errors.New("tag cannot be empty")
+	ErrInvalidTagName       = fmt.Errorf("invalid tag name, should match pattern: %s", TagPattern)
+	ErrReservedTagName      = errors.New("tag names can't look like commit ids, HEAD or latest")
 )
 
 // IsUUID check if the string is a UUID (version 3, 4 or 5).
@@ -134,6 +139,25 @@ func IsValidSnapshotName(str string) error {
 	return nil
 }
 
+// IsValidTagName checks a new tag's name. Tags are accepted wherever a commit
+// id is, so they can't be mistaken for one, or for the other names commits
+// go by.
+func IsValidTagName(str string) error {
+	if str == "" {
+		return ErrEmptyTag
+	}
+
+	if !rxTag.MatchString(str) {
+		return ErrInvalidTagName
+	}
+
+	if IsUUID(str) || str == "HEAD" || str == "latest" {
+		return ErrReservedTagName
+	}
+
+	return nil
+}
+
 // ReplaceUUID replace UUID in string
 func ReplaceUUID(str, replace string) string {
 	return rxUUIDPattern.ReplaceAllString(str, replace)
@@ -161,3 +161,25 @@ func TestIsValidSubdotName(t *testing.T) {
 		})
 	}
 }
+
+func TestIsValidTagName(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		wantErr error
+	}{
+		{name: "empty", str: "", wantErr: ErrEmptyTag},
+		{name: "valid", str: "release-1_2", wantErr: nil},
+		{name: "funny characters shouldn't be valid", str: "v1.2", wantErr: ErrInvalidTagName},
+		{name: "commit id", str: "f1c8a3a4-6d1e-4b1c-9f0a-2a6b1e0c9d3e", wantErr: ErrReservedTagName},
+		{name: "HEAD", str: "HEAD", wantErr: ErrReservedTagName},
+		{name: "latest", str: "latest", wantErr: ErrReservedTagName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if gotErr := IsValidTagName(tt.str); gotErr != tt.wantErr {
+				t.Errorf("IsValidTagName() = %v, want %v", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
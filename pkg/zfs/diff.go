@@ -0,0 +1,138 @@
+package zfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pmezard/go-difflib/difflib"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+)
+
+// PaginateDiff returns the page of a diff which opts ask for.
+func PaginateDiff(files []types.ZFSFileDiff, opts types.DiffOptions) []types.ZFSFileDiff {
+	if opts.Offset > 0 {
+		if opts.Offset >= len(files) {
+			return []types.ZFSFileDiff{}
+		}
+		files = files[opts.Offset:]
+	}
+	if opts.Limit > 0 && opts.Limit < len(files) {
+		files = files[:opts.Limit]
+	}
+	return files
+}
+
+// how many diffs between commits are kept
+const commitDiffCacheSize = 16
+
+// commitDiffCache holds whole diffs between pairs of commits, keyed by their
+// two ends. Commits don't change, so paging through a diff can reuse it
+// rather than walking both commits again for every page. The zero value is an
+// empty cache.
+type commitDiffCache struct {
+	mu    sync.Mutex
+	diffs map[string][]types.ZFSFileDiff
+}
+
+func commitDiffKey(fromFilesystemID, fromSnapshotID, toFilesystemID, toSnapshotID string) string {
+	return FullIdWithSnapshot(fromFilesystemID, fromSnapshotID) + ".." + FullIdWithSnapshot(toFilesystemID, toSnapshotID)
+}
+
+func (c *commitDiffCache) get(key string) ([]types.ZFSFileDiff, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files, ok := c.diffs[key]
+	return files, ok
+}
+
+func (c *commitDiffCache) put(key string, files []types.ZFSFileDiff) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.diffs == nil {
+		c.diffs = map[string][]types.ZFSFileDiff{}
+	}
+	if len(c.diffs) >= commitDiffCacheSize {
+		// make room by forgetting any one of them
+		for k := range c.diffs {
+			delete(c.diffs, k)
+			break
+		}
+	}
+	c.diffs[key] = files
+}
+
+// diffPage copies out the page of a diff which opts ask for, so that adding
+// hunks to it leaves a cached diff alone.
+func diffPage(files []types.ZFSFileDiff, opts types.DiffOptions) []types.ZFSFileDiff {
+	page := PaginateDiff(files, opts)
+	return append(make([]types.ZFSFileDiff, 0, len(page)), page...)
+}
+
+// DiffHunks returns the change from one version of a file's contents to
+// another as unified diff hunks, or "" if either is too big or isn't text.
+func DiffHunks(filename string, from, to []byte) (string, error) {
+	for _, contents := range [][]byte{from, to} {
+		if len(contents) > types.MaxHunkFileSize || bytes.IndexByte(contents, 0) != -1 || !utf8.Valid(contents) {
+			return "", nil
+		}
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(string(from)),
+		B:        splitLines(string(to)),
+		FromFile: "a/" + filename,
+		ToFile:   "b/" + filename,
+		Context:  3,
+	})
+}
+
+// splitLines splits text into lines for difflib, each ending in a newline,
+// without the empty line after the last newline that difflib.SplitLines adds.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n"
+	return lines
+}
+
+// addHunks fills in the Hunks of the small regular files in a diff, reading
+// them from under the __default__ subdot of the two roots.
+func addHunks(files []types.ZFSFileDiff, fromRoot, toRoot string) error {
+	for i, f := range files {
+		if !hunkable(f.Old) || !hunkable(f.New) {
+			continue
+		}
+		from, err := readHunkable(f.Old, fromRoot, f.Filename)
+		if err != nil {
+			return err
+		}
+		to, err := readHunkable(f.New, toRoot, f.Filename)
+		if err != nil {
+			return err
+		}
+		files[i].Hunks, err = DiffHunks(f.Filename, from, to)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hunkable says whether one side of a changed file could have hunks; a
+// missing side counts as empty.
+func hunkable(info *types.DiffFileInfo) bool {
+	return info == nil || (info.Type == types.FileTypeFile && info.Size <= types.MaxHunkFileSize)
+}
+
+func readHunkable(info *types.DiffFileInfo, root, filename string) ([]byte, error) {
+	if info == nil {
+		return []byte{}, nil
+	}
+	return ioutil.ReadFile(filepath.Join(root, "__default__", filepath.FromSlash(filename)))
+}
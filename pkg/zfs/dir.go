@@ -0,0 +1,1247 @@
+package zfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+
+	"github.com/dotmesh-io/dotmesh/pkg/metrics"
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/dotmesh-io/dotmesh/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	A storage backend for hosts without ZFS. Each filesystem is a directory
+	under <root>/dmfs/<filesystem id> laid out as:
+
+		data/               the live filesystem, bind mounted into place
+		snapshots/<id>/     a frozen copy of data/ per snapshot
+		snapshots.json      snapshot ids (in creation order) and metadata
+
+	Copies are made with `cp --reflink=auto`, so they share blocks on
+	filesystems which support it (btrfs, xfs) and fall back to full copies
+	elsewhere.
+
+	Send streams are tar archives of whole snapshots (there's no block-level
+	incremental send), preceded by a header describing where the stream
+	starts from and the snapshots it carries. They are only understood by
+	another dir backend.
+*/
+
+var _ ZFS = &dirZFS{}
+
+const (
+	dirDataName          = "data"
+	dirSnapshotsName     = "snapshots"
+	dirSnapshotIndexName = "snapshots.json"
+	dirPoolIdName        = "dotmesh-pool-id"
+	dirRecvName          = "recv"
+	dirStreamHeaderName  = ".dotmesh-stream"
+	dirOriginName        = "origin"
+)
+
+type dirZFS struct {
+	root   string
+	poolId string
+	// indexMu serialises read-modify-write cycles of snapshot index files
+	indexMu sync.Mutex
+	// diffs between commits, for paging through them
+	commitDiffs commitDiffCache
+}
+
+// dirStreamHeader is the first entry in a dir backend send stream.
+type dirStreamHeader struct {
+	// "START", a snapshot id for incremental streams, or
+	// "<filesystem>@<snapshot>" for streams based on a clone origin
+	From      string
+	Snapshots []*types.Snapshot
+}
+
+func NewDirZFS(root string) (ZFS, error) {
+	err := os.MkdirAll(filepath.Join(root, types.RootFS), 0775)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create storage directory %s: %s", root, err)
+	}
+	poolId, err := readOrCreateDirPoolId(filepath.Join(root, dirPoolIdName))
+	if err != nil {
+		return nil, err
+	}
+	return &dirZFS{
+		root:   root,
+		poolId: poolId,
+	}, nil
+}
+
+func readOrCreateDirPoolId(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(contents)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	// same shape as the ZFS pool guid we'd use otherwise
+	b := make([]byte, 8)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	poolId := fmt.Sprintf("%x", b)
+	log.Infof("Did not find %s, will create it and write node id %s to it", path, poolId)
+	err = ioutil.WriteFile(path, []byte(poolId), 0666)
+	if err != nil {
+		return "", err
+	}
+	return poolId, nil
+}
+
+func (d *dirZFS) fsPath(filesystemId string) string {
+	return filepath.Join(d.root, types.RootFS, filesystemId)
+}
+
+func (d *dirZFS) dataPath(filesystemId string) string {
+	return filepath.Join(d.fsPath(filesystemId), dirDataName)
+}
+
+func (d *dirZFS) snapshotPath(filesystemId, snapshotId string) string {
+	return filepath.Join(d.fsPath(filesystemId), dirSnapshotsName, snapshotId)
+}
+
+func (d *dirZFS) indexPath(filesystemId string) string {
+	return filepath.Join(d.fsPath(filesystemId), dirSnapshotIndexName)
+}
+
+func (d *dirZFS) originPath(filesystemId string) string {
+	return filepath.Join(d.fsPath(filesystemId), dirOriginName)
+}
+
+// readOrigin returns the snapshot a filesystem was cloned from, or two empty
+// strings if it isn't a clone.
+func (d *dirZFS) readOrigin(filesystemId string) (string, string, error) {
+	bts, err := ioutil.ReadFile(d.originPath(filesystemId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	shrapnel := strings.SplitN(strings.TrimSpace(string(bts)), "@", 2)
+	if len(shrapnel) != 2 {
+		return "", "", fmt.Errorf("corrupt origin for %s: %q", filesystemId, bts)
+	}
+	return shrapnel[0], shrapnel[1], nil
+}
+
+// writeOrigin records the snapshot a filesystem was cloned from, which
+// nothing else needs here as clones are copies, but which Promote follows as
+// `zfs promote` would. An empty originFilesystemId makes it not a clone.
+func (d *dirZFS) writeOrigin(filesystemId, originFilesystemId, originSnapshotId string) error {
+	if originFilesystemId == "" {
+		err := os.Remove(d.originPath(filesystemId))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return ioutil.WriteFile(
+		d.originPath(filesystemId), []byte(originFilesystemId+"@"+originSnapshotId), 0664,
+	)
+}
+
+func (d *dirZFS) exists(filesystemId string) bool {
+	_, err := os.Stat(d.dataPath(filesystemId))
+	return err == nil
+}
+
+func (d *dirZFS) readIndex(filesystemId string) ([]*types.Snapshot, error) {
+	bts, err := ioutil.ReadFile(d.indexPath(filesystemId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*types.Snapshot{}, nil
+		}
+		return nil, err
+	}
+	snapshots := []*types.Snapshot{}
+	err = json.Unmarshal(bts, &snapshots)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt snapshot index for %s: %s", filesystemId, err)
+	}
+	return snapshots, nil
+}
+
+func (d *dirZFS) writeIndex(filesystemId string, snapshots []*types.Snapshot) error {
+	bts, err := json.Marshal(snapshots)
+	if err != nil {
+		return err
+	}
+	tmp := d.indexPath(filesystemId) + ".tmp"
+	err = ioutil.WriteFile(tmp, bts, 0664)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.indexPath(filesystemId))
+}
+
+// checkSnapshotExists must be called with indexMu held.
+func (d *dirZFS) checkSnapshotExists(filesystemId, snapshotId string) error {
+	snapshots, err := d.readIndex(filesystemId)
+	if err != nil {
+		return err
+	}
+	if snapshotIndex(snapshots, snapshotId) == -1 {
+		return fmt.Errorf("snapshot %s@%s does not exist", filesystemId, snapshotId)
+	}
+	return nil
+}
+
+func snapshotIndex(snapshots []*types.Snapshot, snapshotId string) int {
+	for i, s := range snapshots {
+		if s.Id == snapshotId {
+			return i
+		}
+	}
+	return -1
+}
+
+// copyTree copies the contents of src into dst, sharing blocks where the
+// underlying filesystem allows it.
+func copyTree(src, dst string) error {
+	err := os.MkdirAll(dst, 0775)
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command("cp", "-a", "--reflink=auto", src+"/.", dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %s %s", src, dst, err, out)
+	}
+	return nil
+}
+
+// replaceContents swaps the contents of dst for a copy of src, leaving dst
+// itself in place so that any bind mounts of it stay valid.
+func replaceContents(dst, src string) error {
+	entries, err := ioutil.ReadDir(dst)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = os.RemoveAll(filepath.Join(dst, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return copyTree(src, dst)
+}
+
+func (d *dirZFS) makeFilesystem(filesystemId string) error {
+	err := os.MkdirAll(d.dataPath(filesystemId), 0775)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(d.fsPath(filesystemId), dirSnapshotsName), 0775)
+	if err != nil {
+		return err
+	}
+	return d.writeIndex(filesystemId, []*types.Snapshot{})
+}
+
+func (d *dirZFS) GetPoolID() string {
+	return d.poolId
+}
+
+func (d *dirZFS) GetZPoolCapacity() (float64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(d.root, &stat)
+	if err != nil {
+		return 0, err
+	}
+	if stat.Blocks == 0 {
+		return 0, nil
+	}
+	used := stat.Blocks - stat.Bfree
+	return float64(used) * 100 / float64(used+stat.Bavail), nil
+}
+
+func (d *dirZFS) ReportZpoolCapacity() error {
+	capacity, err := d.GetZPoolCapacity()
+	if err != nil {
+		return err
+	}
+	metrics.ZPoolCapacity.WithLabelValues(d.poolId, d.root).Set(capacity)
+	return nil
+}
+
+func (d *dirZFS) FindFilesystemIdsOnSystem() []string {
+	log.Print("Finding filesystem ids...")
+	entries, err := ioutil.ReadDir(filepath.Join(d.root, types.RootFS))
+	if err != nil {
+		log.Fatalf("%s, while listing %s", err, d.root)
+	}
+	ids := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && d.exists(entry.Name()) {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids
+}
+
+func (d *dirZFS) DeleteFilesystemInZFS(fs string) error {
+	err := clearMounts(fs, "")
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(d.fsPath(fs))
+	if err != nil {
+		return fmt.Errorf("error deleting filesystem %s: %s", fs, err)
+	}
+	return nil
+}
+
+// GetDirtyDelta approximates ZFS's "written@" property as the total size of
+// the files which have been added, changed or removed since the snapshot.
+func (d *dirZFS) GetDirtyDelta(filesystemId, latestSnap string) (int64, int64, error) {
+	current, total, err := dirDiffSide(d.dataPath(filesystemId))
+	if err != nil {
+		return 0, 0, err
+	}
+	previous := DiffSide{}
+	if latestSnap != "" {
+		previous, _, err = dirDiffSide(d.snapshotPath(filesystemId, latestSnap))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	var dirty int64
+	for _, change := range diffSides(previous, current) {
+		side := current
+		if change.Change == types.FileChangeRemoved {
+			side = previous
+		}
+		dirty += side[change.Filename].size
+	}
+	return dirty, total, nil
+}
+
+func (d *dirZFS) Snapshot(filesystemId string, snapshotId string, meta []string) ([]byte, error) {
+	metadata, err := utils.DecodeMetadata(meta)
+	if err != nil {
+		return nil, err
+	}
+	if !d.exists(filesystemId) {
+		return nil, fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+
+	snapshots, err := d.readIndex(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotIndex(snapshots, snapshotId) != -1 {
+		return nil, fmt.Errorf("snapshot %s@%s already exists", filesystemId, snapshotId)
+	}
+	err = copyTree(d.dataPath(filesystemId), d.snapshotPath(filesystemId, snapshotId))
+	if err != nil {
+		os.RemoveAll(d.snapshotPath(filesystemId, snapshotId))
+		return nil, err
+	}
+	snapshots = append(snapshots, &types.Snapshot{Id: snapshotId, Metadata: metadata})
+	return nil, d.writeIndex(filesystemId, snapshots)
+}
+
+func (d *dirZFS) List(filesystemId, snapshotId string) ([]byte, error) {
+	path := d.dataPath(filesystemId)
+	if snapshotId != "" {
+		path = d.snapshotPath(filesystemId, snapshotId)
+	}
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(path + "\n"), nil
+}
+
+func (d *dirZFS) FQ(filesystemId string) string {
+	return d.fsPath(filesystemId)
+}
+
+func (d *dirZFS) DiscoverSystem(fs string) (*types.Filesystem, error) {
+	if !d.exists(fs) {
+		return &types.Filesystem{
+			Id:     fs,
+			Exists: false,
+			// Important not to leave snapshots nil in the default case, we
+			// need to inform other nodes that we have no snapshots of a
+			// filesystem if we don't have the filesystem.
+			Snapshots: []*types.Snapshot{},
+		}, nil
+	}
+
+	mounted, err := utils.IsFilesystemMounted(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	d.indexMu.Lock()
+	snapshots, err := d.readIndex(fs)
+	d.indexMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		if s.Metadata == nil {
+			s.Metadata = map[string]string{}
+		}
+	}
+
+	return &types.Filesystem{
+		Id:        fs,
+		Exists:    true,
+		Mounted:   mounted,
+		Snapshots: snapshots,
+	}, nil
+}
+
+func (d *dirZFS) StashBranch(existingFs string, newFs string, rollbackTo string) error {
+	log.WithFields(log.Fields{
+		"existing_fs": existingFs,
+		"new_fs":      newFs,
+		"rollback_to": rollbackTo,
+	}).Info("stashing branch")
+	err := clearMounts(existingFs, "")
+	if err != nil {
+		return err
+	}
+
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+
+	snapshots, err := d.readIndex(existingFs)
+	if err != nil {
+		return err
+	}
+	idx := snapshotIndex(snapshots, rollbackTo)
+	if idx == -1 {
+		return fmt.Errorf("snapshot %s@%s does not exist", existingFs, rollbackTo)
+	}
+
+	// The same shape as a ZFS rename, clone and promote: the existing
+	// filesystem keeps the snapshots up to rollbackTo, the stash gets the
+	// rest along with the diverged live data.
+	err = os.Rename(d.fsPath(existingFs), d.fsPath(newFs))
+	if err != nil {
+		return fmt.Errorf("rename filesystem %s to %s for retroBranch: %s", existingFs, newFs, err)
+	}
+	err = d.makeFilesystem(existingFs)
+	if err != nil {
+		return err
+	}
+	// the existing filesystem keeps its origin too, and the stash becomes a
+	// clone of it
+	originFs, originSnap, err := d.readOrigin(newFs)
+	if err != nil {
+		return err
+	}
+	err = d.writeOrigin(existingFs, originFs, originSnap)
+	if err != nil {
+		return err
+	}
+	err = d.writeOrigin(newFs, existingFs, rollbackTo)
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots[:idx+1] {
+		err = os.Rename(d.snapshotPath(newFs, s.Id), d.snapshotPath(existingFs, s.Id))
+		if err != nil {
+			return fmt.Errorf("move snapshot %s from %s to %s for retroBranch: %s", s.Id, newFs, existingFs, err)
+		}
+	}
+	err = d.writeIndex(existingFs, snapshots[:idx+1])
+	if err != nil {
+		return err
+	}
+	err = d.writeIndex(newFs, snapshots[idx+1:])
+	if err != nil {
+		return err
+	}
+	return copyTree(d.snapshotPath(existingFs, rollbackTo), d.dataPath(existingFs))
+}
+
+func (d *dirZFS) Clone(filesystemId, originSnapshotId, newCloneFilesystemId string) ([]byte, error) {
+	origin := d.snapshotPath(filesystemId, originSnapshotId)
+	_, err := os.Stat(origin)
+	if err != nil {
+		return nil, fmt.Errorf("origin snapshot %s@%s does not exist: %s", filesystemId, originSnapshotId, err)
+	}
+	if d.exists(newCloneFilesystemId) {
+		return nil, fmt.Errorf("filesystem %s already exists", newCloneFilesystemId)
+	}
+	err = d.makeFilesystem(newCloneFilesystemId)
+	if err != nil {
+		return nil, err
+	}
+	err = d.writeOrigin(newCloneFilesystemId, filesystemId, originSnapshotId)
+	if err != nil {
+		return nil, err
+	}
+	return nil, copyTree(origin, d.dataPath(newCloneFilesystemId))
+}
+
+func (d *dirZFS) Promote(filesystemId, originFilesystemId string) ([]byte, error) {
+	// the origin's snapshots move, so can't stay mounted where they are
+	err := clearMounts(originFilesystemId+"@", "")
+	if err != nil {
+		return nil, err
+	}
+
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+
+	originFs, originSnap, err := d.readOrigin(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+	if originFs != originFilesystemId {
+		return nil, fmt.Errorf("%s is not a clone of %s", filesystemId, originFilesystemId)
+	}
+	originSnapshots, err := d.readIndex(originFs)
+	if err != nil {
+		return nil, err
+	}
+	idx := snapshotIndex(originSnapshots, originSnap)
+	if idx == -1 {
+		return nil, fmt.Errorf("snapshot %s@%s does not exist", originFs, originSnap)
+	}
+	snapshots, err := d.readIndex(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+
+	// The same shape as a ZFS promote: the clone takes the origin's
+	// snapshots up to the one it was cloned from, and the origin's own
+	// origin, while the origin and any other clones of the snapshots which
+	// moved become clones of it.
+	moved := originSnapshots[:idx+1]
+	for _, s := range moved {
+		err = os.Rename(d.snapshotPath(originFs, s.Id), d.snapshotPath(filesystemId, s.Id))
+		if err != nil {
+			return nil, fmt.Errorf("move snapshot %s from %s to %s for promote: %s", s.Id, originFs, filesystemId, err)
+		}
+	}
+	err = d.writeIndex(filesystemId, append(append([]*types.Snapshot{}, moved...), snapshots...))
+	if err != nil {
+		return nil, err
+	}
+	err = d.writeIndex(originFs, originSnapshots[idx+1:])
+	if err != nil {
+		return nil, err
+	}
+	grandFs, grandSnap, err := d.readOrigin(originFs)
+	if err != nil {
+		return nil, err
+	}
+	err = d.writeOrigin(filesystemId, grandFs, grandSnap)
+	if err != nil {
+		return nil, err
+	}
+	err = d.writeOrigin(originFs, filesystemId, originSnap)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range d.FindFilesystemIdsOnSystem() {
+		if id == filesystemId || id == originFs {
+			continue
+		}
+		cloneOf, cloneSnap, err := d.readOrigin(id)
+		if err != nil {
+			return nil, err
+		}
+		if cloneOf == originFs && snapshotIndex(moved, cloneSnap) != -1 {
+			err = d.writeOrigin(id, filesystemId, cloneSnap)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (d *dirZFS) DestroySnapshot(filesystemId, snapshotId string) ([]byte, error) {
+	err := clearMounts(filesystemId+"@"+snapshotId, "")
+	if err != nil {
+		return nil, err
+	}
+
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+
+	snapshots, err := d.readIndex(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+	idx := snapshotIndex(snapshots, snapshotId)
+	if idx == -1 {
+		return nil, fmt.Errorf("snapshot %s@%s does not exist", filesystemId, snapshotId)
+	}
+	// clones are copies here, so unlike zfs nothing stops the origin of one
+	// going
+	err = os.RemoveAll(d.snapshotPath(filesystemId, snapshotId))
+	if err != nil {
+		return nil, err
+	}
+	return nil, d.writeIndex(filesystemId, append(snapshots[:idx], snapshots[idx+1:]...))
+}
+
+func (d *dirZFS) Rollback(filesystemId, snapshotId string) ([]byte, error) {
+	// only clear mounts of snapshots, the live data is replaced in place
+	err := clearMounts(filesystemId+"@", "")
+	if err != nil {
+		return nil, err
+	}
+
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+
+	snapshots, err := d.readIndex(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+	idx := snapshotIndex(snapshots, snapshotId)
+	if idx == -1 {
+		return nil, fmt.Errorf("snapshot %s@%s does not exist", filesystemId, snapshotId)
+	}
+	for _, s := range snapshots[idx+1:] {
+		err = os.RemoveAll(d.snapshotPath(filesystemId, s.Id))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = d.writeIndex(filesystemId, snapshots[:idx+1])
+	if err != nil {
+		return nil, err
+	}
+	return nil, replaceContents(d.dataPath(filesystemId), d.snapshotPath(filesystemId, snapshotId))
+}
+
+func (d *dirZFS) Revert(filesystemId, snapshotId string) ([]byte, error) {
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+
+	err := d.checkSnapshotExists(filesystemId, snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	return nil, replaceContents(d.dataPath(filesystemId), d.snapshotPath(filesystemId, snapshotId))
+}
+
+func (d *dirZFS) Create(filesystemId string) ([]byte, error) {
+	if d.exists(filesystemId) {
+		return nil, fmt.Errorf("filesystem %s already exists", filesystemId)
+	}
+	return nil, d.makeFilesystem(filesystemId)
+}
+
+// streamSnapshots works out which snapshots of toFilesystemId a send stream
+// starting at from and ending at toSnapshotId carries.
+func (d *dirZFS) streamSnapshots(from, toFilesystemId, toSnapshotId string) ([]*types.Snapshot, error) {
+	d.indexMu.Lock()
+	snapshots, err := d.readIndex(toFilesystemId)
+	d.indexMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	toIdx := snapshotIndex(snapshots, toSnapshotId)
+	if toIdx == -1 {
+		return nil, fmt.Errorf("snapshot %s@%s does not exist", toFilesystemId, toSnapshotId)
+	}
+	if from == "START" || strings.Contains(from, "@") {
+		return snapshots[:toIdx+1], nil
+	}
+	fromIdx := snapshotIndex(snapshots, from)
+	if fromIdx == -1 {
+		return nil, fmt.Errorf("incremental source %s@%s does not exist", toFilesystemId, from)
+	}
+	if fromIdx > toIdx {
+		return nil, fmt.Errorf("incremental source %s is newer than %s", from, toSnapshotId)
+	}
+	return snapshots[fromIdx+1 : toIdx+1], nil
+}
+
+func streamFrom(fromFilesystemId, fromSnapshotId string) string {
+	if fromSnapshotId == "" {
+		return "START"
+	}
+	return fromSnapshotId
+}
+
+// PredictSize returns the size of the tar stream, which compresses on the
+// wire by an amount we can't guess at, so Wire is the same as Raw.
+func (d *dirZFS) PredictSize(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string) (*types.PredictedSize, error) {
+	snapshots, err := d.streamSnapshots(streamFrom(fromFilesystemId, fromSnapshotId), toFilesystemId, toSnapshotId)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for _, s := range snapshots {
+		err := filepath.Walk(d.snapshotPath(toFilesystemId, s.Id), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// tar header plus contents, rounded up to the tar block size
+			size += 512 + (info.Size()+511)/512*512
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &types.PredictedSize{Raw: size, Wire: size}, nil
+}
+
+// PredictResumeSize always fails, as interrupted receives leave nothing
+// behind to resume from, see ReceiveResumeToken.
+func (d *dirZFS) PredictResumeSize(resumeToken string) (int64, error) {
+	return 0, fmt.Errorf("the dir backend cannot resume interrupted receives")
+}
+
+// Send ignores opts.Compressed, tar streams are only ever compressed on the
+// wire.
+func (d *dirZFS) Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, opts SendOptions, preludeEncoded []byte) (*io.PipeReader, chan error) {
+	log.WithFields(log.Fields{
+		"fromFilesystemId": fromFilesystemId,
+		"fromSnapshotId":   fromSnapshotId,
+		"toFilesystemId":   toFilesystemId,
+		"toSnapshotId":     toSnapshotId,
+	}).Debug("dirZFS.Send() starting")
+	pipeReader, pipeWriter := io.Pipe()
+	errch := make(chan error)
+	go func() {
+		from := streamFrom(fromFilesystemId, fromSnapshotId)
+		err := func() error {
+			if opts.ResumeToken != "" {
+				return fmt.Errorf("the dir backend cannot resume interrupted receives")
+			}
+			snapshots, err := d.streamSnapshots(from, toFilesystemId, toSnapshotId)
+			if err != nil {
+				return err
+			}
+			_, err = pipeWriter.Write(preludeEncoded)
+			if err != nil {
+				return fmt.Errorf("error writing prelude: %s", err)
+			}
+			return d.writeStream(pipeWriter, toFilesystemId, &dirStreamHeader{From: from, Snapshots: snapshots})
+		}()
+		if err != nil {
+			log.Errorf("[dirZFS.Send:%s] error sending %s => %s: %s", toFilesystemId, from, toSnapshotId, err)
+			pipeWriter.CloseWithError(err)
+		} else {
+			pipeWriter.Close()
+		}
+		errch <- err
+	}()
+	return pipeReader, errch
+}
+
+func (d *dirZFS) writeStream(w io.Writer, filesystemId string, header *dirStreamHeader) error {
+	tw := tar.NewWriter(w)
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:     dirStreamHeaderName,
+		Mode:     0644,
+		Size:     int64(len(headerBytes)),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(headerBytes)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range header.Snapshots {
+		root := d.snapshotPath(filesystemId, s.Id)
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				link, err = os.Readlink(path)
+				if err != nil {
+					return err
+				}
+			}
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(filepath.Join(s.Id, rel))
+			if info.IsDir() {
+				hdr.Name += "/"
+			}
+			err = tw.WriteHeader(hdr)
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (d *dirZFS) Recv(pipeReader *io.PipeReader, toFilesystemId string, errBuffer *bytes.Buffer) error {
+	if errBuffer == nil {
+		errBuffer = &bytes.Buffer{}
+	}
+	err := d.recv(pipeReader, toFilesystemId)
+	if err != nil {
+		fmt.Fprintf(errBuffer, "cannot receive: %s\n", err)
+		log.Errorf("[dirZFS.Recv:%s] %s", toFilesystemId, err)
+	}
+	return err
+}
+
+func (d *dirZFS) CompressedStreams() bool {
+	return false
+}
+
+// ReceiveResumeToken always returns "": a receive is unpacked into a staging
+// directory which is thrown away if the stream is cut short.
+func (d *dirZFS) ReceiveResumeToken(filesystemId string) (string, error) {
+	return "", nil
+}
+
+func (d *dirZFS) AbortReceive(filesystemId string) error {
+	return nil
+}
+
+func (d *dirZFS) recv(r io.Reader, toFilesystemId string) error {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("error reading stream header: %s", err)
+	}
+	if hdr.Name != dirStreamHeaderName {
+		return fmt.Errorf("invalid stream, expected %s but got %s", dirStreamHeaderName, hdr.Name)
+	}
+	var header dirStreamHeader
+	err = json.NewDecoder(tr).Decode(&header)
+	if err != nil {
+		return fmt.Errorf("error decoding stream header: %s", err)
+	}
+
+	err = d.checkRecvDestination(toFilesystemId, header.From)
+	if err != nil {
+		return err
+	}
+
+	staging := filepath.Join(d.root, dirRecvName, toFilesystemId)
+	err = os.RemoveAll(staging)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	err = extractTar(tr, staging)
+	if err != nil {
+		return err
+	}
+	for _, s := range header.Snapshots {
+		_, err := os.Stat(filepath.Join(staging, s.Id))
+		if err != nil {
+			return fmt.Errorf("stream is missing snapshot %s", s.Id)
+		}
+	}
+
+	if header.From == "START" {
+		if !d.exists(toFilesystemId) {
+			err = d.makeFilesystem(toFilesystemId)
+		}
+	} else if strings.Contains(header.From, "@") {
+		shrapnel := strings.SplitN(header.From, "@", 2)
+		_, err = d.Clone(shrapnel[0], shrapnel[1], toFilesystemId)
+	}
+	if err != nil {
+		return err
+	}
+
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+
+	snapshots, err := d.readIndex(toFilesystemId)
+	if err != nil {
+		return err
+	}
+	for _, s := range header.Snapshots {
+		err = os.Rename(filepath.Join(staging, s.Id), d.snapshotPath(toFilesystemId, s.Id))
+		if err != nil {
+			return err
+		}
+		snapshots = append(snapshots, s)
+	}
+	err = d.writeIndex(toFilesystemId, snapshots)
+	if err != nil {
+		return err
+	}
+	if len(header.Snapshots) == 0 {
+		return nil
+	}
+	latest := header.Snapshots[len(header.Snapshots)-1].Id
+	return replaceContents(d.dataPath(toFilesystemId), d.snapshotPath(toFilesystemId, latest))
+}
+
+// checkRecvDestination refuses the same receives that `zfs recv` would.
+func (d *dirZFS) checkRecvDestination(toFilesystemId, from string) error {
+	exists := d.exists(toFilesystemId)
+	if from == "START" || strings.Contains(from, "@") {
+		if !exists {
+			return nil
+		}
+		snapshots, err := d.readIndex(toFilesystemId)
+		if err != nil {
+			return err
+		}
+		if len(snapshots) > 0 || strings.Contains(from, "@") {
+			return fmt.Errorf("destination '%s' exists", toFilesystemId)
+		}
+		return nil
+	}
+	if !exists {
+		return fmt.Errorf("destination '%s' does not exist", toFilesystemId)
+	}
+	snapshots, err := d.readIndex(toFilesystemId)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 || snapshots[len(snapshots)-1].Id != from {
+		return fmt.Errorf("most recent snapshot of %s does not match incremental source", toFilesystemId)
+	}
+	dirty, _, err := d.GetDirtyDelta(toFilesystemId, from)
+	if err != nil {
+		return err
+	}
+	if dirty > 0 {
+		return fmt.Errorf("destination %s has been modified since most recent snapshot", toFilesystemId)
+	}
+	return nil
+}
+
+func extractTar(tr *tar.Reader, dst string) error {
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	// directory mtimes are set last, as writing their contents changes them
+	dirTimes := []dirTime{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading stream: %s", err)
+		}
+		path, err := securejoin.SecureJoin(dst, hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0775)
+			if err == nil {
+				err = os.Chmod(path, mode)
+			}
+			dirTimes = append(dirTimes, dirTime{path, hdr.ModTime})
+		case tar.TypeReg, tar.TypeRegA:
+			err = func() error {
+				f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				_, err = io.Copy(f, tr)
+				return err
+			}()
+			if err == nil {
+				err = os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+			}
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, path)
+		default:
+			log.Warnf("[extractTar] skipping %s of unsupported type %c", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return fmt.Errorf("error extracting %s: %s", hdr.Name, err)
+		}
+	}
+	for i := len(dirTimes) - 1; i >= 0; i-- {
+		err := os.Chtimes(dirTimes[i].path, dirTimes[i].mtime, dirTimes[i].mtime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dirZFS) ApplyPrelude(prelude types.Prelude, fs string) error {
+	if len(prelude.SnapshotProperties) == 0 {
+		return nil
+	}
+
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+
+	snapshots, err := d.readIndex(fs)
+	if err != nil {
+		return err
+	}
+	for _, j := range prelude.SnapshotProperties {
+		idx := snapshotIndex(snapshots, j.Id)
+		if idx == -1 {
+			return fmt.Errorf("Error applying prelude: no snapshot %s@%s", fs, j.Id)
+		}
+		if snapshots[idx].Metadata == nil {
+			snapshots[idx].Metadata = map[string]string{}
+		}
+		for k, v := range j.Metadata {
+			snapshots[idx].Metadata[k] = v
+		}
+	}
+	return d.writeIndex(fs, snapshots)
+}
+
+func (d *dirZFS) SetCanmount(filesystemId, snapshotId string) ([]byte, error) {
+	// nothing to do, directories are only ever mounted explicitly
+	return nil, nil
+}
+
+func (d *dirZFS) Mount(filesystemId, snapshotId string, options string, mountPath string) ([]byte, error) {
+	src := d.dataPath(filesystemId)
+	if snapshotId != "" {
+		src = d.snapshotPath(filesystemId, snapshotId)
+	}
+	err := os.MkdirAll(mountPath, 0775)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":         err,
+			"filesystem_id": FullIdWithSnapshot(filesystemId, snapshotId),
+			"mountpath":     mountPath,
+		}).Error("error while trying to create a directory")
+		return nil, err
+	}
+	output, err := exec.Command("mount", "--bind", src, mountPath).CombinedOutput()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":         err,
+			"filesystem_id": FullIdWithSnapshot(filesystemId, snapshotId),
+			"mountpath":     mountPath,
+			"output":        string(output),
+		}).Error("error while trying to bind mount")
+		return output, err
+	}
+	if options == "" {
+		return output, nil
+	}
+	// bind mounts ignore most options on the initial mount, so apply them
+	// with a remount
+	return exec.Command("mount", "-o", "remount,bind,"+options, mountPath).CombinedOutput()
+}
+
+func (d *dirZFS) Fork(filesystemId, latestSnapshot, forkFilesystemId string) error {
+	d.indexMu.Lock()
+	snapshots, err := d.readIndex(filesystemId)
+	d.indexMu.Unlock()
+	if err != nil {
+		return err
+	}
+	idx := snapshotIndex(snapshots, latestSnapshot)
+	if idx == -1 {
+		return fmt.Errorf("snapshot %s@%s does not exist", filesystemId, latestSnapshot)
+	}
+	err = d.makeFilesystem(forkFilesystemId)
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots[:idx+1] {
+		err = copyTree(d.snapshotPath(filesystemId, s.Id), d.snapshotPath(forkFilesystemId, s.Id))
+		if err != nil {
+			return err
+		}
+	}
+	err = d.writeIndex(forkFilesystemId, snapshots[:idx+1])
+	if err != nil {
+		return err
+	}
+	return copyTree(d.snapshotPath(filesystemId, latestSnapshot), d.dataPath(forkFilesystemId))
+}
+
+// dirDiffSide lists the files under root in the same form as the find(1)
+// listing used by the ZFS backend, also returning their total size.
+func dirDiffSide(root string) (DiffSide, int64, error) {
+	ds := DiffSide{}
+	var total int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		total += info.Size()
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		size := info.Size()
+		if info.IsDir() {
+			// directory sizes depend on their history rather than their
+			// contents, and a copy won't match the original
+			size = 0
+		}
+		ds[filepath.ToSlash(rel)] = DiffResult{
+			mtime: info.ModTime().UnixNano(),
+			size:  size,
+			mode:  info.Mode(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return ds, total, nil
+}
+
+func (d *dirZFS) Diff(filesystemID string) ([]types.ZFSFileDiff, error) {
+	d.indexMu.Lock()
+	snapshots, err := d.readIndex(filesystemID)
+	d.indexMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("cannot diff against a filesystem with no snapshots")
+	}
+	snapshot := snapshots[len(snapshots)-1].Id
+
+	mapLatest, _, err := dirDiffSide(filepath.Join(d.snapshotPath(filesystemID, snapshot), "__default__"))
+	if err != nil {
+		log.WithError(err).Error("[diff] getting latest files")
+		return nil, err
+	}
+	mapTmp, _, err := dirDiffSide(filepath.Join(d.dataPath(filesystemID), "__default__"))
+	if err != nil {
+		log.WithError(err).Error("[diff] getting current files")
+		return nil, err
+	}
+	return diffSides(mapLatest, mapTmp), nil
+}
+
+func (d *dirZFS) DiffSnapshots(fromFilesystemID, fromSnapshotID, toFilesystemID, toSnapshotID string, opts types.DiffOptions) ([]types.ZFSFileDiff, int, error) {
+	d.indexMu.Lock()
+	err := d.checkSnapshotExists(fromFilesystemID, fromSnapshotID)
+	if err == nil && toSnapshotID != "" {
+		err = d.checkSnapshotExists(toFilesystemID, toSnapshotID)
+	}
+	d.indexMu.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fromPath := d.snapshotPath(fromFilesystemID, fromSnapshotID)
+	toPath := d.dataPath(toFilesystemID)
+	var files []types.ZFSFileDiff
+	cached := false
+	key := ""
+	if toSnapshotID != "" {
+		toPath = d.snapshotPath(toFilesystemID, toSnapshotID)
+		key = commitDiffKey(fromFilesystemID, fromSnapshotID, toFilesystemID, toSnapshotID)
+		files, cached = d.commitDiffs.get(key)
+	}
+	if !cached {
+		mapFrom, _, err := dirDiffSide(filepath.Join(fromPath, "__default__"))
+		if err != nil {
+			return nil, 0, err
+		}
+		mapTo, _, err := dirDiffSide(filepath.Join(toPath, "__default__"))
+		if err != nil {
+			return nil, 0, err
+		}
+		files = diffSides(mapFrom, mapTo)
+		if key != "" {
+			d.commitDiffs.put(key, files)
+		}
+	}
+	page := diffPage(files, opts)
+	if opts.Hunks {
+		err = addHunks(page, fromPath, toPath)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return page, len(files), nil
+}
+
+// LastModified returns the time of the most recent change to the live
+// filesystem.
+func (d *dirZFS) LastModified(filesystemID string) (*types.LastModified, error) {
+	var latest time.Time
+	err := filepath.Walk(d.dataPath(filesystemID), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &types.LastModified{
+		Time: latest.UTC().Truncate(time.Second),
+	}, nil
+}
+
+func (d *dirZFS) DestroyTmpSnapIfExists(filesystemId string) error {
+	// Diff works on the live directory, there's never a tmp snapshot
+	return nil
+}
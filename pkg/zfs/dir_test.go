@@ -0,0 +1,608 @@
+package zfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/dotmesh-io/dotmesh/pkg/utils"
+)
+
+func newTestDirZFS(t *testing.T) (*dirZFS, cleanupFunc) {
+	root, err := ioutil.TempDir("", "dirzfs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	os.Setenv("MOUNT_PREFIX", filepath.Join(root, "mnt"))
+	z, err := NewDirZFS(root)
+	if err != nil {
+		t.Fatalf("failed to create dir backend: %s", err)
+	}
+	return z.(*dirZFS), func() { os.RemoveAll(root) }
+}
+
+func writeDefaultFile(t *testing.T, z *dirZFS, fs, name, contents string) {
+	dir := filepath.Join(z.dataPath(fs), "__default__")
+	err := os.MkdirAll(dir, 0775)
+	if err != nil {
+		t.Fatalf("failed to create __default__: %s", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s", name, err)
+	}
+}
+
+// withoutFileInfo returns just the changes and filenames of a diff.
+func withoutFileInfo(changes []types.ZFSFileDiff) []types.ZFSFileDiff {
+	result := []types.ZFSFileDiff{}
+	for _, c := range changes {
+		result = append(result, types.ZFSFileDiff{Change: c.Change, Filename: c.Filename})
+	}
+	return result
+}
+
+func readDefaultFile(t *testing.T, z *dirZFS, fs, name string) string {
+	bts, err := ioutil.ReadFile(filepath.Join(z.dataPath(fs), "__default__", name))
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", name, err)
+	}
+	return string(bts)
+}
+
+func mustSnapshot(t *testing.T, z *dirZFS, fs, snap string, meta map[string]string) {
+	encoded, err := utils.EncodeMetadata(meta)
+	if err != nil {
+		t.Fatalf("failed to encode metadata: %s", err)
+	}
+	_, err = z.Snapshot(fs, snap, encoded)
+	if err != nil {
+		t.Fatalf("failed to snapshot %s@%s: %s", fs, snap, err)
+	}
+}
+
+func snapshotIds(t *testing.T, z *dirZFS, fs string) []string {
+	filesystem, err := z.DiscoverSystem(fs)
+	if err != nil {
+		t.Fatalf("failed to discover %s: %s", fs, err)
+	}
+	ids := []string{}
+	for _, s := range filesystem.Snapshots {
+		ids = append(ids, s.Id)
+	}
+	return ids
+}
+
+func TestDirSnapshotAndRollback(t *testing.T) {
+	z, cleanup := newTestDirZFS(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create: %s", err)
+	}
+	writeDefaultFile(t, z, "fs", "hello", "one")
+	mustSnapshot(t, z, "fs", "snap1", map[string]string{"message": "first"})
+	writeDefaultFile(t, z, "fs", "hello", "two")
+	mustSnapshot(t, z, "fs", "snap2", nil)
+	writeDefaultFile(t, z, "fs", "hello", "three")
+
+	filesystem, err := z.DiscoverSystem("fs")
+	if err != nil {
+		t.Fatalf("failed to discover: %s", err)
+	}
+	if !filesystem.Exists || len(filesystem.Snapshots) != 2 {
+		t.Fatalf("unexpected filesystem: %#v", filesystem)
+	}
+	if filesystem.Snapshots[0].Metadata["message"] != "first" {
+		t.Errorf("metadata not recorded: %#v", filesystem.Snapshots[0].Metadata)
+	}
+
+	_, err = z.Rollback("fs", "snap1")
+	if err != nil {
+		t.Fatalf("failed to roll back: %s", err)
+	}
+	if got := readDefaultFile(t, z, "fs", "hello"); got != "one" {
+		t.Errorf("expected rolled back contents 'one', got '%s'", got)
+	}
+	if ids := snapshotIds(t, z, "fs"); !reflect.DeepEqual(ids, []string{"snap1"}) {
+		t.Errorf("expected only snap1 after rollback, got %v", ids)
+	}
+}
+
+func TestDirRevert(t *testing.T) {
+	z, cleanup := newTestDirZFS(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create: %s", err)
+	}
+	writeDefaultFile(t, z, "fs", "hello", "one")
+	mustSnapshot(t, z, "fs", "snap1", nil)
+	writeDefaultFile(t, z, "fs", "hello", "two")
+	writeDefaultFile(t, z, "fs", "extra", "added later")
+	mustSnapshot(t, z, "fs", "snap2", nil)
+
+	_, err = z.Revert("fs", "snap1")
+	if err != nil {
+		t.Fatalf("failed to revert: %s", err)
+	}
+	if got := readDefaultFile(t, z, "fs", "hello"); got != "one" {
+		t.Errorf("expected reverted contents 'one', got '%s'", got)
+	}
+	_, err = os.Stat(filepath.Join(z.dataPath("fs"), "__default__", "extra"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the file added after snap1 to be gone, got %v", err)
+	}
+	if ids := snapshotIds(t, z, "fs"); !reflect.DeepEqual(ids, []string{"snap1", "snap2"}) {
+		t.Errorf("expected both snapshots to be kept, got %v", ids)
+	}
+
+	_, err = z.Revert("fs", "nonexistent")
+	if err == nil {
+		t.Errorf("expected reverting to a missing snapshot to fail")
+	}
+}
+
+func TestDirDestroySnapshot(t *testing.T) {
+	z, cleanup := newTestDirZFS(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create: %s", err)
+	}
+	for _, snap := range []string{"snap1", "snap2", "snap3"} {
+		writeDefaultFile(t, z, "fs", "hello", snap)
+		mustSnapshot(t, z, "fs", snap, nil)
+	}
+
+	_, err = z.DestroySnapshot("fs", "snap2")
+	if err != nil {
+		t.Fatalf("failed to destroy snapshot: %s", err)
+	}
+	if ids := snapshotIds(t, z, "fs"); !reflect.DeepEqual(ids, []string{"snap1", "snap3"}) {
+		t.Errorf("expected snap1 and snap3 to be left, got %v", ids)
+	}
+	if got := readDefaultFile(t, z, "fs", "hello"); got != "snap3" {
+		t.Errorf("expected live contents 'snap3', got '%s'", got)
+	}
+	_, err = z.DestroySnapshot("fs", "snap2")
+	if err == nil {
+		t.Errorf("expected an error destroying a snapshot twice")
+	}
+}
+
+func TestDirDirtyDeltaAndDiff(t *testing.T) {
+	z, cleanup := newTestDirZFS(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create: %s", err)
+	}
+	writeDefaultFile(t, z, "fs", "a", "aaaa")
+	writeDefaultFile(t, z, "fs", "b", "bbbb")
+	mustSnapshot(t, z, "fs", "snap1", nil)
+
+	dirty, _, err := z.GetDirtyDelta("fs", "snap1")
+	if err != nil {
+		t.Fatalf("failed to get dirty delta: %s", err)
+	}
+	if dirty != 0 {
+		t.Errorf("expected clean filesystem, got %d dirty bytes", dirty)
+	}
+	changes, err := z.Diff("fs")
+	if err != nil {
+		t.Fatalf("failed to diff: %s", err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected no changes, got %#v", changes)
+	}
+
+	os.Remove(filepath.Join(z.dataPath("fs"), "__default__", "b"))
+	writeDefaultFile(t, z, "fs", "c", "cc")
+
+	dirty, _, err = z.GetDirtyDelta("fs", "snap1")
+	if err != nil {
+		t.Fatalf("failed to get dirty delta: %s", err)
+	}
+	if dirty == 0 {
+		t.Errorf("expected dirty filesystem")
+	}
+	changes, err = z.Diff("fs")
+	if err != nil {
+		t.Fatalf("failed to diff: %s", err)
+	}
+	expected := []types.ZFSFileDiff{
+		{Change: types.FileChangeRemoved, Filename: "b"},
+		{Change: types.FileChangeAdded, Filename: "c"},
+	}
+	if !reflect.DeepEqual(withoutFileInfo(changes), expected) {
+		t.Errorf("wrong changes: %#v != %#v", changes, expected)
+	}
+}
+
+func TestDirDiffSnapshots(t *testing.T) {
+	z, cleanup := newTestDirZFS(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create: %s", err)
+	}
+	writeDefaultFile(t, z, "fs", "a", "aaaa")
+	writeDefaultFile(t, z, "fs", "b", "bbbb")
+	mustSnapshot(t, z, "fs", "snap1", nil)
+	writeDefaultFile(t, z, "fs", "a", "aaaaaa")
+	mustSnapshot(t, z, "fs", "snap2", nil)
+
+	changes, _, err := z.DiffSnapshots("fs", "snap1", "fs", "snap2", types.DiffOptions{})
+	if err != nil {
+		t.Fatalf("failed to diff: %s", err)
+	}
+	expected := []types.ZFSFileDiff{
+		{Change: types.FileChangeModified, Filename: "a"},
+	}
+	if !reflect.DeepEqual(withoutFileInfo(changes), expected) {
+		t.Errorf("wrong changes: %#v != %#v", changes, expected)
+	}
+
+	// a branch compared with the commit it was made from
+	_, err = z.Clone("fs", "snap1", "clone")
+	if err != nil {
+		t.Fatalf("failed to clone: %s", err)
+	}
+	os.Remove(filepath.Join(z.dataPath("clone"), "__default__", "b"))
+	writeDefaultFile(t, z, "clone", "c", "cc")
+	mustSnapshot(t, z, "clone", "snap3", nil)
+
+	changes, _, err = z.DiffSnapshots("fs", "snap1", "clone", "snap3", types.DiffOptions{})
+	if err != nil {
+		t.Fatalf("failed to diff: %s", err)
+	}
+	expected = []types.ZFSFileDiff{
+		{Change: types.FileChangeRemoved, Filename: "b"},
+		{Change: types.FileChangeAdded, Filename: "c"},
+	}
+	if !reflect.DeepEqual(withoutFileInfo(changes), expected) {
+		t.Errorf("wrong changes: %#v != %#v", changes, expected)
+	}
+
+	// and with its uncommitted changes
+	writeDefaultFile(t, z, "clone", "d", "dd")
+	changes, _, err = z.DiffSnapshots("clone", "snap3", "clone", "", types.DiffOptions{})
+	if err != nil {
+		t.Fatalf("failed to diff: %s", err)
+	}
+	expected = []types.ZFSFileDiff{
+		{Change: types.FileChangeAdded, Filename: "d"},
+	}
+	if !reflect.DeepEqual(withoutFileInfo(changes), expected) {
+		t.Errorf("wrong changes: %#v != %#v", changes, expected)
+	}
+
+	_, _, err = z.DiffSnapshots("fs", "nope", "clone", "", types.DiffOptions{})
+	if err == nil {
+		t.Errorf("expected an error diffing a missing snapshot")
+	}
+}
+
+func TestDirDiffDetails(t *testing.T) {
+	z, cleanup := newTestDirZFS(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create: %s", err)
+	}
+	writeDefaultFile(t, z, "fs", "config.yaml", "host: db\nport: 5432\n")
+	writeDefaultFile(t, z, "fs", "data.bin", "\x00\x01")
+	writeDefaultFile(t, z, "fs", "old.txt", "bye\n")
+	mustSnapshot(t, z, "fs", "snap1", nil)
+	writeDefaultFile(t, z, "fs", "config.yaml", "host: db\nport: 5433\n")
+	writeDefaultFile(t, z, "fs", "data.bin", "\x00\x02\x03")
+	writeDefaultFile(t, z, "fs", "new.txt", "hi\n")
+	err = os.Chmod(filepath.Join(z.dataPath("fs"), "__default__", "new.txt"), 0600)
+	if err != nil {
+		t.Fatalf("failed to chmod: %s", err)
+	}
+	os.Remove(filepath.Join(z.dataPath("fs"), "__default__", "old.txt"))
+
+	changes, total, err := z.DiffSnapshots("fs", "snap1", "fs", "", types.DiffOptions{Hunks: true})
+	if err != nil {
+		t.Fatalf("failed to diff: %s", err)
+	}
+	if total != 4 || len(changes) != 4 {
+		t.Fatalf("expected 4 changes, got %d: %#v", total, changes)
+	}
+	byName := map[string]types.ZFSFileDiff{}
+	for _, c := range changes {
+		byName[c.Filename] = c
+	}
+
+	config := byName["config.yaml"]
+	if config.Old == nil || config.New == nil || config.Old.Size != 20 || config.New.Type != types.FileTypeFile {
+		t.Errorf("wrong file info for config.yaml: %#v", config)
+	}
+	expectedHunks := "--- a/config.yaml\n+++ b/config.yaml\n@@ -1,2 +1,2 @@\n host: db\n-port: 5432\n+port: 5433\n"
+	if config.Hunks != expectedHunks {
+		t.Errorf("wrong hunks for config.yaml: %q != %q", config.Hunks, expectedHunks)
+	}
+	if bin := byName["data.bin"]; bin.Hunks != "" || bin.New.Size != 3 {
+		t.Errorf("expected no hunks for a binary file, got %#v", bin)
+	}
+	if added := byName["new.txt"]; added.Old != nil || added.New.Mode != 0600 || added.Hunks == "" {
+		t.Errorf("wrong details for an added file: %#v", added)
+	}
+	if removed := byName["old.txt"]; removed.New != nil || removed.Old.Size != 4 {
+		t.Errorf("wrong details for a removed file: %#v", removed)
+	}
+
+	// a page at a time, without hunks unless asked for
+	changes, total, err = z.DiffSnapshots("fs", "snap1", "fs", "", types.DiffOptions{Offset: 1, Limit: 2})
+	if err != nil {
+		t.Fatalf("failed to diff: %s", err)
+	}
+	expected := []types.ZFSFileDiff{
+		{Change: types.FileChangeModified, Filename: "data.bin"},
+		{Change: types.FileChangeAdded, Filename: "new.txt"},
+	}
+	if total != 4 || !reflect.DeepEqual(withoutFileInfo(changes), expected) {
+		t.Errorf("wrong page of %d changes: %#v", total, changes)
+	}
+	if changes[1].Hunks != "" {
+		t.Errorf("expected no hunks, got %q", changes[1].Hunks)
+	}
+}
+
+func TestDirDiffSnapshotsPagesFromCache(t *testing.T) {
+	z, cleanup := newTestDirZFS(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create: %s", err)
+	}
+	mustSnapshot(t, z, "fs", "snap1", nil)
+	writeDefaultFile(t, z, "fs", "a", "aaaa\n")
+	writeDefaultFile(t, z, "fs", "b", "bbbb\n")
+	writeDefaultFile(t, z, "fs", "c", "cccc\n")
+	mustSnapshot(t, z, "fs", "snap2", nil)
+
+	changes, total, err := z.DiffSnapshots("fs", "snap1", "fs", "snap2", types.DiffOptions{Limit: 1, Hunks: true})
+	if err != nil {
+		t.Fatalf("failed to diff: %s", err)
+	}
+	if total != 3 || len(changes) != 1 || changes[0].Filename != "a" || changes[0].Hunks == "" {
+		t.Fatalf("wrong first page of %d changes: %#v", total, changes)
+	}
+
+	// later pages come from the diff worked out for the first, so changing
+	// what's under a commit behind the backend's back isn't noticed
+	os.Remove(filepath.Join(z.snapshotPath("fs", "snap2"), "__default__", "c"))
+	changes, total, err = z.DiffSnapshots("fs", "snap1", "fs", "snap2", types.DiffOptions{Offset: 1, Limit: 2})
+	if err != nil {
+		t.Fatalf("failed to diff: %s", err)
+	}
+	expected := []types.ZFSFileDiff{
+		{Change: types.FileChangeAdded, Filename: "b"},
+		{Change: types.FileChangeAdded, Filename: "c"},
+	}
+	if total != 3 || !reflect.DeepEqual(withoutFileInfo(changes), expected) {
+		t.Errorf("wrong second page of %d changes: %#v", total, changes)
+	}
+
+	// and hunks added to one page aren't kept in the cache
+	changes, _, err = z.DiffSnapshots("fs", "snap1", "fs", "snap2", types.DiffOptions{Limit: 1})
+	if err != nil {
+		t.Fatalf("failed to diff: %s", err)
+	}
+	if changes[0].Hunks != "" {
+		t.Errorf("expected no hunks, got %q", changes[0].Hunks)
+	}
+}
+
+func sendAndReceive(t *testing.T, from *dirZFS, to *dirZFS, fromSnap, fs, toSnap string) error {
+	reader, errch := from.Send("", fromSnap, fs, toSnap, SendOptions{}, []byte{})
+	errBuffer := &bytes.Buffer{}
+	err := to.Recv(reader, fs, errBuffer)
+	reader.Close()
+	sendErr := <-errch
+	if err != nil {
+		return err
+	}
+	if sendErr != nil {
+		t.Fatalf("send failed: %s", sendErr)
+	}
+	return nil
+}
+
+func TestDirSendRecv(t *testing.T) {
+	src, cleanupSrc := newTestDirZFS(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTestDirZFS(t)
+	defer cleanupDst()
+
+	_, err := src.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create: %s", err)
+	}
+	writeDefaultFile(t, src, "fs", "hello", "one")
+	mustSnapshot(t, src, "fs", "snap1", map[string]string{"message": "first"})
+	writeDefaultFile(t, src, "fs", "hello", "two")
+	mustSnapshot(t, src, "fs", "snap2", nil)
+
+	// full stream
+	err = sendAndReceive(t, src, dst, "START", "fs", "snap1")
+	if err != nil {
+		t.Fatalf("failed to receive full stream: %s", err)
+	}
+	if got := readDefaultFile(t, dst, "fs", "hello"); got != "one" {
+		t.Errorf("expected 'one', got '%s'", got)
+	}
+
+	// incremental stream
+	err = sendAndReceive(t, src, dst, "snap1", "fs", "snap2")
+	if err != nil {
+		t.Fatalf("failed to receive incremental stream: %s", err)
+	}
+	if got := readDefaultFile(t, dst, "fs", "hello"); got != "two" {
+		t.Errorf("expected 'two', got '%s'", got)
+	}
+	received, err := dst.DiscoverSystem("fs")
+	if err != nil {
+		t.Fatalf("failed to discover: %s", err)
+	}
+	if len(received.Snapshots) != 2 || received.Snapshots[0].Metadata["message"] != "first" {
+		t.Errorf("unexpected received snapshots: %#v", received.Snapshots)
+	}
+
+	// the same incremental again doesn't apply any more
+	err = sendAndReceive(t, src, dst, "snap1", "fs", "snap2")
+	if err == nil {
+		t.Errorf("expected receiving a stale incremental stream to fail")
+	}
+
+	// dirty data on the receiver is refused
+	writeDefaultFile(t, src, "fs", "hello", "three")
+	mustSnapshot(t, src, "fs", "snap3", nil)
+	writeDefaultFile(t, dst, "fs", "dirty", "data")
+	reader, errch := src.Send("", "snap2", "fs", "snap3", SendOptions{}, []byte{})
+	errBuffer := &bytes.Buffer{}
+	err = dst.Recv(reader, "fs", errBuffer)
+	reader.Close()
+	<-errch
+	if err == nil || !bytes.Contains(errBuffer.Bytes(), []byte("has been modified")) {
+		t.Errorf("expected dirty receive to fail with 'has been modified', got %s / %s", err, errBuffer.String())
+	}
+}
+
+func TestDirStashBranch(t *testing.T) {
+	z, cleanup := newTestDirZFS(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create: %s", err)
+	}
+	writeDefaultFile(t, z, "fs", "hello", "one")
+	mustSnapshot(t, z, "fs", "snap1", nil)
+	writeDefaultFile(t, z, "fs", "hello", "diverged")
+	mustSnapshot(t, z, "fs", "snap2", nil)
+
+	err = z.StashBranch("fs", "stash", "snap1")
+	if err != nil {
+		t.Fatalf("failed to stash: %s", err)
+	}
+	if ids := snapshotIds(t, z, "fs"); !reflect.DeepEqual(ids, []string{"snap1"}) {
+		t.Errorf("expected fs to keep snap1, got %v", ids)
+	}
+	if ids := snapshotIds(t, z, "stash"); !reflect.DeepEqual(ids, []string{"snap2"}) {
+		t.Errorf("expected stash to have snap2, got %v", ids)
+	}
+	if got := readDefaultFile(t, z, "fs", "hello"); got != "one" {
+		t.Errorf("expected 'one', got '%s'", got)
+	}
+	if got := readDefaultFile(t, z, "stash", "hello"); got != "diverged" {
+		t.Errorf("expected 'diverged', got '%s'", got)
+	}
+}
+
+func TestDirCloneAndFork(t *testing.T) {
+	z, cleanup := newTestDirZFS(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create: %s", err)
+	}
+	writeDefaultFile(t, z, "fs", "hello", "one")
+	mustSnapshot(t, z, "fs", "snap1", nil)
+
+	_, err = z.Clone("fs", "snap1", "clone")
+	if err != nil {
+		t.Fatalf("failed to clone: %s", err)
+	}
+	if got := readDefaultFile(t, z, "clone", "hello"); got != "one" {
+		t.Errorf("expected 'one', got '%s'", got)
+	}
+	if ids := snapshotIds(t, z, "clone"); len(ids) != 0 {
+		t.Errorf("expected a clone to start with no snapshots, got %v", ids)
+	}
+
+	err = z.Fork("fs", "snap1", "fork")
+	if err != nil {
+		t.Fatalf("failed to fork: %s", err)
+	}
+	if ids := snapshotIds(t, z, "fork"); !reflect.DeepEqual(ids, []string{"snap1"}) {
+		t.Errorf("expected fork to have snap1, got %v", ids)
+	}
+
+	ids := z.FindFilesystemIdsOnSystem()
+	if len(ids) != 3 {
+		t.Errorf("expected 3 filesystems, got %v", ids)
+	}
+}
+
+func TestDirPromote(t *testing.T) {
+	z, cleanup := newTestDirZFS(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create: %s", err)
+	}
+	mustSnapshot(t, z, "fs", "snap1", nil)
+	mustSnapshot(t, z, "fs", "snap2", nil)
+	mustSnapshot(t, z, "fs", "snap3", nil)
+	for _, c := range []struct{ clone, origin string }{
+		{"older", "snap1"},
+		{"newer", "snap2"},
+		{"newest", "snap3"},
+	} {
+		_, err = z.Clone("fs", c.origin, c.clone)
+		if err != nil {
+			t.Fatalf("failed to clone: %s", err)
+		}
+	}
+	mustSnapshot(t, z, "newer", "snap4", nil)
+
+	_, err = z.Promote("newer", "older")
+	if err == nil {
+		t.Errorf("expected promoting a clone of something else to fail")
+	}
+	_, err = z.Promote("newer", "fs")
+	if err != nil {
+		t.Fatalf("failed to promote: %s", err)
+	}
+	if ids := snapshotIds(t, z, "newer"); !reflect.DeepEqual(ids, []string{"snap1", "snap2", "snap4"}) {
+		t.Errorf("expected newer to take snap1 and snap2, got %v", ids)
+	}
+	if ids := snapshotIds(t, z, "fs"); !reflect.DeepEqual(ids, []string{"snap3"}) {
+		t.Errorf("expected fs to keep snap3, got %v", ids)
+	}
+	for fs, expected := range map[string]string{
+		"newer":  "",
+		"fs":     "newer@snap2",
+		"older":  "newer@snap1",
+		"newest": "fs@snap3",
+	} {
+		originFs, originSnap, err := z.readOrigin(fs)
+		if err != nil {
+			t.Fatalf("failed to read origin of %s: %s", fs, err)
+		}
+		origin := ""
+		if originFs != "" {
+			origin = originFs + "@" + originSnap
+		}
+		if origin != expected {
+			t.Errorf("expected %s to be a clone of %q, got %q", fs, expected, origin)
+		}
+	}
+}
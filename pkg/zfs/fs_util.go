@@ -27,7 +27,7 @@ func FullIdWithSnapshot(filesystemId, snapshotId string) string {
 	return filesystemId
 }
 
-func filterMountpoints(mountPrefix string, filesystem string, r *bufio.Reader) ([]string, error) {
+func filterMountpoints(mountPrefix string, filesystem string, fsType string, r *bufio.Reader) ([]string, error) {
 
 	mountPrefix = filepath.Join(mountPrefix, "dmfs", filesystem)
 
@@ -38,9 +38,9 @@ func filterMountpoints(mountPrefix string, filesystem string, r *bufio.Reader) (
 		if line != "" {
 			parts := strings.Split(line, " ")
 			if len(parts) >= 11 {
-				fsType := parts[8]
+				mountFsType := parts[8]
 				mountpoint := parts[4]
-				if fsType == "zfs" && strings.HasPrefix(mountpoint, mountPrefix) {
+				if (fsType == "" || mountFsType == fsType) && strings.HasPrefix(mountpoint, mountPrefix) {
 					mountpoints = append(mountpoints, mountpoint)
 				}
 			}
@@ -45,7 +45,7 @@ func TestMountpointFilter(t *testing.T) {
 
 	reader := bufio.NewReader(buf)
 
-	filtered, err := filterMountpoints("/var/lib/dotmesh/mnt", "8709de2a-f4c0-4d38-9241-61ca16c6764f", reader)
+	filtered, err := filterMountpoints("/var/lib/dotmesh/mnt", "8709de2a-f4c0-4d38-9241-61ca16c6764f", "zfs", reader)
 	if err != nil {
 		t.Errorf("failed to filter: %s", err)
 	}
@@ -76,7 +76,7 @@ func TestMountpointFilterWithSnapshots(t *testing.T) {
 
 	reader := bufio.NewReader(buf)
 
-	filtered, err := filterMountpoints("/var/lib/dotmesh/mnt", "5887919c-c980-4d5f-983d-edd0f0d76be3", reader)
+	filtered, err := filterMountpoints("/var/lib/dotmesh/mnt", "5887919c-c980-4d5f-983d-edd0f0d76be3", "zfs", reader)
 	if err != nil {
 		t.Errorf("failed to filter: %s", err)
 	}
@@ -45,17 +45,53 @@ type ZFS interface {
 	FQ(filesystemId string) string
 	DiscoverSystem(fs string) (*types.Filesystem, error)
 	StashBranch(existingFs string, newFs string, rollbackTo string) error
-	PredictSize(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string) (int64, error)
+	// PredictSize returns how big the stream for the given range will be,
+	// both as zfs sends it and once compressed on the wire.
+	PredictSize(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string) (*types.PredictedSize, error)
+	// PredictResumeSize returns how many bytes are left to send to finish
+	// the interrupted receive that resumeToken was taken from.
+	PredictResumeSize(resumeToken string) (int64, error)
 	Clone(filesystemId, originSnapshotId, newCloneFilesystemId string) ([]byte, error)
+	// Promote makes a clone of originFilesystemId independent of it, moving
+	// the origin's snapshots up to the one the clone was taken from over to
+	// the clone, so that the origin can be destroyed without it. It fails if
+	// the filesystem isn't a clone of originFilesystemId.
+	Promote(filesystemId, originFilesystemId string) ([]byte, error)
 	Rollback(filesystemId, snapshotId string) ([]byte, error)
+	// Revert makes the live filesystem's contents match one of its
+	// snapshots, like Rollback, but keeps the snapshots after it.
+	Revert(filesystemId, snapshotId string) ([]byte, error)
+	// DestroySnapshot destroys one snapshot, leaving the ones either side of
+	// it. It fails if the snapshot is the origin of a clone.
+	DestroySnapshot(filesystemId, snapshotId string) ([]byte, error)
 	Create(filesystemId string) ([]byte, error)
+	// Recv keeps what it managed to receive if the stream is cut short, where
+	// supported, so that the sender can carry on from there.
 	Recv(pipeReader *io.PipeReader, toFilesystemId string, errBuffer *bytes.Buffer) error
+	// ReceiveResumeToken returns the token for carrying on an interrupted
+	// receive into the filesystem, or "" if there isn't one.
+	ReceiveResumeToken(filesystemId string) (string, error)
+	// AbortReceive throws away the partial state of an interrupted receive,
+	// if there is any, so that a new stream can be received from scratch.
+	AbortReceive(filesystemId string) error
 	ApplyPrelude(prelude types.Prelude, fs string) error
-	Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, preludeEncoded []byte) (*io.PipeReader, chan error)
+	// Send streams the given range, or if opts.ResumeToken is set, the rest
+	// of the interrupted receive it was taken from, in which case the
+	// snapshot ids are only used for logging.
+	Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, opts SendOptions, preludeEncoded []byte) (*io.PipeReader, chan error)
+	// CompressedStreams reports whether we can send and receive streams of
+	// blocks as they are compressed on disk (see SendOptions.Compressed).
+	CompressedStreams() bool
 	SetCanmount(filesystemId, snapshotId string) ([]byte, error)
 	Mount(filesystemId, snapshotId string, options string, mountPath string) ([]byte, error)
 	Fork(filesystemId, latestSnapshot, forkFilesystemId string) error
 	Diff(filesystemId string) ([]types.ZFSFileDiff, error)
+	// DiffSnapshots compares the files of two snapshots, which can be on
+	// different filesystems (e.g. a branch and its origin, or a fork and its
+	// parent). An empty toSnapshotId compares with the live filesystem.
+	// It returns the page of changes opts ask for, and how many there are
+	// altogether.
+	DiffSnapshots(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, opts types.DiffOptions) ([]types.ZFSFileDiff, int, error)
 	// LastModified returns last modified temp snapshot, must be called after Diff
 	LastModified(filesystemID string) (*types.LastModified, error)
 	DestroyTmpSnapIfExists(filesystemId string) error
@@ -63,6 +99,16 @@ type ZFS interface {
 
 var _ ZFS = &zfs{}
 
+// SendOptions change how Send streams a range.
+type SendOptions struct {
+	// carry on from the interrupted receive this token was taken from,
+	// with whatever options the original stream was sent with
+	ResumeToken string
+	// send blocks as they are compressed on disk, and large blocks whole
+	// (zfs send -c -L), which both ends must support
+	Compressed bool
+}
+
 const dotmeshDiffSnapshotName = "dotmesh-fastdiff"
 
 type zfs struct {
@@ -74,6 +120,14 @@ type zfs struct {
 	mountZFS string
 	poolId   string
 	diffMu   sync.Mutex
+	// diffs between commits, for paging through them
+	commitDiffs commitDiffCache
+	// whether this version of zfs can save the partial state of an
+	// interrupted receive (zfs recv -s)
+	resumable bool
+	// whether this version of zfs and the pool can send and receive
+	// compressed streams (zfs send -c -L)
+	compressedStreams bool
 }
 
 func NewZFS(zfsPath, zpoolPath, poolName, mountZFS string) (ZFS, error) {
@@ -105,6 +159,8 @@ func NewZFS(zfsPath, zpoolPath, poolName, mountZFS string) (ZFS, error) {
 		return nil, fmt.Errorf("The pool id for this dotmesh changed. If this is deliberate, delete the file `/dotmesh-pool-id`, otherwise investigate the issue.")
 	}
 	zfsInter.poolId = poolId
+	zfsInter.resumable = zfsInter.supportsResumableReceive()
+	zfsInter.compressedStreams = zfsInter.supportsCompressedStreams()
 	return zfsInter, nil
 }
 
@@ -145,7 +201,7 @@ func (z *zfs) Create(filesystemId string) ([]byte, error) {
 
 func (z *zfs) Rollback(filesystemId, snapshotId string) ([]byte, error) {
 
-	err := z.clearMounts(filesystemId)
+	err := clearMounts(filesystemId, "zfs")
 	if err != nil {
 		return nil, err
 	}
@@ -153,6 +209,33 @@ func (z *zfs) Rollback(filesystemId, snapshotId string) ([]byte, error) {
 	return z.runOnFilesystem(filesystemId, snapshotId, []string{"rollback", "-Rfr"})
 }
 
+func (z *zfs) Revert(filesystemId, snapshotId string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Minute)
+	defer cancel()
+
+	snapshotRoot, unmount, err := z.mountReadOnly(ctx, filesystemId, snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	defer unmount()
+	// rsync only rewrites the files which differ, and --delete removes the
+	// ones added since. Files are compared by checksum rather than by size
+	// and mtime, which a change within the same second can leave as they
+	// were, and ACLs and xattrs are copied along with the rest.
+	return exec.CommandContext(
+		ctx, "rsync", "-aHAX", "--checksum", "--delete", snapshotRoot+"/", utils.Mnt(filesystemId)+"/",
+	).CombinedOutput()
+}
+
+func (z *zfs) DestroySnapshot(filesystemId, snapshotId string) ([]byte, error) {
+	err := clearMounts(filesystemId+"@"+snapshotId, "zfs")
+	if err != nil {
+		return nil, err
+	}
+
+	return z.runOnFilesystem(filesystemId, snapshotId, []string{"destroy"})
+}
+
 func (z *zfs) SetCanmount(filesystemId, snapshotId string) ([]byte, error) {
 	return z.runOnFilesystem(filesystemId, snapshotId, []string{"set", "canmount=noauto"})
 }
@@ -224,6 +307,33 @@ func (z *zfs) Clone(filesystemId, originSnapshotId, newCloneFilesystemId string)
 	return out, err
 }
 
+func (z *zfs) Promote(filesystemId, originFilesystemId string) ([]byte, error) {
+	out, err := exec.Command(
+		z.zfsPath, "get", "-H", "-o", "value", "origin", z.FQ(filesystemId),
+	).CombinedOutput()
+	if err != nil {
+		return out, err
+	}
+	// the snapshot the filesystem was cloned from, or "-" if it isn't a
+	// clone
+	origin := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(origin, z.FQ(originFilesystemId)+"@") {
+		return nil, fmt.Errorf(
+			"%s is not a clone of %s (its origin is %s)",
+			filesystemId, originFilesystemId, origin,
+		)
+	}
+	LogZFSCommand(filesystemId, fmt.Sprintf("%s promote %s", z.zfsPath, z.FQ(filesystemId)))
+	out, err = exec.Command(z.zfsPath, "promote", z.FQ(filesystemId)).CombinedOutput()
+	if err != nil {
+		log.Printf(
+			"[Promote] %v while trying to promote filesystem %s: %s",
+			err, z.FQ(filesystemId), out,
+		)
+	}
+	return out, err
+}
+
 func (z *zfs) DiscoverSystem(fs string) (*types.Filesystem, error) {
 	// TODO sanitize fs
 	// does filesystem exist? (early exit if not)
@@ -363,6 +473,38 @@ func (z *zfs) findLocalPoolId() (string, error) {
 	return fmt.Sprintf("%x", i), nil
 }
 
+// supportsResumableReceive reports whether the pool knows about the
+// receive_resume_token property, which older versions of zfs (eg the one
+// bundled with Ubuntu 16.04) don't.
+func (z *zfs) supportsResumableReceive() bool {
+	output, err := exec.Command(z.zfsPath, "get", "-H", "-o", "value", "receive_resume_token", z.poolName).CombinedOutput()
+	if err != nil {
+		log.Warnf("[supportsResumableReceive] resumable receive not supported, interrupted transfers will start over: %s", output)
+		return false
+	}
+	return true
+}
+
+// supportsCompressedStreams reports whether compressed sends can be used,
+// which arrived in the same version of zfs as resumable receives, and (for
+// -L) whether the pool has the large_blocks feature.
+func (z *zfs) supportsCompressedStreams() bool {
+	if !z.resumable {
+		return false
+	}
+	output, err := exec.Command(z.zpoolPath, "get", "-H", "-o", "value", "feature@large_blocks", z.poolName).CombinedOutput()
+	value := strings.TrimSpace(string(output))
+	if err != nil || (value != "enabled" && value != "active") {
+		log.Warnf("[supportsCompressedStreams] large_blocks not enabled on %s, replicating uncompressed streams: %s", z.poolName, output)
+		return false
+	}
+	return true
+}
+
+func (z *zfs) CompressedStreams() bool {
+	return z.compressedStreams
+}
+
 func (z *zfs) ReportZpoolCapacity() error {
 	capacity, err := z.GetZPoolCapacity()
 	if err != nil {
@@ -466,7 +608,7 @@ func (z *zfs) StashBranch(existingFs string, newFs string, rollbackTo string) er
 		"new_fs":      newFs,
 		"rollback_to": rollbackTo,
 	}).Info("stashing branch")
-	err := z.clearMounts(existingFs)
+	err := clearMounts(existingFs, "zfs")
 	if err != nil {
 		return err
 	}
@@ -524,8 +666,53 @@ func (z *zfs) StashBranch(existingFs string, newFs string, rollbackTo string) er
 		   Print machine-parsable verbose information about the stream
 		   package generated.
 */
-func (z *zfs) PredictSize(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string) (int64, error) {
+func (z *zfs) PredictSize(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string) (*types.PredictedSize, error) {
 	sendArgs := z.calculateSendArgs(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId)
+	raw, err := z.predict(sendArgs)
+	if err != nil {
+		return nil, err
+	}
+	if z.compressedStreams {
+		wire, err := z.predict(append([]string{"-c", "-L"}, sendArgs...))
+		if err != nil {
+			return nil, err
+		}
+		return &types.PredictedSize{Raw: raw, Wire: wire}, nil
+	}
+	// without compressed sends, guess that the stream will compress about
+	// as well on the wire as the data does on disk
+	ratio, err := z.compressRatio(toFilesystemId, toSnapshotId)
+	if err != nil {
+		log.Warnf("[PredictSize] can't get compression ratio of %s@%s, assuming none: %s", toFilesystemId, toSnapshotId, err)
+		ratio = 1
+	}
+	return &types.PredictedSize{Raw: raw, Wire: int64(float64(raw) / ratio)}, nil
+}
+
+// compressRatio returns the compressratio property of a snapshot.
+func (z *zfs) compressRatio(filesystemId, snapshotId string) (float64, error) {
+	output, err := exec.Command(
+		z.zfsPath, "get", "-H", "-p", "-o", "value", "compressratio",
+		z.fullZFSFilesystemPath(filesystemId, snapshotId),
+	).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("%s (%s)", err, output)
+	}
+	ratio, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(string(output)), "x"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if ratio < 1 {
+		return 1, nil
+	}
+	return ratio, nil
+}
+
+func (z *zfs) PredictResumeSize(resumeToken string) (int64, error) {
+	return z.predict([]string{"-t", resumeToken})
+}
+
+func (z *zfs) predict(sendArgs []string) (int64, error) {
 	predictArgs := []string{"send", "-nP"}
 	predictArgs = append(predictArgs, sendArgs...)
 
@@ -595,7 +782,15 @@ func (z *zfs) calculateSendArgs(fromFilesystemId, fromSnapshotId, toFilesystemId
 }
 
 func (z *zfs) Recv(pipeReader *io.PipeReader, toFilesystemId string, errBuffer *bytes.Buffer) error {
-	cmd := exec.Command(z.zfsPath, "recv", z.FQ(toFilesystemId))
+	recvArgs := []string{"recv"}
+	if z.resumable {
+		// -s keeps whatever was received if the stream is cut short, so that
+		// a retry can pick up from receive_resume_token rather than sending
+		// everything again.
+		recvArgs = append(recvArgs, "-s")
+	}
+	recvArgs = append(recvArgs, z.FQ(toFilesystemId))
+	cmd := exec.Command(z.zfsPath, recvArgs...)
 
 	cmd.Stdin = pipeReader
 	cmd.Stdout = utils.GetLogfile("zfs-recv-stdout")
@@ -607,6 +802,42 @@ func (z *zfs) Recv(pipeReader *io.PipeReader, toFilesystemId string, errBuffer *
 	return cmd.Run()
 }
 
+func (z *zfs) ReceiveResumeToken(filesystemId string) (string, error) {
+	if !z.resumable {
+		return "", nil
+	}
+	output, err := exec.Command(
+		z.zfsPath, "get", "-H", "-o", "value", "receive_resume_token", z.FQ(filesystemId),
+	).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(output), "dataset does not exist") {
+			return "", nil
+		}
+		return "", fmt.Errorf("error getting receive_resume_token of %s: %s (%s)", filesystemId, err, output)
+	}
+	token := strings.TrimSpace(string(output))
+	if token == "-" {
+		return "", nil
+	}
+	return token, nil
+}
+
+func (z *zfs) AbortReceive(filesystemId string) error {
+	token, err := z.ReceiveResumeToken(filesystemId)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return nil
+	}
+	LogZFSCommand(filesystemId, fmt.Sprintf("%s recv -A %s", z.zfsPath, z.FQ(filesystemId)))
+	output, err := exec.Command(z.zfsPath, "recv", "-A", z.FQ(filesystemId)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error aborting partial receive into %s: %s (%s)", filesystemId, err, output)
+	}
+	return nil
+}
+
 func (z *zfs) ApplyPrelude(prelude types.Prelude, fs string) error {
 	// iterate over it setting zfs user properties accordingly.
 	for _, j := range prelude.SnapshotProperties {
@@ -634,16 +865,26 @@ func (z *zfs) ApplyPrelude(prelude types.Prelude, fs string) error {
 	return nil
 }
 
-func (z *zfs) Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, preludeEncoded []byte) (*io.PipeReader, chan error) {
+func (z *zfs) Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, opts SendOptions, preludeEncoded []byte) (*io.PipeReader, chan error) {
 	log.WithFields(log.Fields{
 		"fromFilesystemId": fromFilesystemId,
 		"fromSnapshotId":   fromSnapshotId,
 		"toFilesystemId":   toFilesystemId,
 		"toSnapshotId":     toSnapshotId,
+		"resuming":         opts.ResumeToken != "",
+		"compressed":       opts.Compressed,
 	}).Debug("zfs.Send() starting")
-	sendArgs := z.calculateSendArgs(
-		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
-	)
+	var sendArgs []string
+	if opts.ResumeToken != "" {
+		sendArgs = []string{"-t", opts.ResumeToken}
+	} else {
+		sendArgs = z.calculateSendArgs(
+			fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
+		)
+		if opts.Compressed {
+			sendArgs = append([]string{"-c", "-L"}, sendArgs...)
+		}
+	}
 	realArgs := []string{"send"}
 	realArgs = append(realArgs, sendArgs...)
 	LogZFSCommand(fromFilesystemId, fmt.Sprintf("%s %s", z.zfsPath, strings.Join(realArgs, " ")))
@@ -739,11 +980,38 @@ func (z *zfs) Fork(filesystemId, latestSnapshot, forkFilesystemId string) error
 }
 
 type DiffResult struct {
-	mtime string
-	size  string
+	// unix nanoseconds
+	mtime int64
+	size  int64
+	// type and permission bits
+	mode os.FileMode
 }
+
+func (r DiffResult) fileInfo() *types.DiffFileInfo {
+	return &types.DiffFileInfo{
+		Type:  types.FileTypeOf(r.mode),
+		Size:  r.size,
+		Mode:  r.mode.Perm(),
+		Mtime: time.Unix(0, r.mtime).UTC(),
+	}
+}
+
 type DiffSide map[string]DiffResult
 
+// the find(1) format diffSideFromLines parses
+const findDiffFormat = `%T@ %s %m %y %p\n`
+
+// find's %y file types
+var findFileTypes = map[string]os.FileMode{
+	"f": 0,
+	"d": os.ModeDir,
+	"l": os.ModeSymlink,
+	"p": os.ModeNamedPipe,
+	"s": os.ModeSocket,
+	"c": os.ModeDevice | os.ModeCharDevice,
+	"b": os.ModeDevice,
+}
+
 func diffSideFromLines(result []byte) (DiffSide, error) {
 	lines := strings.Split(string(result), "\n")
 	ds := DiffSide{}
@@ -751,23 +1019,105 @@ func diffSideFromLines(result []byte) (DiffSide, error) {
 		if line == "" {
 			continue
 		}
-		shrapnel := strings.SplitN(line, " ", 3)
-		if len(shrapnel) < 3 {
+		shrapnel := strings.SplitN(line, " ", 5)
+		if len(shrapnel) < 5 {
 			return nil, fmt.Errorf("too few parts")
 		}
-		mtime := shrapnel[0]
-		size := shrapnel[1]
-		filename := shrapnel[2]
+		filename := shrapnel[4]
 		prefix := "./__default__/"
 		if !strings.HasPrefix(filename, prefix) {
 			continue
 		}
 		filename = filename[len(prefix):]
-		ds[filename] = DiffResult{mtime: mtime, size: size}
+		mtime, err := parseFindTime(shrapnel[0])
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(shrapnel[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad size %q for %s", shrapnel[1], filename)
+		}
+		perm, err := strconv.ParseUint(shrapnel[2], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad mode %q for %s", shrapnel[2], filename)
+		}
+		fileType, ok := findFileTypes[shrapnel[3]]
+		if !ok {
+			fileType = os.ModeIrregular
+		}
+		ds[filename] = DiffResult{mtime: mtime, size: size, mode: fileType | os.FileMode(perm).Perm()}
 	}
 	return ds, nil
 }
 
+// parseFindTime parses find's %T@, seconds since the epoch with a fraction,
+// into nanoseconds.
+func parseFindTime(s string) (int64, error) {
+	parts := strings.SplitN(s, ".", 2)
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	var nanos int64
+	if len(parts) == 2 {
+		fraction := (parts[1] + "000000000")[:9]
+		nanos, err = strconv.ParseInt(fraction, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad time %q", s)
+		}
+	}
+	return seconds*int64(time.Second) + nanos, nil
+}
+
+// diffSides compares the file listing of the latest snapshot with the file
+// listing of the current state of the filesystem, returning the changes sorted
+// by filename.
+func diffSides(mapLatest, mapTmp DiffSide) []types.ZFSFileDiff {
+	result := map[string]types.ZFSFileDiff{}
+	resultFiles := []string{}
+
+	for filename, tmpProps := range mapTmp {
+		if latestProps, ok := mapLatest[filename]; ok {
+			// exists in previous snap, check if modified
+			if tmpProps != latestProps {
+				// modified!
+				resultFiles = append(resultFiles, filename)
+				result[filename] = types.ZFSFileDiff{
+					Change:   types.FileChangeModified,
+					Filename: filename,
+					Old:      latestProps.fileInfo(),
+					New:      tmpProps.fileInfo(),
+				}
+			}
+		} else {
+			// does not exist in previous snap, created
+			resultFiles = append(resultFiles, filename)
+			result[filename] = types.ZFSFileDiff{
+				Change:   types.FileChangeAdded,
+				Filename: filename,
+				New:      tmpProps.fileInfo(),
+			}
+		}
+	}
+	for filename, latestProps := range mapLatest {
+		if _, ok := mapTmp[filename]; !ok {
+			// exists in latest but not tmp, must have been deleted
+			resultFiles = append(resultFiles, filename)
+			result[filename] = types.ZFSFileDiff{
+				Change:   types.FileChangeRemoved,
+				Filename: filename,
+				Old:      latestProps.fileInfo(),
+			}
+		}
+	}
+	sort.Strings(resultFiles)
+	sortedResult := []types.ZFSFileDiff{}
+	for _, file := range resultFiles {
+		sortedResult = append(sortedResult, result[file])
+	}
+	return sortedResult
+}
+
 // NB: the following caches would be better on an object than as globals.
 
 type FilesystemDiffCache struct {
@@ -923,7 +1273,7 @@ func (z *zfs) Diff(filesystemID string) ([]types.ZFSFileDiff, error) {
 		return nil, err
 	}
 
-	findCmdTmpl := `(cd %s; find . -printf "%%T+ %%s %%p\n")`
+	findCmdTmpl := `(cd %s; find . -printf "` + strings.Replace(findDiffFormat, "%", "%%", -1) + `")`
 
 	// only mount & fetch file list from latest if we haven't got it cached already
 
@@ -989,44 +1339,7 @@ func (z *zfs) Diff(filesystemID string) ([]types.ZFSFileDiff, error) {
 		return nil, err
 	}
 
-	result := map[string]types.ZFSFileDiff{}
-	resultFiles := []string{}
-
-	for filename, tmpProps := range mapTmp {
-		if latestProps, ok := mapLatest[filename]; ok {
-			// exists in previous snap, check if modified
-			if tmpProps != latestProps {
-				// modified!
-				resultFiles = append(resultFiles, filename)
-				result[filename] = types.ZFSFileDiff{
-					Change:   types.FileChangeModified,
-					Filename: filename,
-				}
-			}
-		} else {
-			// does not exist in previous snap, created
-			resultFiles = append(resultFiles, filename)
-			result[filename] = types.ZFSFileDiff{
-				Change:   types.FileChangeAdded,
-				Filename: filename,
-			}
-		}
-	}
-	for filename, _ := range mapLatest {
-		if _, ok := mapTmp[filename]; !ok {
-			// exists in latest but not tmp, must have been deleted
-			resultFiles = append(resultFiles, filename)
-			result[filename] = types.ZFSFileDiff{
-				Change:   types.FileChangeRemoved,
-				Filename: filename,
-			}
-		}
-	}
-	sort.Strings(resultFiles)
-	sortedResult := []types.ZFSFileDiff{}
-	for _, file := range resultFiles {
-		sortedResult = append(sortedResult, result[file])
-	}
+	sortedResult := diffSides(mapLatest, mapTmp)
 
 	// only try to clean up latest mount if we needed to mount it at all
 	if mountedLatest {
@@ -1069,7 +1382,10 @@ func (z *zfs) Diff(filesystemID string) ([]types.ZFSFileDiff, error) {
 	return sortedResult, nil
 }
 
-func (z *zfs) clearMounts(filesystem string) error {
+// clearMounts unmounts, from whichever mount namespace holds them, all mounts
+// of the given filesystem (and its snapshots) of the given type. An empty
+// fsType matches mounts of any type.
+func clearMounts(filesystem, fsType string) error {
 
 	f, err := os.Open("/proc/self/mountinfo")
 	if err != nil {
@@ -1079,7 +1395,7 @@ func (z *zfs) clearMounts(filesystem string) error {
 	r := bufio.NewReader(f)
 	mountPrefix := os.Getenv("MOUNT_PREFIX")
 
-	mountpoints, err := filterMountpoints(mountPrefix, filesystem, r)
+	mountpoints, err := filterMountpoints(mountPrefix, filesystem, fsType, r)
 	if err != nil {
 		return fmt.Errorf("failed to get filesystem %s mountpoints, error: %s", filesystem, err)
 	}
@@ -1152,3 +1468,103 @@ func namespaceForMount(mountpoint string) (string, error) {
 	}
 	return "", nil
 }
+
+func (z *zfs) DiffSnapshots(fromFilesystemID, fromSnapshotID, toFilesystemID, toSnapshotID string, opts types.DiffOptions) ([]types.ZFSFileDiff, int, error) {
+	// a diff to the live filesystem can change from one page to the next, so
+	// only diffs between commits are cached
+	var files []types.ZFSFileDiff
+	cached := false
+	key := ""
+	if toSnapshotID != "" {
+		key = commitDiffKey(fromFilesystemID, fromSnapshotID, toFilesystemID, toSnapshotID)
+		files, cached = z.commitDiffs.get(key)
+	}
+	if cached && !opts.Hunks {
+		return diffPage(files, opts), len(files), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Minute)
+	defer cancel()
+
+	fromRoot, unmountFrom, err := z.mountReadOnly(ctx, fromFilesystemID, fromSnapshotID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unmountFrom()
+	// the live filesystem is mounted where the fsm put it
+	toRoot := utils.Mnt(toFilesystemID)
+	if toSnapshotID != "" {
+		var unmountTo func()
+		toRoot, unmountTo, err = z.mountReadOnly(ctx, toFilesystemID, toSnapshotID)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer unmountTo()
+	}
+
+	if !cached {
+		mapFrom, err := findDiffSide(ctx, fromRoot)
+		if err != nil {
+			return nil, 0, err
+		}
+		mapTo, err := findDiffSide(ctx, toRoot)
+		if err != nil {
+			return nil, 0, err
+		}
+		files = diffSides(mapFrom, mapTo)
+		if key != "" {
+			z.commitDiffs.put(key, files)
+		}
+	}
+	page := diffPage(files, opts)
+	if opts.Hunks {
+		err = addHunks(page, fromRoot, toRoot)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return page, len(files), nil
+}
+
+// mountReadOnly mounts a snapshot read-only, returning where, and how to
+// unmount it again.
+func (z *zfs) mountReadOnly(ctx context.Context, filesystemID, snapshotID string) (string, func(), error) {
+	// each call gets its own mountpoint, so that concurrent diffs of the same
+	// commit don't unmount each other's
+	parent := utils.Mnt("diff")
+	err := os.MkdirAll(parent, 0775)
+	if err != nil {
+		return "", nil, err
+	}
+	mnt, err := ioutil.TempDir(parent, FullIdWithSnapshot(filesystemID, snapshotID)+"-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	out, err := exec.CommandContext(
+		ctx, "mount", "-t", "zfs", "-o", "ro", z.fullZFSFilesystemPath(filesystemID, snapshotID), mnt,
+	).CombinedOutput()
+	if err != nil {
+		log.WithError(err).Errorf("[mountReadOnly] error mounting %s@%s: %s", filesystemID, snapshotID, string(out))
+		os.Remove(mnt)
+		return "", nil, fmt.Errorf("failed to mount %s@%s: %s %s", filesystemID, snapshotID, err, out)
+	}
+	return mnt, func() {
+		out, err := exec.Command("umount", mnt).CombinedOutput()
+		if err != nil {
+			log.WithError(err).Warnf("[mountReadOnly] error unmounting %s: %s", mnt, string(out))
+			return
+		}
+		os.Remove(mnt)
+	}, nil
+}
+
+func findDiffSide(ctx context.Context, root string) (DiffSide, error) {
+	files, err := exec.CommandContext(
+		ctx, "bash", "-c", fmt.Sprintf(`(cd %s; find . -printf "%s")`, root, findDiffFormat),
+	).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files in %s: %s %s", root, err, files)
+	}
+	return diffSideFromLines(files)
+}
@@ -0,0 +1,1028 @@
+// Package zfstest provides an in-memory zfs.ZFS for tests which need to run
+// filesystem machines without a zpool.
+package zfstest
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dotmesh-io/dotmesh/pkg/types"
+	"github.com/dotmesh-io/dotmesh/pkg/utils"
+	"github.com/dotmesh-io/dotmesh/pkg/zfs"
+)
+
+var _ zfs.ZFS = &FakeZFS{}
+
+// FakeZFS keeps filesystems, snapshots and their contents in memory. File
+// contents are keyed by their path relative to the root of the filesystem, so
+// the files a container sees live under "__default__/".
+//
+// Send and Recv produce and consume a private stream format, and refuse the
+// same receives `zfs recv` would, so two FakeZFS instances can stand in for
+// the pools of two nodes. A receive cut short by InterruptNextRecv leaves
+// partial state behind that a resumed send can finish, as `zfs recv -s` does.
+type FakeZFS struct {
+	mu sync.Mutex
+
+	poolId      string
+	filesystems map[string]*fakeFilesystem
+	calls       map[string]int
+	failures    map[string]error
+	// interrupted receives, by filesystem id
+	partial         map[string]*fakePartialReceive
+	interruptNextRx bool
+}
+
+type fakeFilesystem struct {
+	origin    types.Origin
+	files     map[string][]byte
+	snapshots []*fakeSnapshot
+	mounted   bool
+	modified  time.Time
+}
+
+type fakeSnapshot struct {
+	Id       string
+	Metadata map[string]string
+	Files    map[string][]byte
+}
+
+// fakeStream is what Send writes after the prelude. A resumed stream carries
+// the token it was sent for, and the rest of the snapshot it names.
+type fakeStream struct {
+	From      string
+	Resume    string
+	Snapshots []*fakeSnapshot
+}
+
+// fakePartialReceive is what an interrupted receive left of the snapshot it
+// was partway through.
+type fakePartialReceive struct {
+	SnapshotId string
+	Received   int64
+}
+
+// fakeResumeToken is the token for carrying on an interrupted receive into
+// filesystemId. Unlike a real one, it's readable, but callers shouldn't rely
+// on that.
+func fakeResumeToken(filesystemId string, partial *fakePartialReceive) string {
+	return fmt.Sprintf("%s@%s:%d", filesystemId, partial.SnapshotId, partial.Received)
+}
+
+func parseFakeResumeToken(token string) (string, *fakePartialReceive, error) {
+	at := strings.Index(token, "@")
+	colon := strings.LastIndex(token, ":")
+	if at == -1 || colon < at {
+		return "", nil, fmt.Errorf("invalid resume token %s", token)
+	}
+	received, err := strconv.ParseInt(token[colon+1:], 10, 64)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid resume token %s: %s", token, err)
+	}
+	return token[:at], &fakePartialReceive{SnapshotId: token[at+1 : colon], Received: received}, nil
+}
+
+func NewFakeZFS(poolId string) *FakeZFS {
+	return &FakeZFS{
+		poolId:      poolId,
+		filesystems: map[string]*fakeFilesystem{},
+		calls:       map[string]int{},
+		failures:    map[string]error{},
+		partial:     map[string]*fakePartialReceive{},
+	}
+}
+
+// FailNext makes the next call to the named method (eg "Snapshot" or "Recv")
+// return err.
+func (z *FakeZFS) FailNext(method string, err error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.failures[method] = err
+}
+
+// InterruptNextRecv makes the next receive stop partway through the last
+// snapshot in its stream, keeping the ones before it and leaving a resume
+// token for the rest, as if the connection had dropped.
+func (z *FakeZFS) InterruptNextRecv() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.interruptNextRx = true
+}
+
+// Calls returns how many times the named method has been called.
+func (z *FakeZFS) Calls(method string) int {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.calls[method]
+}
+
+// call records a call and returns the injected failure for it, if any. Must
+// be called with mu held.
+func (z *FakeZFS) call(method string) error {
+	z.calls[method]++
+	err, ok := z.failures[method]
+	if ok {
+		delete(z.failures, method)
+	}
+	return err
+}
+
+// WriteFile writes to the live filesystem, as a container using it would.
+func (z *FakeZFS) WriteFile(filesystemId, path string, contents []byte) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	fs.files[path] = append([]byte{}, contents...)
+	fs.modified = time.Now()
+	return nil
+}
+
+// RemoveFile removes a file from the live filesystem.
+func (z *FakeZFS) RemoveFile(filesystemId, path string) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	delete(fs.files, path)
+	fs.modified = time.Now()
+	return nil
+}
+
+// ReadFile reads from the live filesystem, or from a snapshot if snapshotId
+// is set.
+func (z *FakeZFS) ReadFile(filesystemId, snapshotId, path string) ([]byte, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	files := fs.files
+	if snapshotId != "" {
+		snap := fs.snapshot(snapshotId)
+		if snap == nil {
+			return nil, fmt.Errorf("snapshot %s@%s does not exist", filesystemId, snapshotId)
+		}
+		files = snap.Files
+	}
+	contents, ok := files[path]
+	if !ok {
+		return nil, fmt.Errorf("%s does not exist in %s", path, zfs.FullIdWithSnapshot(filesystemId, snapshotId))
+	}
+	return append([]byte{}, contents...), nil
+}
+
+func copyFiles(files map[string][]byte) map[string][]byte {
+	result := map[string][]byte{}
+	for path, contents := range files {
+		result[path] = append([]byte{}, contents...)
+	}
+	return result
+}
+
+func copyMetadata(meta map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range meta {
+		result[k] = v
+	}
+	return result
+}
+
+func newFakeFilesystem() *fakeFilesystem {
+	return &fakeFilesystem{
+		files:     map[string][]byte{},
+		snapshots: []*fakeSnapshot{},
+		modified:  time.Now(),
+	}
+}
+
+func (fs *fakeFilesystem) snapshotIndex(snapshotId string) int {
+	for idx, s := range fs.snapshots {
+		if s.Id == snapshotId {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (fs *fakeFilesystem) snapshot(snapshotId string) *fakeSnapshot {
+	idx := fs.snapshotIndex(snapshotId)
+	if idx == -1 {
+		return nil
+	}
+	return fs.snapshots[idx]
+}
+
+func (fs *fakeFilesystem) latestFiles() map[string][]byte {
+	if len(fs.snapshots) == 0 {
+		return map[string][]byte{}
+	}
+	return fs.snapshots[len(fs.snapshots)-1].Files
+}
+
+func (fs *fakeFilesystem) typesSnapshots() []*types.Snapshot {
+	result := []*types.Snapshot{}
+	for _, s := range fs.snapshots {
+		result = append(result, &types.Snapshot{Id: s.Id, Metadata: copyMetadata(s.Metadata)})
+	}
+	return result
+}
+
+func filesSize(files map[string][]byte) int64 {
+	var size int64
+	for _, contents := range files {
+		size += int64(len(contents))
+	}
+	return size
+}
+
+// changedBytes is the number of bytes in files which differ between two sets
+// of files.
+func changedBytes(from, to map[string][]byte) int64 {
+	var changed int64
+	for path, contents := range to {
+		old, ok := from[path]
+		if !ok || !bytes.Equal(old, contents) {
+			changed += int64(len(contents))
+		}
+	}
+	for path, contents := range from {
+		if _, ok := to[path]; !ok {
+			changed += int64(len(contents))
+		}
+	}
+	return changed
+}
+
+func (z *FakeZFS) GetPoolID() string {
+	return z.poolId
+}
+
+func (z *FakeZFS) GetZPoolCapacity() (float64, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return 0, z.call("GetZPoolCapacity")
+}
+
+func (z *FakeZFS) ReportZpoolCapacity() error {
+	return nil
+}
+
+func (z *FakeZFS) FindFilesystemIdsOnSystem() []string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	ids := []string{}
+	for id := range z.filesystems {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (z *FakeZFS) DeleteFilesystemInZFS(fs string) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("DeleteFilesystemInZFS")
+	if err != nil {
+		return err
+	}
+	delete(z.filesystems, fs)
+	delete(z.partial, fs)
+	return nil
+}
+
+func (z *FakeZFS) GetDirtyDelta(filesystemId, latestSnap string) (int64, int64, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("GetDirtyDelta")
+	if err != nil {
+		return 0, 0, err
+	}
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return 0, 0, fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	base := map[string][]byte{}
+	if latestSnap != "" {
+		snap := fs.snapshot(latestSnap)
+		if snap == nil {
+			return 0, 0, fmt.Errorf("snapshot %s@%s does not exist", filesystemId, latestSnap)
+		}
+		base = snap.Files
+	}
+	return changedBytes(base, fs.files), filesSize(fs.files), nil
+}
+
+func (z *FakeZFS) Snapshot(filesystemId string, snapshotId string, meta []string) ([]byte, error) {
+	metadata, err := utils.DecodeMetadata(meta)
+	if err != nil {
+		return nil, err
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err = z.call("Snapshot")
+	if err != nil {
+		return []byte(err.Error()), err
+	}
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	if fs.snapshotIndex(snapshotId) != -1 {
+		return nil, fmt.Errorf("snapshot %s@%s already exists", filesystemId, snapshotId)
+	}
+	fs.snapshots = append(fs.snapshots, &fakeSnapshot{
+		Id:       snapshotId,
+		Metadata: metadata,
+		Files:    copyFiles(fs.files),
+	})
+	return nil, nil
+}
+
+func (z *FakeZFS) List(filesystemId, snapshotId string) ([]byte, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	fs, ok := z.filesystems[filesystemId]
+	if !ok || (snapshotId != "" && fs.snapshot(snapshotId) == nil) {
+		return nil, fmt.Errorf("dataset %s does not exist", z.FQ(zfs.FullIdWithSnapshot(filesystemId, snapshotId)))
+	}
+	return []byte(z.FQ(zfs.FullIdWithSnapshot(filesystemId, snapshotId)) + "\n"), nil
+}
+
+func (z *FakeZFS) FQ(filesystemId string) string {
+	return filepath.Join(z.poolId, types.RootFS, filesystemId)
+}
+
+func (z *FakeZFS) DiscoverSystem(filesystemId string) (*types.Filesystem, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("DiscoverSystem")
+	if err != nil {
+		return nil, err
+	}
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return &types.Filesystem{
+			Id:        filesystemId,
+			Exists:    false,
+			Snapshots: []*types.Snapshot{},
+		}, nil
+	}
+	return &types.Filesystem{
+		Id:        filesystemId,
+		Exists:    true,
+		Mounted:   fs.mounted,
+		Snapshots: fs.typesSnapshots(),
+		Origin:    fs.origin,
+	}, nil
+}
+
+func (z *FakeZFS) StashBranch(existingFs string, newFs string, rollbackTo string) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("StashBranch")
+	if err != nil {
+		return err
+	}
+	fs, ok := z.filesystems[existingFs]
+	if !ok {
+		return fmt.Errorf("filesystem %s does not exist", existingFs)
+	}
+	idx := fs.snapshotIndex(rollbackTo)
+	if idx == -1 {
+		return fmt.Errorf("snapshot %s@%s does not exist", existingFs, rollbackTo)
+	}
+	stash := &fakeFilesystem{
+		origin:    types.Origin{FilesystemId: existingFs, SnapshotId: rollbackTo},
+		files:     fs.files,
+		snapshots: fs.snapshots[idx+1:],
+		modified:  fs.modified,
+	}
+	fs.snapshots = fs.snapshots[:idx+1]
+	fs.files = copyFiles(fs.snapshots[idx].Files)
+	fs.mounted = false
+	fs.modified = time.Now()
+	z.filesystems[newFs] = stash
+	return nil
+}
+
+func (z *FakeZFS) PredictSize(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string) (*types.PredictedSize, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("PredictSize")
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := z.streamSnapshots(streamFrom(fromSnapshotId), toFilesystemId, toSnapshotId)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for _, s := range snapshots {
+		size += filesSize(s.Files)
+	}
+	return &types.PredictedSize{Raw: size, Wire: size}, nil
+}
+
+func (z *FakeZFS) PredictResumeSize(resumeToken string) (int64, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("PredictResumeSize")
+	if err != nil {
+		return 0, err
+	}
+	filesystemId, partial, err := parseFakeResumeToken(resumeToken)
+	if err != nil {
+		return 0, err
+	}
+	snap, err := z.resumedSnapshot(filesystemId, partial)
+	if err != nil {
+		return 0, err
+	}
+	return filesSize(snap.Files) - partial.Received, nil
+}
+
+// resumedSnapshot finds the snapshot a resume token was taken partway
+// through. Must be called with mu held.
+func (z *FakeZFS) resumedSnapshot(filesystemId string, partial *fakePartialReceive) (*fakeSnapshot, error) {
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	snap := fs.snapshot(partial.SnapshotId)
+	if snap == nil {
+		return nil, fmt.Errorf("snapshot %s@%s does not exist", filesystemId, partial.SnapshotId)
+	}
+	return snap, nil
+}
+
+func (z *FakeZFS) Clone(filesystemId, originSnapshotId, newCloneFilesystemId string) ([]byte, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("Clone")
+	if err != nil {
+		return []byte(err.Error()), err
+	}
+	return nil, z.clone(filesystemId, originSnapshotId, newCloneFilesystemId)
+}
+
+func (z *FakeZFS) clone(filesystemId, originSnapshotId, newCloneFilesystemId string) error {
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	snap := fs.snapshot(originSnapshotId)
+	if snap == nil {
+		return fmt.Errorf("snapshot %s@%s does not exist", filesystemId, originSnapshotId)
+	}
+	if _, ok := z.filesystems[newCloneFilesystemId]; ok {
+		return fmt.Errorf("filesystem %s already exists", newCloneFilesystemId)
+	}
+	clone := newFakeFilesystem()
+	clone.origin = types.Origin{FilesystemId: filesystemId, SnapshotId: originSnapshotId}
+	clone.files = copyFiles(snap.Files)
+	z.filesystems[newCloneFilesystemId] = clone
+	return nil
+}
+
+func (z *FakeZFS) Promote(filesystemId, originFilesystemId string) ([]byte, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("Promote")
+	if err != nil {
+		return []byte(err.Error()), err
+	}
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	if fs.origin.FilesystemId != originFilesystemId {
+		return nil, fmt.Errorf("%s is not a clone of %s", filesystemId, originFilesystemId)
+	}
+	origin, ok := z.filesystems[originFilesystemId]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s does not exist", originFilesystemId)
+	}
+	originSnap := fs.origin.SnapshotId
+	idx := origin.snapshotIndex(originSnap)
+	if idx == -1 {
+		return nil, fmt.Errorf("snapshot %s@%s does not exist", originFilesystemId, originSnap)
+	}
+	moved := origin.snapshots[:idx+1]
+	fs.snapshots = append(append([]*fakeSnapshot{}, moved...), fs.snapshots...)
+	origin.snapshots = origin.snapshots[idx+1:]
+	fs.origin, origin.origin = origin.origin, types.Origin{FilesystemId: filesystemId, SnapshotId: originSnap}
+	for id, other := range z.filesystems {
+		if id == filesystemId || other.origin.FilesystemId != originFilesystemId {
+			continue
+		}
+		for _, snap := range moved {
+			if snap.Id == other.origin.SnapshotId {
+				other.origin.FilesystemId = filesystemId
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (z *FakeZFS) Rollback(filesystemId, snapshotId string) ([]byte, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("Rollback")
+	if err != nil {
+		return []byte(err.Error()), err
+	}
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	idx := fs.snapshotIndex(snapshotId)
+	if idx == -1 {
+		return nil, fmt.Errorf("snapshot %s@%s does not exist", filesystemId, snapshotId)
+	}
+	fs.snapshots = fs.snapshots[:idx+1]
+	fs.files = copyFiles(fs.snapshots[idx].Files)
+	fs.modified = time.Now()
+	return nil, nil
+}
+
+func (z *FakeZFS) Revert(filesystemId, snapshotId string) ([]byte, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("Revert")
+	if err != nil {
+		return []byte(err.Error()), err
+	}
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	idx := fs.snapshotIndex(snapshotId)
+	if idx == -1 {
+		return nil, fmt.Errorf("snapshot %s@%s does not exist", filesystemId, snapshotId)
+	}
+	fs.files = copyFiles(fs.snapshots[idx].Files)
+	fs.modified = time.Now()
+	return nil, nil
+}
+
+func (z *FakeZFS) DestroySnapshot(filesystemId, snapshotId string) ([]byte, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("DestroySnapshot")
+	if err != nil {
+		return []byte(err.Error()), err
+	}
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	idx := fs.snapshotIndex(snapshotId)
+	if idx == -1 {
+		return nil, fmt.Errorf("snapshot %s@%s does not exist", filesystemId, snapshotId)
+	}
+	fs.snapshots = append(fs.snapshots[:idx], fs.snapshots[idx+1:]...)
+	return nil, nil
+}
+
+func (z *FakeZFS) Create(filesystemId string) ([]byte, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("Create")
+	if err != nil {
+		return []byte(err.Error()), err
+	}
+	if _, ok := z.filesystems[filesystemId]; ok {
+		return nil, fmt.Errorf("filesystem %s already exists", filesystemId)
+	}
+	z.filesystems[filesystemId] = newFakeFilesystem()
+	return nil, nil
+}
+
+func streamFrom(fromSnapshotId string) string {
+	if fromSnapshotId == "" {
+		return "START"
+	}
+	return fromSnapshotId
+}
+
+// streamSnapshots works out which snapshots a send stream starting at from
+// and ending at toSnapshotId carries. Must be called with mu held.
+func (z *FakeZFS) streamSnapshots(from, toFilesystemId, toSnapshotId string) ([]*fakeSnapshot, error) {
+	fs, ok := z.filesystems[toFilesystemId]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s does not exist", toFilesystemId)
+	}
+	toIdx := fs.snapshotIndex(toSnapshotId)
+	if toIdx == -1 {
+		return nil, fmt.Errorf("snapshot %s@%s does not exist", toFilesystemId, toSnapshotId)
+	}
+	if from == "START" {
+		return fs.snapshots[:toIdx+1], nil
+	}
+	fromIdx := fs.snapshotIndex(from)
+	if fromIdx == -1 {
+		return nil, fmt.Errorf("incremental source %s@%s does not exist", toFilesystemId, from)
+	}
+	if fromIdx > toIdx {
+		return nil, fmt.Errorf("incremental source %s is newer than %s", from, toSnapshotId)
+	}
+	return fs.snapshots[fromIdx+1 : toIdx+1], nil
+}
+
+func (z *FakeZFS) Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, opts zfs.SendOptions, preludeEncoded []byte) (*io.PipeReader, chan error) {
+	pipeReader, pipeWriter := io.Pipe()
+	errch := make(chan error)
+	go func() {
+		stream, err := func() (*fakeStream, error) {
+			z.mu.Lock()
+			defer z.mu.Unlock()
+			err := z.call("Send")
+			if err != nil {
+				return nil, err
+			}
+			var snapshots []*fakeSnapshot
+			stream := &fakeStream{}
+			if opts.ResumeToken != "" {
+				// like zfs send -t, the token says what to send
+				filesystemId, partial, err := parseFakeResumeToken(opts.ResumeToken)
+				if err != nil {
+					return nil, err
+				}
+				snap, err := z.resumedSnapshot(filesystemId, partial)
+				if err != nil {
+					return nil, err
+				}
+				snapshots = []*fakeSnapshot{snap}
+				stream.Resume = opts.ResumeToken
+			} else {
+				stream.From = streamFrom(fromSnapshotId)
+				snapshots, err = z.streamSnapshots(stream.From, toFilesystemId, toSnapshotId)
+				if err != nil {
+					return nil, err
+				}
+			}
+			for _, s := range snapshots {
+				stream.Snapshots = append(stream.Snapshots, &fakeSnapshot{
+					Id:       s.Id,
+					Metadata: copyMetadata(s.Metadata),
+					Files:    copyFiles(s.Files),
+				})
+			}
+			return stream, nil
+		}()
+		if err == nil {
+			_, err = pipeWriter.Write(preludeEncoded)
+		}
+		if err == nil {
+			err = gob.NewEncoder(pipeWriter).Encode(stream)
+		}
+		if err != nil {
+			pipeWriter.CloseWithError(err)
+		} else {
+			pipeWriter.Close()
+		}
+		errch <- err
+	}()
+	return pipeReader, errch
+}
+
+func (z *FakeZFS) Recv(pipeReader *io.PipeReader, toFilesystemId string, errBuffer *bytes.Buffer) error {
+	if errBuffer == nil {
+		errBuffer = &bytes.Buffer{}
+	}
+	err := z.recv(pipeReader, toFilesystemId)
+	if err != nil {
+		fmt.Fprintf(errBuffer, "cannot receive: %s\n", err)
+	}
+	return err
+}
+
+// CompressedStreams is false, streams are never compressed by the fake.
+func (z *FakeZFS) CompressedStreams() bool {
+	return false
+}
+
+// ReceiveResumeToken returns "" unless a receive into filesystemId was
+// interrupted by InterruptNextRecv.
+func (z *FakeZFS) ReceiveResumeToken(filesystemId string) (string, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("ReceiveResumeToken")
+	if err != nil {
+		return "", err
+	}
+	partial, ok := z.partial[filesystemId]
+	if !ok {
+		return "", nil
+	}
+	return fakeResumeToken(filesystemId, partial), nil
+}
+
+func (z *FakeZFS) AbortReceive(filesystemId string) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("AbortReceive")
+	if err != nil {
+		return err
+	}
+	delete(z.partial, filesystemId)
+	return nil
+}
+
+func (z *FakeZFS) recv(r io.Reader, toFilesystemId string) error {
+	var stream fakeStream
+	err := gob.NewDecoder(r).Decode(&stream)
+	if err != nil {
+		return fmt.Errorf("error decoding stream: %s", err)
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err = z.call("Recv")
+	if err != nil {
+		return err
+	}
+
+	fs, exists := z.filesystems[toFilesystemId]
+	partial, interrupted := z.partial[toFilesystemId]
+	if stream.Resume != "" {
+		if !interrupted || fakeResumeToken(toFilesystemId, partial) != stream.Resume {
+			return fmt.Errorf("resume token %s does not match %s's partially-complete state", stream.Resume, toFilesystemId)
+		}
+		if !exists {
+			fs = newFakeFilesystem()
+			z.filesystems[toFilesystemId] = fs
+		}
+		delete(z.partial, toFilesystemId)
+	} else if interrupted {
+		return fmt.Errorf("destination %s contains partially-complete state from \"zfs receive -s\"", toFilesystemId)
+	} else if stream.From == "START" {
+		if exists && len(fs.snapshots) > 0 {
+			return fmt.Errorf("destination '%s' exists", toFilesystemId)
+		}
+		if !exists {
+			fs = newFakeFilesystem()
+			z.filesystems[toFilesystemId] = fs
+		}
+	} else {
+		if !exists {
+			return fmt.Errorf("destination '%s' does not exist", toFilesystemId)
+		}
+		if len(fs.snapshots) == 0 || fs.snapshots[len(fs.snapshots)-1].Id != stream.From {
+			return fmt.Errorf("most recent snapshot of %s does not match incremental source", toFilesystemId)
+		}
+		if changedBytes(fs.latestFiles(), fs.files) > 0 {
+			return fmt.Errorf("destination %s has been modified since most recent snapshot", toFilesystemId)
+		}
+	}
+	var interruption error
+	if z.interruptNextRx && len(stream.Snapshots) > 0 {
+		z.interruptNextRx = false
+		last := stream.Snapshots[len(stream.Snapshots)-1]
+		stream.Snapshots = stream.Snapshots[:len(stream.Snapshots)-1]
+		z.partial[toFilesystemId] = &fakePartialReceive{
+			SnapshotId: last.Id,
+			Received:   filesSize(last.Files) / 2,
+		}
+		interruption = fmt.Errorf("stream of %s interrupted partway through %s", toFilesystemId, last.Id)
+	}
+	for _, s := range stream.Snapshots {
+		if s.Metadata == nil {
+			s.Metadata = map[string]string{}
+		}
+		if s.Files == nil {
+			s.Files = map[string][]byte{}
+		}
+		fs.snapshots = append(fs.snapshots, s)
+	}
+	if len(stream.Snapshots) > 0 {
+		fs.files = copyFiles(fs.latestFiles())
+		fs.modified = time.Now()
+	}
+	return interruption
+}
+
+func (z *FakeZFS) ApplyPrelude(prelude types.Prelude, filesystemId string) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("ApplyPrelude")
+	if err != nil {
+		return err
+	}
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	for _, j := range prelude.SnapshotProperties {
+		snap := fs.snapshot(j.Id)
+		if snap == nil {
+			return fmt.Errorf("Error applying prelude: no snapshot %s@%s", filesystemId, j.Id)
+		}
+		if snap.Metadata == nil {
+			snap.Metadata = map[string]string{}
+		}
+		for k, v := range j.Metadata {
+			snap.Metadata[k] = v
+		}
+	}
+	return nil
+}
+
+func (z *FakeZFS) SetCanmount(filesystemId, snapshotId string) ([]byte, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("SetCanmount")
+	if err != nil {
+		return []byte(err.Error()), err
+	}
+	return nil, nil
+}
+
+// Mount only records that the filesystem is mounted, nothing appears at
+// mountPath.
+func (z *FakeZFS) Mount(filesystemId, snapshotId string, options string, mountPath string) ([]byte, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("Mount")
+	if err != nil {
+		return []byte(err.Error()), err
+	}
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	if snapshotId != "" {
+		if fs.snapshot(snapshotId) == nil {
+			return nil, fmt.Errorf("snapshot %s@%s does not exist", filesystemId, snapshotId)
+		}
+		return nil, nil
+	}
+	fs.mounted = true
+	return nil, nil
+}
+
+// Mounted reports whether the live filesystem has been mounted.
+func (z *FakeZFS) Mounted(filesystemId string) bool {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	fs, ok := z.filesystems[filesystemId]
+	return ok && fs.mounted
+}
+
+func (z *FakeZFS) Fork(filesystemId, latestSnapshot, forkFilesystemId string) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("Fork")
+	if err != nil {
+		return err
+	}
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	idx := fs.snapshotIndex(latestSnapshot)
+	if idx == -1 {
+		return fmt.Errorf("snapshot %s@%s does not exist", filesystemId, latestSnapshot)
+	}
+	if _, ok := z.filesystems[forkFilesystemId]; ok {
+		return fmt.Errorf("filesystem %s already exists", forkFilesystemId)
+	}
+	fork := newFakeFilesystem()
+	for _, s := range fs.snapshots[:idx+1] {
+		fork.snapshots = append(fork.snapshots, &fakeSnapshot{
+			Id:       s.Id,
+			Metadata: copyMetadata(s.Metadata),
+			Files:    copyFiles(s.Files),
+		})
+	}
+	fork.files = copyFiles(fs.snapshots[idx].Files)
+	z.filesystems[forkFilesystemId] = fork
+	return nil
+}
+
+func (z *FakeZFS) Diff(filesystemId string) ([]types.ZFSFileDiff, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("Diff")
+	if err != nil {
+		return nil, err
+	}
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	if len(fs.snapshots) == 0 {
+		return nil, fmt.Errorf("cannot diff against a filesystem with no snapshots")
+	}
+	return diffFiles(fs.latestFiles(), fs.files), nil
+}
+
+func (z *FakeZFS) DiffSnapshots(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, opts types.DiffOptions) ([]types.ZFSFileDiff, int, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	err := z.call("DiffSnapshots")
+	if err != nil {
+		return nil, 0, err
+	}
+	from, ok := z.filesystems[fromFilesystemId]
+	if !ok || from.snapshot(fromSnapshotId) == nil {
+		return nil, 0, fmt.Errorf("snapshot %s@%s does not exist", fromFilesystemId, fromSnapshotId)
+	}
+	to, ok := z.filesystems[toFilesystemId]
+	if !ok {
+		return nil, 0, fmt.Errorf("filesystem %s does not exist", toFilesystemId)
+	}
+	toFiles := to.files
+	if toSnapshotId != "" {
+		snapshot := to.snapshot(toSnapshotId)
+		if snapshot == nil {
+			return nil, 0, fmt.Errorf("snapshot %s@%s does not exist", toFilesystemId, toSnapshotId)
+		}
+		toFiles = snapshot.Files
+	}
+	fromFiles := from.snapshot(fromSnapshotId).Files
+	files := diffFiles(fromFiles, toFiles)
+	page := zfs.PaginateDiff(files, opts)
+	if opts.Hunks {
+		for i, f := range page {
+			path := "__default__/" + f.Filename
+			page[i].Hunks, err = zfs.DiffHunks(f.Filename, fromFiles[path], toFiles[path])
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	return page, len(files), nil
+}
+
+// fakeFileInfo describes a file in a diff; files here are all plain ones,
+// without modes or times.
+func fakeFileInfo(contents []byte) *types.DiffFileInfo {
+	return &types.DiffFileInfo{Type: types.FileTypeFile, Size: int64(len(contents)), Mode: 0644}
+}
+
+// diffFiles compares the files under __default__, sorted by filename.
+func diffFiles(from, to map[string][]byte) []types.ZFSFileDiff {
+	const prefix = "__default__/"
+	result := []types.ZFSFileDiff{}
+	for path, contents := range to {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		old, ok := from[path]
+		if !ok {
+			result = append(result, types.ZFSFileDiff{
+				Change: types.FileChangeAdded, Filename: strings.TrimPrefix(path, prefix),
+				New: fakeFileInfo(contents),
+			})
+		} else if !bytes.Equal(old, contents) {
+			result = append(result, types.ZFSFileDiff{
+				Change: types.FileChangeModified, Filename: strings.TrimPrefix(path, prefix),
+				Old: fakeFileInfo(old), New: fakeFileInfo(contents),
+			})
+		}
+	}
+	for path, contents := range from {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if _, ok := to[path]; !ok {
+			result = append(result, types.ZFSFileDiff{
+				Change: types.FileChangeRemoved, Filename: strings.TrimPrefix(path, prefix),
+				Old: fakeFileInfo(contents),
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Filename < result[j].Filename
+	})
+	return result
+}
+
+func (z *FakeZFS) LastModified(filesystemId string) (*types.LastModified, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	fs, ok := z.filesystems[filesystemId]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s does not exist", filesystemId)
+	}
+	return &types.LastModified{Time: fs.modified.UTC().Truncate(time.Second)}, nil
+}
+
+func (z *FakeZFS) DestroyTmpSnapIfExists(filesystemId string) error {
+	return nil
+}